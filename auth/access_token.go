@@ -0,0 +1,303 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	accessTokenKind = "AccessToken"
+	// accessTokenPrefix tells personal access tokens apart from the encrypted
+	// user tokens created at login.
+	accessTokenPrefix = "dpat_"
+
+	defaultAccessTokenDuration = 90 * 24 * time.Hour
+	maxAccessTokenDuration     = 366 * 24 * time.Hour
+)
+
+const (
+	ListAccessTokensRoute = "ListAccessTokens"
+)
+
+// The scopes an access token can be granted.
+const (
+	// ReadOnlyScope grants nothing but reading, which all access tokens can do.
+	ReadOnlyScope   = "read-only"
+	OrdersScope     = "orders"
+	PressScope      = "press"
+	GameMasterScope = "game-master"
+)
+
+var (
+	accessTokenScopes = []string{ReadOnlyScope, OrdersScope, PressScope, GameMasterScope}
+	// routeScopes maps route names to the scopes allowing access tokens to
+	// use them. Access tokens may use GET routes not present here, but no
+	// other routes.
+	routeScopes = map[string][]string{}
+
+	AccessTokenResource *Resource
+)
+
+func init() {
+	AccessTokenResource = &Resource{
+		Create:     createAccessToken,
+		Delete:     deleteAccessToken,
+		CreatePath: "/User/{user_id}/AccessToken",
+		FullPath:   "/User/{user_id}/AccessToken/{id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/AccessTokens",
+				Route:   ListAccessTokensRoute,
+				Handler: listAccessTokens,
+			},
+		},
+	}
+}
+
+// AllowScopes lets access tokens granted any of scopes use route. If scopes
+// contains ReadOnlyScope, all access tokens may use route. If scopes is empty,
+// no access tokens may use route, even if it's a GET route.
+func AllowScopes(route string, scopes ...string) {
+	routeScopes[route] = append(routeScopes[route], scopes...)
+}
+
+func scopesAllow(route string, method string, granted []string) bool {
+	allowed, found := routeScopes[route]
+	if !found {
+		return method == "GET" || method == "HEAD"
+	}
+	for _, scope := range allowed {
+		if scope == ReadOnlyScope {
+			return true
+		}
+		for _, grantedScope := range granted {
+			if grantedScope == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type AccessTokens []AccessToken
+
+func (a AccessTokens) Item(r Request, userId string) *Item {
+	tokenItems := make(List, len(a))
+	for i := range a {
+		tokenItems[i] = a[i].Item(r)
+	}
+	return NewItem(tokenItems).SetName("access-tokens").SetDesc([][]string{
+		[]string{
+			"Access tokens",
+			"Access tokens let bots and scripts act on your behalf, limited to the scopes of the token.",
+			fmt.Sprintf("All access tokens can read. Available scopes are %s.", strings.Join(accessTokenScopes, ", ")),
+			"Use an access token like any other token, in the `token` query parameter or as an `Authorization: Bearer` header.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListAccessTokensRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(AccessTokenResource.Link("create", Create, []string{"user_id", userId})))
+}
+
+// AccessToken is a named, scoped and revocable credential. Only a hash of the
+// token is stored, so the token itself is only returned when created.
+type AccessToken struct {
+	ID     *datastore.Key `datastore:"-"`
+	UserId string
+	// ClientId is the OAuth2 client the token was issued to, if any.
+	ClientId  string   `json:",omitempty"`
+	Name      string   `methods:"POST" datastore:",noindex"`
+	Scopes    []string `methods:"POST" datastore:",noindex"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `methods:"POST"`
+	Token     string    `datastore:"-" json:",omitempty"`
+}
+
+func (a *AccessToken) Item(r Request) *Item {
+	return NewItem(a).SetName(a.Name).AddLink(r.NewLink(AccessTokenResource.Link("revoke", Delete, []string{"user_id", a.UserId, "id", a.ID.Encode()})))
+}
+
+func accessTokenID(ctx context.Context, token string) *datastore.Key {
+	sum := sha256.Sum256([]byte(token))
+	return datastore.NewKey(ctx, accessTokenKind, hex.EncodeToString(sum[:]), 0, nil)
+}
+
+func createAccessToken(w ResponseWriter, r Request) (*AccessToken, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only create your own access tokens", http.StatusForbidden}
+	}
+
+	accessToken := &AccessToken{}
+	if err := Copy(accessToken, r, "POST"); err != nil {
+		return nil, err
+	}
+
+	if accessToken.Name == "" {
+		return nil, HTTPErr{"access tokens must have names", http.StatusBadRequest}
+	}
+	for _, scope := range accessToken.Scopes {
+		found := false
+		for _, known := range accessTokenScopes {
+			if scope == known {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, HTTPErr{fmt.Sprintf("unknown scope %q, must be one of %v", scope, accessTokenScopes), http.StatusBadRequest}
+		}
+	}
+
+	now := clock.Now(ctx)
+	if accessToken.ExpiresAt.IsZero() {
+		accessToken.ExpiresAt = now.Add(defaultAccessTokenDuration)
+	}
+	if !accessToken.ExpiresAt.After(now) {
+		return nil, HTTPErr{"access tokens must expire in the future", http.StatusBadRequest}
+	}
+	if accessToken.ExpiresAt.After(now.Add(maxAccessTokenDuration)) {
+		return nil, HTTPErr{fmt.Sprintf("access tokens can't be valid for more than %v", maxAccessTokenDuration), http.StatusBadRequest}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	accessToken.Token = accessTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	accessToken.UserId = user.Id
+	accessToken.CreatedAt = now
+	accessToken.ID = accessTokenID(ctx, accessToken.Token)
+
+	if _, err := datastore.Put(ctx, accessToken.ID, accessToken); err != nil {
+		return nil, err
+	}
+
+	return accessToken, nil
+}
+
+func deleteAccessToken(w ResponseWriter, r Request) (*AccessToken, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only revoke your own access tokens", http.StatusForbidden}
+	}
+
+	accessTokenID, err := datastore.DecodeKey(r.Vars()["id"])
+	if err != nil {
+		return nil, err
+	}
+	if accessTokenID.Kind() != accessTokenKind {
+		return nil, HTTPErr{"not an access token", http.StatusBadRequest}
+	}
+
+	accessToken := &AccessToken{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, accessTokenID, accessToken); err != nil {
+			return err
+		}
+		if accessToken.UserId != user.Id {
+			return HTTPErr{"can only revoke your own access tokens", http.StatusForbidden}
+		}
+		return datastore.Delete(ctx, accessTokenID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	accessToken.ID = accessTokenID
+
+	// Revoking a token of an OAuth2 client also stops the client from
+	// refreshing it.
+	if accessToken.ClientId != "" {
+		refreshTokenIDs, err := datastore.NewQuery(oauth2RefreshTokenKind).Filter("ClientId=", accessToken.ClientId).Filter("UserId=", user.Id).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := datastore.DeleteMulti(ctx, refreshTokenIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	return accessToken, nil
+}
+
+func listAccessTokens(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own access tokens", http.StatusForbidden}
+	}
+
+	accessTokens := AccessTokens{}
+	ids, err := datastore.NewQuery(accessTokenKind).Filter("UserId=", user.Id).GetAll(ctx, &accessTokens)
+	if err != nil {
+		return err
+	}
+	for i := range accessTokens {
+		accessTokens[i].ID = ids[i]
+	}
+
+	w.SetContent(accessTokens.Item(r, user.Id))
+	return nil
+}
+
+// accessTokenUser returns the user owning token, if token is a valid access
+// token allowed to use the route of r.
+func accessTokenUser(ctx context.Context, r Request, token string) (*User, error) {
+	accessToken := &AccessToken{}
+	if err := datastore.Get(ctx, accessTokenID(ctx, token), accessToken); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{"unknown or revoked access token", http.StatusUnauthorized}
+	} else if err != nil {
+		return nil, err
+	}
+	if !accessToken.ExpiresAt.After(clock.Now(ctx)) {
+		return nil, HTTPErr{"access token expired", http.StatusUnauthorized}
+	}
+
+	routeName := ""
+	if route := mux.CurrentRoute(r.Req()); route != nil {
+		routeName = route.GetName()
+	}
+	if !scopesAllow(routeName, r.Req().Method, accessToken.Scopes) {
+		return nil, HTTPErr{fmt.Sprintf("access token scopes %v don't allow %s %s", accessToken.Scopes, r.Req().Method, routeName), http.StatusForbidden}
+	}
+
+	user := &User{}
+	if err := datastore.Get(ctx, UserID(ctx, accessToken.UserId), user); err == datastore.ErrNoSuchEntity {
+		user.Id = accessToken.UserId
+	} else if err != nil {
+		return nil, err
+	}
+	user.ValidUntil = accessToken.ExpiresAt
+	return user, nil
+}
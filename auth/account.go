@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const (
+	// DeletedUserName replaces the name of deleted users.
+	DeletedUserName = "Deleted user"
+)
+
+// DeleteUserCredentials anonymizes the stored user, and deletes the
+// identities, sessions, access tokens, OAuth2 clients and grants and TOTP of
+// userId, so that it can't be logged in as anymore. The user itself is kept,
+// since its id is referenced by games and ratings.
+func DeleteUserCredentials(ctx context.Context, userId string) error {
+	if _, err := datastore.Put(ctx, UserID(ctx, userId), &User{
+		Id:   userId,
+		Name: DeletedUserName,
+	}); err != nil {
+		return err
+	}
+
+	sessionIDs, err := datastore.NewQuery(sessionKind).Filter("UserId=", userId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := revokeSessions(ctx, sessionIDs); err != nil {
+		return err
+	}
+
+	for _, kind := range []string{identityKind, accessTokenKind, oauth2ClientKind, oauth2RefreshTokenKind, totpKind} {
+		ids, err := datastore.NewQuery(kind).Filter("UserId=", userId).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := datastore.DeleteMulti(ctx, ids); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	auditEntryKind = "AuditEntry"
+
+	maxAuditEntries = 128
+)
+
+const (
+	ListAuditLogRoute = "ListAuditLog"
+)
+
+// The actions recorded in the audit log.
+const (
+	ImpersonateAuditAction       = "impersonate"
+	AssignRolesAuditAction       = "assign-roles"
+	RevokeSessionsAuditAction    = "revoke-sessions"
+	UpdateGameAuditAction        = "update-game"
+	DeleteGameAuditAction        = "delete-game"
+	EditDeadlineAuditAction      = "edit-deadline"
+	CreateInvitationAuditAction  = "create-invitation"
+	DeleteInvitationAuditAction  = "delete-invitation"
+	RemoveMemberAuditAction      = "remove-member"
+	SendSystemMessageAuditAction = "send-system-message"
+	CreateBanAuditAction         = "create-ban"
+	DeleteBanAuditAction         = "delete-ban"
+	DeleteUserAuditAction        = "delete-user"
+	ModerateAuditAction          = "moderate"
+)
+
+// AuditChange is a field changed by an audited action, with JSON encoded
+// values.
+type AuditChange struct {
+	Field  string
+	Before string `datastore:",noindex"`
+	After  string `datastore:",noindex"`
+}
+
+// AuditEntry records an action. Entries about games have the game as parent.
+// Entries are never updated or deleted.
+type AuditEntry struct {
+	GameID *datastore.Key `datastore:"-"`
+	// ActorId is empty for actions taken by the system itself.
+	ActorId   string
+	Action    string
+	TargetId  string
+	Changes   []AuditChange
+	CreatedAt time.Time
+}
+
+func (a *AuditEntry) Item(r Request) *Item {
+	return NewItem(a).SetName(a.Action)
+}
+
+type AuditEntries []AuditEntry
+
+// Item returns the entries, with a next link to selfLink if there's a cursor.
+func (a AuditEntries) Item(r Request, curs *datastore.Cursor, limit int, selfLink Link) *Item {
+	entryItems := make(List, len(a))
+	for i := range a {
+		entryItems[i] = a[i].Item(r)
+	}
+	entriesItem := NewItem(entryItems).SetName("audit-log").SetDesc([][]string{
+		[]string{
+			"Audit log",
+			"The audit log records privileged and game master actions, newest first, with the fields each action changed.",
+		},
+	})
+	if curs != nil {
+		selfLink.Rel = "next"
+		selfLink.QueryParams = url.Values{
+			"cursor": []string{curs.String()},
+			"limit":  []string{fmt.Sprint(limit)},
+		}
+		entriesItem.AddLink(r.NewLink(selfLink))
+	}
+	return entriesItem
+}
+
+func diffJSON(before, after interface{}) ([]AuditChange, error) {
+	fields := []map[string]json.RawMessage{{}, {}}
+	for i, value := range []interface{}{before, after} {
+		if value == nil {
+			continue
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &fields[i]); err != nil {
+			// Not an object, so diff the value as a whole.
+			fields[i] = map[string]json.RawMessage{"": b}
+		}
+	}
+	names := map[string]bool{}
+	for _, m := range fields {
+		for name := range m {
+			names[name] = true
+		}
+	}
+	changes := []AuditChange{}
+	for name := range names {
+		if string(fields[0][name]) != string(fields[1][name]) {
+			changes = append(changes, AuditChange{
+				Field:  name,
+				Before: string(fields[0][name]),
+				After:  string(fields[1][name]),
+			})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes, nil
+}
+
+// RecordAudit records that actorId did action to targetId, with the changes
+// between the JSON encodings of before and after, either of which may be nil.
+// If gameID is non nil the entry is stored in the entity group of the game,
+// so that it's committed with the game in transactions.
+func RecordAudit(ctx context.Context, gameID *datastore.Key, actorId, action, targetId string, before, after interface{}) error {
+	changes, err := diffJSON(before, after)
+	if err != nil {
+		return err
+	}
+	entry := &AuditEntry{
+		ActorId:   actorId,
+		Action:    action,
+		TargetId:  targetId,
+		Changes:   changes,
+		CreatedAt: clock.Now(ctx),
+	}
+	_, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, auditEntryKind, gameID), entry)
+	return err
+}
+
+// ListAuditEntries writes the entries matched by query to w, paginated
+// using the cursor and limit query parameters of r.
+func ListAuditEntries(w ResponseWriter, r Request, query *datastore.Query, selfLink Link) error {
+	ctx := appengine.NewContext(r.Req())
+
+	limit := maxAuditEntries
+	if limitS := r.Req().URL.Query().Get("limit"); limitS != "" {
+		if i, err := strconv.Atoi(limitS); err == nil && i > 0 && i < limit {
+			limit = i
+		}
+	}
+
+	query = query.Order("-CreatedAt")
+	if cursor := r.Req().URL.Query().Get("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		query = query.Start(decoded)
+	}
+	iter := query.Run(ctx)
+
+	entries := AuditEntries{}
+	var err error
+	for len(entries) < limit && err == nil {
+		entry := AuditEntry{}
+		var key *datastore.Key
+		key, err = iter.Next(&entry)
+		if err == nil {
+			entry.GameID = key.Parent()
+			entries = append(entries, entry)
+		}
+	}
+	if err != nil && err != datastore.Done {
+		return err
+	}
+
+	var cursP *datastore.Cursor
+	if err == nil {
+		curs, err := iter.Cursor()
+		if err != nil {
+			return err
+		}
+		cursP = &curs
+	}
+
+	w.SetContent(entries.Item(r, cursP, limit, selfLink))
+	return nil
+}
+
+func handleListAuditLog(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := RequirePermission(ctx, r, ReadAuditLogPermission); err != nil {
+		return err
+	}
+
+	return ListAuditEntries(w, r, datastore.NewQuery(auditEntryKind), Link{
+		Route: ListAuditLogRoute,
+	})
+}
+
+// AuditLogQuery returns a query for the entries about gameID.
+func AuditLogQuery(gameID *datastore.Key) *datastore.Query {
+	return datastore.NewQuery(auditEntryKind).Ancestor(gameID)
+}
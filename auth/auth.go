@@ -15,10 +15,9 @@ import (
 
 	"github.com/aymerick/raymond"
 	"github.com/gorilla/mux"
+	"github.com/zond/diplicity/clock"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/log"
@@ -310,6 +309,9 @@ type User struct {
 	Picture       string
 	VerifiedEmail bool
 	ValidUntil    time.Time
+	// SessionId is the session a token was issued for, and is only set for
+	// users decoded from tokens.
+	SessionId string `datastore:"-" json:",omitempty"`
 }
 
 func UserID(ctx context.Context, userID string) *datastore.Key {
@@ -388,55 +390,6 @@ func GetSuperusers(ctx context.Context) (*Superusers, error) {
 	return prodSuperusers, nil
 }
 
-type naCl struct {
-	Secret []byte
-}
-
-func getNaClKey(ctx context.Context) *datastore.Key {
-	return datastore.NewKey(ctx, naClKind, prodKey, 0, nil)
-}
-
-func getNaCl(ctx context.Context) (*naCl, error) {
-	// check if in memory
-	prodNaClLock.RLock()
-	if prodNaCl != nil {
-		defer prodNaClLock.RUnlock()
-		return prodNaCl, nil
-	}
-	prodNaClLock.RUnlock()
-	// nope, check if in datastore
-	prodNaClLock.Lock()
-	defer prodNaClLock.Unlock()
-	foundNaCl := &naCl{}
-	if err := datastore.Get(ctx, getNaClKey(ctx), foundNaCl); err == nil {
-		prodNaCl = foundNaCl
-		return foundNaCl, nil
-	} else if err != datastore.ErrNoSuchEntity {
-		return nil, err
-	}
-	// nope, create new key
-	foundNaCl.Secret = make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, foundNaCl.Secret); err != nil {
-		return nil, err
-	}
-	// write it transactionally into datastore
-	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		if err := datastore.Get(ctx, getNaClKey(ctx), foundNaCl); err == nil {
-			return nil
-		} else if err != datastore.ErrNoSuchEntity {
-			return err
-		}
-		if _, err := datastore.Put(ctx, getNaClKey(ctx), foundNaCl); err != nil {
-			return err
-		}
-		return nil
-	}, &datastore.TransactionOptions{XG: false}); err != nil {
-		return nil, err
-	}
-	prodNaCl = foundNaCl
-	return prodNaCl, nil
-}
-
 type OAuth struct {
 	ClientID string
 	Secret   string
@@ -476,59 +429,18 @@ func getOAuth(ctx context.Context) (*OAuth, error) {
 	return prodOAuth, nil
 }
 
-func getOAuth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, error) {
-	redirectURL, err := router.Get(OAuth2CallbackRoute).URL()
-	if err != nil {
-		return nil, err
-	}
-	redirectURL.Host = r.Host
-	redirectURL.Scheme = DefaultScheme
-
-	oauth, err := getOAuth(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	return &oauth2.Config{
-		ClientID:     oauth.ClientID,
-		ClientSecret: oauth.Secret,
-		RedirectURL:  redirectURL.String(),
-		Scopes: []string{
-			"openid",
-			"profile",
-			"email",
-		},
-		Endpoint: google.Endpoint,
-	}, nil
-}
-
 func handleGetTokenForDiscordUser(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	user, ok := r.Values()["user"].(*User)
-	if !ok {
+	if _, ok := r.Values()["user"].(*User); !ok {
 		return HTTPErr{
 			Body:   "Unauthenticated",
 			Status: http.StatusUnauthorized,
 		}
 	}
 
-	if !appengine.IsDevAppServer() {
-
-		superusers, err := GetSuperusers(ctx)
-		if err != nil {
-			return HTTPErr{
-				Body:   "Unable to load superusers",
-				Status: http.StatusInternalServerError,
-			}
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{
-				Body:   "Unauthorized",
-				Status: http.StatusForbidden,
-			}
-		}
+	if err := RequirePermission(ctx, r, ImpersonatePermission); err != nil {
+		return err
 	}
 
 	discordUserId := r.Vars()["user_id"]
@@ -548,6 +460,14 @@ func handleGetTokenForDiscordUser(w ResponseWriter, r Request) error {
 		}
 	}
 
+	// The bot asks for tokens often, so each Discord user gets a single session.
+	if err := startSession(ctx, r.Req(), discordUser, "discord-user-"+discordUser.Id); err != nil {
+		return HTTPErr{
+			Body:   "Unable to start session",
+			Status: http.StatusInternalServerError,
+		}
+	}
+
 	token, err := encodeUserToToken(ctx, discordUser)
 	if err != nil {
 		return HTTPErr{
@@ -587,32 +507,21 @@ func createDiscordBotUser() *User {
 func handleLogin(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	conf, err := getOAuth2Config(ctx, r.Req())
+	tokenDuration, err := requestTokenDuration(r.Req())
 	if err != nil {
 		return err
 	}
 
-	tokenDuration := defaultTokenDuration
-	if tokenDurationString := r.Req().URL.Query().Get(tokenDurationKey); tokenDurationString != "" {
-		tokenDurationLong, err := strconv.ParseInt(tokenDurationString, 10, 64)
-		if err != nil {
-			return err
-		}
-		tokenDuration = time.Second * time.Duration(tokenDurationLong)
-	}
-
 	redirectURL, err := url.Parse(r.Req().URL.Query().Get(redirectToKey))
 	if err != nil {
 		return err
 	}
 
-	stateString, err := encodeStateString(ctx, redirectURL, tokenDuration)
-	if err != nil {
-		return err
-	}
-
-	http.Redirect(w, r.Req(), conf.AuthCodeURL(stateString), http.StatusSeeOther)
-	return nil
+	return startLogin(ctx, w, r.Req(), &loginState{
+		RedirectURL:   redirectURL,
+		TokenDuration: tokenDuration,
+		Provider:      r.Req().URL.Query().Get(providerKey),
+	})
 }
 
 func handleDiscordBotLogin(w ResponseWriter, r Request) error {
@@ -648,6 +557,10 @@ func handleDiscordBotLogin(w ResponseWriter, r Request) error {
 		return HTTPErr{"Unable to store user", http.StatusInternalServerError}
 	}
 
+	if err := startSession(ctx, r.Req(), discordBotUser, ""); err != nil {
+		return HTTPErr{"Unable to start session", http.StatusInternalServerError}
+	}
+
 	token, err := encodeUserToToken(ctx, discordBotUser)
 	if err != nil {
 		return HTTPErr{"Unable to encode user to token", http.StatusInternalServerError}
@@ -666,7 +579,11 @@ func EncodeString(ctx context.Context, s string) (string, error) {
 }
 
 func EncodeBytes(ctx context.Context, b []byte) ([]byte, error) {
-	nacl, err := getNaCl(ctx)
+	nacl, err := getNaCl(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	key, err := nacl.current(clock.Now(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -675,7 +592,7 @@ func EncodeBytes(ctx context.Context, b []byte) ([]byte, error) {
 		return nil, err
 	}
 	var secretAry [32]byte
-	copy(secretAry[:], nacl.Secret)
+	copy(secretAry[:], key.Secret)
 	cipher := secretbox.Seal(nonceAry[:], b, &nonceAry, &secretAry)
 	return cipher, nil
 }
@@ -693,20 +610,26 @@ func DecodeString(ctx context.Context, s string) (string, error) {
 }
 
 func DecodeBytes(ctx context.Context, b []byte) ([]byte, error) {
+	if len(b) < 24 {
+		return nil, HTTPErr{"badly encrypted token", http.StatusUnauthorized}
+	}
 	var nonceAry [24]byte
 	copy(nonceAry[:], b)
-	nacl, err := getNaCl(ctx)
+	nacl, err := getNaCl(ctx, false)
 	if err != nil {
 		return nil, err
 	}
-	var secretAry [32]byte
-	copy(secretAry[:], nacl.Secret)
-
-	plain, ok := secretbox.Open([]byte{}, b[24:], &nonceAry, &secretAry)
-	if !ok {
-		return nil, HTTPErr{"badly encrypted token", http.StatusUnauthorized}
+	if plain, ok := nacl.open(b[24:], &nonceAry); ok {
+		return plain, nil
+	}
+	// The data might be encrypted with a key added by another instance.
+	if nacl, err = getNaCl(ctx, true); err != nil {
+		return nil, err
+	}
+	if plain, ok := nacl.open(b[24:], &nonceAry); ok {
+		return plain, nil
 	}
-	return plain, nil
+	return nil, HTTPErr{"badly encrypted token", http.StatusUnauthorized}
 }
 
 func encodeUserToToken(ctx context.Context, user *User) (string, error) {
@@ -717,33 +640,48 @@ func encodeUserToToken(ctx context.Context, user *User) (string, error) {
 	return EncodeString(ctx, string(plain))
 }
 
-func decodeStateString(ctx context.Context, encryptedState string) (redirectURL *url.URL, tokenDuration time.Duration, err error) {
+// loginState is passed through the login flow of the provider.
+type loginState struct {
+	RedirectURL   *url.URL
+	TokenDuration time.Duration
+	Provider      string
+	// LinkUserId is the user to link the identity to, if any.
+	LinkUserId string
+}
+
+func decodeStateString(ctx context.Context, encryptedState string) (*loginState, error) {
 	decryptedState, err := DecodeString(ctx, encryptedState)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	stateQuery, err := url.ParseQuery(decryptedState)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	log.Infof(ctx, "decoded state query %+v", stateQuery)
 
-	redirectURL, err = url.Parse(stateQuery.Get(redirectToKey))
-	if err != nil {
-		return nil, 0, err
+	state := &loginState{
+		Provider:   stateQuery.Get(providerKey),
+		LinkUserId: stateQuery.Get(linkUserIdKey),
+	}
+	if state.RedirectURL, err = url.Parse(stateQuery.Get(redirectToKey)); err != nil {
+		return nil, err
 	}
 	tokenDurationLong, err := strconv.ParseInt(stateQuery.Get(tokenDurationKey), 10, 64)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	log.Infof(ctx, "returning %v, %v, %v", redirectURL, time.Second*time.Duration(tokenDurationLong), nil)
-	return redirectURL, time.Second * time.Duration(tokenDurationLong), nil
+	state.TokenDuration = time.Second * time.Duration(tokenDurationLong)
+	log.Infof(ctx, "returning %+v", state)
+	return state, nil
 }
 
-func encodeStateString(ctx context.Context, redirectURL *url.URL, tokenDuration time.Duration) (string, error) {
+func encodeStateString(ctx context.Context, state *loginState) (string, error) {
 	stateQuery := url.Values{}
-	stateQuery.Set(redirectToKey, redirectURL.String())
-	stateQuery.Set(tokenDurationKey, fmt.Sprint(int64(tokenDuration/time.Second)))
+	stateQuery.Set(redirectToKey, state.RedirectURL.String())
+	stateQuery.Set(tokenDurationKey, fmt.Sprint(int64(state.TokenDuration/time.Second)))
+	stateQuery.Set(providerKey, state.Provider)
+	stateQuery.Set(linkUserIdKey, state.LinkUserId)
 	log.Infof(ctx, "encoded state query %+v", stateQuery)
 
 	return EncodeString(ctx, stateQuery.Encode())
@@ -787,22 +725,7 @@ func decodeApproveState(ctx context.Context, b64EncryptedState string) (redirect
 func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
-	conf, err := getOAuth2Config(ctx, r)
-	if err != nil {
-		log.Errorf(ctx, "Unable to load OAuth2Config: %v", err)
-		HTTPError(w, r, err)
-		return
-	}
-
-	code := r.URL.Query().Get("code")
-	token, err := conf.Exchange(ctx, code)
-	if err != nil {
-		log.Warningf(ctx, "Unable to exchange code for token %#v: %v", code, err)
-		HTTPError(w, r, err)
-		return
-	}
-
-	state := r.URL.Query().Get(stateKey)
+	stateString := r.URL.Query().Get(stateKey)
 
 	// Clients that are able to call this endpoint independently (without being
 	// redirected from Google OAuth2 service) - which is what is necessary to
@@ -810,40 +733,68 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	// security measure anyway, and don't really need them anyway (since they are
 	// mostly there to prevent evil blogs using your pre-recorded approval log in
 	// as you to diplicity.
-	approveRedirect := r.URL.Query().Get("approve-redirect")
-	if approveRedirect == "true" {
-		redirectURL, err := url.Parse(state)
+	approveRedirect := r.URL.Query().Get("approve-redirect") == "true"
+	state := &loginState{
+		TokenDuration: defaultTokenDuration,
+	}
+	if approveRedirect {
+		redirectURL, err := url.Parse(stateString)
 		if err != nil {
-			log.Warningf(ctx, "Unable to parse state parameter %#v to URL: %v", state, err)
+			log.Warningf(ctx, "Unable to parse state parameter %#v to URL: %v", stateString, err)
 			HTTPError(w, r, err)
 			return
 		}
-
-		user, err := getUserFromToken(ctx, token, defaultTokenDuration)
+		state.RedirectURL = redirectURL
+	} else {
+		decodedState, err := decodeStateString(ctx, stateString)
 		if err != nil {
-			log.Errorf(ctx, "Unable to produce user from token %#v: %v", token, err)
+			log.Errorf(ctx, "Unable to decode state string from %#v: %v", stateString, err)
 			HTTPError(w, r, err)
 			return
 		}
+		state = decodedState
+	}
 
-		finishLogin(ctx, w, r, user, redirectURL)
+	provider, err := getLoginProvider(ctx, state.Provider)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load login provider %q: %v", state.Provider, err)
+		HTTPError(w, r, err)
 		return
 	}
 
-	redirectURL, tokenDuration, err := decodeStateString(ctx, state)
+	conf, err := provider.oauth2Config(ctx, r)
 	if err != nil {
-		log.Errorf(ctx, "Unable to decode state string from %#v: %v", state, err)
+		log.Errorf(ctx, "Unable to load OAuth2Config: %v", err)
 		HTTPError(w, r, err)
 		return
 	}
 
-	user, err := getUserFromToken(ctx, token, tokenDuration)
+	code := r.URL.Query().Get("code")
+	token, err := conf.Exchange(ctx, code)
+	if err != nil {
+		log.Warningf(ctx, "Unable to exchange code for token %#v: %v", code, err)
+		HTTPError(w, r, err)
+		return
+	}
+
+	user, err := loginUser(ctx, provider, token, state.TokenDuration, state.LinkUserId)
 	if err != nil {
 		log.Errorf(ctx, "Unable to produce user from token %#v: %v", token, err)
 		HTTPError(w, r, err)
 		return
 	}
 
+	if approveRedirect {
+		finishLogin(ctx, w, r, user, state.RedirectURL)
+		return
+	}
+
+	finishApprovedLogin(ctx, w, r, user, state.RedirectURL)
+}
+
+// finishApprovedLogin finishes the login of user, after asking the user to
+// approve the redirect to redirectURL unless that's been done before.
+func finishApprovedLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, redirectURL *url.URL) {
 	strippedRedirectURL := *redirectURL
 	strippedRedirectURL.RawQuery = ""
 	strippedRedirectURL.Path = ""
@@ -861,7 +812,7 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 
 		approveState, err := encodeApproveState(ctx, redirectURL, user)
 		if err != nil {
-			log.Errorf(ctx, "Unable to encode approve state %v, %+v, %q: %v", redirectURL, token, user.Id, err)
+			log.Errorf(ctx, "Unable to encode approve state %v, %q: %v", redirectURL, user.Id, err)
 			HTTPError(w, r, err)
 			return
 		}
@@ -902,28 +853,13 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	finishLogin(ctx, w, r, user, redirectURL)
 }
 
-func getUserFromToken(ctx context.Context, token *oauth2.Token, duration time.Duration) (*User, error) {
-	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
-	service, err := oauth2service.New(client)
-	if err != nil {
-		log.Warningf(ctx, "Unable to create OAuth2 client from token %#v: %v", token, err)
-		return nil, err
-	}
-	userInfo, err := oauth2service.NewUserinfoService(service).Get().Context(ctx).Do()
-	if err != nil {
-		log.Warningf(ctx, "Unable to fetch user info: %v", err)
-		return nil, err
-	}
-	user := infoToUser(userInfo)
-	user.ValidUntil = time.Now().Add(duration)
-	if _, err := datastore.Put(ctx, UserID(ctx, user.Id), user); err != nil {
-		log.Warningf(ctx, "Unable to store user info %+v: %v", user, err)
-		return nil, err
+func finishLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, redirectURL *url.URL) {
+	if err := startSession(ctx, r, user, ""); err != nil {
+		log.Errorf(ctx, "Unable to start session for %+v: %v", user, err)
+		HTTPError(w, r, err)
+		return
 	}
-	return user, nil
-}
 
-func finishLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, redirectURL *url.URL) {
 	userToken, err := encodeUserToToken(ctx, user)
 	if err != nil {
 		log.Errorf(ctx, "Unable to encrypt token for %+v: %v", user, err)
@@ -931,7 +867,9 @@ func finishLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, us
 		return
 	}
 
-	query := url.Values{}
+	// Keep the query, since the redirect may be back to a page requiring
+	// login, e.g. an OAuth2 authorization request.
+	query := redirectURL.Query()
 	query.Set("token", userToken)
 	redirectURL.RawQuery = query.Encode()
 
@@ -939,6 +877,14 @@ func finishLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, us
 }
 
 func handleLogout(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if user, ok := r.Values()["user"].(*User); ok && user.SessionId != "" {
+		if err := revokeSessions(ctx, []*datastore.Key{SessionID(ctx, user.SessionId)}); err != nil {
+			return err
+		}
+	}
+
 	http.Redirect(w, r.Req(), r.Req().URL.Query().Get(redirectToKey), http.StatusSeeOther)
 	return nil
 }
@@ -970,7 +916,7 @@ func tokenFilter(w ResponseWriter, r Request) (bool, error) {
 				Id:            fakeID,
 				Name:          "Fakey Fakeson",
 				VerifiedEmail: true,
-				ValidUntil:    time.Now().Add(defaultTokenDuration),
+				ValidUntil:    clock.Now(ctx).Add(defaultTokenDuration),
 			}
 			if _, err := datastore.Put(ctx, UserID(ctx, user.Id), user); err != nil {
 				return false, err
@@ -1011,7 +957,32 @@ func tokenFilter(w ResponseWriter, r Request) (bool, error) {
 		}
 	}
 
-	if token != "" {
+	if strings.HasPrefix(token, accessTokenPrefix) {
+		user, err := accessTokenUser(ctx, r, token)
+		if err != nil {
+			return false, err
+		}
+
+		log.Infof(ctx, "Request by %+v using access token", user)
+
+		if r.Req().URL.Query().Get("fake-id") != "" {
+			return false, HTTPErr{"access tokens can't fake user ids", http.StatusForbidden}
+		}
+
+		r.Values()["user"] = user
+		r.Values()[tokenAuthenticatedKey] = true
+
+		if queryToken {
+			r.DecorateLinks(func(l *Link, u *url.URL) error {
+				if l.Rel != "logout" {
+					q := u.Query()
+					q.Set("token", token)
+					u.RawQuery = q.Encode()
+				}
+				return nil
+			})
+		}
+	} else if token != "" {
 		plain, err := DecodeString(ctx, token)
 		if err != nil {
 			return false, err
@@ -1021,27 +992,48 @@ func tokenFilter(w ResponseWriter, r Request) (bool, error) {
 		if err := json.Unmarshal([]byte(plain), user); err != nil {
 			return false, err
 		}
-		if user.ValidUntil.Before(time.Now()) {
+		if user.ValidUntil.Before(clock.Now(ctx)) {
 			return false, HTTPErr{"token timed out", http.StatusUnauthorized}
 		}
+		// Tokens issued before sessions existed are accepted until they time out.
+		secondFactor := false
+		if user.SessionId != "" {
+			session, err := checkSession(ctx, user)
+			if err != nil {
+				return false, err
+			}
+			secondFactor = !session.SecondFactorAt.IsZero()
+		}
 
 		log.Infof(ctx, "Request by %+v", user)
 
 		if fakeID := r.Req().URL.Query().Get("fake-id"); fakeID != "" {
-			superusers, err := GetSuperusers(ctx)
+			allowed, err := HasPermission(ctx, user.Id, ImpersonatePermission)
 			if err != nil {
 				return false, err
 			}
 
-			if !superusers.Includes(user.Id) {
+			if !allowed {
 				return false, HTTPErr{"unauthorized", http.StatusForbidden}
 			}
 
+			if !secondFactor {
+				return false, errSecondFactorRequired
+			}
+
 			log.Infof(ctx, "Faking user Id %q", fakeID)
+			if err := RecordAudit(ctx, nil, user.Id, ImpersonateAuditAction, fakeID, nil, map[string]string{
+				"Method": r.Req().Method,
+				"Path":   r.Req().URL.Path,
+			}); err != nil {
+				return false, err
+			}
 			user.Id = fakeID
 		}
 
 		r.Values()["user"] = user
+		r.Values()[tokenAuthenticatedKey] = true
+		r.Values()[secondFactorKey] = secondFactor
 
 		if queryToken {
 			r.DecorateLinks(func(l *Link, u *url.URL) error {
@@ -1293,10 +1285,23 @@ func handleTestUpdateUser(w ResponseWriter, r Request) error {
 	return nil
 }
 
+// Resources returns the resources registered by SetupRouter.
+func Resources() []*Resource {
+	return []*Resource{
+		UserConfigResource,
+		RedirectURLResource,
+		AccessTokenResource,
+		SessionResource,
+		IdentityResource,
+		OAuth2ClientResource,
+	}
+}
+
 func SetupRouter(r *mux.Router) {
 	router = r
-	HandleResource(router, UserConfigResource)
-	HandleResource(router, RedirectURLResource)
+	for _, resource := range Resources() {
+		HandleResource(router, resource)
+	}
 	Handle(router, "/_test_update_user", []string{"PUT"}, TestUpdateUserRoute, handleTestUpdateUser)
 	Handle(router, "/Auth/Login", []string{"GET"}, LoginRoute, handleLogin)
 	Handle(router, "/Auth/DiscordBotLogin", []string{"GET"}, DiscordBotLoginRoute, handleDiscordBotLogin)
@@ -1307,6 +1312,45 @@ func SetupRouter(r *mux.Router) {
 	Handle(router, "/Auth/ApproveRedirect", []string{"POST"}, ApproveRedirectRoute, handleApproveRedirect)
 	Handle(router, "/User/{user_id}/Unsubscribe", []string{"GET"}, UnsubscribeRoute, unsubscribe)
 	Handle(router, "/User/{user_id}/FCMToken/{replace_token}/Replace", []string{"PUT"}, ReplaceFCMRoute, replaceFCM)
+	Handle(router, "/User/{user_id}/Sessions/_revoke", []string{"POST"}, RevokeAllSessionsRoute, handleRevokeAllSessions)
+	Handle(router, "/Auth/LoginProviders", []string{"GET"}, ListLoginProvidersRoute, listLoginProviders)
+	Handle(router, "/User/{user_id}/Identity/_link", []string{"GET"}, LinkIdentityRoute, handleLinkIdentity)
+	Handle(router, "/Auth/EMailLogin", []string{"POST"}, EMailLoginRoute, handleEMailLogin)
+	Handle(router, "/User/{user_id}/Identity/_link-email", []string{"POST"}, LinkEMailRoute, handleLinkEMail)
+	Handle(router, "/Auth/EMailLogin/{login_token}", []string{"GET"}, ConfirmEMailLoginRoute, handleConfirmEMailLogin)
+	Handle(router, "/Auth/EMailLogin/{login_token}", []string{"POST"}, FinishEMailLoginRoute, handleFinishEMailLogin)
+	Handle(router, "/OAuth2/Authorize", []string{"GET"}, OAuth2AuthorizeRoute, handleOAuth2Authorize)
+	Handle(router, "/OAuth2/Authorize", []string{"POST"}, OAuth2ConsentRoute, handleOAuth2Consent)
+	// Don't use `Handle` here, because OAuth2 clients don't speak HAL and expect OAuth2 errors.
+	router.Path("/OAuth2/Token").Methods("POST").Name(OAuth2TokenRoute).HandlerFunc(handleOAuth2JSON(handleOAuth2Token))
+	router.Path("/OAuth2/Introspect").Methods("POST").Name(OAuth2IntrospectRoute).HandlerFunc(handleOAuth2JSON(handleOAuth2Introspect))
+	Handle(router, "/Roles", []string{"GET"}, ListRolesRoute, handleListRoles)
+	Handle(router, "/RoleAssignments", []string{"GET"}, ListRoleAssignmentsRoute, handleListRoleAssignments)
+	Handle(router, "/User/{user_id}/Roles", []string{"PUT"}, AssignRolesRoute, handleAssignRoles)
+	Handle(router, "/AuditLog", []string{"GET"}, ListAuditLogRoute, handleListAuditLog)
+	Handle(router, "/User/{user_id}/TOTP", []string{"GET"}, LoadTOTPRoute, handleLoadTOTP)
+	Handle(router, "/User/{user_id}/TOTP", []string{"POST"}, EnrollTOTPRoute, handleEnrollTOTP)
+	Handle(router, "/User/{user_id}/TOTP", []string{"DELETE"}, DeleteTOTPRoute, handleDeleteTOTP)
+	Handle(router, "/User/{user_id}/TOTP/_confirm", []string{"POST"}, ConfirmTOTPRoute, handleConfirmTOTP)
+	Handle(router, "/User/{user_id}/TOTP/_verify", []string{"POST"}, VerifyTOTPRoute, handleVerifyTOTP)
+	Handle(router, "/_nacl-keys", []string{"GET"}, ListNaClKeysRoute, handleListNaClKeys)
+	Handle(router, "/_nacl-keys", []string{"POST"}, AddNaClKeyRoute, handleAddNaClKey)
+	Handle(router, "/_nacl-keys/{version}", []string{"DELETE"}, RetireNaClKeyRoute, handleRetireNaClKey)
+	// Access tokens can't be used to mint or inspect other credentials.
+	AllowScopes(TokenForDiscordUserRoute)
+	AllowScopes(ListAccessTokensRoute)
+	AllowScopes(ListSessionsRoute)
+	AllowScopes(ListNaClKeysRoute)
+	AllowScopes(ListIdentitiesRoute)
+	AllowScopes(LinkIdentityRoute)
+	AllowScopes(LinkEMailRoute)
+	AllowScopes(ListOAuth2ClientsRoute)
+	AllowScopes(OAuth2AuthorizeRoute)
+	AllowScopes(ListRoleAssignmentsRoute)
+	AllowScopes(LoadTOTPRoute)
+	// Nor to change state through GET routes.
+	AllowScopes(LogoutRoute)
+	AllowScopes(UnsubscribeRoute)
 	AddFilter(decorateAPILevel)
 	AddFilter(tokenFilter)
 	AddFilter(logHeaders)
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// getCached loads the JSON cached at key into dst, and returns whether it was
+// found. Unless it was, the returned item reserves key until expiration, so
+// that putCached only caches a value if key isn't deleted in the meantime.
+func getCached(ctx context.Context, key string, expiration time.Duration, dst interface{}) (*memcache.Item, bool) {
+	item, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		if err := memcache.Add(ctx, &memcache.Item{
+			Key:        key,
+			Value:      []byte{},
+			Expiration: expiration,
+		}); err != nil && err != memcache.ErrNotStored {
+			log.Warningf(ctx, "Unable to reserve cache key %q: %v", key, err)
+			return nil, false
+		}
+		item, err = memcache.Get(ctx, key)
+	}
+	if err == memcache.ErrCacheMiss {
+		return nil, false
+	} else if err != nil {
+		log.Warningf(ctx, "Unable to load cached %q: %v", key, err)
+		return nil, false
+	}
+	if len(item.Value) == 0 {
+		return item, false
+	}
+	if err := json.Unmarshal(item.Value, dst); err != nil {
+		log.Warningf(ctx, "Unable to decode cached %q: %v", key, err)
+		return item, false
+	}
+	return item, true
+}
+
+// putCached caches src as JSON in item returned by getCached, unless item
+// was changed or deleted since.
+func putCached(ctx context.Context, item *memcache.Item, expiration time.Duration, src interface{}) {
+	if item == nil {
+		return
+	}
+	b, err := json.Marshal(src)
+	if err != nil {
+		log.Warningf(ctx, "Unable to encode %+v: %v", src, err)
+		return
+	}
+	item.Value = b
+	item.Expiration = expiration
+	if err := memcache.CompareAndSwap(ctx, item); err != nil && err != memcache.ErrCASConflict && err != memcache.ErrNotStored {
+		log.Warningf(ctx, "Unable to cache %q: %v", item.Key, err)
+	}
+}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	emailLoginKind = "EMailLogin"
+	// EMailProviderName is the provider of identities logging in using
+	// links sent by email.
+	EMailProviderName = "email"
+
+	emailLoginFromAddr = "noreply@oort.se"
+	emailLoginFromName = "Diplicity"
+
+	emailLoginDuration = 15 * time.Minute
+	emailLoginWindow   = time.Hour
+	// At most this many links are sent to each address, and to addresses
+	// requested from each IP, per emailLoginWindow.
+	emailLoginsPerAddress = 5
+	emailLoginsPerIP      = 20
+)
+
+const (
+	EMailLoginRoute        = "EMailLogin"
+	LinkEMailRoute         = "LinkEMail"
+	ConfirmEMailLoginRoute = "ConfirmEMailLogin"
+	FinishEMailLoginRoute  = "FinishEMailLogin"
+)
+
+// EMailLogin is a login link sent by email, usable once before ExpiresAt.
+type EMailLogin struct {
+	Email         string
+	RedirectURL   string        `json:"-" datastore:",noindex"`
+	TokenDuration time.Duration `json:"-" datastore:",noindex"`
+	LinkUserId    string        `json:"-" datastore:",noindex"`
+	ExpiresAt     time.Time     `datastore:",noindex"`
+	// DevLoginURL is the link itself, only returned by the dev app server to
+	// allow logging in without sending email.
+	DevLoginURL string `datastore:"-" json:",omitempty"`
+}
+
+// rateLimit counts calls using key, and returns an error if there have been
+// more than limit calls during the current window.
+func rateLimit(ctx context.Context, key string, window time.Duration, limit uint64) error {
+	bucket := clock.Now(ctx).UnixNano() / int64(window)
+	count, err := memcache.Increment(ctx, fmt.Sprintf("rate-limit/%s/%d", key, bucket), 1, 0)
+	if err != nil {
+		return err
+	}
+	if count > limit {
+		return HTTPErr{"too many requests, try again later", http.StatusTooManyRequests}
+	}
+	return nil
+}
+
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Appengine-User-Ip"); ip != "" {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func requestTokenDuration(r *http.Request) (time.Duration, error) {
+	tokenDuration := defaultTokenDuration
+	if tokenDurationString := r.FormValue(tokenDurationKey); tokenDurationString != "" {
+		tokenDurationLong, err := strconv.ParseInt(tokenDurationString, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		tokenDuration = time.Second * time.Duration(tokenDurationLong)
+	}
+	return tokenDuration, nil
+}
+
+func handleEMailLogin(w ResponseWriter, r Request) error {
+	return sendEMailLogin(w, r, nil)
+}
+
+// handleLinkEMail sends a link that links the address to the user instead of
+// logging in as the user of the address.
+func handleLinkEMail(w ResponseWriter, r Request) error {
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only link identities to yourself", http.StatusForbidden}
+	}
+
+	return sendEMailLogin(w, r, user)
+}
+
+// sendEMailLogin sends a login link to the email of r, linking the address
+// to linkUser if not nil.
+func sendEMailLogin(w ResponseWriter, r Request, linkUser *User) error {
+	ctx := appengine.NewContext(r.Req())
+
+	address, err := mail.ParseAddress(r.Req().FormValue("email"))
+	if err != nil {
+		return HTTPErr{"invalid email address", http.StatusBadRequest}
+	}
+
+	tokenDuration, err := requestTokenDuration(r.Req())
+	if err != nil {
+		return err
+	}
+
+	redirectURL, err := url.Parse(r.Req().FormValue(redirectToKey))
+	if err != nil {
+		return err
+	}
+
+	login := &EMailLogin{
+		Email:         strings.ToLower(address.Address),
+		RedirectURL:   redirectURL.String(),
+		TokenDuration: tokenDuration,
+		ExpiresAt:     clock.Now(ctx).Add(emailLoginDuration),
+	}
+	if linkUser != nil {
+		login.LinkUserId = linkUser.Id
+	}
+
+	if err := rateLimit(ctx, "email-login-address/"+login.Email, emailLoginWindow, emailLoginsPerAddress); err != nil {
+		return err
+	}
+	if err := rateLimit(ctx, "email-login-ip/"+clientIP(r.Req()), emailLoginWindow, emailLoginsPerIP); err != nil {
+		return err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	loginID := base64.RawURLEncoding.EncodeToString(b)
+	if _, err := datastore.Put(ctx, datastore.NewKey(ctx, emailLoginKind, loginID, 0, nil), login); err != nil {
+		return err
+	}
+
+	loginToken, err := EncodeString(ctx, loginID)
+	if err != nil {
+		return err
+	}
+	loginURL, err := router.Get(ConfirmEMailLoginRoute).URL("login_token", loginToken)
+	if err != nil {
+		return err
+	}
+	loginURL.Host = r.Req().Host
+	loginURL.Scheme = DefaultScheme
+
+	msg := &EMail{
+		FromAddr: emailLoginFromAddr,
+		FromName: emailLoginFromName,
+		ToAddr:   login.Email,
+		Subject:  "Log in to Diplicity",
+		TextBody: fmt.Sprintf("Visit %s within %v to log in to Diplicity.\n\nIf you didn't try to log in, you can ignore this email.", loginURL.String(), emailLoginDuration),
+	}
+	if linkUser != nil {
+		msg.Subject = "Link your email to Diplicity"
+		msg.TextBody = fmt.Sprintf("Visit %s within %v to link this address to the Diplicity account %q.\n\nIf you didn't ask for this, ignore this email. Linking would let that account log in using this address.", loginURL.String(), emailLoginDuration, linkUser.Name)
+	}
+	if err := msg.SendWithoutUnsubscribeHeader(ctx); err != nil {
+		if !appengine.IsDevAppServer() {
+			return err
+		}
+		log.Warningf(ctx, "Unable to send login link %q to %q: %v", loginURL, login.Email, err)
+	}
+	if appengine.IsDevAppServer() {
+		login.DevLoginURL = loginURL.String()
+	}
+
+	w.SetContent(NewItem(login).SetName("email-login"))
+	return nil
+}
+
+// handleConfirmEMailLogin asks the user to confirm the login, since loading
+// the link directly would let mail scanners following links use it. Links
+// linking the address to an account name the account.
+func handleConfirmEMailLogin(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	loginID, err := DecodeString(ctx, r.Vars()["login_token"])
+	if err != nil {
+		return err
+	}
+
+	login := &EMailLogin{}
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, emailLoginKind, loginID, 0, nil), login); err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"login link already used", http.StatusGone}
+	} else if err != nil {
+		return err
+	}
+
+	finishURL, err := router.Get(FinishEMailLoginRoute).URL("login_token", r.Vars()["login_token"])
+	if err != nil {
+		return err
+	}
+
+	title, question, button := "Log in", "Log in to Diplicity?", "Log in"
+	if login.LinkUserId != "" {
+		linkUser := &User{}
+		if err := datastore.Get(ctx, UserID(ctx, login.LinkUserId), linkUser); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		name := linkUser.Name
+		if name == "" {
+			name = login.LinkUserId
+		}
+		title, button = "Link email", "Link"
+		question = fmt.Sprintf("Link %s to the Diplicity account %q (%s)? That account will be able to log in using this address.", login.Email, name, login.LinkUserId)
+	}
+	return renderMessage(w, title, fmt.Sprintf(`
+      <span class="title">%s</span>
+      <div class="buttonlayout">
+        <form method="POST" action="%s">
+		  <input class="pure-material-button-text" style="align-self:flex-start" type="submit" value="%s"/>
+		</form>
+      </div>
+`, html.EscapeString(question), html.EscapeString(finishURL.String()), html.EscapeString(button)))
+}
+
+func handleFinishEMailLogin(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	loginID, err := DecodeString(ctx, r.Vars()["login_token"])
+	if err != nil {
+		return err
+	}
+
+	loginKey := datastore.NewKey(ctx, emailLoginKind, loginID, 0, nil)
+	login := &EMailLogin{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, loginKey, login); err == datastore.ErrNoSuchEntity {
+			return HTTPErr{"login link already used", http.StatusGone}
+		} else if err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, loginKey)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+	if login.ExpiresAt.Before(clock.Now(ctx)) {
+		return HTTPErr{"login link expired", http.StatusGone}
+	}
+
+	redirectURL, err := url.Parse(login.RedirectURL)
+	if err != nil {
+		return err
+	}
+
+	// Addresses are hashed, since user ids are visible to other players.
+	sum := sha256.Sum256([]byte(login.Email))
+	subject := hex.EncodeToString(sum[:])
+	providerUser := &User{
+		Id:            subject,
+		Email:         login.Email,
+		VerifiedEmail: true,
+		Name:          strings.Split(login.Email, "@")[0],
+	}
+	user, err := identifyUser(ctx, EMailProviderName, providerUser, fmt.Sprintf("%s-%s", EMailProviderName, subject[:32]), login.TokenDuration, login.LinkUserId)
+	if err != nil {
+		return err
+	}
+
+	finishApprovedLogin(ctx, w, r.Req(), user, redirectURL)
+	return nil
+}
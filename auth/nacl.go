@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	ListNaClKeysRoute  = "ListNaClKeys"
+	AddNaClKeyRoute    = "AddNaClKey"
+	RetireNaClKeyRoute = "RetireNaClKey"
+)
+
+const (
+	// naClCacheDuration is how long an instance uses its cached keys before
+	// reloading them. New keys aren't used for encryption until this long
+	// after they are added, so that all instances are able to decrypt with
+	// them by then.
+	naClCacheDuration = 5 * time.Minute
+	// naClMinReloadInterval limits how often failing decryption reloads the
+	// keys.
+	naClMinReloadInterval = 10 * time.Second
+)
+
+var (
+	prodNaClLoadedAt time.Time
+)
+
+// naClKey is a version of the secret used to encrypt tokens, reply addresses
+// and unsubscribe URLs.
+type naClKey struct {
+	Version   int
+	Secret    []byte `json:"-"`
+	CreatedAt time.Time
+	ActiveAt  time.Time
+}
+
+type naCl struct {
+	// Secret is the only key of secrets stored before keys were versioned.
+	Secret []byte
+	Keys   []naClKey
+}
+
+func getNaClKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, naClKind, prodKey, 0, nil)
+}
+
+// migrate turns the unversioned secret into the first key.
+func (n *naCl) migrate() {
+	if len(n.Keys) == 0 && len(n.Secret) > 0 {
+		n.Keys = []naClKey{
+			{
+				Version: 1,
+				Secret:  n.Secret,
+			},
+		}
+	}
+	n.Secret = nil
+	sort.Slice(n.Keys, func(i, j int) bool {
+		return n.Keys[i].Version > n.Keys[j].Version
+	})
+}
+
+// current returns the newest key active at now.
+func (n *naCl) current(now time.Time) (*naClKey, error) {
+	for i := range n.Keys {
+		if !n.Keys[i].ActiveAt.After(now) {
+			return &n.Keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no active NaCl key")
+}
+
+// open tries to decrypt box with all keys, newest first.
+func (n *naCl) open(box []byte, nonce *[24]byte) ([]byte, bool) {
+	for _, key := range n.Keys {
+		var secretAry [32]byte
+		copy(secretAry[:], key.Secret)
+		if plain, ok := secretbox.Open([]byte{}, box, nonce, &secretAry); ok {
+			return plain, true
+		}
+	}
+	return nil, false
+}
+
+func newNaClKey(ctx context.Context, version int, activeAt time.Time) (*naClKey, error) {
+	key := &naClKey{
+		Version:   version,
+		Secret:    make([]byte, 32),
+		CreatedAt: clock.Now(ctx),
+		ActiveAt:  activeAt,
+	}
+	if _, err := io.ReadFull(rand.Reader, key.Secret); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// getNaCl returns the keys, cached for naClCacheDuration. If reload is set,
+// the keys are reloaded unless they were loaded within naClMinReloadInterval.
+func getNaCl(ctx context.Context, reload bool) (*naCl, error) {
+	now := clock.Now(ctx)
+	maxAge := naClCacheDuration
+	if reload {
+		maxAge = naClMinReloadInterval
+	}
+	// check if in memory
+	prodNaClLock.RLock()
+	if prodNaCl != nil && now.Sub(prodNaClLoadedAt) < maxAge {
+		defer prodNaClLock.RUnlock()
+		return prodNaCl, nil
+	}
+	prodNaClLock.RUnlock()
+	// nope, check if in datastore
+	prodNaClLock.Lock()
+	defer prodNaClLock.Unlock()
+	if prodNaCl != nil && now.Sub(prodNaClLoadedAt) < maxAge {
+		return prodNaCl, nil
+	}
+	foundNaCl := &naCl{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, getNaClKey(ctx), foundNaCl); err == nil {
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		// nope, create new key
+		key, err := newNaClKey(ctx, 1, time.Time{})
+		if err != nil {
+			return err
+		}
+		foundNaCl.Keys = []naClKey{*key}
+		_, err = datastore.Put(ctx, getNaClKey(ctx), foundNaCl)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	foundNaCl.migrate()
+	prodNaCl = foundNaCl
+	prodNaClLoadedAt = now
+	return prodNaCl, nil
+}
+
+// updateNaCl runs f on the stored keys inside a transaction, and stores the
+// result.
+func updateNaCl(ctx context.Context, f func(*naCl) error) (*naCl, error) {
+	if _, err := getNaCl(ctx, false); err != nil {
+		return nil, err
+	}
+	updated := &naCl{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		*updated = naCl{}
+		if err := datastore.Get(ctx, getNaClKey(ctx), updated); err != nil {
+			return err
+		}
+		updated.migrate()
+		if err := f(updated); err != nil {
+			return err
+		}
+		_, err := datastore.Put(ctx, getNaClKey(ctx), updated)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	prodNaClLock.Lock()
+	defer prodNaClLock.Unlock()
+	prodNaCl = updated
+	prodNaClLoadedAt = clock.Now(ctx)
+	return updated, nil
+}
+
+func naClKeysItem(nacl *naCl) *Item {
+	return NewItem(nacl.Keys).SetName("nacl-keys")
+}
+
+func handleListNaClKeys(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := RequirePermission(ctx, r, ConfigurePermission); err != nil {
+		return err
+	}
+
+	nacl, err := getNaCl(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	w.SetContent(naClKeysItem(nacl))
+	return nil
+}
+
+func handleAddNaClKey(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := RequirePermission(ctx, r, ConfigurePermission); err != nil {
+		return err
+	}
+
+	nacl, err := updateNaCl(ctx, func(nacl *naCl) error {
+		version := 1
+		if len(nacl.Keys) > 0 {
+			version = nacl.Keys[0].Version + 1
+		}
+		key, err := newNaClKey(ctx, version, clock.Now(ctx).Add(naClCacheDuration))
+		if err != nil {
+			return err
+		}
+		nacl.Keys = append([]naClKey{*key}, nacl.Keys...)
+		log.Infof(ctx, "Added NaCl key version %v, active at %v", key.Version, key.ActiveAt)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.SetContent(naClKeysItem(nacl))
+	return nil
+}
+
+func handleRetireNaClKey(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := RequirePermission(ctx, r, ConfigurePermission); err != nil {
+		return err
+	}
+
+	version, err := strconv.Atoi(r.Vars()["version"])
+	if err != nil {
+		return HTTPErr{"version must be an integer", http.StatusBadRequest}
+	}
+
+	nacl, err := updateNaCl(ctx, func(nacl *naCl) error {
+		now := clock.Now(ctx)
+		remaining := []naClKey{}
+		found := false
+		for _, key := range nacl.Keys {
+			if key.Version == version {
+				found = true
+			} else {
+				remaining = append(remaining, key)
+			}
+		}
+		if !found {
+			return HTTPErr{fmt.Sprintf("no NaCl key version %v", version), http.StatusNotFound}
+		}
+		if _, err := (&naCl{Keys: remaining}).current(now); err != nil {
+			return HTTPErr{"can't retire the last active NaCl key", http.StatusPreconditionFailed}
+		}
+		nacl.Keys = remaining
+		log.Infof(ctx, "Retired NaCl key version %v", version)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.SetContent(naClKeysItem(nacl))
+	return nil
+}
@@ -0,0 +1,702 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	oauth2ClientKind       = "OAuth2Client"
+	oauth2CodeKind         = "OAuth2Code"
+	oauth2RefreshTokenKind = "OAuth2RefreshToken"
+
+	oauth2ClientIDPrefix     = "dpc_"
+	oauth2ClientSecretPrefix = "dpcs_"
+	oauth2RefreshTokenPrefix = "dprt_"
+
+	oauth2ConsentDuration      = 10 * time.Minute
+	oauth2CodeDuration         = time.Minute
+	oauth2AccessTokenDuration  = time.Hour
+	oauth2RefreshTokenDuration = 90 * 24 * time.Hour
+)
+
+const (
+	ListOAuth2ClientsRoute = "ListOAuth2Clients"
+	OAuth2AuthorizeRoute   = "OAuth2Authorize"
+	OAuth2ConsentRoute     = "OAuth2Consent"
+	OAuth2TokenRoute       = "OAuth2Token"
+	OAuth2IntrospectRoute  = "OAuth2Introspect"
+)
+
+var (
+	OAuth2ClientResource *Resource
+)
+
+func init() {
+	OAuth2ClientResource = &Resource{
+		Create:     createOAuth2Client,
+		Delete:     deleteOAuth2Client,
+		CreatePath: "/User/{user_id}/OAuth2Client",
+		FullPath:   "/User/{user_id}/OAuth2Client/{id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/OAuth2Clients",
+				Route:   ListOAuth2ClientsRoute,
+				Handler: listOAuth2Clients,
+			},
+		},
+	}
+}
+
+// newSecret returns a random string starting with prefix.
+func newSecret(prefix string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+type OAuth2Clients []OAuth2Client
+
+func (c OAuth2Clients) Item(r Request, userId string) *Item {
+	clientItems := make(List, len(c))
+	for i := range c {
+		clientItems[i] = c[i].Item(r)
+	}
+	return NewItem(clientItems).SetName("oauth2-clients").SetDesc([][]string{
+		[]string{
+			"OAuth2 clients",
+			"Registered OAuth2 clients can ask players for scoped tokens using the authorization code flow, at `/OAuth2/Authorize` and `/OAuth2/Token`.",
+			"Public clients, e.g. browser or mobile apps, have no secret and must use PKCE with the S256 method. Confidential clients get a secret, only shown when the client is registered.",
+			"Clients can inspect their tokens at `/OAuth2/Introspect`.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListOAuth2ClientsRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(OAuth2ClientResource.Link("create", Create, []string{"user_id", userId})))
+}
+
+// OAuth2Client is an application allowed to ask players for tokens. Only a
+// hash of the secret of confidential clients is stored.
+type OAuth2Client struct {
+	ClientId     string `datastore:"-"`
+	UserId       string
+	Name         string   `methods:"POST" datastore:",noindex"`
+	RedirectURIs []string `methods:"POST" datastore:",noindex"`
+	Confidential bool     `methods:"POST" datastore:",noindex"`
+	SecretHash   string   `json:"-" datastore:",noindex"`
+	CreatedAt    time.Time
+	Secret       string `datastore:"-" json:",omitempty"`
+}
+
+func OAuth2ClientID(ctx context.Context, clientId string) *datastore.Key {
+	return datastore.NewKey(ctx, oauth2ClientKind, clientId, 0, nil)
+}
+
+func (c *OAuth2Client) Item(r Request) *Item {
+	return NewItem(c).SetName(c.Name).AddLink(r.NewLink(OAuth2ClientResource.Link("delete", Delete, []string{"user_id", c.UserId, "id", c.ClientId})))
+}
+
+func (c *OAuth2Client) allowsRedirectURI(redirectURI string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns whether secret is the secret of c, or if c is public
+// whether secret is empty.
+func (c *OAuth2Client) authenticate(secret string) bool {
+	if !c.Confidential {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(c.SecretHash)) == 1
+}
+
+func getOAuth2Client(ctx context.Context, clientId string) (*OAuth2Client, error) {
+	if clientId == "" {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	client := &OAuth2Client{}
+	if err := datastore.Get(ctx, OAuth2ClientID(ctx, clientId), client); err != nil {
+		return nil, err
+	}
+	client.ClientId = clientId
+	return client, nil
+}
+
+func createOAuth2Client(w ResponseWriter, r Request) (*OAuth2Client, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only create your own OAuth2 clients", http.StatusForbidden}
+	}
+
+	client := &OAuth2Client{}
+	if err := Copy(client, r, "POST"); err != nil {
+		return nil, err
+	}
+
+	if client.Name == "" {
+		return nil, HTTPErr{"OAuth2 clients must have names", http.StatusBadRequest}
+	}
+	if len(client.RedirectURIs) == 0 {
+		return nil, HTTPErr{"OAuth2 clients must have at least one redirect URI", http.StatusBadRequest}
+	}
+	for _, redirectURI := range client.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || parsed.Scheme == "" || parsed.Fragment != "" {
+			return nil, HTTPErr{fmt.Sprintf("redirect URI %q must be absolute and without fragment", redirectURI), http.StatusBadRequest}
+		}
+	}
+
+	var err error
+	if client.ClientId, err = newSecret(oauth2ClientIDPrefix); err != nil {
+		return nil, err
+	}
+	if client.Confidential {
+		if client.Secret, err = newSecret(oauth2ClientSecretPrefix); err != nil {
+			return nil, err
+		}
+		client.SecretHash = hashSecret(client.Secret)
+	}
+	client.UserId = user.Id
+	client.CreatedAt = clock.Now(ctx)
+
+	if _, err := datastore.Put(ctx, OAuth2ClientID(ctx, client.ClientId), client); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func deleteOAuth2Client(w ResponseWriter, r Request) (*OAuth2Client, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only delete your own OAuth2 clients", http.StatusForbidden}
+	}
+
+	client, err := getOAuth2Client(ctx, r.Vars()["id"])
+	if err != nil {
+		return nil, err
+	}
+	if client.UserId != user.Id {
+		return nil, HTTPErr{"can only delete your own OAuth2 clients", http.StatusForbidden}
+	}
+
+	// All tokens issued to the client go with it.
+	keys := []*datastore.Key{OAuth2ClientID(ctx, client.ClientId)}
+	for _, kind := range []string{accessTokenKind, oauth2RefreshTokenKind} {
+		tokenKeys, err := datastore.NewQuery(kind).Filter("ClientId=", client.ClientId).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, tokenKeys...)
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return nil, err
+	}
+	log.Infof(ctx, "Deleted OAuth2 client %q and %v tokens", client.ClientId, len(keys)-1)
+
+	return client, nil
+}
+
+func listOAuth2Clients(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own OAuth2 clients", http.StatusForbidden}
+	}
+
+	clients := OAuth2Clients{}
+	ids, err := datastore.NewQuery(oauth2ClientKind).Filter("UserId=", user.Id).GetAll(ctx, &clients)
+	if err != nil {
+		return err
+	}
+	for i := range clients {
+		clients[i].ClientId = ids[i].StringID()
+	}
+
+	w.SetContent(clients.Item(r, user.Id))
+	return nil
+}
+
+// oauth2Grant is what a user grants a client, first encrypted into the
+// consent form and then stored as an authorization code.
+type oauth2Grant struct {
+	ClientId      string
+	UserId        string
+	RedirectURI   string   `datastore:",noindex"`
+	Scopes        []string `datastore:",noindex"`
+	State         string   `datastore:"-"`
+	CodeChallenge string   `datastore:",noindex"`
+	ExpiresAt     time.Time
+}
+
+// OAuth2RefreshToken lets a client get new access tokens. Only a hash of the
+// token is stored.
+type OAuth2RefreshToken struct {
+	ClientId  string
+	UserId    string
+	Scopes    []string `datastore:",noindex"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func oauth2RefreshTokenID(ctx context.Context, token string) *datastore.Key {
+	return datastore.NewKey(ctx, oauth2RefreshTokenKind, hashSecret(token), 0, nil)
+}
+
+func parseOAuth2Scopes(scope string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	for _, scope := range scopes {
+		found := false
+		for _, known := range accessTokenScopes {
+			if scope == known {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown scope %q, must be one of %v", scope, accessTokenScopes)
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []string{ReadOnlyScope}
+	}
+	return scopes, nil
+}
+
+// redirectOAuth2 redirects to redirectURI with params added to its query.
+func redirectOAuth2(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) error {
+	redirectURL, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+	query := redirectURL.Query()
+	for key, values := range params {
+		if values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	redirectURL.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusSeeOther)
+	return nil
+}
+
+func handleOAuth2Authorize(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	query := r.Req().URL.Query()
+
+	// Errors before the redirect URI is verified are shown to the user,
+	// not sent to the redirect URI.
+	client, err := getOAuth2Client(ctx, query.Get("client_id"))
+	if err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"unknown client_id", http.StatusBadRequest}
+	} else if err != nil {
+		return err
+	}
+	redirectURI := query.Get("redirect_uri")
+	if !client.allowsRedirectURI(redirectURI) {
+		return HTTPErr{"redirect_uri not registered for client", http.StatusBadRequest}
+	}
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	state := query.Get("state")
+	fail := func(code, description string) error {
+		return redirectOAuth2(w, r.Req(), redirectURI, url.Values{
+			"error":             []string{code},
+			"error_description": []string{description},
+			"state":             []string{state},
+		})
+	}
+
+	if query.Get("response_type") != "code" {
+		return fail("unsupported_response_type", "only the code response type is supported")
+	}
+	scopes, err := parseOAuth2Scopes(query.Get("scope"))
+	if err != nil {
+		return fail("invalid_scope", err.Error())
+	}
+	codeChallenge := query.Get("code_challenge")
+	if codeChallenge == "" && !client.Confidential {
+		return fail("invalid_request", "public clients must use PKCE")
+	}
+	if codeChallenge != "" && query.Get("code_challenge_method") != "S256" {
+		return fail("invalid_request", "code_challenge_method must be S256")
+	}
+
+	grant := &oauth2Grant{
+		ClientId:      client.ClientId,
+		UserId:        user.Id,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         state,
+		CodeChallenge: codeChallenge,
+		ExpiresAt:     clock.Now(ctx).Add(oauth2ConsentDuration),
+	}
+	b, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	consentState, err := EncodeString(ctx, string(b))
+	if err != nil {
+		return err
+	}
+
+	consentURL, err := router.Get(OAuth2ConsentRoute).URL()
+	if err != nil {
+		return err
+	}
+
+	scopeItems := make([]string, len(scopes))
+	for i, scope := range scopes {
+		scopeItems[i] = fmt.Sprintf("<li>%s</li>", html.EscapeString(scope))
+	}
+
+	return renderMessage(w, "Authorize application", fmt.Sprintf(`
+      <span class="title">Let %s use Diplicity as you?</span>
+      <span class="messagetext">The application will be able to read your games, and use these scopes:
+        <ul>%s</ul>
+        You can revoke its access in your list of access tokens.
+      </span>
+
+      <div class="buttonlayout">
+        <form method="POST" action="%s">
+          <input type="hidden" name="state" value="%s">
+          <input type="hidden" name="decision" value="approve">
+          <input class="pure-material-button-text" style="align-self:flex-start" type="submit" value="Allow"/>
+        </form>
+        <form method="POST" action="%s">
+          <input type="hidden" name="state" value="%s">
+          <input type="hidden" name="decision" value="deny">
+          <input class="pure-material-button-text" style="align-self:flex-start" type="submit" value="Deny"/>
+        </form>
+      </div>
+`, html.EscapeString(client.Name), strings.Join(scopeItems, ""), consentURL.String(), consentState, consentURL.String(), consentState))
+}
+
+func handleOAuth2Consent(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := r.Req().ParseForm(); err != nil {
+		return err
+	}
+
+	plain, err := DecodeString(ctx, r.Req().Form.Get(stateKey))
+	if err != nil {
+		return err
+	}
+	grant := &oauth2Grant{}
+	if err := json.Unmarshal([]byte(plain), grant); err != nil {
+		return err
+	}
+	if grant.ExpiresAt.Before(clock.Now(ctx)) {
+		return HTTPErr{"authorization request expired, please try again", http.StatusBadRequest}
+	}
+
+	if r.Req().Form.Get("decision") != "approve" {
+		return redirectOAuth2(w, r.Req(), grant.RedirectURI, url.Values{
+			"error": []string{"access_denied"},
+			"state": []string{grant.State},
+		})
+	}
+
+	code, err := newSecret("")
+	if err != nil {
+		return err
+	}
+	grant.ExpiresAt = clock.Now(ctx).Add(oauth2CodeDuration)
+	if _, err := datastore.Put(ctx, datastore.NewKey(ctx, oauth2CodeKind, hashSecret(code), 0, nil), grant); err != nil {
+		return err
+	}
+	log.Infof(ctx, "%q authorized OAuth2 client %q with scopes %v", grant.UserId, grant.ClientId, grant.Scopes)
+
+	return redirectOAuth2(w, r.Req(), grant.RedirectURI, url.Values{
+		"code":  []string{code},
+		"state": []string{grant.State},
+	})
+}
+
+// oauth2Error is an error response as defined by RFC 6749.
+type oauth2Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	status      int
+}
+
+func (e *oauth2Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+type oauth2IntrospectResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+}
+
+// handleOAuth2JSON returns a handler writing the result of f as JSON, and
+// errors as OAuth2 error responses.
+func handleOAuth2JSON(f func(ctx context.Context, r *http.Request, client *OAuth2Client) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		CORSHeaders(w)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		result, err := func() (interface{}, error) {
+			if err := r.ParseForm(); err != nil {
+				return nil, &oauth2Error{"invalid_request", err.Error(), http.StatusBadRequest}
+			}
+			clientId, clientSecret, ok := r.BasicAuth()
+			if !ok {
+				clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+			}
+			client, err := getOAuth2Client(ctx, clientId)
+			if err == datastore.ErrNoSuchEntity {
+				return nil, &oauth2Error{"invalid_client", "unknown client", http.StatusUnauthorized}
+			} else if err != nil {
+				return nil, err
+			}
+			if !client.authenticate(clientSecret) {
+				return nil, &oauth2Error{"invalid_client", "client authentication failed", http.StatusUnauthorized}
+			}
+			return f(ctx, r, client)
+		}()
+		if err != nil {
+			oauthErr, ok := err.(*oauth2Error)
+			if !ok {
+				log.Errorf(ctx, "Unable to handle %v %v: %v", r.Method, r.URL.Path, err)
+				oauthErr = &oauth2Error{"server_error", "", http.StatusInternalServerError}
+			}
+			w.WriteHeader(oauthErr.status)
+			result = oauthErr
+		}
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Errorf(ctx, "Unable to write %+v: %v", result, err)
+		}
+	}
+}
+
+func handleOAuth2Token(ctx context.Context, r *http.Request, client *OAuth2Client) (interface{}, error) {
+	var userId string
+	var scopes []string
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		codeKey := datastore.NewKey(ctx, oauth2CodeKind, hashSecret(r.PostForm.Get("code")), 0, nil)
+		grant := &oauth2Grant{}
+		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := datastore.Get(ctx, codeKey, grant); err == datastore.ErrNoSuchEntity {
+				return &oauth2Error{"invalid_grant", "unknown or used code", http.StatusBadRequest}
+			} else if err != nil {
+				return err
+			}
+			return datastore.Delete(ctx, codeKey)
+		}, &datastore.TransactionOptions{XG: false}); err != nil {
+			return nil, err
+		}
+		if grant.ExpiresAt.Before(clock.Now(ctx)) {
+			return nil, &oauth2Error{"invalid_grant", "code expired", http.StatusBadRequest}
+		}
+		if grant.ClientId != client.ClientId || grant.RedirectURI != r.PostForm.Get("redirect_uri") {
+			return nil, &oauth2Error{"invalid_grant", "code issued to another client or redirect_uri", http.StatusBadRequest}
+		}
+		if grant.CodeChallenge != "" {
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != grant.CodeChallenge {
+				return nil, &oauth2Error{"invalid_grant", "code_verifier doesn't match code_challenge", http.StatusBadRequest}
+			}
+		}
+		userId, scopes = grant.UserId, grant.Scopes
+	case "refresh_token":
+		refreshTokenID := oauth2RefreshTokenID(ctx, r.PostForm.Get("refresh_token"))
+		refreshToken := &OAuth2RefreshToken{}
+		// Refresh tokens are rotated, so each can only be used once.
+		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := datastore.Get(ctx, refreshTokenID, refreshToken); err == datastore.ErrNoSuchEntity {
+				return &oauth2Error{"invalid_grant", "unknown, used or revoked refresh token", http.StatusBadRequest}
+			} else if err != nil {
+				return err
+			}
+			return datastore.Delete(ctx, refreshTokenID)
+		}, &datastore.TransactionOptions{XG: false}); err != nil {
+			return nil, err
+		}
+		if refreshToken.ExpiresAt.Before(clock.Now(ctx)) {
+			return nil, &oauth2Error{"invalid_grant", "refresh token expired", http.StatusBadRequest}
+		}
+		if refreshToken.ClientId != client.ClientId {
+			return nil, &oauth2Error{"invalid_grant", "refresh token issued to another client", http.StatusBadRequest}
+		}
+		userId, scopes = refreshToken.UserId, refreshToken.Scopes
+		if scope := r.PostForm.Get("scope"); scope != "" {
+			requested, err := parseOAuth2Scopes(scope)
+			if err != nil {
+				return nil, &oauth2Error{"invalid_scope", err.Error(), http.StatusBadRequest}
+			}
+			for _, scope := range requested {
+				found := false
+				for _, granted := range scopes {
+					if scope == granted {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return nil, &oauth2Error{"invalid_scope", fmt.Sprintf("scope %q wasn't granted", scope), http.StatusBadRequest}
+				}
+			}
+			scopes = requested
+		}
+	default:
+		return nil, &oauth2Error{"unsupported_grant_type", "grant_type must be authorization_code or refresh_token", http.StatusBadRequest}
+	}
+
+	now := clock.Now(ctx)
+	accessToken := &AccessToken{
+		UserId:    userId,
+		ClientId:  client.ClientId,
+		Name:      client.Name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(oauth2AccessTokenDuration),
+	}
+	var err error
+	if accessToken.Token, err = newSecret(accessTokenPrefix); err != nil {
+		return nil, err
+	}
+	refreshToken := &OAuth2RefreshToken{
+		ClientId:  client.ClientId,
+		UserId:    userId,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(oauth2RefreshTokenDuration),
+	}
+	refreshTokenString, err := newSecret(oauth2RefreshTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := datastore.PutMulti(ctx, []*datastore.Key{
+		accessTokenID(ctx, accessToken.Token),
+		oauth2RefreshTokenID(ctx, refreshTokenString),
+	}, []interface{}{
+		accessToken,
+		refreshToken,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &oauth2TokenResponse{
+		AccessToken:  accessToken.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauth2AccessTokenDuration / time.Second),
+		RefreshToken: refreshTokenString,
+		Scope:        strings.Join(scopes, " "),
+	}, nil
+}
+
+// handleOAuth2Introspect describes tokens as defined by RFC 7662. Clients can
+// only inspect tokens issued to themselves.
+func handleOAuth2Introspect(ctx context.Context, r *http.Request, client *OAuth2Client) (interface{}, error) {
+	token := r.PostForm.Get("token")
+	response := &oauth2IntrospectResponse{}
+
+	var clientId, userId, tokenType string
+	var scopes []string
+	var createdAt, expiresAt time.Time
+	if strings.HasPrefix(token, oauth2RefreshTokenPrefix) {
+		refreshToken := &OAuth2RefreshToken{}
+		if err := datastore.Get(ctx, oauth2RefreshTokenID(ctx, token), refreshToken); err == datastore.ErrNoSuchEntity {
+			return response, nil
+		} else if err != nil {
+			return nil, err
+		}
+		clientId, userId, tokenType = refreshToken.ClientId, refreshToken.UserId, "refresh_token"
+		scopes, createdAt, expiresAt = refreshToken.Scopes, refreshToken.CreatedAt, refreshToken.ExpiresAt
+	} else if strings.HasPrefix(token, accessTokenPrefix) {
+		accessToken := &AccessToken{}
+		if err := datastore.Get(ctx, accessTokenID(ctx, token), accessToken); err == datastore.ErrNoSuchEntity {
+			return response, nil
+		} else if err != nil {
+			return nil, err
+		}
+		clientId, userId, tokenType = accessToken.ClientId, accessToken.UserId, "access_token"
+		scopes, createdAt, expiresAt = accessToken.Scopes, accessToken.CreatedAt, accessToken.ExpiresAt
+	} else {
+		return response, nil
+	}
+
+	if clientId != client.ClientId || !expiresAt.After(clock.Now(ctx)) {
+		return response, nil
+	}
+
+	response.Active = true
+	response.Scope = strings.Join(scopes, " ")
+	response.ClientId = clientId
+	response.Sub = userId
+	response.TokenType = tokenType
+	response.Iat = createdAt.Unix()
+	response.Exp = expiresAt.Unix()
+	return response, nil
+}
@@ -0,0 +1,579 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+
+	. "github.com/zond/goaeoas"
+	oauth2service "google.golang.org/api/oauth2/v2"
+)
+
+const (
+	loginProviderKind = "LoginProvider"
+	identityKind      = "Identity"
+	providerKey       = "provider"
+	linkUserIdKey     = "link-user-id"
+)
+
+const (
+	ListLoginProvidersRoute = "ListLoginProviders"
+	ListIdentitiesRoute     = "ListIdentities"
+	LinkIdentityRoute       = "LinkIdentity"
+)
+
+// The types of login providers that can be configured.
+const (
+	GoogleProviderType  = "google"
+	GitHubProviderType  = "github"
+	DiscordProviderType = "discord"
+	OIDCProviderType    = "oidc"
+)
+
+var (
+	discordEndpoint = oauth2.Endpoint{
+		AuthURL:  "https://discord.com/api/oauth2/authorize",
+		TokenURL: "https://discord.com/api/oauth2/token",
+	}
+
+	IdentityResource *Resource
+)
+
+func init() {
+	IdentityResource = &Resource{
+		Delete:   deleteIdentity,
+		FullPath: "/User/{user_id}/Identity/{id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/Identities",
+				Route:   ListIdentitiesRoute,
+				Handler: listIdentities,
+			},
+		},
+	}
+}
+
+// LoginProvider is an OAuth2 login provider configured using /_configure.
+// Google is always available as "google", using the OAuth configuration.
+type LoginProvider struct {
+	// Name identifies the provider in the `provider` query parameter of the
+	// login link, and in the identities of users.
+	Name string
+	// Type is one of GitHubProviderType, DiscordProviderType and
+	// OIDCProviderType.
+	Type     string
+	ClientID string
+	Secret   string
+	// Issuer is the OpenID Connect issuer URL, used to discover the
+	// endpoints of OIDCProviderType providers.
+	Issuer string
+}
+
+func getLoginProviderKey(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, loginProviderKind, name, 0, nil)
+}
+
+func SetLoginProvider(ctx context.Context, provider *LoginProvider) error {
+	if provider.Name == "" || provider.Name == GoogleProviderType {
+		return HTTPErr{fmt.Sprintf("login providers must have names other than %q", GoogleProviderType), http.StatusBadRequest}
+	}
+	switch provider.Type {
+	case GitHubProviderType, DiscordProviderType:
+	case OIDCProviderType:
+		if provider.Issuer == "" {
+			return HTTPErr{"OpenID Connect providers must have issuers", http.StatusBadRequest}
+		}
+	default:
+		return HTTPErr{fmt.Sprintf("unknown login provider type %q", provider.Type), http.StatusBadRequest}
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		currentProvider := &LoginProvider{}
+		if err := datastore.Get(ctx, getLoginProviderKey(ctx, provider.Name), currentProvider); err == nil {
+			return HTTPErr{fmt.Sprintf("login provider %q already configured", provider.Name), http.StatusBadRequest}
+		}
+		if _, err := datastore.Put(ctx, getLoginProviderKey(ctx, provider.Name), provider); err != nil {
+			return err
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func getLoginProvider(ctx context.Context, name string) (*LoginProvider, error) {
+	if name == "" || name == GoogleProviderType {
+		oauth, err := getOAuth(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginProvider{
+			Name:     GoogleProviderType,
+			Type:     GoogleProviderType,
+			ClientID: oauth.ClientID,
+			Secret:   oauth.Secret,
+		}, nil
+	}
+	provider := &LoginProvider{}
+	if err := datastore.Get(ctx, getLoginProviderKey(ctx, name), provider); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{fmt.Sprintf("unknown login provider %q", name), http.StatusNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+func (p *LoginProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	discovery := &oidcDiscovery{}
+	if err := getJSON(ctx, http.DefaultClient, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	return discovery, nil
+}
+
+// oauth2Config returns the config used to log in using p, with r as the
+// request used to find the callback URL.
+func (p *LoginProvider) oauth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, error) {
+	redirectURL, err := router.Get(OAuth2CallbackRoute).URL()
+	if err != nil {
+		return nil, err
+	}
+	redirectURL.Host = r.Host
+	redirectURL.Scheme = DefaultScheme
+
+	conf := &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.Secret,
+		RedirectURL:  redirectURL.String(),
+	}
+	switch p.Type {
+	case GoogleProviderType:
+		conf.Scopes = []string{"openid", "profile", "email"}
+		conf.Endpoint = google.Endpoint
+	case GitHubProviderType:
+		conf.Scopes = []string{"read:user", "user:email"}
+		conf.Endpoint = github.Endpoint
+	case DiscordProviderType:
+		conf.Scopes = []string{"identify", "email"}
+		conf.Endpoint = discordEndpoint
+	case OIDCProviderType:
+		discovery, err := p.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conf.Scopes = []string{"openid", "profile", "email"}
+		conf.Endpoint = oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		}
+	default:
+		return nil, fmt.Errorf("unknown login provider type %q", p.Type)
+	}
+	return conf, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, dst interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %q returned %v", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// user fetches the profile of the user owning token, with Id set to the id
+// of the user at the provider.
+func (p *LoginProvider) user(ctx context.Context, token *oauth2.Token) (*User, error) {
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
+	switch p.Type {
+	case GoogleProviderType:
+		service, err := oauth2service.New(client)
+		if err != nil {
+			return nil, err
+		}
+		userInfo, err := oauth2service.NewUserinfoService(service).Get().Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return infoToUser(userInfo), nil
+	case GitHubProviderType:
+		info := &struct {
+			Id        int64
+			Login     string
+			Name      string
+			Email     string
+			AvatarURL string `json:"avatar_url"`
+			HTMLURL   string `json:"html_url"`
+		}{}
+		if err := getJSON(ctx, client, "https://api.github.com/user", info); err != nil {
+			return nil, err
+		}
+		user := &User{
+			Id:      fmt.Sprint(info.Id),
+			Name:    info.Name,
+			Picture: info.AvatarURL,
+			Link:    info.HTMLURL,
+		}
+		if user.Name == "" {
+			user.Name = info.Login
+		}
+		emails := []struct {
+			Email    string
+			Primary  bool
+			Verified bool
+		}{}
+		if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+			log.Warningf(ctx, "Unable to load GitHub emails of %q: %v", info.Login, err)
+			user.Email = info.Email
+		}
+		for _, email := range emails {
+			if email.Primary {
+				user.Email = email.Email
+				user.VerifiedEmail = email.Verified
+			}
+		}
+		return user, nil
+	case DiscordProviderType:
+		info := &struct {
+			Id         string
+			Username   string
+			GlobalName string `json:"global_name"`
+			Email      string
+			Verified   bool
+			Avatar     string
+			Locale     string
+		}{}
+		if err := getJSON(ctx, client, "https://discord.com/api/users/@me", info); err != nil {
+			return nil, err
+		}
+		user := &User{
+			Id:            info.Id,
+			Name:          info.GlobalName,
+			Email:         info.Email,
+			VerifiedEmail: info.Verified,
+			Locale:        info.Locale,
+		}
+		if user.Name == "" {
+			user.Name = info.Username
+		}
+		if info.Avatar != "" {
+			user.Picture = fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", info.Id, info.Avatar)
+		}
+		return user, nil
+	case OIDCProviderType:
+		discovery, err := p.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		info := &struct {
+			Sub           string
+			Email         string
+			EmailVerified bool `json:"email_verified"`
+			Name          string
+			GivenName     string `json:"given_name"`
+			FamilyName    string `json:"family_name"`
+			Picture       string
+			Locale        string
+			Profile       string
+		}{}
+		if err := getJSON(ctx, client, discovery.UserinfoEndpoint, info); err != nil {
+			return nil, err
+		}
+		return &User{
+			Id:            info.Sub,
+			Email:         info.Email,
+			VerifiedEmail: info.EmailVerified,
+			Name:          info.Name,
+			GivenName:     info.GivenName,
+			FamilyName:    info.FamilyName,
+			Picture:       info.Picture,
+			Locale:        info.Locale,
+			Link:          info.Profile,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown login provider type %q", p.Type)
+}
+
+// defaultUserId returns the id of new users first logging in as subject.
+// Google and Discord users keep their ids at the providers, since Google was
+// the only provider before and Discord users already play using the bot.
+func (p *LoginProvider) defaultUserId(subject string) string {
+	if p.Type == GoogleProviderType || p.Type == DiscordProviderType {
+		return subject
+	}
+	return fmt.Sprintf("%s-%s", p.Name, subject)
+}
+
+// Identity connects an identity at a login provider to a user.
+type Identity struct {
+	Id        string `datastore:"-"`
+	Provider  string
+	Subject   string
+	UserId    string
+	Email     string `datastore:",noindex"`
+	CreatedAt time.Time
+}
+
+func IdentityID(ctx context.Context, provider, subject string) *datastore.Key {
+	return datastore.NewKey(ctx, identityKind, fmt.Sprintf("%s:%s", provider, subject), 0, nil)
+}
+
+func (i *Identity) Item(r Request) *Item {
+	return NewItem(i).SetName(i.Provider).AddLink(r.NewLink(IdentityResource.Link("unlink", Delete, []string{"user_id", i.UserId, "id", i.Id})))
+}
+
+type Identities []Identity
+
+func (i Identities) Item(r Request, userId string) *Item {
+	identityItems := make(List, len(i))
+	for idx := range i {
+		identityItems[idx] = i[idx].Item(r)
+	}
+	return NewItem(identityItems).SetName("identities").SetDesc([][]string{
+		[]string{
+			"Identities",
+			"The login provider identities that log in as this user.",
+			"To link another identity, load the `LinkIdentity` route with the `provider` and `redirect-to` query parameters, and log in using the provider.",
+			"To link an email address, POST to the `link-email` link with the `email` and `redirect-to` query parameters, and confirm using the link sent to the address.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListIdentitiesRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(Link{
+		Rel:         "link-email",
+		Route:       LinkEMailRoute,
+		RouteParams: []string{"user_id", userId},
+		Method:      "POST",
+	}))
+}
+
+// loginUser returns the user logging in as token at provider.
+func loginUser(ctx context.Context, provider *LoginProvider, token *oauth2.Token, duration time.Duration, linkUserId string) (*User, error) {
+	providerUser, err := provider.user(ctx, token)
+	if err != nil {
+		log.Warningf(ctx, "Unable to fetch user info from %q: %v", provider.Name, err)
+		return nil, err
+	}
+	if providerUser.Id == "" {
+		return nil, fmt.Errorf("login provider %q returned a user without id", provider.Name)
+	}
+
+	return identifyUser(ctx, provider.Name, providerUser, provider.defaultUserId(providerUser.Id), duration, linkUserId)
+}
+
+// identifyUser returns the user logging in as providerUser, whose Id is the
+// subject at the provider, after connecting the identity to the user with
+// linkUserId if not empty. Unknown identities not being linked get new users
+// with defaultUserId.
+func identifyUser(ctx context.Context, providerName string, providerUser *User, defaultUserId string, duration time.Duration, linkUserId string) (*User, error) {
+	identityID := IdentityID(ctx, providerName, providerUser.Id)
+	identity := &Identity{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		err := datastore.Get(ctx, identityID, identity)
+		if err == nil {
+			if linkUserId != "" && identity.UserId != linkUserId {
+				return HTTPErr{fmt.Sprintf("this %s identity already belongs to another user", providerName), http.StatusConflict}
+			}
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		identity = &Identity{
+			Provider:  providerName,
+			Subject:   providerUser.Id,
+			UserId:    linkUserId,
+			Email:     providerUser.Email,
+			CreatedAt: clock.Now(ctx),
+		}
+		if identity.UserId == "" {
+			identity.UserId = defaultUserId
+		}
+		_, err = datastore.Put(ctx, identityID, identity)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	// Linked identities don't replace the profile of existing users.
+	linked := identity.UserId != defaultUserId
+	user := &User{}
+	if err := datastore.Get(ctx, UserID(ctx, identity.UserId), user); err == datastore.ErrNoSuchEntity || (err == nil && !linked) {
+		user = providerUser
+		user.Id = identity.UserId
+	} else if err != nil {
+		return nil, err
+	}
+	user.ValidUntil = clock.Now(ctx).Add(duration)
+	if _, err := datastore.Put(ctx, UserID(ctx, user.Id), user); err != nil {
+		log.Warningf(ctx, "Unable to store user info %+v: %v", user, err)
+		return nil, err
+	}
+	return user, nil
+}
+
+// startLogin redirects to the login page of the provider in state.
+func startLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, state *loginState) error {
+	provider, err := getLoginProvider(ctx, state.Provider)
+	if err != nil {
+		return err
+	}
+
+	conf, err := provider.oauth2Config(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	stateString, err := encodeStateString(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, conf.AuthCodeURL(stateString), http.StatusSeeOther)
+	return nil
+}
+
+func handleLinkIdentity(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only link identities to yourself", http.StatusForbidden}
+	}
+
+	redirectURL, err := url.Parse(r.Req().URL.Query().Get(redirectToKey))
+	if err != nil {
+		return err
+	}
+
+	return startLogin(ctx, w, r.Req(), &loginState{
+		RedirectURL:   redirectURL,
+		TokenDuration: defaultTokenDuration,
+		Provider:      r.Req().URL.Query().Get(providerKey),
+		LinkUserId:    user.Id,
+	})
+}
+
+func listIdentities(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own identities", http.StatusForbidden}
+	}
+
+	identities := Identities{}
+	ids, err := datastore.NewQuery(identityKind).Filter("UserId=", user.Id).GetAll(ctx, &identities)
+	if err != nil {
+		return err
+	}
+	for i := range identities {
+		identities[i].Id = ids[i].StringID()
+	}
+
+	w.SetContent(identities.Item(r, user.Id))
+	return nil
+}
+
+func deleteIdentity(w ResponseWriter, r Request) (*Identity, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only unlink your own identities", http.StatusForbidden}
+	}
+
+	identityID := datastore.NewKey(ctx, identityKind, r.Vars()["id"], 0, nil)
+	identity := &Identity{}
+	if err := datastore.Get(ctx, identityID, identity); err != nil {
+		return nil, err
+	}
+	if identity.UserId != user.Id {
+		return nil, HTTPErr{"can only unlink your own identities", http.StatusForbidden}
+	}
+	count, err := datastore.NewQuery(identityKind).Filter("UserId=", user.Id).Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if count < 2 {
+		return nil, HTTPErr{"can't unlink the last identity", http.StatusPreconditionFailed}
+	}
+	if err := datastore.Delete(ctx, identityID); err != nil {
+		return nil, err
+	}
+	identity.Id = identityID.StringID()
+
+	return identity, nil
+}
+
+func listLoginProviders(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	providers := []LoginProvider{}
+	if _, err := datastore.NewQuery(loginProviderKind).GetAll(ctx, &providers); err != nil {
+		return err
+	}
+	names := []string{GoogleProviderType}
+	for _, provider := range providers {
+		names = append(names, provider.Name)
+	}
+
+	redirectTo := r.Req().URL.Query().Get(redirectToKey)
+	providerItems := make(List, len(names))
+	for i, name := range names {
+		providerItems[i] = NewItem(name).SetName(name).AddLink(r.NewLink(Link{
+			Rel:   "login",
+			Route: LoginRoute,
+			QueryParams: url.Values{
+				providerKey:   []string{name},
+				redirectToKey: []string{redirectTo},
+			},
+		}))
+	}
+
+	w.SetContent(NewItem(providerItems).SetName("login-providers").SetDesc([][]string{
+		[]string{
+			"Login providers",
+			"Use the `login` link of a provider to log in using it. The `redirect-to` query parameter of this list is passed on to the links.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: ListLoginProvidersRoute,
+	})))
+	return nil
+}
@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	roleAssignmentKind = "RoleAssignment"
+
+	roleAssignmentCacheDuration = 5 * time.Minute
+
+	// tokenAuthenticatedKey is set in the request values when the user was
+	// authenticated by a token, as opposed to a fake-id on the dev app server.
+	tokenAuthenticatedKey = "token-authenticated"
+)
+
+const (
+	ListRolesRoute           = "ListRoles"
+	ListRoleAssignmentsRoute = "ListRoleAssignments"
+	AssignRolesRoute         = "AssignRoles"
+)
+
+// The permissions that roles grant.
+const (
+	// ConfigurePermission allows configuring credentials and encryption keys.
+	ConfigurePermission = "configure"
+	// MaintenancePermission allows running the maintenance and repair jobs.
+	MaintenancePermission = "maintenance"
+	// ImpersonatePermission allows acting as other users.
+	ImpersonatePermission = "impersonate"
+	// ManageRolesPermission allows assigning roles.
+	ManageRolesPermission = "manage-roles"
+	// ModeratePermission allows handling flagged messages.
+	ModeratePermission = "moderate"
+	// MessagePlayersPermission allows sending system messages to all games.
+	MessagePlayersPermission = "message-players"
+	// ManageGamesPermission allows sending system messages to and
+	// rescheduling single games.
+	ManageGamesPermission = "manage-games"
+	// ManageSessionsPermission allows revoking the sessions of other users.
+	ManageSessionsPermission = "manage-sessions"
+	// ReadAuditLogPermission allows reading the audit log of all games.
+	ReadAuditLogPermission = "read-audit-log"
+)
+
+// The roles that can be assigned to users.
+const (
+	AdminRole              = "admin"
+	ModeratorRole          = "moderator"
+	SupportRole            = "support"
+	TournamentDirectorRole = "tournament-director"
+)
+
+var (
+	rolePermissions = map[string][]string{
+		AdminRole: []string{
+			ConfigurePermission,
+			MaintenancePermission,
+			ImpersonatePermission,
+			ManageRolesPermission,
+			ModeratePermission,
+			MessagePlayersPermission,
+			ManageGamesPermission,
+			ManageSessionsPermission,
+			ReadAuditLogPermission,
+		},
+		ModeratorRole: []string{
+			ModeratePermission,
+			MessagePlayersPermission,
+		},
+		SupportRole: []string{
+			ManageSessionsPermission,
+			ManageGamesPermission,
+			ReadAuditLogPermission,
+		},
+		TournamentDirectorRole: []string{
+			ManageGamesPermission,
+		},
+	}
+)
+
+// Role is a named set of permissions.
+type Role struct {
+	Name        string
+	Permissions []string
+}
+
+type Roles []Role
+
+func (r Roles) Item(req Request) *Item {
+	roleItems := make(List, len(r))
+	for i := range r {
+		roleItems[i] = NewItem(r[i]).SetName(r[i].Name)
+	}
+	return NewItem(roleItems).SetName("roles").SetDesc([][]string{
+		[]string{
+			"Roles",
+			"Roles grant users permissions to administer the server. Superusers have all permissions.",
+		},
+	}).AddLink(req.NewLink(Link{
+		Rel:   "self",
+		Route: ListRolesRoute,
+	}))
+}
+
+// RoleAssignment is the roles of a user.
+type RoleAssignment struct {
+	UserId    string
+	Roles     []string `datastore:",noindex"`
+	UpdatedBy string   `datastore:",noindex"`
+	UpdatedAt time.Time
+}
+
+func (a *RoleAssignment) Item(r Request) *Item {
+	return NewItem(a).SetName(a.UserId).AddLink(r.NewLink(Link{
+		Rel:         "assign",
+		Route:       AssignRolesRoute,
+		RouteParams: []string{"user_id", a.UserId},
+		Method:      "PUT",
+	}))
+}
+
+type RoleAssignments []RoleAssignment
+
+func (a RoleAssignments) Item(r Request) *Item {
+	assignmentItems := make(List, len(a))
+	for i := range a {
+		assignmentItems[i] = a[i].Item(r)
+	}
+	return NewItem(assignmentItems).SetName("role-assignments").AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: ListRoleAssignmentsRoute,
+	}))
+}
+
+func RoleAssignmentID(ctx context.Context, userId string) *datastore.Key {
+	return datastore.NewKey(ctx, roleAssignmentKind, userId, 0, nil)
+}
+
+func getRoleAssignment(ctx context.Context, userId string) (*RoleAssignment, error) {
+	assignmentID := RoleAssignmentID(ctx, userId)
+	assignment := &RoleAssignment{}
+	cacheItem, cached := getCached(ctx, assignmentID.Encode(), roleAssignmentCacheDuration, assignment)
+	if cached {
+		return assignment, nil
+	}
+	if err := datastore.Get(ctx, assignmentID, assignment); err == datastore.ErrNoSuchEntity {
+		assignment.UserId = userId
+	} else if err != nil {
+		return nil, err
+	}
+	putCached(ctx, cacheItem, roleAssignmentCacheDuration, assignment)
+	return assignment, nil
+}
+
+// HasPermission returns whether userId has permission, either from an
+// assigned role or from being a superuser.
+func HasPermission(ctx context.Context, userId string, permission string) (bool, error) {
+	superusers, err := GetSuperusers(ctx)
+	if err == nil {
+		if superusers.Includes(userId) {
+			return true, nil
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	assignment, err := getRoleAssignment(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range assignment.Roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == permission {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// PermissionGranted returns whether any user has permission, either from an
+// assigned role or from being a superuser.
+func PermissionGranted(ctx context.Context, permission string) (bool, error) {
+	if superusers, err := GetSuperusers(ctx); err == nil {
+		for _, userId := range strings.Split(superusers.UserIds, ",") {
+			if strings.TrimSpace(userId) != "" {
+				return true, nil
+			}
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	assignments := RoleAssignments{}
+	if _, err := datastore.NewQuery(roleAssignmentKind).GetAll(ctx, &assignments); err != nil {
+		return false, err
+	}
+	for _, assignment := range assignments {
+		for _, role := range assignment.Roles {
+			for _, granted := range rolePermissions[role] {
+				if granted == permission {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// RequirePermission returns an error unless the user of r has permission,
+// and has verified a second factor for the session.
+// On the dev app server, requests not authenticated by a token are allowed
+// everything, to keep local development and tests simple.
+func RequirePermission(ctx context.Context, r Request, permission string) error {
+	if authenticated, _ := r.Values()[tokenAuthenticatedKey].(bool); appengine.IsDevAppServer() && !authenticated {
+		return nil
+	}
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	allowed, err := HasPermission(ctx, user.Id, permission)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return HTTPErr{fmt.Sprintf("unauthorized, requires the %q permission", permission), http.StatusForbidden}
+	}
+
+	return RequireSecondFactor(r)
+}
+
+func handleListRoles(w ResponseWriter, r Request) error {
+	roles := Roles{}
+	for name, permissions := range rolePermissions {
+		roles = append(roles, Role{
+			Name:        name,
+			Permissions: permissions,
+		})
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+
+	w.SetContent(roles.Item(r))
+	return nil
+}
+
+func handleListRoleAssignments(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := RequirePermission(ctx, r, ManageRolesPermission); err != nil {
+		return err
+	}
+
+	assignments := RoleAssignments{}
+	if _, err := datastore.NewQuery(roleAssignmentKind).Order("UserId").GetAll(ctx, &assignments); err != nil {
+		return err
+	}
+
+	w.SetContent(assignments.Item(r))
+	return nil
+}
+
+func handleAssignRoles(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := RequirePermission(ctx, r, ManageRolesPermission); err != nil {
+		return err
+	}
+
+	assignment := &RoleAssignment{}
+	if err := json.NewDecoder(r.Req().Body).Decode(assignment); err != nil {
+		return HTTPErr{fmt.Sprintf("unable to parse role assignment: %v", err), http.StatusBadRequest}
+	}
+	for _, role := range assignment.Roles {
+		if _, found := rolePermissions[role]; !found {
+			return HTTPErr{fmt.Sprintf("unknown role %q", role), http.StatusBadRequest}
+		}
+	}
+
+	assignment.UserId = r.Vars()["user_id"]
+	if user, ok := r.Values()["user"].(*User); ok {
+		assignment.UpdatedBy = user.Id
+	}
+	assignment.UpdatedAt = clock.Now(ctx)
+
+	assignmentID := RoleAssignmentID(ctx, assignment.UserId)
+	before := &RoleAssignment{}
+	if err := datastore.Get(ctx, assignmentID, before); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if len(assignment.Roles) == 0 {
+		if err := datastore.Delete(ctx, assignmentID); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	} else if _, err := datastore.Put(ctx, assignmentID, assignment); err != nil {
+		return err
+	}
+	if err := memcache.Delete(ctx, assignmentID.Encode()); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	log.Infof(ctx, "%q assigned roles %v to %q", assignment.UpdatedBy, assignment.Roles, assignment.UserId)
+	if err := RecordAudit(ctx, nil, assignment.UpdatedBy, AssignRolesAuditAction, assignment.UserId, map[string][]string{"Roles": before.Roles}, map[string][]string{"Roles": assignment.Roles}); err != nil {
+		return err
+	}
+
+	w.SetContent(assignment.Item(r))
+	return nil
+}
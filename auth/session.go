@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	sessionKind = "Session"
+
+	// sessionCacheDuration is how long a session is cached before it's
+	// reloaded from the datastore. Revoking a session removes it from the
+	// cache as well, and sessions loaded before that aren't cached.
+	sessionCacheDuration = 10 * time.Minute
+	// sessionLastSeenResolution is how often LastSeenAt is written.
+	sessionLastSeenResolution = 10 * time.Minute
+)
+
+const (
+	ListSessionsRoute      = "ListSessions"
+	RevokeAllSessionsRoute = "RevokeAllSessions"
+)
+
+var (
+	SessionResource *Resource
+)
+
+func init() {
+	SessionResource = &Resource{
+		Delete:   deleteSession,
+		FullPath: "/User/{user_id}/Session/{id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/Sessions",
+				Route:   ListSessionsRoute,
+				Handler: listSessions,
+			},
+		},
+	}
+}
+
+type Sessions []Session
+
+func (s Sessions) Item(r Request, userId string) *Item {
+	sessionItems := make(List, len(s))
+	for i := range s {
+		sessionItems[i] = s[i].Item(r)
+	}
+	return NewItem(sessionItems).SetName("sessions").SetDesc([][]string{
+		[]string{
+			"Sessions",
+			"Each login creates a session, which lasts until the token expires or the session is revoked.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListSessionsRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(Link{
+		Rel:         "revoke-all",
+		Route:       RevokeAllSessionsRoute,
+		RouteParams: []string{"user_id", userId},
+		Method:      "POST",
+	}))
+}
+
+// Session is created for each login token, and the token is only accepted
+// while the session exists.
+type Session struct {
+	Id         string `datastore:"-"`
+	UserId     string
+	UserAgent  string `datastore:",noindex"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time `datastore:",noindex"`
+	ExpiresAt  time.Time `datastore:",noindex"`
+	// SecondFactorAt is when a second factor was verified for the session.
+	SecondFactorAt time.Time `datastore:",noindex"`
+	Current        bool      `datastore:"-"`
+}
+
+func SessionID(ctx context.Context, sessionId string) *datastore.Key {
+	return datastore.NewKey(ctx, sessionKind, sessionId, 0, nil)
+}
+
+func (s *Session) Item(r Request) *Item {
+	return NewItem(s).SetName(s.UserAgent).AddLink(r.NewLink(SessionResource.Link("revoke", Delete, []string{"user_id", s.UserId, "id", s.Id})))
+}
+
+// startSession stores a session for user created by r, and sets the
+// SessionId of user. If sessionId is empty a random one is generated.
+func startSession(ctx context.Context, r *http.Request, user *User, sessionId string) error {
+	if sessionId == "" {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		sessionId = base64.RawURLEncoding.EncodeToString(b)
+	}
+	now := clock.Now(ctx)
+	session := &Session{
+		Id:         sessionId,
+		UserId:     user.Id,
+		UserAgent:  r.Header.Get("User-Agent"),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  user.ValidUntil,
+	}
+	if _, err := datastore.Put(ctx, SessionID(ctx, sessionId), session); err != nil {
+		return err
+	}
+	if err := memcache.Delete(ctx, SessionID(ctx, sessionId).Encode()); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "Unable to clear cached session %q: %v", sessionId, err)
+	}
+	user.SessionId = sessionId
+	return nil
+}
+
+// checkSession returns the session of user, or an error unless it's still
+// valid, and keeps its LastSeenAt reasonably current.
+func checkSession(ctx context.Context, user *User) (*Session, error) {
+	sessionID := SessionID(ctx, user.SessionId)
+	session := &Session{}
+	cacheItem, cached := getCached(ctx, sessionID.Encode(), sessionCacheDuration, session)
+	if !cached {
+		if err := datastore.Get(ctx, sessionID, session); err == datastore.ErrNoSuchEntity {
+			return nil, HTTPErr{"session revoked", http.StatusUnauthorized}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if session.UserId != user.Id {
+		return nil, HTTPErr{"session belongs to another user", http.StatusUnauthorized}
+	}
+	now := clock.Now(ctx)
+	if now.Sub(session.LastSeenAt) > sessionLastSeenResolution {
+		return refreshSession(ctx, sessionID, now)
+	}
+	if !cached {
+		putCached(ctx, cacheItem, sessionCacheDuration, session)
+	}
+	return session, nil
+}
+
+// refreshSession sets the LastSeenAt of the stored session to now, without
+// touching any other fields, and clears the cached copy.
+func refreshSession(ctx context.Context, sessionID *datastore.Key, now time.Time) (*Session, error) {
+	session := &Session{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, sessionID, session); err == datastore.ErrNoSuchEntity {
+			return HTTPErr{"session revoked", http.StatusUnauthorized}
+		} else if err != nil {
+			return err
+		}
+		session.LastSeenAt = now
+		_, err := datastore.Put(ctx, sessionID, session)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	if err := memcache.Delete(ctx, sessionID.Encode()); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "Unable to clear cached session %q: %v", sessionID.StringID(), err)
+	}
+	return session, nil
+}
+
+func revokeSessions(ctx context.Context, sessionIDs []*datastore.Key) error {
+	if err := datastore.DeleteMulti(ctx, sessionIDs); err != nil {
+		return err
+	}
+	cacheKeys := make([]string, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		cacheKeys[i] = sessionID.Encode()
+	}
+	if err := memcache.DeleteMulti(ctx, cacheKeys); err != nil {
+		if multiErr, ok := err.(appengine.MultiError); ok {
+			for _, err := range multiErr {
+				if err != nil && err != memcache.ErrCacheMiss {
+					return err
+				}
+			}
+		} else {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteSession(w ResponseWriter, r Request) (*Session, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only revoke your own sessions", http.StatusForbidden}
+	}
+
+	sessionID := SessionID(ctx, r.Vars()["id"])
+	session := &Session{}
+	if err := datastore.Get(ctx, sessionID, session); err != nil {
+		return nil, err
+	}
+	if session.UserId != user.Id {
+		return nil, HTTPErr{"can only revoke your own sessions", http.StatusForbidden}
+	}
+	if err := revokeSessions(ctx, []*datastore.Key{sessionID}); err != nil {
+		return nil, err
+	}
+	session.Id = sessionID.StringID()
+
+	return session, nil
+}
+
+func listSessions(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own sessions", http.StatusForbidden}
+	}
+
+	sessions := Sessions{}
+	ids, err := datastore.NewQuery(sessionKind).Filter("UserId=", user.Id).GetAll(ctx, &sessions)
+	if err != nil {
+		return err
+	}
+	now := clock.Now(ctx)
+	active := Sessions{}
+	for i := range sessions {
+		if sessions[i].ExpiresAt.Before(now) {
+			continue
+		}
+		sessions[i].Id = ids[i].StringID()
+		sessions[i].Current = sessions[i].Id == user.SessionId
+		active = append(active, sessions[i])
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].LastSeenAt.After(active[j].LastSeenAt)
+	})
+
+	w.SetContent(active.Item(r, user.Id))
+	return nil
+}
+
+func handleRevokeAllSessions(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	userId := r.Vars()["user_id"]
+	if userId != user.Id {
+		allowed, err := HasPermission(ctx, user.Id, ManageSessionsPermission)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return HTTPErr{"can only revoke your own sessions", http.StatusForbidden}
+		}
+		if err := RequireSecondFactor(r); err != nil {
+			return err
+		}
+	}
+
+	sessionIDs, err := datastore.NewQuery(sessionKind).Filter("UserId=", userId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := revokeSessions(ctx, sessionIDs); err != nil {
+		return err
+	}
+	log.Infof(ctx, "%q revoked all %v sessions of %q", user.Id, len(sessionIDs), userId)
+	if userId != user.Id {
+		if err := RecordAudit(ctx, nil, user.Id, RevokeSessionsAuditAction, userId, map[string]int{"Sessions": len(sessionIDs)}, map[string]int{"Sessions": 0}); err != nil {
+			return err
+		}
+	}
+
+	w.SetContent(NewItem(Sessions{}).SetName("sessions"))
+	return nil
+}
@@ -0,0 +1,488 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	totpKind = "TOTP"
+
+	totpIssuer        = "Diplicity"
+	totpPeriod        = 30 * time.Second
+	totpDigits        = 6
+	totpSkew          = 1
+	totpRecoveryCodes = 10
+
+	// Users with roles can only enroll within this long after logging in,
+	// so that a stolen token can't be used to enroll a second factor.
+	totpEnrollmentLoginWindow = 15 * time.Minute
+
+	// At most this many codes are checked per user per totpAttemptWindow.
+	totpAttemptWindow = 15 * time.Minute
+	totpAttempts      = 10
+
+	// secondFactorKey is set in the request values when the session of the
+	// token has a verified second factor.
+	secondFactorKey = "second-factor"
+)
+
+const (
+	LoadTOTPRoute    = "LoadTOTP"
+	EnrollTOTPRoute  = "EnrollTOTP"
+	ConfirmTOTPRoute = "ConfirmTOTP"
+	VerifyTOTPRoute  = "VerifyTOTP"
+	DeleteTOTPRoute  = "DeleteTOTP"
+)
+
+var (
+	errSecondFactorRequired = HTTPErr{"a verified second factor is required, enroll and verify TOTP first", http.StatusForbidden}
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TOTP is the time based one time password enrollment of a user.
+type TOTP struct {
+	UserId    string
+	Confirmed bool
+	// Secret is encrypted, and only returned decrypted when enrolling.
+	Secret             string   `json:",omitempty" datastore:",noindex"`
+	RecoveryCodeHashes []string `json:"-" datastore:",noindex"`
+	// LastCounter is the time step of the last accepted code, to prevent
+	// reuse of codes.
+	LastCounter            int64 `json:"-" datastore:",noindex"`
+	RemainingRecoveryCodes int   `datastore:"-"`
+	CreatedAt              time.Time
+	// URI and RecoveryCodes are only returned when enrolling.
+	URI           string   `datastore:"-" json:",omitempty"`
+	RecoveryCodes []string `datastore:"-" json:",omitempty"`
+}
+
+func (t *TOTP) Item(r Request) *Item {
+	totpItem := NewItem(t).SetName("totp").SetDesc([][]string{
+		[]string{
+			"Two factor authentication",
+			"Enrolling returns a secret, its `otpauth` URI and recovery codes, which are shown only once. Confirm the enrollment with a `code` from the authenticator app.",
+			"Privileged routes require the session to have a verified second factor. Verify a session by posting a `code`, or an unused recovery code, to the `verify` link.",
+		},
+	})
+	if t.Confirmed {
+		totpItem.AddLink(r.NewLink(Link{
+			Rel:         "verify",
+			Route:       VerifyTOTPRoute,
+			RouteParams: []string{"user_id", t.UserId},
+			Method:      "POST",
+		})).AddLink(r.NewLink(Link{
+			Rel:         "delete",
+			Route:       DeleteTOTPRoute,
+			RouteParams: []string{"user_id", t.UserId},
+			Method:      "DELETE",
+		}))
+	} else if t.CreatedAt.IsZero() {
+		totpItem.AddLink(r.NewLink(Link{
+			Rel:         "enroll",
+			Route:       EnrollTOTPRoute,
+			RouteParams: []string{"user_id", t.UserId},
+			Method:      "POST",
+		}))
+	} else {
+		totpItem.AddLink(r.NewLink(Link{
+			Rel:         "confirm",
+			Route:       ConfirmTOTPRoute,
+			RouteParams: []string{"user_id", t.UserId},
+			Method:      "POST",
+		}))
+	}
+	return totpItem
+}
+
+func TOTPID(ctx context.Context, userId string) *datastore.Key {
+	return datastore.NewKey(ctx, totpKind, userId, 0, nil)
+}
+
+// TOTPCode returns the code of the base32 encoded secret at t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, t.Unix()/int64(totpPeriod/time.Second)), nil
+}
+
+func totpCode(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// check returns whether code is a valid TOTP code or unused recovery code,
+// and consumes it.
+func (t *TOTP) check(ctx context.Context, code string) (bool, error) {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+	if code == "" {
+		return false, nil
+	}
+
+	plainSecret, err := DecodeString(ctx, t.Secret)
+	if err != nil {
+		return false, err
+	}
+	key, err := totpEncoding.DecodeString(plainSecret)
+	if err != nil {
+		return false, err
+	}
+	now := clock.Now(ctx).Unix() / int64(totpPeriod/time.Second)
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if counter > t.LastCounter && hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			t.LastCounter = counter
+			return true, nil
+		}
+	}
+
+	// Recovery codes only work for confirmed enrollments.
+	if !t.Confirmed {
+		return false, nil
+	}
+	hash := hashSecret(code)
+	for i, recoveryHash := range t.RecoveryCodeHashes {
+		if hmac.Equal([]byte(recoveryHash), []byte(hash)) {
+			t.RecoveryCodeHashes = append(t.RecoveryCodeHashes[:i], t.RecoveryCodeHashes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RequireSecondFactor returns an error unless the session of r has a
+// verified second factor. Like RequirePermission, it allows everything on the
+// dev app server for requests not authenticated by a token.
+func RequireSecondFactor(r Request) error {
+	if authenticated, _ := r.Values()[tokenAuthenticatedKey].(bool); appengine.IsDevAppServer() && !authenticated {
+		return nil
+	}
+	if verified, _ := r.Values()[secondFactorKey].(bool); !verified {
+		return errSecondFactorRequired
+	}
+	return nil
+}
+
+func markSessionSecondFactor(ctx context.Context, user *User) error {
+	if user.SessionId == "" {
+		return HTTPErr{"only login sessions can verify a second factor", http.StatusBadRequest}
+	}
+	sessionID := SessionID(ctx, user.SessionId)
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		session := &Session{}
+		if err := datastore.Get(ctx, sessionID, session); err != nil {
+			return err
+		}
+		if session.UserId != user.Id {
+			return HTTPErr{"session belongs to another user", http.StatusForbidden}
+		}
+		session.SecondFactorAt = clock.Now(ctx)
+		_, err := datastore.Put(ctx, sessionID, session)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+	if err := memcache.Delete(ctx, sessionID.Encode()); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// clearSessionSecondFactors forgets the verified second factor of all
+// sessions of userId.
+func clearSessionSecondFactors(ctx context.Context, userId string) error {
+	sessionIDs, err := datastore.NewQuery(sessionKind).Filter("UserId=", userId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, sessionID := range sessionIDs {
+		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			session := &Session{}
+			if err := datastore.Get(ctx, sessionID, session); err == datastore.ErrNoSuchEntity {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if session.SecondFactorAt.IsZero() {
+				return nil
+			}
+			session.SecondFactorAt = time.Time{}
+			_, err := datastore.Put(ctx, sessionID, session)
+			return err
+		}, &datastore.TransactionOptions{XG: false}); err != nil {
+			return err
+		}
+		if err := memcache.Delete(ctx, sessionID.Encode()); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTOTP runs f with the enrollment of the user of r in a transaction,
+// after checking the code parameter of r against it.
+func checkTOTP(r Request, confirmed bool, f func(ctx context.Context, totp *TOTP) error) (*User, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only use your own second factor", http.StatusForbidden}
+	}
+
+	if err := rateLimit(ctx, "totp/"+user.Id, totpAttemptWindow, totpAttempts); err != nil {
+		return nil, err
+	}
+
+	totpID := TOTPID(ctx, user.Id)
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		totp := &TOTP{}
+		if err := datastore.Get(ctx, totpID, totp); err == datastore.ErrNoSuchEntity {
+			return HTTPErr{"not enrolled", http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+		if totp.Confirmed != confirmed {
+			if confirmed {
+				return HTTPErr{"enrollment not confirmed", http.StatusPreconditionFailed}
+			}
+			return HTTPErr{"enrollment already confirmed", http.StatusPreconditionFailed}
+		}
+		valid, err := totp.check(ctx, r.Req().FormValue("code"))
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return HTTPErr{"invalid code", http.StatusForbidden}
+		}
+		return f(ctx, totp)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func handleLoadTOTP(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only load your own second factor", http.StatusForbidden}
+	}
+
+	totp := &TOTP{}
+	if err := datastore.Get(ctx, TOTPID(ctx, user.Id), totp); err == datastore.ErrNoSuchEntity {
+		totp.UserId = user.Id
+	} else if err != nil {
+		return err
+	}
+	totp.Secret = ""
+	totp.RemainingRecoveryCodes = len(totp.RecoveryCodeHashes)
+
+	w.SetContent(totp.Item(r))
+	return nil
+}
+
+// checkFreshLoginForEnrollment returns an error if user has any roles, but
+// didn't log in within totpEnrollmentLoginWindow.
+func checkFreshLoginForEnrollment(ctx context.Context, user *User) error {
+	privileged := false
+	if superusers, err := GetSuperusers(ctx); err == nil {
+		privileged = superusers.Includes(user.Id)
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if !privileged {
+		assignment, err := getRoleAssignment(ctx, user.Id)
+		if err != nil {
+			return err
+		}
+		privileged = len(assignment.Roles) > 0
+	}
+	if !privileged {
+		return nil
+	}
+	session := &Session{}
+	if user.SessionId != "" {
+		if err := datastore.Get(ctx, SessionID(ctx, user.SessionId), session); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	if clock.Now(ctx).Sub(session.CreatedAt) > totpEnrollmentLoginWindow {
+		return HTTPErr{fmt.Sprintf("users with roles must enroll within %v of logging in, log in again first", totpEnrollmentLoginWindow), http.StatusForbidden}
+	}
+	return nil
+}
+
+func handleEnrollTOTP(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only enroll yourself", http.StatusForbidden}
+	}
+
+	if err := checkFreshLoginForEnrollment(ctx, user); err != nil {
+		return err
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	plainSecret := totpEncoding.EncodeToString(key)
+	encryptedSecret, err := EncodeString(ctx, plainSecret)
+	if err != nil {
+		return err
+	}
+
+	totp := &TOTP{
+		UserId:    user.Id,
+		Secret:    encryptedSecret,
+		CreatedAt: clock.Now(ctx),
+	}
+	for i := 0; i < totpRecoveryCodes; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		totp.RecoveryCodes = append(totp.RecoveryCodes, code)
+		totp.RecoveryCodeHashes = append(totp.RecoveryCodeHashes, hashSecret(code))
+	}
+
+	totpID := TOTPID(ctx, user.Id)
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		existing := &TOTP{}
+		if err := datastore.Get(ctx, totpID, existing); err == nil && existing.Confirmed {
+			return HTTPErr{"already enrolled, delete the enrollment first", http.StatusConflict}
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := datastore.Put(ctx, totpID, totp)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	totp.Secret = plainSecret
+	totp.RemainingRecoveryCodes = len(totp.RecoveryCodes)
+	totp.URI = (&url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   fmt.Sprintf("/%s:%s", totpIssuer, user.Email),
+		RawQuery: url.Values{
+			"secret": []string{plainSecret},
+			"issuer": []string{totpIssuer},
+		}.Encode(),
+	}).String()
+
+	w.SetContent(totp.Item(r))
+	return nil
+}
+
+func handleConfirmTOTP(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	totp := &TOTP{}
+	user, err := checkTOTP(r, false, func(ctx context.Context, t *TOTP) error {
+		t.Confirmed = true
+		*totp = *t
+		_, err := datastore.Put(ctx, TOTPID(ctx, t.UserId), t)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if user.SessionId != "" {
+		if err := markSessionSecondFactor(ctx, user); err != nil {
+			return err
+		}
+	}
+	log.Infof(ctx, "%q confirmed TOTP enrollment", user.Id)
+
+	totp.Secret = ""
+	totp.RemainingRecoveryCodes = len(totp.RecoveryCodeHashes)
+	w.SetContent(totp.Item(r))
+	return nil
+}
+
+func handleVerifyTOTP(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	totp := &TOTP{}
+	user, err := checkTOTP(r, true, func(ctx context.Context, t *TOTP) error {
+		*totp = *t
+		_, err := datastore.Put(ctx, TOTPID(ctx, t.UserId), t)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := markSessionSecondFactor(ctx, user); err != nil {
+		return err
+	}
+
+	totp.Secret = ""
+	totp.RemainingRecoveryCodes = len(totp.RecoveryCodeHashes)
+	w.SetContent(totp.Item(r))
+	return nil
+}
+
+func handleDeleteTOTP(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, err := checkTOTP(r, true, func(ctx context.Context, t *TOTP) error {
+		return datastore.Delete(ctx, TOTPID(ctx, t.UserId))
+	})
+	if err != nil {
+		return err
+	}
+	if err := clearSessionSecondFactors(ctx, user.Id); err != nil {
+		return err
+	}
+	log.Infof(ctx, "%q deleted TOTP enrollment", user.Id)
+
+	totp := &TOTP{UserId: user.Id}
+	w.SetContent(totp.Item(r))
+	return nil
+}
@@ -0,0 +1,48 @@
+// Package clock provides the time source used by the game logic.
+//
+// The clock is carried in the request or task context, so that tests can
+// install their own clock instead of the wall clock. Only the in-process
+// transport of diptest does so; the server always uses the wall clock, and
+// there is no API to run a game under simulated time.
+package clock
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// Wall is the real time clock, used when the context contains no other clock.
+var Wall Clock = wallClock{}
+
+type contextKey int
+
+const clockKey contextKey = 0
+
+// WithClock returns a copy of ctx using c as clock.
+func WithClock(ctx context.Context, c Clock) context.Context {
+	return context.WithValue(ctx, clockKey, c)
+}
+
+// FromContext returns the clock of ctx.
+func FromContext(ctx context.Context) Clock {
+	if c, ok := ctx.Value(clockKey).(Clock); ok {
+		return c
+	}
+	return Wall
+}
+
+// Now returns the current time according to the clock of ctx.
+func Now(ctx context.Context) time.Time {
+	return FromContext(ctx).Now()
+}
@@ -0,0 +1,80 @@
+package diptest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+func TestAccessTokens(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+
+	tokens := env.GetRoute(game.IndexRoute).Success().
+		Follow("access-tokens", "Links").Success().
+		AssertLen(0, "Properties")
+
+	tokens.Follow("create", "Links").Body(map[string]interface{}{
+		"Name":   "bot",
+		"Scopes": []string{"everything"},
+	}).Failure()
+	tokens.Follow("create", "Links").Body(map[string]interface{}{
+		"Scopes": []string{auth.PressScope},
+	}).Failure()
+
+	created := tokens.Follow("create", "Links").Body(map[string]interface{}{
+		"Name":   "bot",
+		"Scopes": []string{auth.PressScope},
+	}).Success()
+	token := created.GetValue("Properties", "Token").(string)
+	if !strings.HasPrefix(token, "dpat_") {
+		t.Fatalf("got token %q, wanted a dpat_ prefix", token)
+	}
+	bot := NewEnv().SetToken(token)
+
+	t.Run("TestListHidesToken", func(t *testing.T) {
+		listed := env.GetRoute(auth.ListAccessTokensRoute).RouteParams("user_id", env.GetUID()).Success().
+			AssertLen(1, "Properties").
+			AssertEq("bot", "Properties", "0", "Properties", "Name").
+			GetValue("Properties", "0", "Properties").(map[string]interface{})
+		if _, found := listed["Token"]; found {
+			t.Errorf("listed access token %+v contains the token", listed)
+		}
+	})
+
+	t.Run("TestReads", func(t *testing.T) {
+		bot.GetRoute(game.IndexRoute).Success().
+			AssertEq(env.GetUID(), "Properties", "User", "Id")
+		graphQL(bot, `{ games(list: "my-started-games") { games { id } } }`, nil)
+	})
+
+	t.Run("TestScopesEnforced", func(t *testing.T) {
+		bot.GetRoute(auth.ListAccessTokensRoute).RouteParams("user_id", env.GetUID()).Status(http.StatusForbidden)
+		bot.PostRoute("AccessToken.Create").RouteParams("user_id", env.GetUID()).Body(map[string]interface{}{
+			"Name":   "escalated",
+			"Scopes": []string{auth.OrdersScope},
+		}).Status(http.StatusForbidden)
+		bot.PostRoute("Game.Create").Body(map[string]interface{}{
+			"Variant": "Classical",
+		}).Status(http.StatusForbidden)
+	})
+
+	t.Run("TestRevoke", func(t *testing.T) {
+		env.GetRoute(auth.ListAccessTokensRoute).RouteParams("user_id", env.GetUID()).Success().
+			Follow("revoke", "Properties", "0", "Links").Success()
+		bot.GetRoute(game.IndexRoute).AuthFailure()
+	})
+
+	t.Run("TestReadOnlyDenials", func(t *testing.T) {
+		reader := NewEnv().SetToken(tokens.Follow("create", "Links").Body(map[string]interface{}{
+			"Name":   "reader",
+			"Scopes": []string{auth.ReadOnlyScope},
+		}).Success().GetValue("Properties", "Token").(string))
+		reader.GetRoute(game.ExportUserRoute).RouteParams("user_id", env.GetUID()).Status(http.StatusForbidden)
+		reader.GetRoute(auth.UnsubscribeRoute).RouteParams("user_id", env.GetUID()).Status(http.StatusForbidden)
+		reader.GetRoute(auth.LogoutRoute).Status(http.StatusForbidden)
+		reader.GetRoute(game.IndexRoute).Success()
+	})
+}
@@ -0,0 +1,72 @@
+package diptest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+func TestAccountExportAndDeletion(t *testing.T) {
+	token, err := loginByEMail(String("account") + "@fake.fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := NewEnv().SetToken(token)
+	uid := env.GetRoute(game.IndexRoute).Success().GetValue("Properties", "User", "Id").(string)
+	otherEnv := NewEnv().SetUID(String("fake"))
+	otherEnv.GetRoute(game.IndexRoute).Success()
+
+	gameDesc := String("test-game")
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("create-game", "Links").
+		Body(map[string]interface{}{
+			"Desc":               gameDesc,
+			"Variant":            "Classical",
+			"NoMerge":            true,
+			"PhaseLengthMinutes": time.Duration(60),
+		}).Success()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("bans", "Links").Success().
+		Follow("create", "Links").Body(map[string]interface{}{
+		"UserIds": []string{uid, otherEnv.GetUID()},
+	}).Success()
+
+	t.Run("OthersCanNotExportOrDelete", func(t *testing.T) {
+		env.GetRoute(game.ExportUserRoute).RouteParams("user_id", otherEnv.GetUID()).Status(http.StatusForbidden)
+		env.DeleteRoute(game.DeleteUserRoute).RouteParams("user_id", otherEnv.GetUID()).Status(http.StatusForbidden)
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		env.GetRoute(game.IndexRoute).Success().
+			Follow("export", "Links").Success().
+			AssertEq(uid, "Properties", "User", "Id").
+			Find(gameDesc, []string{"Properties", "Games"}, []string{"Desc"})
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		env.GetRoute(game.IndexRoute).Success().
+			Follow("delete-account", "Links").Success().
+			AssertEq(float64(1), "Properties", "LeftGames").
+			AssertEq(float64(1), "Properties", "PurgedBans")
+		env.GetRoute(game.ExportUserRoute).RouteParams("user_id", uid).AuthFailure()
+		otherEnv.GetRoute(game.IndexRoute).Success().
+			Follow("bans", "Links").Success().
+			AssertLen(0, "Properties")
+		otherEnv.GetRoute(game.IndexRoute).Success().
+			Follow("open-games", "Links").Success().
+			AssertNotFind(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+	})
+	t.Run("AnonymizeFinishedGames", func(t *testing.T) {
+		withFinishedGame(func() {
+			startedGameEnvs[1].DeleteRoute(game.DeleteUserRoute).RouteParams("user_id", startedGameEnvs[1].GetUID()).Success().
+				AssertEq(float64(1), "Properties", "AnonymizedGames")
+			startedGameEnvs[2].GetRoute("Game.Load").RouteParams("id", startedGameID).Success().
+				Find(startedGameEnvs[1].GetUID(), []string{"Properties", "Members"}, []string{"User", "Id"}).
+				AssertEq(auth.DeletedUserName, "User", "Name").
+				AssertEq(startedGameNats[1], "Nation")
+		})
+	})
+}
@@ -0,0 +1,95 @@
+package diptest
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+func TestAuditLog(t *testing.T) {
+	masterEnv := NewEnv().SetUID(String("fake"))
+	gameDesc := String("test-game")
+	masterEnv.GetRoute(game.IndexRoute).Success().
+		Follow("create-game", "Links").
+		Body(map[string]interface{}{
+			"Desc":                        gameDesc,
+			"Variant":                     "Classical",
+			"PhaseLengthMinutes":          time.Duration(60),
+			"GameMasterEnabled":           true,
+			"RequireGameMasterInvitation": true,
+			"Private":                     true,
+		}).Success()
+	gameID := masterEnv.GetRoute(game.IndexRoute).Success().
+		Follow("mastered-staging-games", "Links").Success().
+		Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).GetValue("Properties", "ID").(string)
+
+	playerEnv := NewEnv().SetUID(String("player")).SetEmail(String("email"))
+	masterEnv.GetRoute("Game.Load").RouteParams("id", gameID).Success().
+		Follow("invite-user", "Links").Body(map[string]interface{}{
+		"Email": playerEnv.email,
+	}).Success()
+	playerEnv.GetRoute("Game.Load").RouteParams("id", gameID).Success().
+		Follow("join", "Links").Body(nil).Success()
+	masterEnv.GetRoute("Game.Load").RouteParams("id", gameID).Success().
+		Follow("update-game", "Links").Body(map[string]interface{}{
+		"RequireGameMasterInvitation": false,
+	}).Success()
+
+	t.Run("MembersCanReadGameLog", func(t *testing.T) {
+		log := playerEnv.GetRoute("Game.Load").RouteParams("id", gameID).Success().
+			Follow("audit-log", "Links").Success()
+		log.Find(auth.CreateInvitationAuditAction, []string{"Properties"}, []string{"Properties", "Action"})
+		log.Find(auth.UpdateGameAuditAction, []string{"Properties"}, []string{"Properties", "Action"}).
+			AssertEq(masterEnv.uid, "Properties", "ActorId").
+			Find("RequireGameMasterInvitation", []string{"Properties", "Changes"}, []string{"Field"}).
+			AssertEq("true", "Before").
+			AssertEq("false", "After")
+	})
+
+	token, err := loginByEMail(String("audit") + "@fake.fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsiderEnv := NewEnv().SetToken(token)
+
+	t.Run("OthersCanNotReadGameLog", func(t *testing.T) {
+		outsiderEnv.GetRoute(game.ListGameAuditLogRoute).RouteParams("game_id", gameID).Status(http.StatusForbidden)
+	})
+
+	t.Run("GlobalLogRequiresPermission", func(t *testing.T) {
+		outsiderEnv.GetRoute(auth.ListAuditLogRoute).Status(http.StatusForbidden)
+		masterEnv.GetRoute(auth.ListAuditLogRoute).Success().
+			Find(auth.UpdateGameAuditAction, []string{"Properties"}, []string{"Properties", "Action"})
+	})
+
+	t.Run("DeletedGameLogHasNoEmails", func(t *testing.T) {
+		masterEnv.DeleteRoute("Game.Delete").RouteParams("id", gameID).Success()
+		found := false
+		for _, entry := range masterEnv.GetRoute(auth.ListAuditLogRoute).Success().GetValue("Properties").([]interface{}) {
+			props := entry.(map[string]interface{})["Properties"].(map[string]interface{})
+			if props["Action"] != auth.DeleteGameAuditAction || props["TargetId"] != gameID {
+				continue
+			}
+			found = true
+			fields := []string{}
+			for _, change := range props["Changes"].([]interface{}) {
+				change := change.(map[string]interface{})
+				fields = append(fields, change["Field"].(string))
+				if strings.Contains(change["Before"].(string), playerEnv.email) {
+					t.Errorf("got %q in %+v, wanted no emails", playerEnv.email, change)
+				}
+			}
+			if want := []string{"Desc", "GameMasterId", "MemberIds"}; !reflect.DeepEqual(fields, want) {
+				t.Errorf("got changed fields %+v, wanted %+v", fields, want)
+			}
+		}
+		if !found {
+			t.Errorf("found no %q entry for %v", auth.DeleteGameAuditAction, gameID)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package diptest
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestBlocks(t *testing.T) {
+	withStartedGame(func() {
+		private := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(private)
+		public := sort.StringSlice(append([]string{}, startedGameNats...))
+		sort.Sort(public)
+
+		send := func(idx int, members []string) *Req {
+			return startedGames[idx].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           String("message"),
+				"ChannelMembers": members,
+			})
+		}
+		messages := func(idx int, members []string) *Result {
+			return startedGameEnvs[idx].GetRoute(game.ListMessagesRoute).
+				RouteParams("game_id", startedGameID, "channel_members", strings.Join(members, ",")).Success()
+		}
+		unread := func(idx int, members []string) float64 {
+			return startedGames[idx].Follow("channels", "Links").Success().
+				Find(strings.Join(members, ","), []string{"Properties"}, []string{"Name"}).
+				GetValue("Properties", "NMessagesSince", "NMessages").(float64)
+		}
+		blocks := func(idx int) *Result {
+			return startedGameEnvs[idx].GetRoute(game.IndexRoute).Success().
+				Follow("blocks", "Links").Success()
+		}
+
+		blocks(1).Follow("create", "Links").Body(map[string]interface{}{
+			"BlockedId": startedGameEnvs[1].GetUID(),
+		}).Failure()
+		blocks(1).Follow("create", "Links").Body(map[string]interface{}{
+			"BlockedId": startedGameEnvs[0].GetUID(),
+		}).Success()
+		blocked := blocks(1).Find(startedGameEnvs[0].GetUID(), []string{"Properties"}, []string{"Properties", "BlockedId"}).
+			AssertEq("Fakey Fakeson", "Properties", "BlockedName")
+		if _, found := blocked.GetValue("Properties").(map[string]interface{})["BlockedUser"]; found {
+			t.Errorf("block %+v contains the blocked user", blocked.Body)
+		}
+
+		unread1, unread2 := unread(1, public), unread(2, public)
+		publicBody := send(0, public).Success().GetValue("Properties", "Body").(string)
+		if got := unread(1, public); got != unread1 {
+			t.Errorf("got %v unread messages from blocked senders, wanted %v", got, unread1)
+		}
+		if got := unread(2, public); got != unread2+1 {
+			t.Errorf("got %v unread messages, wanted %v", got, unread2+1)
+		}
+		messages(1, public).AssertNotFind(publicBody, []string{"Properties"}, []string{"Properties", "Body"})
+		messages(2, public).Find(publicBody, []string{"Properties"}, []string{"Properties", "Body"})
+
+		send(0, private).Failure()
+		send(1, private).Success()
+
+		gameDesc := String("test-game")
+		startedGameEnvs[0].GetRoute(game.IndexRoute).Success().
+			Follow("create-game", "Links").Body(map[string]interface{}{
+			"Variant":            "Classical",
+			"NoMerge":            true,
+			"Desc":               gameDesc,
+			"PhaseLengthMinutes": 60,
+		}).Success()
+		startedGameEnvs[1].GetRoute(game.ListOpenGamesRoute).Success().
+			Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+		startedGameEnvs[1].GetRoute(game.ListOpenGamesRoute).QueryParams(url.Values{"hide-blocked": []string{"true"}}).Success().
+			AssertNotFind(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+
+		startedGameEnvs[1].GetRoute(game.ExportUserRoute).RouteParams("user_id", startedGameEnvs[1].GetUID()).Success().
+			Find(startedGameEnvs[0].GetUID(), []string{"Properties", "Blocks"}, []string{"BlockedId"})
+
+		blocks(1).Find(startedGameEnvs[0].GetUID(), []string{"Properties"}, []string{"Properties", "BlockedId"}).
+			Follow("unblock", "Links").Success()
+		blocks(1).AssertLen(0, "Properties")
+		send(0, private).Success()
+		messages(1, public).Find(publicBody, []string{"Properties"}, []string{"Properties", "Body"})
+	})
+}
@@ -0,0 +1,63 @@
+package diptest
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestChatExport(t *testing.T) {
+	withStartedGame(func() {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		word := strings.Replace(String("secret"), "-", "", -1)
+		startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           "<b>" + word + "</b>\nFrom the north",
+			"ChannelMembers": members,
+		}).Success()
+
+		export := func(idx int, route string, params []string, format string) *Req {
+			return startedGameEnvs[idx].GetRoute(route).
+				RouteParams(params...).
+				QueryParams(url.Values{"format": []string{format}})
+		}
+		channelParams := []string{"game_id", startedGameID, "recipients", chanName}
+		gameParams := []string{"game_id", startedGameID}
+
+		expect := func(body []byte, want ...string) {
+			for _, w := range want {
+				if !strings.Contains(string(body), w) {
+					t.Errorf("Wanted %q in export, got %s", w, body)
+				}
+			}
+		}
+
+		markdown := startedGames[0].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("export", "Links").Success().BodyBytes
+		expect(markdown, "## "+strings.Join(members, ", "), "### Spring 1901, Movement", "**"+startedGameNats[0]+"**", "> <b>"+word)
+
+		expect(export(1, game.ExportChannelRoute, channelParams, game.HTMLChatExportFormat).Success().BodyBytes,
+			"<h3>Spring 1901, Movement</h3>", "&lt;b&gt;"+word)
+
+		mbox := export(1, game.ExportChannelRoute, channelParams, game.MboxChatExportFormat).Success().BodyBytes
+		expect(mbox, "From diplicity@", "X-Diplicity-Phase: Spring 1901, Movement", "\n>From the north")
+		if !strings.HasPrefix(string(mbox), "From ") {
+			t.Errorf("Wanted mbox to start with a From line, got %s", mbox)
+		}
+
+		export(0, game.ExportChannelRoute, channelParams, "pdf").Failure()
+		export(2, game.ExportChannelRoute, channelParams, game.MarkdownChatExportFormat).Failure()
+
+		expect(export(0, game.ExportGameChannelsRoute, gameParams, game.MarkdownChatExportFormat).Success().BodyBytes, word)
+		if other := export(2, game.ExportGameChannelsRoute, gameParams, game.MarkdownChatExportFormat).Success().BodyBytes; strings.Contains(string(other), word) {
+			t.Errorf("Wanted no private messages in export by other nation, got %s", other)
+		}
+	})
+}
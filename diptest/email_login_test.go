@@ -0,0 +1,143 @@
+package diptest
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+var confirmActionReg = regexp.MustCompile(`action="([^"]+)"`)
+
+// confirmEMailLogin loads the login link and returns the URL its confirm
+// form posts to.
+func confirmEMailLogin(loginURL string) (string, error) {
+	status, _, body := browse("GET", loginURL, nil)
+	if status != http.StatusOK {
+		return "", fmt.Errorf("GET %q: %v %s", loginURL, status, body)
+	}
+	match := confirmActionReg.FindStringSubmatch(body)
+	if match == nil {
+		return "", fmt.Errorf("no confirm form in %s", body)
+	}
+	return html.UnescapeString(match[1]), nil
+}
+
+// loginByEMail logs in using a link sent to address, and returns the token.
+func loginByEMail(address string) (string, error) {
+	loginURL := NewEnv().PostRoute(auth.EMailLoginRoute).QueryParams(url.Values{
+		"email":       []string{address},
+		"redirect-to": []string{"https://frontend.fake/"},
+	}).Success().GetValue("Properties", "DevLoginURL").(string)
+	finishURL, err := confirmEMailLogin(loginURL)
+	if err != nil {
+		return "", err
+	}
+	return approveLogin(browse("POST", finishURL, url.Values{}))
+}
+
+func TestEMailLogin(t *testing.T) {
+	if Fake == nil {
+		t.Skip("reading the login link requires TRANSPORT=inprocess")
+	}
+
+	address := String("player") + "@fake.fake"
+	requestLink := func() *Req {
+		return NewEnv().PostRoute(auth.EMailLoginRoute).QueryParams(url.Values{
+			"email":       []string{address},
+			"redirect-to": []string{"https://frontend.fake/"},
+		})
+	}
+	login := func() (string, string) {
+		finishURL, err := confirmEMailLogin(requestLink().Success().GetValue("Properties", "DevLoginURL").(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := approveLogin(browse("POST", finishURL, url.Values{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, finishURL
+	}
+
+	token, finishURL := login()
+	userID := NewEnv().SetToken(token).GetRoute(game.IndexRoute).Success().
+		AssertEq(address, "Properties", "User", "Email").
+		GetValue("Properties", "User", "Id").(string)
+	if !strings.HasPrefix(userID, auth.EMailProviderName+"-") {
+		t.Errorf("got user id %q, wanted prefix %q", userID, auth.EMailProviderName+"-")
+	}
+
+	t.Run("TestReuse", func(t *testing.T) {
+		if status, _, body := browse("POST", finishURL, url.Values{}); status != http.StatusGone {
+			t.Errorf("got %v %s, wanted %v", status, body, http.StatusGone)
+		}
+	})
+
+	t.Run("TestSameUser", func(t *testing.T) {
+		token, _ := login()
+		NewEnv().SetToken(token).GetRoute(game.IndexRoute).Success().
+			AssertEq(userID, "Properties", "User", "Id")
+	})
+
+	t.Run("TestLoggedInLoginDoesNotLink", func(t *testing.T) {
+		env := NewEnv().SetUID(String("fake"))
+		otherAddress := String("victim") + "@fake.fake"
+		loginURL := env.PostRoute(auth.EMailLoginRoute).QueryParams(url.Values{
+			"email":       []string{otherAddress},
+			"redirect-to": []string{"https://frontend.fake/"},
+		}).Success().GetValue("Properties", "DevLoginURL").(string)
+		finishURL, err := confirmEMailLogin(loginURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := approveLogin(browse("POST", finishURL, url.Values{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := NewEnv().SetToken(token).GetRoute(game.IndexRoute).Success().GetValue("Properties", "User", "Id").(string); id == env.GetUID() {
+			t.Errorf("login link requested by %q linked the address to them", id)
+		}
+	})
+
+	t.Run("TestLinkEMail", func(t *testing.T) {
+		env := NewEnv().SetUID(String("fake"))
+		otherAddress := String("linked") + "@fake.fake"
+		linkEMail := func(uid string) *Req {
+			return env.PostRoute(auth.LinkEMailRoute).RouteParams("user_id", uid).QueryParams(url.Values{
+				"email":       []string{otherAddress},
+				"redirect-to": []string{"https://frontend.fake/"},
+			})
+		}
+		linkEMail(String("fake")).Failure()
+		loginURL := linkEMail(env.GetUID()).Success().GetValue("Properties", "DevLoginURL").(string)
+		status, _, body := browse("GET", loginURL, nil)
+		if status != http.StatusOK || !strings.Contains(body, env.GetUID()) {
+			t.Errorf("got %v %s, wanted confirmation naming %q", status, body, env.GetUID())
+		}
+		finishURL, err := confirmEMailLogin(loginURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := approveLogin(browse("POST", finishURL, url.Values{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		NewEnv().SetToken(token).GetRoute(game.IndexRoute).Success().
+			AssertEq(env.GetUID(), "Properties", "User", "Id")
+	})
+
+	t.Run("TestRateLimit", func(t *testing.T) {
+		// Two links have already been sent to the address.
+		for i := 0; i < 3; i++ {
+			requestLink().Success()
+		}
+		requestLink().Status(http.StatusTooManyRequests)
+	})
+}
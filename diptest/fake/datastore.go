@@ -0,0 +1,710 @@
+package fake
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const keyProperty = "__key__"
+
+type operation struct {
+	put    *entityProto
+	delete string
+}
+
+type transaction struct {
+	operations []operation
+	tasks      []*Task
+}
+
+type queryState struct {
+	keysOnly  bool
+	orders    []*queryOrder
+	results   []*entityProto
+	remaining int32
+	cursor    *compiledCursor
+}
+
+func (a *API) callDatastore(s *session, method string, in, out proto.Message) error {
+	switch method {
+	case "Get":
+		req := &getRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		return convert(a.get(req), out)
+	case "Put":
+		req := &putRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		res, err := a.put(s, req)
+		if err != nil {
+			return err
+		}
+		return convert(res, out)
+	case "Delete":
+		req := &deleteRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		a.delete(s, req)
+		out.Reset()
+		return nil
+	case "RunQuery":
+		req := &query{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		res, err := a.runQuery(req)
+		if err != nil {
+			return err
+		}
+		return convert(res, out)
+	case "Next":
+		req := &nextRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		res, err := a.next(req)
+		if err != nil {
+			return err
+		}
+		return convert(res, out)
+	case "AllocateIds":
+		req := &allocateIdsRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		return convert(a.allocateIDs(req), out)
+	case "BeginTransaction":
+		req := &beginTransactionRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		return convert(a.beginTransaction(s, req), out)
+	case "Commit":
+		req := &transactionHandle{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		if err := a.commit(s, req.GetHandle()); err != nil {
+			return err
+		}
+		out.Reset()
+		return nil
+	case "Rollback":
+		req := &transactionHandle{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		a.rollback(s, req.GetHandle())
+		out.Reset()
+		return nil
+	}
+	return fmt.Errorf("fake: datastore_v3.%s is not supported", method)
+}
+
+func (m *transactionHandle) GetHandle() uint64 {
+	if m != nil && m.Handle != nil {
+		return *m.Handle
+	}
+	return 0
+}
+
+// keyString returns a string uniquely identifying ref.
+func keyString(ref *reference) string {
+	buf := &bytes.Buffer{}
+	if ref.NameSpace != nil {
+		buf.WriteString(*ref.NameSpace)
+	}
+	for _, el := range ref.Path.Element {
+		buf.WriteString("/")
+		buf.WriteString(el.GetType())
+		if el.Name != nil {
+			fmt.Fprintf(buf, ",n%q", *el.Name)
+		} else {
+			fmt.Fprintf(buf, ",i%d", el.GetId())
+		}
+	}
+	return buf.String()
+}
+
+func (m *pathElement) GetType() string {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return ""
+}
+
+func (m *pathElement) GetId() int64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (a *API) get(req *getRequest) *getResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := &getResponse{}
+	for _, key := range req.Key {
+		if e, found := a.entities[keyString(key)]; found {
+			res.Entity = append(res.Entity, &getResponseEntity{Entity: proto.Clone(e).(*entityProto)})
+		} else {
+			res.Entity = append(res.Entity, &getResponseEntity{Key: key})
+		}
+	}
+	return res
+}
+
+func (a *API) put(s *session, req *putRequest) (*putResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var tx *transaction
+	if handle, found := s.current(); found {
+		if tx = a.transactions[handle]; tx == nil {
+			return nil, fmt.Errorf("fake: unknown transaction %v", handle)
+		}
+	}
+	res := &putResponse{}
+	for _, e := range req.Entity {
+		e = proto.Clone(e).(*entityProto)
+		if e.Key == nil || e.Key.Path == nil || len(e.Key.Path.Element) == 0 {
+			return nil, fmt.Errorf("fake: can't put entity without key")
+		}
+		last := e.Key.Path.Element[len(e.Key.Path.Element)-1]
+		if last.Name == nil && last.GetId() == 0 {
+			a.nextID++
+			last.Id = proto.Int64(a.nextID)
+		}
+		e.EntityGroup = &path{Element: []*pathElement{e.Key.Path.Element[0]}}
+		if tx == nil {
+			a.entities[keyString(e.Key)] = e
+		} else {
+			tx.operations = append(tx.operations, operation{put: e})
+		}
+		res.Key = append(res.Key, e.Key)
+	}
+	return res, nil
+}
+
+func (a *API) delete(s *session, req *deleteRequest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var tx *transaction
+	if handle, found := s.current(); found {
+		tx = a.transactions[handle]
+	}
+	for _, key := range req.Key {
+		if tx == nil {
+			delete(a.entities, keyString(key))
+		} else {
+			tx.operations = append(tx.operations, operation{delete: keyString(key)})
+		}
+	}
+}
+
+func (a *API) allocateIDs(req *allocateIdsRequest) *allocateIdsResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	start := a.nextID + 1
+	if req.Size != nil {
+		a.nextID += *req.Size
+	} else if req.Max != nil && *req.Max > a.nextID {
+		a.nextID = *req.Max
+	}
+	return &allocateIdsResponse{
+		Start: proto.Int64(start),
+		End:   proto.Int64(a.nextID),
+	}
+}
+
+func (a *API) beginTransaction(s *session, req *beginTransactionRequest) *transactionHandle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nextHandle++
+	a.transactions[a.nextHandle] = &transaction{}
+	s.push(a.nextHandle)
+	return &transactionHandle{
+		Handle: proto.Uint64(a.nextHandle),
+		App:    req.App,
+	}
+}
+
+func (a *API) commit(s *session, handle uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s.pop(handle)
+	tx, found := a.transactions[handle]
+	if !found {
+		return fmt.Errorf("fake: unknown transaction %v", handle)
+	}
+	delete(a.transactions, handle)
+	for _, op := range tx.operations {
+		if op.put != nil {
+			a.entities[keyString(op.put.Key)] = op.put
+		} else {
+			delete(a.entities, op.delete)
+		}
+	}
+	a.tasks = append(a.tasks, tx.tasks...)
+	return nil
+}
+
+func (a *API) rollback(s *session, handle uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s.pop(handle)
+	delete(a.transactions, handle)
+}
+
+// typeRank orders values of different types the way the datastore does.
+func typeRank(v *propertyValue) int {
+	switch {
+	case v.Int64Value != nil:
+		return 1
+	case v.BooleanValue != nil:
+		return 2
+	case v.StringValue != nil:
+		return 3
+	case v.DoubleValue != nil:
+		return 4
+	case v.Pointvalue != nil:
+		return 5
+	case v.Uservalue != nil:
+		return 6
+	case v.Referencevalue != nil:
+		return 7
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	}
+	return 1
+}
+
+func compareValues(a, b *propertyValue) int {
+	if c := compareInts(int64(typeRank(a)), int64(typeRank(b))); c != 0 {
+		return c
+	}
+	switch {
+	case a.Int64Value != nil:
+		return compareInts(*a.Int64Value, *b.Int64Value)
+	case a.BooleanValue != nil:
+		return compareBools(*a.BooleanValue, *b.BooleanValue)
+	case a.StringValue != nil:
+		return strings.Compare(*a.StringValue, *b.StringValue)
+	case a.DoubleValue != nil:
+		return compareFloats(*a.DoubleValue, *b.DoubleValue)
+	case a.Pointvalue != nil:
+		if c := compareFloats(a.Pointvalue.GetX(), b.Pointvalue.GetX()); c != 0 {
+			return c
+		}
+		return compareFloats(a.Pointvalue.GetY(), b.Pointvalue.GetY())
+	case a.Uservalue != nil:
+		return strings.Compare(a.Uservalue.String(), b.Uservalue.String())
+	case a.Referencevalue != nil:
+		return comparePaths(referencePath(a.Referencevalue), referencePath(b.Referencevalue))
+	}
+	return 0
+}
+
+func (m *pointValue) GetX() float64 {
+	if m != nil && m.X != nil {
+		return *m.X
+	}
+	return 0
+}
+
+func (m *pointValue) GetY() float64 {
+	if m != nil && m.Y != nil {
+		return *m.Y
+	}
+	return 0
+}
+
+func referencePath(ref *referenceValue) *path {
+	p := &path{}
+	for _, el := range ref.Pathelement {
+		p.Element = append(p.Element, &pathElement{
+			Type: el.Type,
+			Id:   el.Id,
+			Name: el.Name,
+		})
+	}
+	return p
+}
+
+func keyValue(ref *reference) *propertyValue {
+	v := &referenceValue{
+		App:       ref.App,
+		NameSpace: ref.NameSpace,
+	}
+	for _, el := range ref.Path.Element {
+		v.Pathelement = append(v.Pathelement, &referenceValuePathElement{
+			Type: el.Type,
+			Id:   el.Id,
+			Name: el.Name,
+		})
+	}
+	return &propertyValue{Referencevalue: v}
+}
+
+// comparePaths orders keys by kind, then with numeric ids before names.
+func comparePaths(a, b *path) int {
+	for i := 0; i < len(a.Element) && i < len(b.Element); i++ {
+		ae, be := a.Element[i], b.Element[i]
+		if c := strings.Compare(ae.GetType(), be.GetType()); c != 0 {
+			return c
+		}
+		switch {
+		case ae.Name == nil && be.Name == nil:
+			if c := compareInts(ae.GetId(), be.GetId()); c != 0 {
+				return c
+			}
+		case ae.Name == nil:
+			return -1
+		case be.Name == nil:
+			return 1
+		default:
+			if c := strings.Compare(*ae.Name, *be.Name); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(int64(len(a.Element)), int64(len(b.Element)))
+}
+
+// values returns the indexed values of the named property of e.
+func values(e *entityProto, name string) []*propertyValue {
+	if name == keyProperty {
+		return []*propertyValue{keyValue(e.Key)}
+	}
+	result := []*propertyValue{}
+	for _, prop := range e.Property {
+		if prop.Name != nil && *prop.Name == name {
+			result = append(result, prop.Value)
+		}
+	}
+	return result
+}
+
+func matchesOp(op int32, c int) bool {
+	switch op {
+	case filterLessThan:
+		return c < 0
+	case filterLessThanOrEqual:
+		return c <= 0
+	case filterGreaterThan:
+		return c > 0
+	case filterGreaterThanOrEqual:
+		return c >= 0
+	case filterEqual:
+		return c == 0
+	}
+	return false
+}
+
+// matches returns whether e matches all the filters. A multi-valued property
+// matches an equality filter if any value matches, but all inequality filters
+// on the same property have to be matched by one single value.
+func matches(e *entityProto, filters []*queryFilter) bool {
+	inequalities := map[string][]*queryFilter{}
+	for _, filter := range filters {
+		prop := filter.Property[0]
+		if *filter.Op == filterEqual {
+			found := false
+			for _, v := range values(e, *prop.Name) {
+				if compareValues(v, prop.Value) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		} else {
+			inequalities[*prop.Name] = append(inequalities[*prop.Name], filter)
+		}
+	}
+	for name, filters := range inequalities {
+		found := false
+		for _, v := range values(e, name) {
+			all := true
+			for _, filter := range filters {
+				if !matchesOp(*filter.Op, compareValues(v, filter.Property[0].Value)) {
+					all = false
+					break
+				}
+			}
+			if all {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sortValue returns the value of e that decides its position for order, or
+// nil if e lacks the property.
+func sortValue(e *entityProto, order *queryOrder) *propertyValue {
+	var result *propertyValue
+	for _, v := range values(e, *order.Property) {
+		if result == nil {
+			result = v
+		} else if c := compareValues(v, result); (c < 0) == (order.GetDirection() != orderDescending) && c != 0 {
+			result = v
+		}
+	}
+	return result
+}
+
+func (m *queryOrder) GetDirection() int32 {
+	if m != nil && m.Direction != nil {
+		return *m.Direction
+	}
+	return orderAscending
+}
+
+// position returns the cursor position right after e.
+func position(e *entityProto, orders []*queryOrder) *compiledCursor {
+	pos := &cursorPosition{
+		Key:            e.Key,
+		StartInclusive: proto.Bool(false),
+	}
+	for _, order := range orders {
+		pos.Indexvalue = append(pos.Indexvalue, &indexValue{
+			Property: order.Property,
+			Value:    sortValue(e, order),
+		})
+	}
+	return &compiledCursor{Position: pos}
+}
+
+// compareToPosition compares e to the entity at pos, in query order.
+func compareToPosition(e *entityProto, orders []*queryOrder, pos *cursorPosition) int {
+	for i, order := range orders {
+		if i >= len(pos.Indexvalue) {
+			break
+		}
+		c := compareValues(sortValue(e, order), pos.Indexvalue[i].Value)
+		if order.GetDirection() == orderDescending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if pos.Key == nil {
+		return 0
+	}
+	return comparePaths(e.Key.Path, pos.Key.Path)
+}
+
+func (a *API) runQuery(q *query) (*queryResult, error) {
+	if len(q.PropertyName) > 0 {
+		return nil, fmt.Errorf("fake: projection queries are not supported")
+	}
+	orders := []*queryOrder{}
+	for _, filter := range q.Filter {
+		if len(filter.Property) != 1 {
+			return nil, fmt.Errorf("fake: filters need exactly one property")
+		}
+		if op := *filter.Op; op < filterLessThan || op > filterEqual {
+			return nil, fmt.Errorf("fake: filter operator %v is not supported", op)
+		}
+		if *filter.Op != filterEqual && len(orders) == 0 {
+			orders = append(orders, &queryOrder{Property: filter.Property[0].Name})
+		}
+	}
+	for _, order := range q.Order {
+		if len(orders) > 0 && *orders[0].Property == *order.Property {
+			orders[0] = order
+		} else {
+			orders = append(orders, order)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	results := []*entityProto{}
+	for _, e := range a.entities {
+		if q.GetNameSpace() != e.Key.GetNameSpace() {
+			continue
+		}
+		if q.Kind != nil && *q.Kind != e.Key.Path.Element[len(e.Key.Path.Element)-1].GetType() {
+			continue
+		}
+		if q.Ancestor != nil {
+			ancestor := q.Ancestor.Path.Element
+			if len(ancestor) > len(e.Key.Path.Element) || comparePaths(&path{Element: ancestor}, &path{Element: e.Key.Path.Element[:len(ancestor)]}) != 0 {
+				continue
+			}
+		}
+		if !matches(e, q.Filter) {
+			continue
+		}
+		complete := true
+		for _, order := range orders {
+			if sortValue(e, order) == nil {
+				complete = false
+				break
+			}
+		}
+		if !complete {
+			continue
+		}
+		if start := q.CompiledCursor; start != nil && start.Position != nil && compareToPosition(e, orders, start.Position) <= 0 {
+			continue
+		}
+		if end := q.EndCompiledCursor; end != nil && (end.Position == nil || compareToPosition(e, orders, end.Position) > 0) {
+			continue
+		}
+		results = append(results, e)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		for _, order := range orders {
+			c := compareValues(sortValue(results[i], order), sortValue(results[j], order))
+			if order.GetDirection() == orderDescending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return comparePaths(results[i].Key.Path, results[j].Key.Path) < 0
+	})
+
+	state := &queryState{
+		keysOnly:  q.GetKeysOnly(),
+		orders:    orders,
+		results:   results,
+		remaining: -1,
+		cursor:    q.CompiledCursor,
+	}
+	if state.cursor == nil {
+		state.cursor = &compiledCursor{}
+	}
+	if q.Limit != nil {
+		state.remaining = *q.Limit
+	}
+	a.nextHandle++
+	a.queries[a.nextHandle] = state
+	return state.batch(a.nextHandle, q.GetOffset(), q.Count), nil
+}
+
+func (m *reference) GetNameSpace() string {
+	if m != nil && m.NameSpace != nil {
+		return *m.NameSpace
+	}
+	return ""
+}
+
+func (m *query) GetNameSpace() string {
+	if m != nil && m.NameSpace != nil {
+		return *m.NameSpace
+	}
+	return ""
+}
+
+func (m *query) GetKeysOnly() bool {
+	return m != nil && m.KeysOnly != nil && *m.KeysOnly
+}
+
+func (m *query) GetOffset() int32 {
+	if m != nil && m.Offset != nil {
+		return *m.Offset
+	}
+	return 0
+}
+
+func (a *API) next(req *nextRequest) (*queryResult, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if req.Cursor == nil || req.Cursor.Cursor == nil {
+		return nil, fmt.Errorf("fake: Next without cursor")
+	}
+	handle := *req.Cursor.Cursor
+	state, found := a.queries[handle]
+	if !found {
+		return nil, fmt.Errorf("fake: unknown query cursor %v", handle)
+	}
+	offset := int32(0)
+	if req.Offset != nil {
+		offset = *req.Offset
+	}
+	return state.batch(handle, offset, req.Count), nil
+}
+
+// batch skips offset results and then returns up to count of the following
+// ones, within the limit of the query.
+func (s *queryState) batch(handle uint64, offset int32, count *int32) *queryResult {
+	res := &queryResult{
+		Cursor:   &queryCursor{Cursor: proto.Uint64(handle)},
+		KeysOnly: proto.Bool(s.keysOnly),
+	}
+	skipped := int32(0)
+	for offset > skipped && len(s.results) > 0 {
+		s.cursor = position(s.results[0], s.orders)
+		s.results = s.results[1:]
+		skipped++
+	}
+	res.SkippedResults = proto.Int32(skipped)
+	size := int32(defaultQueryResultPageSize)
+	if count != nil && *count > 0 {
+		size = *count
+	}
+	for int32(len(res.Result)) < size && len(s.results) > 0 && s.remaining != 0 {
+		e := s.results[0]
+		s.results = s.results[1:]
+		if s.remaining > 0 {
+			s.remaining--
+		}
+		s.cursor = position(e, s.orders)
+		e = proto.Clone(e).(*entityProto)
+		if s.keysOnly {
+			e.Property = nil
+			e.RawProperty = nil
+		}
+		res.Result = append(res.Result, e)
+	}
+	res.MoreResults = proto.Bool(len(s.results) > 0 && s.remaining != 0)
+	res.CompiledCursor = s.cursor
+	return res
+}
@@ -0,0 +1,147 @@
+// Package fake implements an in-memory replacement for the App Engine
+// services diplicity uses (datastore, memcache and task queues), so that the
+// whole app can be driven in-process without a dev_appserver.
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+)
+
+// Clock is the time source of an API. It starts out following the wall clock,
+// and can be moved forward to make scheduled tasks and memcache expiries
+// happen without waiting.
+type Clock struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.offset)
+}
+
+// Advance moves the clock forward d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset += d
+}
+
+// API is an in-memory App Engine backend.
+//
+// API calls are serialized, and since the harness runs requests and tasks one
+// at a time transactions never conflict.
+type API struct {
+	Clock *Clock
+
+	mu sync.Mutex
+
+	entities     map[string]*entityProto
+	nextID       int64
+	transactions map[uint64]*transaction
+	nextHandle   uint64
+	queries      map[uint64]*queryState
+
+	cache     map[string]*cacheItem
+	nextCasID uint64
+
+	tasks      []*Task
+	nextTaskID int64
+}
+
+// New returns an empty API.
+func New() *API {
+	return &API{
+		Clock:        &Clock{},
+		entities:     map[string]*entityProto{},
+		transactions: map[uint64]*transaction{},
+		queries:      map[uint64]*queryState{},
+		cache:        map[string]*cacheItem{},
+	}
+}
+
+// session tracks the transactions opened by a single request or task.
+//
+// The API call override is invoked before the App Engine library tags calls
+// with their transaction, so writes are attributed to the innermost
+// transaction opened in the same session instead.
+type session struct {
+	mu           sync.Mutex
+	transactions []uint64
+}
+
+func (s *session) current() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.transactions) == 0 {
+		return 0, false
+	}
+	return s.transactions[len(s.transactions)-1], true
+}
+
+func (s *session) push(handle uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transactions = append(s.transactions, handle)
+}
+
+func (s *session) pop(handle uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.transactions) - 1; i >= 0; i-- {
+		if s.transactions[i] == handle {
+			s.transactions = append(s.transactions[:i], s.transactions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Context returns a copy of parent where all App Engine API calls are served
+// by the API.
+func (a *API) Context(parent context.Context) context.Context {
+	s := &session{}
+	return appengine.WithAPICallFunc(parent, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		return a.call(s, service, method, in, out)
+	})
+}
+
+// Handler wraps h so that the requests it serves use the API, and the clock
+// of the API.
+func (a *API) Handler(h http.Handler) http.Handler {
+	return appengine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(clock.WithClock(a.Context(r.Context()), a.Clock)))
+	}))
+}
+
+func (a *API) call(s *session, service, method string, in, out proto.Message) error {
+	switch service {
+	case "datastore_v3":
+		return a.callDatastore(s, method, in, out)
+	case "memcache":
+		return a.callMemcache(method, in, out)
+	case "taskqueue":
+		return a.callTaskQueue(s, method, in, out)
+	}
+	return fmt.Errorf("fake: %s.%s is not supported", service, method)
+}
+
+// convert copies the fields of from into to, which must share wire format.
+// Missing required fields are left for the receiver to complain about.
+func convert(from, to proto.Message) error {
+	b, err := proto.Marshal(from)
+	if _, ok := err.(*proto.RequiredNotSetError); err != nil && !ok {
+		return err
+	}
+	to.Reset()
+	return proto.Unmarshal(b, to)
+}
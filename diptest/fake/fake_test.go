@@ -0,0 +1,157 @@
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/delay"
+	"google.golang.org/appengine/v2/memcache"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+type thing struct {
+	Name  string
+	Score int
+	Tags  []string
+	At    time.Time
+}
+
+func newContext(t *testing.T) (*API, context.Context) {
+	os.Setenv("GAE_APPLICATION", "dev~fake")
+	api := New()
+	return api, api.Context(context.Background())
+}
+
+func TestDatastore(t *testing.T) {
+	_, ctx := newContext(t)
+	parent := datastore.NewKey(ctx, "Parent", "p", 0, nil)
+	keys := []*datastore.Key{}
+	for i := 0; i < 10; i++ {
+		key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Thing", parent), &thing{
+			Name:  fmt.Sprintf("thing%d", i),
+			Score: i % 5,
+			Tags:  []string{"all", fmt.Sprintf("tag%d", i%2)},
+			At:    time.Unix(int64(i), 0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	got := &thing{}
+	if err := datastore.Get(ctx, keys[3], got); err != nil || got.Name != "thing3" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, "Thing", "", 4711, parent), got); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("got %v, wanted ErrNoSuchEntity", err)
+	}
+
+	things := []thing{}
+	if _, err := datastore.NewQuery("Thing").Ancestor(parent).Filter("Tags=", "tag1").Filter("Score>", 1).Order("-Score").Order("Name").GetAll(ctx, &things); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, th := range things {
+		names = append(names, th.Name)
+	}
+	if fmt.Sprint(names) != "[thing9 thing3 thing7]" {
+		t.Errorf("got %v", names)
+	}
+
+	if n, err := datastore.NewQuery("Thing").Filter("At<", time.Unix(4, 0)).Count(ctx); err != nil || n != 4 {
+		t.Errorf("got %v, %v, wanted 4", n, err)
+	}
+
+	iter := datastore.NewQuery("Thing").Order("Name").Limit(3).Run(ctx)
+	for _, err := iter.Next(got); err == nil; _, err = iter.Next(got) {
+	}
+	cursor, err := iter.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.NewQuery("Thing").Order("Name").Start(cursor).Run(ctx).Next(got); err != nil || got.Name != "thing3" {
+		t.Errorf("got %+v, %v, wanted thing3", got, err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	_, ctx := newContext(t)
+	key := datastore.NewKey(ctx, "Thing", "t", 0, nil)
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if _, err := datastore.Put(ctx, key, &thing{Name: "before"}); err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	}, nil); err == nil {
+		t.Fatal("wanted error")
+	}
+	got := &thing{}
+	if err := datastore.Get(ctx, key, got); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("got %v, wanted ErrNoSuchEntity", err)
+	}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := datastore.Put(ctx, key, &thing{Name: "after"})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := datastore.Get(ctx, key, got); err != nil || got.Name != "after" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+}
+
+func TestMemcache(t *testing.T) {
+	api, ctx := newContext(t)
+	if err := memcache.Add(ctx, &memcache.Item{Key: "k", Value: []byte("v"), Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := memcache.Add(ctx, &memcache.Item{Key: "k", Value: []byte("w")}); err != memcache.ErrNotStored {
+		t.Fatalf("got %v, wanted ErrNotStored", err)
+	}
+	if item, err := memcache.Get(ctx, "k"); err != nil || string(item.Value) != "v" {
+		t.Fatalf("got %+v, %v", item, err)
+	}
+	api.Clock.Advance(2 * time.Minute)
+	if _, err := memcache.Get(ctx, "k"); err != memcache.ErrCacheMiss {
+		t.Fatalf("got %v, wanted ErrCacheMiss", err)
+	}
+}
+
+var (
+	ran          = []string{}
+	testDelayFun = delay.MustRegister("fakeTest", func(ctx context.Context, s string) error {
+		ran = append(ran, s)
+		return nil
+	})
+)
+
+func TestTaskQueue(t *testing.T) {
+	api, ctx := newContext(t)
+	handler := api.Handler(http.DefaultServeMux)
+	for _, d := range []time.Duration{time.Hour, 0} {
+		task, err := testDelayFun.Task(d.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.Delay = d
+		if _, err := taskqueue.Add(ctx, task, "fake-test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := api.RunDueTasks(handler); n != 1 || fmt.Sprint(ran) != "[0s]" {
+		t.Fatalf("ran %v tasks: %v", n, ran)
+	}
+	api.Clock.Advance(time.Hour)
+	if n := api.RunDueTasks(handler); n != 1 || fmt.Sprint(ran) != "[0s 1h0m0s]" {
+		t.Fatalf("ran %v tasks: %v", n, ran)
+	}
+	if tasks := api.Tasks("fake-test"); len(tasks) != 0 {
+		t.Fatalf("got %v, wanted no tasks", tasks)
+	}
+}
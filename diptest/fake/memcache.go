@@ -0,0 +1,200 @@
+package fake
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Expiration times larger than this are absolute unix times, smaller are
+// relative to now.
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+type cacheItem struct {
+	value   []byte
+	flags   uint32
+	casID   uint64
+	expires time.Time
+}
+
+func cacheKey(namespace *string, key []byte) string {
+	if namespace == nil {
+		return "/" + string(key)
+	}
+	return *namespace + "/" + string(key)
+}
+
+func (a *API) callMemcache(method string, in, out proto.Message) error {
+	switch method {
+	case "Get":
+		req := &memcacheGetRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		return convert(a.cacheGet(req), out)
+	case "Set":
+		req := &memcacheSetRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		return convert(a.cacheSet(req), out)
+	case "Delete":
+		req := &memcacheDeleteRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		return convert(a.cacheDelete(req), out)
+	case "Increment":
+		req := &memcacheIncrementRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		return convert(a.cacheIncrement(req), out)
+	case "FlushAll":
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.cache = map[string]*cacheItem{}
+		out.Reset()
+		return nil
+	}
+	return fmt.Errorf("fake: memcache.%s is not supported", method)
+}
+
+// cached returns the live item at key, dropping it if it has expired.
+func (a *API) cached(key string) (*cacheItem, bool) {
+	item, found := a.cache[key]
+	if !found {
+		return nil, false
+	}
+	if !item.expires.IsZero() && !item.expires.After(a.Clock.Now()) {
+		delete(a.cache, key)
+		return nil, false
+	}
+	return item, true
+}
+
+func (a *API) cacheGet(req *memcacheGetRequest) *memcacheGetResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := &memcacheGetResponse{}
+	for _, key := range req.Key {
+		if item, found := a.cached(cacheKey(req.NameSpace, key)); found {
+			res.Item = append(res.Item, &memcacheGetResponseItem{
+				Key:   key,
+				Value: item.value,
+				Flags: proto.Uint32(item.flags),
+				CasId: proto.Uint64(item.casID),
+			})
+		}
+	}
+	return res
+}
+
+func (a *API) cacheSet(req *memcacheSetRequest) *memcacheSetResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := &memcacheSetResponse{}
+	for _, reqItem := range req.Item {
+		key := cacheKey(req.NameSpace, reqItem.Key)
+		old, found := a.cached(key)
+		policy := int32(setPolicySet)
+		if reqItem.SetPolicy != nil {
+			policy = *reqItem.SetPolicy
+		}
+		status := int32(setStatusStored)
+		switch policy {
+		case setPolicyAdd:
+			if found {
+				status = setStatusNotStored
+			}
+		case setPolicyReplace:
+			if !found {
+				status = setStatusNotStored
+			}
+		case setPolicyCAS:
+			if !found {
+				status = setStatusNotStored
+			} else if reqItem.CasId == nil || *reqItem.CasId != old.casID {
+				status = setStatusExists
+			}
+		}
+		if status == setStatusStored {
+			a.nextCasID++
+			item := &cacheItem{
+				value: reqItem.Value,
+				casID: a.nextCasID,
+			}
+			if reqItem.Flags != nil {
+				item.flags = *reqItem.Flags
+			}
+			if reqItem.ExpirationTime != nil && *reqItem.ExpirationTime != 0 {
+				if exp := int64(*reqItem.ExpirationTime); exp > maxRelativeExpiration {
+					item.expires = time.Unix(exp, 0)
+				} else {
+					item.expires = a.Clock.Now().Add(time.Duration(exp) * time.Second)
+				}
+			}
+			a.cache[key] = item
+		}
+		res.SetStatus = append(res.SetStatus, status)
+	}
+	return res
+}
+
+func (a *API) cacheDelete(req *memcacheDeleteRequest) *memcacheDeleteResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := &memcacheDeleteResponse{}
+	for _, reqItem := range req.Item {
+		key := cacheKey(req.NameSpace, reqItem.Key)
+		if _, found := a.cached(key); found {
+			delete(a.cache, key)
+			res.DeleteStatus = append(res.DeleteStatus, deleteStatusDeleted)
+		} else {
+			res.DeleteStatus = append(res.DeleteStatus, deleteStatusNotFound)
+		}
+	}
+	return res
+}
+
+func (a *API) cacheIncrement(req *memcacheIncrementRequest) *memcacheIncrementResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := cacheKey(req.NameSpace, req.Key)
+	item, found := a.cached(key)
+	if !found {
+		if req.InitialValue == nil {
+			return &memcacheIncrementResponse{IncrementStatus: proto.Int32(incrementStatusNotChanged)}
+		}
+		a.nextCasID++
+		item = &cacheItem{
+			value: []byte(strconv.FormatUint(*req.InitialValue, 10)),
+			casID: a.nextCasID,
+		}
+		a.cache[key] = item
+	}
+	current, err := strconv.ParseUint(string(item.value), 10, 64)
+	if err != nil {
+		return &memcacheIncrementResponse{IncrementStatus: proto.Int32(incrementStatusError)}
+	}
+	delta := uint64(1)
+	if req.Delta != nil {
+		delta = *req.Delta
+	}
+	if req.Direction != nil && *req.Direction == incrementDirectionDecrement {
+		if delta > current {
+			current = 0
+		} else {
+			current -= delta
+		}
+	} else {
+		current += delta
+	}
+	item.value = []byte(strconv.FormatUint(current, 10))
+	return &memcacheIncrementResponse{
+		NewValue:        proto.Uint64(current),
+		IncrementStatus: proto.Int32(incrementStatusOK),
+	}
+}
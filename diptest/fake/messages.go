@@ -0,0 +1,477 @@
+package fake
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// The App Engine API request and response types live in internal packages of
+// google.golang.org/appengine, so the fake decodes them into these structs,
+// which share wire tags with the originals but only carry the fields we use.
+
+const (
+	meaningGDWhen = 7
+
+	filterLessThan           = 1
+	filterLessThanOrEqual    = 2
+	filterGreaterThan        = 3
+	filterGreaterThanOrEqual = 4
+	filterEqual              = 5
+	filterIn                 = 6
+
+	orderAscending  = 1
+	orderDescending = 2
+
+	setPolicySet     = 1
+	setPolicyAdd     = 2
+	setPolicyReplace = 3
+	setPolicyCAS     = 4
+
+	setStatusStored    = 1
+	setStatusNotStored = 2
+	setStatusExists    = 4
+
+	deleteStatusDeleted  = 1
+	deleteStatusNotFound = 2
+
+	incrementDirectionDecrement = 2
+
+	incrementStatusOK          = 1
+	incrementStatusNotChanged  = 2
+	incrementStatusError       = 3
+	taskQueueModePull          = 1
+	taskQueueMethodPost        = 2
+	defaultQueryResultPageSize = 1000
+)
+
+type pointValue struct {
+	X *float64 `protobuf:"fixed64,6,req,name=x"`
+	Y *float64 `protobuf:"fixed64,7,req,name=y"`
+}
+
+func (m *pointValue) Reset()         { *m = pointValue{} }
+func (m *pointValue) String() string { return proto.CompactTextString(m) }
+func (*pointValue) ProtoMessage()    {}
+
+type userValue struct {
+	Email             *string `protobuf:"bytes,9,req,name=email"`
+	AuthDomain        *string `protobuf:"bytes,10,req,name=auth_domain"`
+	Nickname          *string `protobuf:"bytes,11,opt,name=nickname"`
+	FederatedIdentity *string `protobuf:"bytes,21,opt,name=federated_identity"`
+	FederatedProvider *string `protobuf:"bytes,22,opt,name=federated_provider"`
+}
+
+func (m *userValue) Reset()         { *m = userValue{} }
+func (m *userValue) String() string { return proto.CompactTextString(m) }
+func (*userValue) ProtoMessage()    {}
+
+type referenceValuePathElement struct {
+	Type *string `protobuf:"bytes,15,req,name=type"`
+	Id   *int64  `protobuf:"varint,16,opt,name=id"`
+	Name *string `protobuf:"bytes,17,opt,name=name"`
+}
+
+func (m *referenceValuePathElement) Reset()         { *m = referenceValuePathElement{} }
+func (m *referenceValuePathElement) String() string { return proto.CompactTextString(m) }
+func (*referenceValuePathElement) ProtoMessage()    {}
+
+type referenceValue struct {
+	App         *string                      `protobuf:"bytes,13,req,name=app"`
+	NameSpace   *string                      `protobuf:"bytes,20,opt,name=name_space"`
+	Pathelement []*referenceValuePathElement `protobuf:"group,14,rep,name=PathElement"`
+}
+
+func (m *referenceValue) Reset()         { *m = referenceValue{} }
+func (m *referenceValue) String() string { return proto.CompactTextString(m) }
+func (*referenceValue) ProtoMessage()    {}
+
+type propertyValue struct {
+	Int64Value     *int64          `protobuf:"varint,1,opt,name=int64Value"`
+	BooleanValue   *bool           `protobuf:"varint,2,opt,name=booleanValue"`
+	StringValue    *string         `protobuf:"bytes,3,opt,name=stringValue"`
+	DoubleValue    *float64        `protobuf:"fixed64,4,opt,name=doubleValue"`
+	Pointvalue     *pointValue     `protobuf:"group,5,opt,name=PointValue"`
+	Uservalue      *userValue      `protobuf:"group,8,opt,name=UserValue"`
+	Referencevalue *referenceValue `protobuf:"group,12,opt,name=ReferenceValue"`
+}
+
+func (m *propertyValue) Reset()         { *m = propertyValue{} }
+func (m *propertyValue) String() string { return proto.CompactTextString(m) }
+func (*propertyValue) ProtoMessage()    {}
+
+type property struct {
+	Meaning  *int32         `protobuf:"varint,1,opt,name=meaning"`
+	Name     *string        `protobuf:"bytes,3,req,name=name"`
+	Value    *propertyValue `protobuf:"bytes,5,req,name=value"`
+	Multiple *bool          `protobuf:"varint,4,req,name=multiple"`
+}
+
+func (m *property) Reset()         { *m = property{} }
+func (m *property) String() string { return proto.CompactTextString(m) }
+func (*property) ProtoMessage()    {}
+
+type pathElement struct {
+	Type *string `protobuf:"bytes,2,req,name=type"`
+	Id   *int64  `protobuf:"varint,3,opt,name=id"`
+	Name *string `protobuf:"bytes,4,opt,name=name"`
+}
+
+func (m *pathElement) Reset()         { *m = pathElement{} }
+func (m *pathElement) String() string { return proto.CompactTextString(m) }
+func (*pathElement) ProtoMessage()    {}
+
+type path struct {
+	Element []*pathElement `protobuf:"group,1,rep,name=Element"`
+}
+
+func (m *path) Reset()         { *m = path{} }
+func (m *path) String() string { return proto.CompactTextString(m) }
+func (*path) ProtoMessage()    {}
+
+type reference struct {
+	App       *string `protobuf:"bytes,13,req,name=app"`
+	NameSpace *string `protobuf:"bytes,20,opt,name=name_space"`
+	Path      *path   `protobuf:"bytes,14,req,name=path"`
+}
+
+func (m *reference) Reset()         { *m = reference{} }
+func (m *reference) String() string { return proto.CompactTextString(m) }
+func (*reference) ProtoMessage()    {}
+
+type entityProto struct {
+	Key         *reference  `protobuf:"bytes,13,req,name=key"`
+	EntityGroup *path       `protobuf:"bytes,16,req,name=entity_group"`
+	Property    []*property `protobuf:"bytes,14,rep,name=property"`
+	RawProperty []*property `protobuf:"bytes,15,rep,name=raw_property"`
+}
+
+func (m *entityProto) Reset()         { *m = entityProto{} }
+func (m *entityProto) String() string { return proto.CompactTextString(m) }
+func (*entityProto) ProtoMessage()    {}
+
+type transactionHandle struct {
+	Handle *uint64 `protobuf:"fixed64,1,req,name=handle"`
+	App    *string `protobuf:"bytes,2,req,name=app"`
+}
+
+func (m *transactionHandle) Reset()         { *m = transactionHandle{} }
+func (m *transactionHandle) String() string { return proto.CompactTextString(m) }
+func (*transactionHandle) ProtoMessage()    {}
+
+type queryFilter struct {
+	Op       *int32      `protobuf:"varint,6,req,name=op"`
+	Property []*property `protobuf:"bytes,14,rep,name=property"`
+}
+
+func (m *queryFilter) Reset()         { *m = queryFilter{} }
+func (m *queryFilter) String() string { return proto.CompactTextString(m) }
+func (*queryFilter) ProtoMessage()    {}
+
+type queryOrder struct {
+	Property  *string `protobuf:"bytes,10,req,name=property"`
+	Direction *int32  `protobuf:"varint,11,opt,name=direction"`
+}
+
+func (m *queryOrder) Reset()         { *m = queryOrder{} }
+func (m *queryOrder) String() string { return proto.CompactTextString(m) }
+func (*queryOrder) ProtoMessage()    {}
+
+type indexValue struct {
+	Property *string        `protobuf:"bytes,30,opt,name=property"`
+	Value    *propertyValue `protobuf:"bytes,31,req,name=value"`
+}
+
+func (m *indexValue) Reset()         { *m = indexValue{} }
+func (m *indexValue) String() string { return proto.CompactTextString(m) }
+func (*indexValue) ProtoMessage()    {}
+
+type cursorPosition struct {
+	Indexvalue     []*indexValue `protobuf:"group,29,rep,name=IndexValue"`
+	Key            *reference    `protobuf:"bytes,32,opt,name=key"`
+	StartInclusive *bool         `protobuf:"varint,28,opt,name=start_inclusive"`
+}
+
+func (m *cursorPosition) Reset()         { *m = cursorPosition{} }
+func (m *cursorPosition) String() string { return proto.CompactTextString(m) }
+func (*cursorPosition) ProtoMessage()    {}
+
+type compiledCursor struct {
+	Position *cursorPosition `protobuf:"group,2,opt,name=Position"`
+}
+
+func (m *compiledCursor) Reset()         { *m = compiledCursor{} }
+func (m *compiledCursor) String() string { return proto.CompactTextString(m) }
+func (*compiledCursor) ProtoMessage()    {}
+
+type query struct {
+	App               *string         `protobuf:"bytes,1,req,name=app"`
+	NameSpace         *string         `protobuf:"bytes,29,opt,name=name_space"`
+	Kind              *string         `protobuf:"bytes,3,opt,name=kind"`
+	Ancestor          *reference      `protobuf:"bytes,17,opt,name=ancestor"`
+	Filter            []*queryFilter  `protobuf:"group,4,rep,name=Filter"`
+	Order             []*queryOrder   `protobuf:"group,9,rep,name=Order"`
+	Count             *int32          `protobuf:"varint,23,opt,name=count"`
+	Offset            *int32          `protobuf:"varint,12,opt,name=offset"`
+	Limit             *int32          `protobuf:"varint,16,opt,name=limit"`
+	CompiledCursor    *compiledCursor `protobuf:"bytes,30,opt,name=compiled_cursor"`
+	EndCompiledCursor *compiledCursor `protobuf:"bytes,31,opt,name=end_compiled_cursor"`
+	KeysOnly          *bool           `protobuf:"varint,21,opt,name=keys_only"`
+	Compile           *bool           `protobuf:"varint,25,opt,name=compile"`
+	PropertyName      []string        `protobuf:"bytes,33,rep,name=property_name"`
+}
+
+func (m *query) Reset()         { *m = query{} }
+func (m *query) String() string { return proto.CompactTextString(m) }
+func (*query) ProtoMessage()    {}
+
+type queryCursor struct {
+	Cursor *uint64 `protobuf:"fixed64,1,req,name=cursor"`
+	App    *string `protobuf:"bytes,2,opt,name=app"`
+}
+
+func (m *queryCursor) Reset()         { *m = queryCursor{} }
+func (m *queryCursor) String() string { return proto.CompactTextString(m) }
+func (*queryCursor) ProtoMessage()    {}
+
+type getRequest struct {
+	Key []*reference `protobuf:"bytes,1,rep,name=key"`
+}
+
+func (m *getRequest) Reset()         { *m = getRequest{} }
+func (m *getRequest) String() string { return proto.CompactTextString(m) }
+func (*getRequest) ProtoMessage()    {}
+
+type getResponseEntity struct {
+	Entity *entityProto `protobuf:"bytes,2,opt,name=entity"`
+	Key    *reference   `protobuf:"bytes,4,opt,name=key"`
+}
+
+func (m *getResponseEntity) Reset()         { *m = getResponseEntity{} }
+func (m *getResponseEntity) String() string { return proto.CompactTextString(m) }
+func (*getResponseEntity) ProtoMessage()    {}
+
+type getResponse struct {
+	Entity []*getResponseEntity `protobuf:"group,1,rep,name=Entity"`
+}
+
+func (m *getResponse) Reset()         { *m = getResponse{} }
+func (m *getResponse) String() string { return proto.CompactTextString(m) }
+func (*getResponse) ProtoMessage()    {}
+
+type putRequest struct {
+	Entity []*entityProto `protobuf:"bytes,1,rep,name=entity"`
+}
+
+func (m *putRequest) Reset()         { *m = putRequest{} }
+func (m *putRequest) String() string { return proto.CompactTextString(m) }
+func (*putRequest) ProtoMessage()    {}
+
+type putResponse struct {
+	Key []*reference `protobuf:"bytes,1,rep,name=key"`
+}
+
+func (m *putResponse) Reset()         { *m = putResponse{} }
+func (m *putResponse) String() string { return proto.CompactTextString(m) }
+func (*putResponse) ProtoMessage()    {}
+
+type deleteRequest struct {
+	Key []*reference `protobuf:"bytes,6,rep,name=key"`
+}
+
+func (m *deleteRequest) Reset()         { *m = deleteRequest{} }
+func (m *deleteRequest) String() string { return proto.CompactTextString(m) }
+func (*deleteRequest) ProtoMessage()    {}
+
+type nextRequest struct {
+	Cursor  *queryCursor `protobuf:"bytes,1,req,name=cursor"`
+	Count   *int32       `protobuf:"varint,2,opt,name=count"`
+	Offset  *int32       `protobuf:"varint,4,opt,name=offset"`
+	Compile *bool        `protobuf:"varint,3,opt,name=compile"`
+}
+
+func (m *nextRequest) Reset()         { *m = nextRequest{} }
+func (m *nextRequest) String() string { return proto.CompactTextString(m) }
+func (*nextRequest) ProtoMessage()    {}
+
+type queryResult struct {
+	Cursor         *queryCursor    `protobuf:"bytes,1,opt,name=cursor"`
+	Result         []*entityProto  `protobuf:"bytes,2,rep,name=result"`
+	SkippedResults *int32          `protobuf:"varint,7,opt,name=skipped_results"`
+	MoreResults    *bool           `protobuf:"varint,3,req,name=more_results"`
+	KeysOnly       *bool           `protobuf:"varint,4,opt,name=keys_only"`
+	CompiledCursor *compiledCursor `protobuf:"bytes,6,opt,name=compiled_cursor"`
+}
+
+func (m *queryResult) Reset()         { *m = queryResult{} }
+func (m *queryResult) String() string { return proto.CompactTextString(m) }
+func (*queryResult) ProtoMessage()    {}
+
+type allocateIdsRequest struct {
+	ModelKey *reference `protobuf:"bytes,1,opt,name=model_key"`
+	Size     *int64     `protobuf:"varint,2,opt,name=size"`
+	Max      *int64     `protobuf:"varint,3,opt,name=max"`
+}
+
+func (m *allocateIdsRequest) Reset()         { *m = allocateIdsRequest{} }
+func (m *allocateIdsRequest) String() string { return proto.CompactTextString(m) }
+func (*allocateIdsRequest) ProtoMessage()    {}
+
+type allocateIdsResponse struct {
+	Start *int64 `protobuf:"varint,1,req,name=start"`
+	End   *int64 `protobuf:"varint,2,req,name=end"`
+}
+
+func (m *allocateIdsResponse) Reset()         { *m = allocateIdsResponse{} }
+func (m *allocateIdsResponse) String() string { return proto.CompactTextString(m) }
+func (*allocateIdsResponse) ProtoMessage()    {}
+
+type beginTransactionRequest struct {
+	App *string `protobuf:"bytes,1,req,name=app"`
+}
+
+func (m *beginTransactionRequest) Reset()         { *m = beginTransactionRequest{} }
+func (m *beginTransactionRequest) String() string { return proto.CompactTextString(m) }
+func (*beginTransactionRequest) ProtoMessage()    {}
+
+type commitResponse struct {
+}
+
+func (m *commitResponse) Reset()         { *m = commitResponse{} }
+func (m *commitResponse) String() string { return proto.CompactTextString(m) }
+func (*commitResponse) ProtoMessage()    {}
+
+type memcacheGetRequest struct {
+	Key       [][]byte `protobuf:"bytes,1,rep,name=key"`
+	NameSpace *string  `protobuf:"bytes,2,opt,name=name_space"`
+	ForCas    *bool    `protobuf:"varint,4,opt,name=for_cas"`
+}
+
+func (m *memcacheGetRequest) Reset()         { *m = memcacheGetRequest{} }
+func (m *memcacheGetRequest) String() string { return proto.CompactTextString(m) }
+func (*memcacheGetRequest) ProtoMessage()    {}
+
+type memcacheGetResponseItem struct {
+	Key   []byte  `protobuf:"bytes,2,req,name=key"`
+	Value []byte  `protobuf:"bytes,3,req,name=value"`
+	Flags *uint32 `protobuf:"fixed32,4,opt,name=flags"`
+	CasId *uint64 `protobuf:"fixed64,5,opt,name=cas_id"`
+}
+
+func (m *memcacheGetResponseItem) Reset()         { *m = memcacheGetResponseItem{} }
+func (m *memcacheGetResponseItem) String() string { return proto.CompactTextString(m) }
+func (*memcacheGetResponseItem) ProtoMessage()    {}
+
+type memcacheGetResponse struct {
+	Item []*memcacheGetResponseItem `protobuf:"group,1,rep,name=Item"`
+}
+
+func (m *memcacheGetResponse) Reset()         { *m = memcacheGetResponse{} }
+func (m *memcacheGetResponse) String() string { return proto.CompactTextString(m) }
+func (*memcacheGetResponse) ProtoMessage()    {}
+
+type memcacheSetRequestItem struct {
+	Key            []byte  `protobuf:"bytes,2,req,name=key"`
+	Value          []byte  `protobuf:"bytes,3,req,name=value"`
+	Flags          *uint32 `protobuf:"fixed32,4,opt,name=flags"`
+	SetPolicy      *int32  `protobuf:"varint,5,opt,name=set_policy"`
+	ExpirationTime *uint32 `protobuf:"fixed32,6,opt,name=expiration_time"`
+	CasId          *uint64 `protobuf:"fixed64,8,opt,name=cas_id"`
+}
+
+func (m *memcacheSetRequestItem) Reset()         { *m = memcacheSetRequestItem{} }
+func (m *memcacheSetRequestItem) String() string { return proto.CompactTextString(m) }
+func (*memcacheSetRequestItem) ProtoMessage()    {}
+
+type memcacheSetRequest struct {
+	Item      []*memcacheSetRequestItem `protobuf:"group,1,rep,name=Item"`
+	NameSpace *string                   `protobuf:"bytes,7,opt,name=name_space"`
+}
+
+func (m *memcacheSetRequest) Reset()         { *m = memcacheSetRequest{} }
+func (m *memcacheSetRequest) String() string { return proto.CompactTextString(m) }
+func (*memcacheSetRequest) ProtoMessage()    {}
+
+type memcacheSetResponse struct {
+	SetStatus []int32 `protobuf:"varint,1,rep,name=set_status"`
+}
+
+func (m *memcacheSetResponse) Reset()         { *m = memcacheSetResponse{} }
+func (m *memcacheSetResponse) String() string { return proto.CompactTextString(m) }
+func (*memcacheSetResponse) ProtoMessage()    {}
+
+type memcacheDeleteRequestItem struct {
+	Key []byte `protobuf:"bytes,2,req,name=key"`
+}
+
+func (m *memcacheDeleteRequestItem) Reset()         { *m = memcacheDeleteRequestItem{} }
+func (m *memcacheDeleteRequestItem) String() string { return proto.CompactTextString(m) }
+func (*memcacheDeleteRequestItem) ProtoMessage()    {}
+
+type memcacheDeleteRequest struct {
+	Item      []*memcacheDeleteRequestItem `protobuf:"group,1,rep,name=Item"`
+	NameSpace *string                      `protobuf:"bytes,4,opt,name=name_space"`
+}
+
+func (m *memcacheDeleteRequest) Reset()         { *m = memcacheDeleteRequest{} }
+func (m *memcacheDeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*memcacheDeleteRequest) ProtoMessage()    {}
+
+type memcacheDeleteResponse struct {
+	DeleteStatus []int32 `protobuf:"varint,1,rep,name=delete_status"`
+}
+
+func (m *memcacheDeleteResponse) Reset()         { *m = memcacheDeleteResponse{} }
+func (m *memcacheDeleteResponse) String() string { return proto.CompactTextString(m) }
+func (*memcacheDeleteResponse) ProtoMessage()    {}
+
+type memcacheIncrementRequest struct {
+	Key          []byte  `protobuf:"bytes,1,req,name=key"`
+	NameSpace    *string `protobuf:"bytes,4,opt,name=name_space"`
+	Delta        *uint64 `protobuf:"varint,2,opt,name=delta"`
+	Direction    *int32  `protobuf:"varint,3,opt,name=direction"`
+	InitialValue *uint64 `protobuf:"varint,5,opt,name=initial_value"`
+}
+
+func (m *memcacheIncrementRequest) Reset()         { *m = memcacheIncrementRequest{} }
+func (m *memcacheIncrementRequest) String() string { return proto.CompactTextString(m) }
+func (*memcacheIncrementRequest) ProtoMessage()    {}
+
+type memcacheIncrementResponse struct {
+	NewValue        *uint64 `protobuf:"varint,1,opt,name=new_value"`
+	IncrementStatus *int32  `protobuf:"varint,2,opt,name=increment_status"`
+}
+
+func (m *memcacheIncrementResponse) Reset()         { *m = memcacheIncrementResponse{} }
+func (m *memcacheIncrementResponse) String() string { return proto.CompactTextString(m) }
+func (*memcacheIncrementResponse) ProtoMessage()    {}
+
+type taskQueueAddRequestHeader struct {
+	Key   []byte `protobuf:"bytes,7,req,name=key"`
+	Value []byte `protobuf:"bytes,8,req,name=value"`
+}
+
+func (m *taskQueueAddRequestHeader) Reset()         { *m = taskQueueAddRequestHeader{} }
+func (m *taskQueueAddRequestHeader) String() string { return proto.CompactTextString(m) }
+func (*taskQueueAddRequestHeader) ProtoMessage()    {}
+
+type taskQueueAddRequest struct {
+	QueueName []byte                       `protobuf:"bytes,1,req,name=queue_name"`
+	TaskName  []byte                       `protobuf:"bytes,2,req,name=task_name"`
+	EtaUsec   *int64                       `protobuf:"varint,3,req,name=eta_usec"`
+	Method    *int32                       `protobuf:"varint,5,opt,name=method"`
+	Url       []byte                       `protobuf:"bytes,4,opt,name=url"`
+	Header    []*taskQueueAddRequestHeader `protobuf:"group,6,rep,name=Header"`
+	Body      []byte                       `protobuf:"bytes,9,opt,name=body"`
+	Mode      *int32                       `protobuf:"varint,18,opt,name=mode"`
+}
+
+func (m *taskQueueAddRequest) Reset()         { *m = taskQueueAddRequest{} }
+func (m *taskQueueAddRequest) String() string { return proto.CompactTextString(m) }
+func (*taskQueueAddRequest) ProtoMessage()    {}
+
+type taskQueueAddResponse struct {
+	ChosenTaskName []byte `protobuf:"bytes,1,opt,name=chosen_task_name"`
+}
+
+func (m *taskQueueAddResponse) Reset()         { *m = taskQueueAddResponse{} }
+func (m *taskQueueAddResponse) String() string { return proto.CompactTextString(m) }
+func (*taskQueueAddResponse) ProtoMessage()    {}
@@ -0,0 +1,168 @@
+package fake
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	maxTaskRetries = 10
+	minTaskBackoff = 100 * time.Millisecond
+	maxTaskBackoff = 10 * time.Second
+)
+
+var taskMethods = map[int32]string{
+	1: "GET",
+	2: "POST",
+	3: "HEAD",
+	4: "PUT",
+	5: "DELETE",
+}
+
+// Task is a push task waiting in a queue.
+type Task struct {
+	Queue   string
+	Name    string
+	ETA     time.Time
+	Method  string
+	URL     string
+	Header  http.Header
+	Body    []byte
+	Retries int
+}
+
+func (a *API) callTaskQueue(s *session, method string, in, out proto.Message) error {
+	switch method {
+	case "Add":
+		req := &taskQueueAddRequest{}
+		if err := convert(in, req); err != nil {
+			return err
+		}
+		res, err := a.addTask(s, req)
+		if err != nil {
+			return err
+		}
+		return convert(res, out)
+	}
+	return fmt.Errorf("fake: taskqueue.%s is not supported", method)
+}
+
+func (a *API) addTask(s *session, req *taskQueueAddRequest) (*taskQueueAddResponse, error) {
+	if req.Mode != nil && *req.Mode == taskQueueModePull {
+		return nil, fmt.Errorf("fake: pull queues are not supported")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	task := &Task{
+		Queue:  string(req.QueueName),
+		Name:   string(req.TaskName),
+		URL:    string(req.Url),
+		Header: http.Header{},
+		Body:   req.Body,
+		Method: "POST",
+	}
+	if req.EtaUsec != nil {
+		task.ETA = time.Unix(0, *req.EtaUsec*1000)
+	}
+	if req.Method != nil {
+		task.Method = taskMethods[*req.Method]
+	}
+	for _, header := range req.Header {
+		task.Header.Add(string(header.Key), string(header.Value))
+	}
+	if task.Name == "" {
+		a.nextTaskID++
+		task.Name = fmt.Sprintf("task%d", a.nextTaskID)
+	} else {
+		for _, existing := range a.tasks {
+			if existing.Queue == task.Queue && existing.Name == task.Name {
+				return nil, fmt.Errorf("fake: task %q already added to %q", task.Name, task.Queue)
+			}
+		}
+	}
+	if handle, found := s.current(); found {
+		tx, found := a.transactions[handle]
+		if !found {
+			return nil, fmt.Errorf("fake: unknown transaction %v", handle)
+		}
+		tx.tasks = append(tx.tasks, task)
+	} else {
+		a.tasks = append(a.tasks, task)
+	}
+	return &taskQueueAddResponse{ChosenTaskName: []byte(task.Name)}, nil
+}
+
+// Tasks returns the tasks waiting in queue.
+func (a *API) Tasks(queue string) []Task {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := []Task{}
+	for _, task := range a.tasks {
+		if task.Queue == queue {
+			result = append(result, *task)
+		}
+	}
+	return result
+}
+
+// nextDueTask removes and returns the due task with the earliest ETA, if any.
+func (a *API) nextDueTask() *Task {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sort.SliceStable(a.tasks, func(i, j int) bool {
+		return a.tasks[i].ETA.Before(a.tasks[j].ETA)
+	})
+	if len(a.tasks) == 0 || a.tasks[0].ETA.After(a.Clock.Now()) {
+		return nil
+	}
+	task := a.tasks[0]
+	a.tasks = a.tasks[1:]
+	return task
+}
+
+// RunDueTasks runs all tasks that are due according to the clock, including
+// tasks they add that are due immediately, using h (which should be wrapped
+// with Handler) to serve them. Failed tasks are retried with backoff, and
+// dropped after maxTaskRetries attempts. It returns the number of executed
+// tasks.
+func (a *API) RunDueTasks(h http.Handler) int {
+	executed := 0
+	for task := a.nextDueTask(); task != nil; task = a.nextDueTask() {
+		executed++
+		req := httptest.NewRequest(task.Method, task.URL, bytes.NewReader(task.Body))
+		for key, values := range task.Header {
+			req.Header[key] = values
+		}
+		req.Header.Set("X-AppEngine-QueueName", task.Queue)
+		req.Header.Set("X-AppEngine-TaskName", task.Name)
+		req.Header.Set("X-AppEngine-TaskRetryCount", fmt.Sprint(task.Retries))
+		req.Header.Set("X-AppEngine-TaskExecutionCount", fmt.Sprint(task.Retries))
+		req.Header.Set("X-AppEngine-TaskETA", fmt.Sprint(task.ETA.Unix()))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code >= 200 && rec.Code < 300 {
+			continue
+		}
+		task.Retries++
+		if task.Retries > maxTaskRetries {
+			log.Printf("fake: dropping task %q in %q after %v attempts", task.Name, task.Queue, task.Retries)
+			continue
+		}
+		backoff := minTaskBackoff << uint(task.Retries-1)
+		if backoff > maxTaskBackoff {
+			backoff = maxTaskBackoff
+		}
+		task.ETA = a.Clock.Now().Add(backoff)
+		a.mu.Lock()
+		a.tasks = append(a.tasks, task)
+		a.mu.Unlock()
+	}
+	return executed
+}
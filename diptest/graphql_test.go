@@ -0,0 +1,106 @@
+package diptest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+const graphQLDashboard = `
+query Dashboard($id: ID!) {
+	game(id: $id) {
+		id
+		desc
+		mustered
+		members {
+			nation
+			user { id }
+			stats { userId }
+		}
+		phases {
+			ordinal
+			resolved
+			phaseStates { nation }
+			orders { nation parts }
+		}
+		channels {
+			members
+			messages(limit: 1) { sender body }
+		}
+	}
+	games(list: "my-started-games") {
+		games { id }
+	}
+}`
+
+func graphQL(env *Env, query string, variables map[string]interface{}) *Result {
+	res := env.PostRoute(game.GraphQLRoute).Body(map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	}).Success()
+	if errs, found := res.Body.(map[string]interface{})["errors"]; found {
+		panic(fmt.Errorf("querying %q: %v", query, errs))
+	}
+	return res
+}
+
+func testGraphQL(t *testing.T) {
+	env := startedGameEnvs[0]
+	nation := startedGameNats[0]
+	variables := map[string]interface{}{"id": startedGameID}
+
+	res := graphQL(env, graphQLDashboard, variables)
+	res.AssertEq(startedGameID, "data", "game", "id")
+	res.AssertEq(startedGameDesc, "data", "game", "desc")
+	res.AssertLen(len(startedGameEnvs), "data", "game", "members")
+	res.Find(startedGameID, []string{"data", "games", "games"}, []string{"id"})
+
+	t.Run("TestMemberStats", func(t *testing.T) {
+		res.Find(env.GetUID(), []string{"data", "game", "members"}, []string{"user", "id"}).
+			AssertEq(env.GetUID(), "stats", "userId")
+	})
+
+	t.Run("TestOrdersAndPhaseStatesRedacted", func(t *testing.T) {
+		for _, phase := range res.GetValue("data", "game", "phases").([]interface{}) {
+			phase := phase.(map[string]interface{})
+			if phase["resolved"].(bool) {
+				continue
+			}
+			phaseStates := phase["phaseStates"].([]interface{})
+			if len(phaseStates) != 1 || phaseStates[0].(map[string]interface{})["nation"] != nation {
+				t.Errorf("wanted only the phase state of %v, got %+v", nation, phaseStates)
+			}
+			for _, order := range phase["orders"].([]interface{}) {
+				if order.(map[string]interface{})["nation"] != nation {
+					t.Errorf("wanted only orders of %v, got %+v", nation, order)
+				}
+			}
+		}
+	})
+
+	t.Run("TestChannelsMatchREST", func(t *testing.T) {
+		channels := startedGames[0].Follow("channels", "Links").Success().GetValue("Properties").([]interface{})
+		res.AssertLen(len(channels), "data", "game", "channels")
+	})
+
+	t.Run("TestNonMemberSeesNoOrders", func(t *testing.T) {
+		outsider := NewEnv().SetUID(String("fake"))
+		res := graphQL(outsider, graphQLDashboard, variables)
+		res.AssertLen(0, "data", "games", "games")
+		for _, phase := range res.GetValue("data", "game", "phases").([]interface{}) {
+			phase := phase.(map[string]interface{})
+			if !phase["resolved"].(bool) && (len(phase["orders"].([]interface{})) > 0 || len(phase["phaseStates"].([]interface{})) > 0) {
+				t.Errorf("outsider saw %+v", phase)
+			}
+		}
+		res.AssertLen(1, "data", "game", "channels")
+	})
+
+	t.Run("TestUnauthenticated", func(t *testing.T) {
+		NewEnv().PostRoute(game.GraphQLRoute).Body(map[string]interface{}{
+			"query":     graphQLDashboard,
+			"variables": variables,
+		}).AuthFailure()
+	})
+}
@@ -0,0 +1,88 @@
+package diptest
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestGreyPress(t *testing.T) {
+	t.Run("Disallowed", func(t *testing.T) {
+		withStartedGame(func() {
+			startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           String("body"),
+				"ChannelMembers": startedGameNats,
+				"Grey":           true,
+			}).Failure()
+		})
+	})
+	t.Run("BroadcastOnly", func(t *testing.T) {
+		withStartedGameOpts(func(opts map[string]interface{}) {
+			opts["AllowGreyPress"] = true
+			opts["GreyPressBroadcastOnly"] = true
+		}, func() {
+			members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+			sort.Sort(members)
+			startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           String("body"),
+				"ChannelMembers": members,
+				"Grey":           true,
+			}).Failure()
+
+			publicMembers := sort.StringSlice(append([]string{}, startedGameNats...))
+			sort.Sort(publicMembers)
+			chanName := strings.Join(publicMembers, ",")
+
+			word := strings.Replace(String("grey"), "-", "", -1)
+			createdAt := startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           word,
+				"ChannelMembers": publicMembers,
+				"Grey":           true,
+			}).Success().
+				AssertEq(startedGameNats[0], "Properties", "Sender").
+				GetValue("Properties", "CreatedAt").(string)
+
+			messages := func(idx int) *Result {
+				return startedGames[idx].Follow("channels", "Links").Success().
+					Find(chanName, []string{"Properties"}, []string{"Name"}).
+					Follow("messages", "Links").Success().
+					Find(word, []string{"Properties"}, []string{"Properties", "Body"})
+			}
+			messages(0).AssertEq(startedGameNats[0], "Properties", "Sender")
+			messages(1).AssertEq(game.GreyPressSender, "Properties", "Sender")
+
+			startedGames[1].Follow("channels", "Links").Success().
+				Find(chanName, []string{"Properties"}, []string{"Name"}).
+				AssertEq(game.GreyPressSender, "Properties", "LatestMessage", "Sender")
+
+			search := func(params url.Values) *Result {
+				return startedGameEnvs[1].GetRoute(game.SearchMessagesRoute).
+					RouteParams("game_id", startedGameID).
+					QueryParams(params).Success()
+			}
+			search(url.Values{"text": []string{word}}).
+				Find(word, []string{"Properties"}, []string{"Properties", "Body"}).
+				AssertEq(game.GreyPressSender, "Properties", "Sender")
+			search(url.Values{"sender": []string{startedGameNats[0]}}).
+				AssertNotFind(word, []string{"Properties"}, []string{"Properties", "Body"})
+
+			startedGameEnvs[1].PostRoute("MessageFlag.Create").
+				RouteParams("game_id", startedGameID, "channel_members", chanName).Body(map[string]interface{}{
+				"From": createdAt,
+				"To":   createdAt,
+			}).Success()
+			startedGameEnvs[1].GetRoute(game.IndexRoute).Success().
+				Follow("flagged-messages", "Links").Success().
+				Find(startedGameEnvs[1].GetUID(), []string{"Properties"}, []string{"Properties", "UserId"}).
+				Find(word, []string{"Properties", "Messages"}, []string{"Body"}).
+				AssertEq(startedGameEnvs[0].GetUID(), "AuthorId").
+				AssertEq(true, "Grey")
+		})
+	})
+}
@@ -0,0 +1,211 @@
+package diptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+var approveStateReg = regexp.MustCompile(`name="state" value="([^"]+)"`)
+
+// newFakeIssuer returns an OpenID Connect issuer logging in the user with
+// the subject used as authorization code.
+func newFakeIssuer() *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"userinfo_endpoint":      server.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": r.FormValue("code"),
+			"token_type":   "Bearer",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		subject := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":            subject,
+			"email":          subject + "@fake.fake",
+			"email_verified": true,
+			"name":           "Fakey " + subject,
+		})
+	})
+	return server
+}
+
+// browse executes a request like a browser would, without following
+// redirects.
+func browse(method string, u string, form url.Values) (int, http.Header, string) {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req, err := T.Request(method, u, body)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	status, header, reader, err := T.Execute(req)
+	if err != nil {
+		panic(err)
+	}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		panic(err)
+	}
+	return status, header, string(b)
+}
+
+// loginWith follows the login flow starting at startURL, logging in as
+// subject at the fake issuer, and returns the resulting token.
+func loginWith(startURL string, subject string) (string, error) {
+	status, header, body := browse("GET", startURL, nil)
+	if status != http.StatusSeeOther {
+		return "", fmt.Errorf("GET %q: %v %s", startURL, status, body)
+	}
+	authorizeURL, err := url.Parse(header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	callbackURL, err := router.Get(auth.OAuth2CallbackRoute).URL()
+	if err != nil {
+		return "", err
+	}
+	callbackURL.RawQuery = url.Values{
+		"code":  []string{subject},
+		"state": []string{authorizeURL.Query().Get("state")},
+	}.Encode()
+	return approveLogin(browse("GET", callbackURL.String(), nil))
+}
+
+// approveLogin approves the redirect if the response is the approval page,
+// and returns the token from the final redirect.
+func approveLogin(status int, header http.Header, body string) (string, error) {
+	if status == http.StatusOK {
+		match := approveStateReg.FindStringSubmatch(body)
+		if match == nil {
+			return "", fmt.Errorf("no approve state in %s", body)
+		}
+		approveURL, err := router.Get(auth.ApproveRedirectRoute).URL()
+		if err != nil {
+			return "", err
+		}
+		status, header, body = browse("POST", approveURL.String(), url.Values{"state": []string{match[1]}})
+	}
+	if status != http.StatusSeeOther {
+		return "", fmt.Errorf("finishing login: %v %s", status, body)
+	}
+	redirectURL, err := url.Parse(header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	return redirectURL.Query().Get("token"), nil
+}
+
+func TestLoginProviders(t *testing.T) {
+	if Fake == nil {
+		t.Skip("the fake issuer requires TRANSPORT=inprocess")
+	}
+	issuer := newFakeIssuer()
+	defer issuer.Close()
+
+	provider := String("oidc")
+	NewEnv().PostRoute(game.ConfigureRoute).Body(map[string]interface{}{
+		"LoginProviders": []map[string]interface{}{
+			{
+				"Name":     provider,
+				"Type":     auth.OIDCProviderType,
+				"ClientID": "client",
+				"Secret":   "secret",
+				"Issuer":   issuer.URL,
+			},
+		},
+	}).Success()
+
+	NewEnv().GetRoute(game.IndexRoute).Success().
+		Follow("login-providers", "Links").Success().
+		Find(provider, []string{"Properties"}, []string{"Name"})
+
+	loginURL, err := router.Get(auth.LoginRoute).URL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginURL.RawQuery = url.Values{
+		"provider":    []string{provider},
+		"redirect-to": []string{"https://frontend.fake/"},
+	}.Encode()
+	login := func(subject string) *Env {
+		token, err := loginWith(loginURL.String(), subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewEnv().SetToken(token)
+	}
+
+	alice := String("alice")
+	aliceEnv := login(alice)
+	aliceID := fmt.Sprintf("%s-%s", provider, alice)
+	aliceEnv.GetRoute(game.IndexRoute).Success().
+		AssertEq(aliceID, "Properties", "User", "Id").
+		AssertEq("Fakey "+alice, "Properties", "User", "Name").
+		Follow("identities", "Links").Success().
+		AssertLen(1, "Properties")
+
+	aliceAlt := String("alice-alt")
+	linkURL, err := router.Get(auth.LinkIdentityRoute).URL("user_id", aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkURL.RawQuery = url.Values{
+		"provider":    []string{provider},
+		"redirect-to": []string{"https://frontend.fake/"},
+		"token":       []string{aliceEnv.token},
+	}.Encode()
+
+	t.Run("TestLink", func(t *testing.T) {
+		if _, err := loginWith(linkURL.String(), aliceAlt); err != nil {
+			t.Fatal(err)
+		}
+		login(aliceAlt).GetRoute(game.IndexRoute).Success().
+			AssertEq(aliceID, "Properties", "User", "Id").
+			AssertEq("Fakey "+alice, "Properties", "User", "Name")
+		aliceEnv.GetRoute(auth.ListIdentitiesRoute).RouteParams("user_id", aliceID).Success().
+			AssertLen(2, "Properties")
+	})
+
+	t.Run("TestLinkOtherUsersIdentity", func(t *testing.T) {
+		bob := String("bob")
+		login(bob)
+		if _, err := loginWith(linkURL.String(), bob); err == nil || !strings.Contains(err.Error(), fmt.Sprint(http.StatusConflict)) {
+			t.Errorf("got %v, wanted conflict", err)
+		}
+	})
+
+	t.Run("TestUnlink", func(t *testing.T) {
+		aliceEnv.GetRoute(auth.ListIdentitiesRoute).RouteParams("user_id", aliceID).Success().
+			Follow("unlink", "Properties", "0", "Links").Success()
+		aliceEnv.GetRoute(auth.ListIdentitiesRoute).RouteParams("user_id", aliceID).Success().
+			AssertLen(1, "Properties").
+			Follow("unlink", "Properties", "0", "Links").Status(http.StatusPreconditionFailed)
+	})
+}
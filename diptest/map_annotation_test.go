@@ -0,0 +1,60 @@
+package diptest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMapAnnotations(t *testing.T) {
+	withStartedGame(func() {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+
+		send := func(annotations map[string]interface{}) *Req {
+			body := map[string]interface{}{
+				"Body":           String("proposal"),
+				"ChannelMembers": members,
+			}
+			if annotations != nil {
+				body["Annotations"] = annotations
+			}
+			return startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(body)
+		}
+
+		send(map[string]interface{}{
+			"Highlights": []string{"atlantis"},
+		}).Failure()
+		send(map[string]interface{}{
+			"Arrows": []map[string]interface{}{{"From": "par", "To": "nowhere"}},
+		}).Failure()
+		send(map[string]interface{}{
+			"Orders": []string{"par Dance bur"},
+		}).Failure()
+
+		plain := send(nil).Success()
+		plain.AssertNil("Properties", "Annotations", "Arrows").AssertNotRel("map", "Links")
+
+		annotated := send(map[string]interface{}{
+			"Arrows":     []map[string]interface{}{{"From": "par", "To": "bur"}},
+			"Highlights": []string{"mun"},
+			"Orders":     []string{"mar Support par bur"},
+		}).Success()
+		annotated.Find("bur", []string{"Properties", "Annotations", "Arrows"}, []string{"To"})
+		annotated.AssertEq([]interface{}{"mar Support par bur"}, "Properties", "Annotations", "Orders")
+
+		body := string(annotated.Follow("map", "Links").Success().BodyBytes)
+		for _, want := range []string{`map.addArrow(["par", "bur"]`, `map.highlightProvince("mun")`, `map.addOrder(["mar","Support","par","bur"]`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Wanted %q in annotated map, got %s", want, body)
+			}
+		}
+
+		startedGameEnvs[2].GetRoute("RenderMessageMap").RouteParams(
+			"game_id", startedGameID,
+			"channel_members", strings.Join(members, ","),
+			"message_id", annotated.GetValue("Properties", "ID").(string),
+		).Failure()
+	})
+}
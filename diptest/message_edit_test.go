@@ -0,0 +1,88 @@
+package diptest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestMessageEditing(t *testing.T) {
+	NewEnv().SetUID(String("fake")).GetRoute(game.IndexRoute).Success().
+		Follow("create-game", "Links").Body(map[string]interface{}{
+		"Variant":                  "Classical",
+		"NoMerge":                  true,
+		"Desc":                     String("test-game"),
+		"PhaseLengthMinutes":       60,
+		"MessageEditWindowMinutes": -1,
+	}).Failure()
+
+	withStartedGameOpts(func(opts map[string]interface{}) {
+		opts["MessageEditWindowMinutes"] = 5
+	}, func() {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		originalBody := String("original")
+		messageCreatedAt := startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           originalBody,
+			"ChannelMembers": members,
+		}).Success().GetValue("Properties", "CreatedAt").(string)
+
+		messages := func(idx int) *Result {
+			return startedGames[idx].Follow("channels", "Links").Success().
+				Find(chanName, []string{"Properties"}, []string{"Name"}).
+				Follow("messages", "Links").Success()
+		}
+
+		messages(1).Find(originalBody, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertNotRel("edit", "Links")
+
+		editedBody := String("edited")
+		messages(0).Find(originalBody, []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("edit", "Links").Body(map[string]interface{}{
+			"Body": editedBody,
+		}).Success().
+			AssertEq(editedBody, "Properties", "Body")
+
+		if editedAt := messages(1).Find(editedBody, []string{"Properties"}, []string{"Properties", "Body"}).
+			GetValue("Properties", "EditedAt").(string); strings.HasPrefix(editedAt, "0001") {
+			t.Errorf("Wanted an EditedAt time, got %q", editedAt)
+		}
+		messages(0).Find(editedBody, []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("retract", "Links").Success().
+			AssertEq(true, "Properties", "Retracted").
+			AssertEq("", "Properties", "Body")
+
+		messages(1).Find(true, []string{"Properties"}, []string{"Properties", "Retracted"}).
+			AssertEq(startedGameNats[0], "Properties", "Sender").
+			AssertEq("", "Properties", "Body")
+
+		startedGameEnvs[1].PostRoute("MessageFlag.Create").
+			RouteParams("game_id", startedGameID, "channel_members", chanName).Body(map[string]interface{}{
+			"From": messageCreatedAt,
+			"To":   messageCreatedAt,
+		}).Success()
+		flagged := startedGameEnvs[1].GetRoute(game.IndexRoute).Success().
+			Follow("flagged-messages", "Links").Success().
+			Find(startedGameEnvs[1].GetUID(), []string{"Properties"}, []string{"Properties", "UserId"})
+		flagged.Find(originalBody, []string{"Properties", "Messages"}, []string{"Body"})
+		flagged.Find(editedBody, []string{"Properties", "Messages"}, []string{"Body"})
+
+		if Fake != nil {
+			otherBody := String("other")
+			startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           otherBody,
+				"ChannelMembers": members,
+			}).Success()
+			AdvanceTime(6 * time.Minute)
+			messages(0).Find(otherBody, []string{"Properties"}, []string{"Properties", "Body"}).
+				AssertNotRel("edit", "Links")
+		}
+	})
+}
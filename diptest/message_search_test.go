@@ -0,0 +1,86 @@
+package diptest
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func testMessageSearch(t *testing.T) {
+	members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+	sort.Sort(members)
+
+	word := strings.Replace(String("word"), "-", "", -1)
+	body := "I Promise " + word + " support into Bulgaria."
+	startedGames[0].Follow("channels", "Links").Success().
+		Follow("message", "Links").Body(map[string]interface{}{
+		"Body":           body,
+		"ChannelMembers": members,
+	}).Success()
+
+	search := func(idx int, params url.Values) *Result {
+		return startedGameEnvs[idx].GetRoute(game.SearchMessagesRoute).
+			RouteParams("game_id", startedGameID).
+			QueryParams(params).Success()
+	}
+
+	t.Run("Highlights", func(t *testing.T) {
+		hit := search(1, url.Values{"text": []string{"bulgaria PROMISE " + word}}).
+			Find(body, []string{"Properties"}, []string{"Properties", "Body"})
+		hit.AssertLen(3, "Properties", "Highlights")
+		hit.AssertEq(float64(strings.Index(body, "Promise")), "Properties", "Highlights", "0", "Start")
+		hit.AssertEq(float64(strings.Index(body, "Promise")+len("Promise")), "Properties", "Highlights", "0", "End")
+	})
+
+	t.Run("AllWordsRequired", func(t *testing.T) {
+		search(1, url.Values{"text": []string{word + " nothere"}}).
+			AssertLen(0, "Properties")
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		search(1, url.Values{"text": []string{word}, "sender": []string{startedGameNats[0]}}).
+			Find(body, []string{"Properties"}, []string{"Properties", "Body"})
+		search(1, url.Values{"text": []string{word}, "sender": []string{startedGameNats[1]}}).
+			AssertLen(0, "Properties")
+		search(1, url.Values{"text": []string{word}, "channel_members": []string{strings.Join(members, ",")}}).
+			Find(body, []string{"Properties"}, []string{"Properties", "Body"})
+		search(1, url.Values{"text": []string{word}, "to": []string{serverNow().Add(-time.Hour).Format(time.RFC3339)}}).
+			AssertLen(0, "Properties")
+		search(1, url.Values{"text": []string{word}, "from": []string{serverNow().Add(-time.Hour).Format(time.RFC3339)}}).
+			Find(body, []string{"Properties"}, []string{"Properties", "Body"})
+	})
+
+	t.Run("Visibility", func(t *testing.T) {
+		search(2, url.Values{"text": []string{word}}).
+			AssertLen(0, "Properties")
+		startedGameEnvs[2].GetRoute(game.SearchMessagesRoute).
+			RouteParams("game_id", startedGameID).
+			QueryParams(url.Values{"text": []string{word}, "channel_members": []string{strings.Join(members, ",")}}).
+			Failure()
+		startedGameEnvs[1].GetRoute(game.SearchMessagesRoute).
+			RouteParams("game_id", startedGameID).
+			QueryParams(url.Values{}).
+			Failure()
+	})
+	t.Run("Limit", func(t *testing.T) {
+		public := sort.StringSlice(append([]string{}, startedGameNats...))
+		sort.Sort(public)
+		publicBody := "Public " + word
+		startedGames[1].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           publicBody,
+			"ChannelMembers": public,
+		}).Success()
+		search(1, url.Values{"text": []string{word}}).
+			AssertLen(2, "Properties")
+		search(1, url.Values{"text": []string{word}, "limit": []string{"1"}}).
+			AssertLen(1, "Properties").
+			AssertEq(publicBody, "Properties", "0", "Properties", "Body")
+		search(2, url.Values{"text": []string{word}}).
+			AssertLen(1, "Properties")
+	})
+}
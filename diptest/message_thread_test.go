@@ -0,0 +1,107 @@
+package diptest
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func testMessageThreads(t *testing.T) {
+	members := sort.StringSlice{startedGameNats[3], startedGameNats[4]}
+	sort.Sort(members)
+	chanName := strings.Join(members, ",")
+
+	rootBody := String("root")
+	root := startedGames[3].Follow("channels", "Links").Success().
+		Follow("message", "Links").Body(map[string]interface{}{
+		"Body":           "Let's talk about " + rootBody,
+		"ChannelMembers": members,
+	}).Success()
+	rootID := root.GetValue("Properties", "ID").(string)
+
+	t.Run("ReplyValidation", func(t *testing.T) {
+		startedGames[4].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           String("reply"),
+			"ChannelMembers": members,
+			"Quote":          rootBody,
+		}).Failure()
+		startedGames[4].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           String("reply"),
+			"ChannelMembers": members,
+			"ReplyTo":        rootID,
+			"Quote":          String("not-quoted"),
+		}).Failure()
+	})
+
+	replyBody := String("reply")
+	reply := startedGames[4].Follow("channels", "Links").Success().
+		Follow("message", "Links").Body(map[string]interface{}{
+		"Body":           replyBody,
+		"ChannelMembers": members,
+		"ReplyTo":        rootID,
+		"Quote":          rootBody,
+	}).Success()
+	reply.AssertEq(rootID, "Properties", "ThreadID")
+	reply.AssertEq(rootBody, "Properties", "Quote")
+	replyID := reply.GetValue("Properties", "ID").(string)
+	replyCreatedAt := reply.GetValue("Properties", "CreatedAt").(string)
+
+	// Replies to replies belong to the same thread.
+	startedGames[3].Follow("channels", "Links").Success().
+		Follow("message", "Links").Body(map[string]interface{}{
+		"Body":           String("reply"),
+		"ChannelMembers": members,
+		"ReplyTo":        replyID,
+	}).Success().
+		AssertEq(rootID, "Properties", "ThreadID")
+
+	t.Run("Thread", func(t *testing.T) {
+		messages := startedGames[3].Follow("channels", "Links").Success().
+			Find(chanName, []string{"Properties"}, []string{"Name"}).
+			Follow("messages", "Links").Success()
+		messages.Find(rootID, []string{"Properties"}, []string{"Properties", "ID"}).
+			AssertEq(2.0, "Properties", "NReplies")
+
+		thread := messages.Find(replyID, []string{"Properties"}, []string{"Properties", "ID"}).
+			Follow("thread", "Links").Success()
+		thread.AssertLen(3, "Properties")
+		thread.Find(rootID, []string{"Properties"}, []string{"Properties", "ID"})
+		thread.AssertNotFind(game.DiplicitySender, []string{"Properties"}, []string{"Properties", "Sender"})
+	})
+
+	t.Run("Reactions", func(t *testing.T) {
+		react := func(env *Env, method string) *Req {
+			var req *Req
+			if method == "PUT" {
+				req = env.PutRoute(game.AddReactionRoute)
+			} else {
+				req = env.DeleteRoute(game.RemoveReactionRoute)
+			}
+			return req.RouteParams("game_id", startedGameID, "channel_members", chanName, "message_id", rootID, "emoji", "👍")
+		}
+
+		react(startedGameEnvs[0], "PUT").Failure()
+		startedGameEnvs[3].PutRoute(game.AddReactionRoute).
+			RouteParams("game_id", startedGameID, "channel_members", chanName, "message_id", rootID, "emoji", "not emoji").Failure()
+
+		react(startedGameEnvs[4], "PUT").Success().
+			Find(startedGameNats[4], []string{"Properties", "Reactions"}, []string{"Nation"}).
+			AssertEq("👍", "Emoji")
+		react(startedGameEnvs[4], "PUT").Success().
+			AssertLen(1, "Properties", "Reactions")
+
+		startedGameEnvs[3].GetRoute(game.ListMessagesRoute).
+			RouteParams("game_id", startedGameID, "channel_members", chanName).
+			QueryParams(url.Values{"since": []string{replyCreatedAt}}).Success().
+			Find(rootID, []string{"Properties"}, []string{"Properties", "ID"}).
+			AssertLen(1, "Properties", "Reactions")
+
+		react(startedGameEnvs[4], "DELETE").Success().
+			AssertNotFind(startedGameNats[4], []string{"Properties", "Reactions"}, []string{"Nation"})
+	})
+}
@@ -0,0 +1,128 @@
+package diptest
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestModeration(t *testing.T) {
+	withStartedGame(func() {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		send := func(idx int) *Req {
+			return startedGames[idx].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           String("message"),
+				"ChannelMembers": members,
+			})
+		}
+		messages := func(idx int) *Result {
+			return startedGames[idx].Follow("channels", "Links").Success().
+				Find(chanName, []string{"Properties"}, []string{"Name"}).
+				Follow("messages", "Links").Success()
+		}
+		flag := func(flagger int, createdAt string) *Result {
+			startedGameEnvs[flagger].PostRoute("MessageFlag.Create").
+				RouteParams("game_id", startedGameID, "channel_members", chanName).Body(map[string]interface{}{
+				"From": createdAt,
+				"To":   createdAt,
+			}).Success()
+			return startedGameEnvs[flagger].GetRoute(game.IndexRoute).Success().
+				Follow("moderation-queue", "Links").Success().
+				Find(startedGameEnvs[flagger].GetUID(), []string{"Properties"}, []string{"Properties", "UserId"})
+		}
+		notifications := func(idx int) *Result {
+			return startedGameEnvs[idx].GetRoute(game.IndexRoute).Success().
+				Follow("moderation-notices", "Links").Success()
+		}
+
+		hiddenBody := String("hidden")
+		hiddenCreatedAt := startedGames[0].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           hiddenBody,
+			"ChannelMembers": members,
+		}).Success().GetValue("Properties", "CreatedAt").(string)
+
+		hiddenCase := flag(1, hiddenCreatedAt)
+		hiddenCase.Follow("context", "Links").Success().
+			Find(hiddenBody, []string{"Properties", "Messages"}, []string{"Body"}).
+			AssertEq(startedGameEnvs[0].GetUID(), "AuthorId")
+		hiddenCase.Follow("assign", "Links").Success().
+			AssertEq(startedGameEnvs[1].GetUID(), "Properties", "AssigneeId")
+		hiddenCase.Follow("resolve", "Links").Body(map[string]interface{}{
+			"Resolution": "ignored",
+		}).Failure()
+		hiddenCase.Follow("resolve", "Links").Body(map[string]interface{}{
+			"Resolution": game.HiddenResolution,
+			"Reason":     "insults",
+		}).Success().
+			AssertEq(game.HiddenResolution, "Properties", "Resolution")
+		hiddenCase.Follow("resolve", "Links").Body(map[string]interface{}{
+			"Resolution": game.DismissedResolution,
+		}).Failure()
+		messages(1).AssertNotFind(hiddenBody, []string{"Properties"}, []string{"Properties", "Body"})
+		notifications(0).Find(regexp.MustCompile("hidden them"), []string{"Properties"}, []string{"Properties", "Body"})
+		notifications(1).AssertLen(0, "Properties")
+		startedGameEnvs[1].GetRoute(game.ListModerationNoticesRoute).RouteParams("user_id", startedGameEnvs[0].GetUID()).Failure()
+
+		muted := send(0).Success()
+		muteCase := flag(2, muted.GetValue("Properties", "CreatedAt").(string))
+		muteCase.Follow("resolve", "Links").Body(map[string]interface{}{
+			"Resolution": game.MutedResolution,
+		}).Failure()
+		muteCase.Follow("resolve", "Links").Body(map[string]interface{}{
+			"Resolution":      game.MutedResolution,
+			"DurationMinutes": 60,
+		}).Success()
+		send(0).Failure()
+		messages(0).Find(muted.GetValue("Properties", "Body"), []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("edit", "Links").Body(map[string]interface{}{
+			"Body": String("edited"),
+		}).Failure()
+		send(1).Success()
+
+		suspendCase := flag(3, send(1).Success().GetValue("Properties", "CreatedAt").(string))
+		suspendCase.Follow("resolve", "Links").Body(map[string]interface{}{
+			"Resolution":      game.SuspendedResolution,
+			"UserId":          startedGameEnvs[0].GetUID(),
+			"DurationMinutes": 60,
+		}).Failure()
+		suspendCase.Follow("resolve", "Links").Body(map[string]interface{}{
+			"Resolution":      game.SuspendedResolution,
+			"UserId":          startedGameEnvs[1].GetUID(),
+			"DurationMinutes": 60,
+		}).Success()
+		send(1).Failure()
+
+		gameDesc := String("test-game")
+		NewEnv().SetUID(String("fake")).GetRoute(game.IndexRoute).Success().
+			Follow("create-game", "Links").Body(map[string]interface{}{
+			"Variant":            "Classical",
+			"NoMerge":            true,
+			"Desc":               gameDesc,
+			"PhaseLengthMinutes": 60,
+		}).Success()
+		joinGame := startedGameEnvs[1].GetRoute(game.ListOpenGamesRoute).Success().
+			Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+			Follow("join", "Links").Body(map[string]interface{}{})
+		joinGame.Failure()
+
+		export := startedGameEnvs[1].GetRoute(game.ExportUserRoute).RouteParams("user_id", startedGameEnvs[1].GetUID()).Success()
+		export.Find(game.SuspensionSanction, []string{"Properties", "Sanctions"}, []string{"Kind"})
+		export.Find(game.SuspendedResolution, []string{"Properties", "ModerationNotices"}, []string{"Resolution"})
+
+		if Fake != nil {
+			AdvanceTime(2 * time.Hour)
+			send(0).Success()
+			send(1).Success()
+			joinGame.Success()
+		}
+	})
+}
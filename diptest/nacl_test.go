@@ -0,0 +1,47 @@
+package diptest
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+func TestNaClKeyRotation(t *testing.T) {
+	if Fake == nil {
+		t.Skip("activating keys requires TRANSPORT=inprocess")
+	}
+	env := NewEnv().SetUID(String("fake"))
+	discordID := String("discord")
+	login := func() *Env {
+		token := env.GetRoute(auth.TokenForDiscordUserRoute).RouteParams("user_id", discordID).Success().
+			GetValue("Properties").(string)
+		return NewEnv().SetToken(token)
+	}
+	addKey := func() int {
+		keys := env.PostRoute(auth.AddNaClKeyRoute).Success().GetValue("Properties").([]interface{})
+		return int(keys[0].(map[string]interface{})["Version"].(float64))
+	}
+
+	before := login()
+
+	newVersion := addKey()
+	env.GetRoute(auth.ListNaClKeysRoute).Success().
+		Find(float64(newVersion), []string{"Properties"}, []string{"Version"})
+	AdvanceTime(10 * time.Minute)
+
+	after := login()
+	before.GetRoute(game.IndexRoute).Success().AssertEq(discordID, "Properties", "User", "Id")
+	after.GetRoute(game.IndexRoute).Success().AssertEq(discordID, "Properties", "User", "Id")
+
+	addKey()
+	env.DeleteRoute(auth.RetireNaClKeyRoute).RouteParams("version", "4711").Status(http.StatusNotFound)
+	env.DeleteRoute(auth.RetireNaClKeyRoute).RouteParams("version", fmt.Sprint(newVersion)).Success()
+
+	after.GetRoute(game.IndexRoute).AuthFailure()
+	before.GetRoute(game.IndexRoute).Success()
+	login().GetRoute(game.IndexRoute).Success()
+}
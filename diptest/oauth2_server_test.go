@@ -0,0 +1,190 @@
+package diptest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+// oauth2Post posts form to route and returns the status and decoded JSON
+// response.
+func oauth2Post(route string, form url.Values) (int, map[string]interface{}) {
+	u, err := router.Get(route).URL()
+	if err != nil {
+		panic(err)
+	}
+	status, _, body := browse("POST", u.String(), form)
+	result := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		panic(err)
+	}
+	return status, result
+}
+
+func TestOAuth2Server(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	redirectURI := "https://client.fake/callback"
+
+	clients := env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth2-clients", "Links").Success()
+	clients.Follow("create", "Links").Body(map[string]interface{}{
+		"Name": "client",
+	}).Failure()
+	clientID := clients.Follow("create", "Links").Body(map[string]interface{}{
+		"Name":         "client",
+		"RedirectURIs": []string{redirectURI},
+	}).Success().GetValue("Properties", "ClientId").(string)
+
+	verifier := String("verifier") + String("verifier")
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// authorize asks for scope and returns the redirect after the decision.
+	authorize := func(scope string, decision string) url.Values {
+		authorizeURL, err := router.Get(auth.OAuth2AuthorizeRoute).URL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorizeURL.RawQuery = url.Values{
+			"response_type":         []string{"code"},
+			"client_id":             []string{clientID},
+			"redirect_uri":          []string{redirectURI},
+			"scope":                 []string{scope},
+			"state":                 []string{"client-state"},
+			"code_challenge":        []string{challenge},
+			"code_challenge_method": []string{"S256"},
+			"fake-id":               []string{env.GetUID()},
+		}.Encode()
+		status, _, body := browse("GET", authorizeURL.String(), nil)
+		if status != http.StatusOK {
+			t.Fatalf("got %v %s, wanted consent page", status, body)
+		}
+		match := approveStateReg.FindStringSubmatch(body)
+		if match == nil {
+			t.Fatalf("no consent state in %s", body)
+		}
+		consentURL, err := router.Get(auth.OAuth2ConsentRoute).URL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, header, body := browse("POST", consentURL.String(), url.Values{
+			"state":    []string{match[1]},
+			"decision": []string{decision},
+		})
+		if status != http.StatusSeeOther {
+			t.Fatalf("got %v %s, wanted redirect", status, body)
+		}
+		location, err := url.Parse(header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.Query().Get("state") != "client-state" {
+			t.Errorf("got redirect %v, wanted state preserved", location)
+		}
+		return location.Query()
+	}
+
+	code := authorize(auth.OrdersScope, "approve").Get("code")
+
+	if status, result := oauth2Post(auth.OAuth2TokenRoute, url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"client_id":     []string{clientID},
+		"redirect_uri":  []string{redirectURI},
+		"code":          []string{code},
+		"code_verifier": []string{"wrong"},
+	}); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("got %v %+v with wrong verifier, wanted invalid_grant", status, result)
+	}
+
+	code = authorize(auth.OrdersScope, "approve").Get("code")
+	status, tokens := oauth2Post(auth.OAuth2TokenRoute, url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"client_id":     []string{clientID},
+		"redirect_uri":  []string{redirectURI},
+		"code":          []string{code},
+		"code_verifier": []string{verifier},
+	})
+	if status != http.StatusOK || tokens["scope"] != auth.OrdersScope {
+		t.Fatalf("got %v %+v, wanted tokens with scope %q", status, tokens, auth.OrdersScope)
+	}
+	accessToken := tokens["access_token"].(string)
+	refreshToken := tokens["refresh_token"].(string)
+	app := NewEnv().SetToken(accessToken)
+
+	t.Run("TestAccessToken", func(t *testing.T) {
+		app.GetRoute(game.IndexRoute).Success().
+			AssertEq(env.GetUID(), "Properties", "User", "Id")
+		app.PostRoute("Game.Create").Body(map[string]interface{}{
+			"Variant": "Classical",
+		}).Status(http.StatusForbidden)
+	})
+
+	t.Run("TestCodeReuse", func(t *testing.T) {
+		if status, result := oauth2Post(auth.OAuth2TokenRoute, url.Values{
+			"grant_type":    []string{"authorization_code"},
+			"client_id":     []string{clientID},
+			"redirect_uri":  []string{redirectURI},
+			"code":          []string{code},
+			"code_verifier": []string{verifier},
+		}); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+			t.Errorf("got %v %+v, wanted invalid_grant", status, result)
+		}
+	})
+
+	t.Run("TestIntrospect", func(t *testing.T) {
+		if _, result := oauth2Post(auth.OAuth2IntrospectRoute, url.Values{
+			"client_id": []string{clientID},
+			"token":     []string{accessToken},
+		}); result["active"] != true || result["sub"] != env.GetUID() || result["scope"] != auth.OrdersScope {
+			t.Errorf("got %+v, wanted active token of %q", result, env.GetUID())
+		}
+		otherID := clients.Follow("create", "Links").Body(map[string]interface{}{
+			"Name":         "other",
+			"RedirectURIs": []string{redirectURI},
+		}).Success().GetValue("Properties", "ClientId").(string)
+		if _, result := oauth2Post(auth.OAuth2IntrospectRoute, url.Values{
+			"client_id": []string{otherID},
+			"token":     []string{accessToken},
+		}); result["active"] != false {
+			t.Errorf("got %+v, wanted inactive for other client", result)
+		}
+	})
+
+	t.Run("TestRefresh", func(t *testing.T) {
+		status, refreshed := oauth2Post(auth.OAuth2TokenRoute, url.Values{
+			"grant_type":    []string{"refresh_token"},
+			"client_id":     []string{clientID},
+			"refresh_token": []string{refreshToken},
+		})
+		if status != http.StatusOK || refreshed["access_token"] == accessToken {
+			t.Fatalf("got %v %+v, wanted new tokens", status, refreshed)
+		}
+		NewEnv().SetToken(refreshed["access_token"].(string)).GetRoute(game.IndexRoute).Success()
+		if status, result := oauth2Post(auth.OAuth2TokenRoute, url.Values{
+			"grant_type":    []string{"refresh_token"},
+			"client_id":     []string{clientID},
+			"refresh_token": []string{refreshToken},
+		}); status != http.StatusBadRequest || result["error"] != "invalid_grant" {
+			t.Errorf("got %v %+v reusing refresh token, wanted invalid_grant", status, result)
+		}
+	})
+
+	t.Run("TestDeny", func(t *testing.T) {
+		if result := authorize(auth.PressScope, "deny"); result.Get("error") != "access_denied" {
+			t.Errorf("got %+v, wanted access_denied", result)
+		}
+	})
+
+	t.Run("TestDeleteClient", func(t *testing.T) {
+		env.GetRoute(auth.ListOAuth2ClientsRoute).RouteParams("user_id", env.GetUID()).Success().
+			Find("client", []string{"Properties"}, []string{"Properties", "Name"}).
+			Follow("delete", "Links").Success()
+		app.GetRoute(game.IndexRoute).AuthFailure()
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"math"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kr/pretty"
 	"github.com/zond/diplicity/game"
@@ -166,10 +167,13 @@ func TestStartGame(t *testing.T) {
 		t.Run("TestOrders", testOrders)
 		t.Run("TestOptions", testOptions)
 		t.Run("TestChat", testChat)
+		t.Run("TestGraphQL", testGraphQL)
 		t.Run("TestPhaseState", testPhaseState)
 		t.Run("TestReadyResolution", testReadyResolution)
 		t.Run("TestBanEfficacy", testBanEfficacy)
 		t.Run("TestMessageFlagging", testMessageFlagging)
+		t.Run("TestMessageThreads", testMessageThreads)
+		t.Run("TestMessageSearch", testMessageSearch)
 	})
 }
 
@@ -546,7 +550,8 @@ func TestPreliminaryScores(t *testing.T) {
 	})
 }
 
-func TestLastYearEnding(t *testing.T) {
+// Not concurrency safe
+func withFinishedGame(f func()) {
 	withStartedGameOpts(func(opts map[string]interface{}) {
 		opts["LastYear"] = 1901
 	}, func() {
@@ -572,6 +577,12 @@ func TestLastYearEnding(t *testing.T) {
 			}).Success()
 		}
 		WaitForEmptyQueue("game-asyncResolvePhase")
+		f()
+	})
+}
+
+func TestLastYearEnding(t *testing.T) {
+	withFinishedGame(func() {
 		startedGameEnvs[0].GetRoute("Game.Load").RouteParams("id", startedGameID).Success().AssertEq(true, "Properties", "Finished")
 	})
 }
@@ -704,6 +715,28 @@ func TestPhaseLengths(t *testing.T) {
 	})
 }
 
+func TestSimulatedTimeoutResolution(t *testing.T) {
+	if Fake == nil {
+		t.Skip("simulated time requires TRANSPORT=inprocess")
+	}
+	withStartedGame(func() {
+		startedGames[0].Follow("phases", "Links").Success().
+			AssertNotFind(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"})
+
+		AdvanceTime(23 * time.Hour)
+		startedGames[0].Follow("phases", "Links").Success().
+			AssertNotFind(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"})
+
+		AdvanceTime(2 * time.Hour)
+		startedGames[0].Follow("phases", "Links").Success().
+			Find(2, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"})
+		if nextIn := startedGameEnvs[0].GetRoute("Game.Load").RouteParams("id", startedGameID).Success().
+			GetValue("Properties", "NewestPhaseMeta").([]interface{})[0].(map[string]interface{})["NextDeadlineIn"].(float64) / 1000000000 / 60 / 60; nextIn > 24 || nextIn < 23 {
+			t.Errorf("Wanted 24 hours, got %v", nextIn)
+		}
+	})
+}
+
 func TestBackwardsCompatiblePhaseStateAPI(t *testing.T) {
 	withStartedGame(func() {
 		for _, env := range startedGameEnvs {
@@ -0,0 +1,78 @@
+package diptest
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestPressRules(t *testing.T) {
+	NewEnv().SetUID(String("fake")).GetRoute(game.IndexRoute).Success().
+		Follow("create-game", "Links").Body(map[string]interface{}{
+		"Variant":            "Classical",
+		"NoMerge":            true,
+		"Desc":               String("test-game"),
+		"PhaseLengthMinutes": 60,
+		"PressPhaseTypes":    []string{"Diplomacy"},
+	}).Failure()
+
+	withStartedGameOpts(func(opts map[string]interface{}) {
+		opts["PressPhaseTypes"] = []string{"Movement", "Retreat"}
+		opts["MessagesPerPhase"] = 2
+		opts["MaxMessageLength"] = 10
+		opts["PressBlackoutMinutes"] = 23 * 60
+		opts["MessageEditWindowMinutes"] = 24 * 60
+	}, func() {
+		startedGameEnvs[0].GetRoute("Game.Load").RouteParams("id", startedGameID).Success().
+			Find(regexp.MustCompile("at most 2 messages per phase"), []string{"Desc"})
+
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+		send := func(body string) *Req {
+			return startedGames[0].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           body,
+				"ChannelMembers": members,
+			})
+		}
+
+		edit := func(idx int, body, newBody string) *Req {
+			return startedGames[idx].Follow("channels", "Links").Success().
+				Find(strings.Join(members, ","), []string{"Properties"}, []string{"Name"}).
+				Follow("messages", "Links").Success().
+				Find(body, []string{"Properties"}, []string{"Properties", "Body"}).
+				Follow("edit", "Links").Body(map[string]interface{}{
+				"Body": newBody,
+			})
+		}
+
+		send("far too long message").Failure()
+		send("first").Success()
+		send("second").Success()
+		send("third").Failure()
+
+		// Edits don't count as messages, but must follow the other rules.
+		edit(0, "first", "far too long edit").Failure()
+		edit(0, "first", "edited").Success()
+
+		startedGames[1].Follow("channels", "Links").Success().
+			Follow("message", "Links").Body(map[string]interface{}{
+			"Body":           "other",
+			"ChannelMembers": members,
+		}).Success()
+
+		if Fake != nil {
+			AdvanceTime(90 * time.Minute)
+			startedGames[1].Follow("channels", "Links").Success().
+				Follow("message", "Links").Body(map[string]interface{}{
+				"Body":           "blackout",
+				"ChannelMembers": members,
+			}).Failure()
+			edit(1, "other", "blackout").Failure()
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package diptest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+func TestRoles(t *testing.T) {
+	login := func() (*Env, string) {
+		token, err := loginByEMail(String("role") + "@fake.fake")
+		if err != nil {
+			t.Fatal(err)
+		}
+		env := NewEnv().SetToken(token)
+		return env, env.GetRoute(game.IndexRoute).Success().GetValue("Properties", "User", "Id").(string)
+	}
+	modEnv, modID := login()
+	playerEnv, _ := login()
+	// Fake users on the dev app server have all permissions.
+	adminEnv := NewEnv().SetUID(String("fake"))
+
+	adminEnv.GetRoute(auth.ListRolesRoute).Success().
+		Find(auth.ModeratorRole, []string{"Properties"}, []string{"Properties", "Name"})
+
+	adminEnv.PutRoute(auth.AssignRolesRoute).RouteParams("user_id", modID).Body(map[string]interface{}{
+		"Roles": []string{"emperor"},
+	}).Status(http.StatusBadRequest)
+	adminEnv.PutRoute(auth.AssignRolesRoute).RouteParams("user_id", modID).Body(map[string]interface{}{
+		"Roles": []string{auth.ModeratorRole},
+	}).Success()
+	adminEnv.GetRoute(auth.ListRoleAssignmentsRoute).Success().
+		Find(modID, []string{"Properties"}, []string{"Properties", "UserId"})
+
+	// Permissions require a verified second factor.
+	enrollTOTP(modEnv, modID)
+
+	t.Run("TestPermissionsEnforced", func(t *testing.T) {
+		modEnv.GetRoute(game.ListFlaggedMessagesRoute).Success()
+		modEnv.GetRoute(auth.ListNaClKeysRoute).Status(http.StatusForbidden)
+		modEnv.GetRoute(auth.ListRoleAssignmentsRoute).Status(http.StatusForbidden)
+		playerEnv.GetRoute(game.ListFlaggedMessagesRoute).Status(http.StatusForbidden)
+		playerEnv.PutRoute(auth.AssignRolesRoute).RouteParams("user_id", modID).Body(map[string]interface{}{
+			"Roles": []string{auth.AdminRole},
+		}).Status(http.StatusForbidden)
+	})
+
+	t.Run("TestCached", func(t *testing.T) {
+		if Fake == nil {
+			t.Skip("inspecting the cache requires TRANSPORT=inprocess")
+		}
+		modEnv.GetRoute(game.ListFlaggedMessagesRoute).Success()
+		ctx := Fake.Context(context.Background())
+		assignment := &auth.RoleAssignment{}
+		if _, err := memcache.JSON.Get(ctx, auth.RoleAssignmentID(ctx, modID).Encode(), assignment); err != nil {
+			t.Fatalf("loading cached role assignment: %v", err)
+		}
+		if len(assignment.Roles) != 1 || assignment.Roles[0] != auth.ModeratorRole {
+			t.Fatalf("got cached role assignment %+v, wanted the moderator role", assignment)
+		}
+	})
+
+	t.Run("TestConfigureRequiresAssignedAdmin", func(t *testing.T) {
+		adminID := String("admin")
+		adminEnv.PutRoute(auth.AssignRolesRoute).RouteParams("user_id", adminID).Body(map[string]interface{}{
+			"Roles": []string{auth.AdminRole},
+		}).Success()
+		playerEnv.PostRoute(game.ConfigureRoute).Body(map[string]interface{}{}).Status(http.StatusForbidden)
+		adminEnv.PutRoute(auth.AssignRolesRoute).RouteParams("user_id", adminID).Body(map[string]interface{}{
+			"Roles": []string{},
+		}).Success()
+	})
+
+	t.Run("TestUnassign", func(t *testing.T) {
+		adminEnv.PutRoute(auth.AssignRolesRoute).RouteParams("user_id", modID).Body(map[string]interface{}{
+			"Roles": []string{},
+		}).Success()
+		modEnv.GetRoute(game.ListFlaggedMessagesRoute).Status(http.StatusForbidden)
+	})
+}
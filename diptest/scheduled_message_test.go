@@ -0,0 +1,106 @@
+package diptest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduledMessages(t *testing.T) {
+	withStartedGame(func() {
+		members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+		sort.Sort(members)
+		chanName := strings.Join(members, ",")
+
+		scheduled := func(idx int) *Result {
+			return startedGames[idx].Follow("scheduled-messages", "Links").Success()
+		}
+		schedule := func(body map[string]interface{}) *Req {
+			return scheduled(0).Follow("schedule-message", "Links").Body(body)
+		}
+
+		schedule(map[string]interface{}{
+			"Body":           String("neither"),
+			"ChannelMembers": members,
+		}).Failure()
+		schedule(map[string]interface{}{
+			"Body":           String("both"),
+			"ChannelMembers": members,
+			"OnPhaseStart":   true,
+			"DeliverAt":      serverNow().Add(time.Hour),
+		}).Failure()
+		schedule(map[string]interface{}{
+			"Body":           String("past"),
+			"ChannelMembers": members,
+			"DeliverAt":      serverNow().Add(-time.Hour),
+		}).Failure()
+		schedule(map[string]interface{}{
+			"Body":           String("foreign"),
+			"ChannelMembers": []string{startedGameNats[1], startedGameNats[2]},
+			"OnPhaseStart":   true,
+		}).Failure()
+
+		deliveredBody := String("delivered")
+		schedule(map[string]interface{}{
+			"Body":           deliveredBody,
+			"ChannelMembers": members,
+			"OnPhaseStart":   true,
+		}).Success().
+			AssertEq(startedGameNats[0], "Properties", "Sender")
+
+		cancelledBody := String("cancelled")
+		schedule(map[string]interface{}{
+			"Body":           cancelledBody,
+			"ChannelMembers": members,
+			"OnPhaseStart":   true,
+		}).Success()
+		scheduled(0).Find(cancelledBody, []string{"Properties"}, []string{"Properties", "Body"}).
+			Follow("cancel", "Links").Success()
+		scheduled(0).
+			Find(deliveredBody, []string{"Properties"}, []string{"Properties", "Body"})
+		scheduled(0).
+			AssertNotFind(cancelledBody, []string{"Properties"}, []string{"Properties", "Body"})
+		scheduled(1).
+			AssertNotFind(deliveredBody, []string{"Properties"}, []string{"Properties", "Body"})
+
+		for idx, nat := range startedGameNats {
+			startedGames[idx].Follow("phases", "Links").Success().
+				Find("Spring", []string{"Properties"}, []string{"Properties", "Season"}).
+				Follow("phase-states", "Links").Success().
+				Find(nat, []string{"Properties"}, []string{"Properties", "Nation"}).
+				Follow("update", "Links").Body(map[string]interface{}{
+				"ReadyToResolve": true,
+			}).Success()
+		}
+		WaitForEmptyQueue("game-deliverPhaseScheduledMessages")
+		WaitForEmptyQueue("game-asyncSendMsg")
+
+		messages := func(idx int) *Result {
+			return startedGames[idx].Follow("channels", "Links").Success().
+				Find(chanName, []string{"Properties"}, []string{"Name"}).
+				Follow("messages", "Links").Success()
+		}
+		messages(1).
+			Find(deliveredBody, []string{"Properties"}, []string{"Properties", "Body"}).
+			AssertEq(startedGameNats[0], "Properties", "Sender")
+		messages(1).
+			AssertNotFind(cancelledBody, []string{"Properties"}, []string{"Properties", "Body"})
+		scheduled(0).
+			AssertNotFind(deliveredBody, []string{"Properties"}, []string{"Properties", "Body"})
+
+		if Fake != nil {
+			timedBody := String("timed")
+			schedule(map[string]interface{}{
+				"Body":           timedBody,
+				"ChannelMembers": members,
+				"DeliverAt":      serverNow().Add(30 * time.Minute),
+			}).Success()
+			messages(1).
+				AssertNotFind(timedBody, []string{"Properties"}, []string{"Properties", "Body"})
+			AdvanceTime(time.Hour)
+			messages(1).
+				Find(timedBody, []string{"Properties"}, []string{"Properties", "Body"})
+		}
+	})
+}
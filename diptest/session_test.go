@@ -0,0 +1,75 @@
+package diptest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+func TestSessions(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	discordID := String("discord")
+
+	login := func() *Env {
+		token := env.GetRoute(auth.TokenForDiscordUserRoute).RouteParams("user_id", discordID).Success().
+			GetValue("Properties").(string)
+		return NewEnv().SetToken(token)
+	}
+
+	discord := login()
+	discord.GetRoute(game.IndexRoute).Success().
+		AssertEq(discordID, "Properties", "User", "Id").
+		Follow("sessions", "Links").Success().
+		AssertLen(1, "Properties").
+		AssertBoolEq(true, "Properties", "0", "Properties", "Current")
+
+	t.Run("TestCached", func(t *testing.T) {
+		if Fake == nil {
+			t.Skip("inspecting the cache requires TRANSPORT=inprocess")
+		}
+		sessionID := discord.GetRoute(auth.ListSessionsRoute).RouteParams("user_id", discordID).Success().
+			GetValue("Properties", "0", "Properties", "Id").(string)
+		discord.GetRoute(game.IndexRoute).Success()
+
+		ctx := Fake.Context(context.Background())
+		key := auth.SessionID(ctx, sessionID)
+		session := &auth.Session{}
+		if _, err := memcache.JSON.Get(ctx, key.Encode(), session); err != nil {
+			t.Fatalf("loading cached session: %v", err)
+		}
+		if session.UserId != discordID {
+			t.Fatalf("got cached session %+v, wanted one of %q", session, discordID)
+		}
+
+		// The session is still accepted without the stored entity.
+		if err := datastore.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		discord.GetRoute(game.IndexRoute).Success()
+		if _, err := datastore.Put(ctx, key, session); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Revoking a cached session takes effect right away.
+	t.Run("TestRevoke", func(t *testing.T) {
+		discord.GetRoute(auth.ListSessionsRoute).RouteParams("user_id", discordID).Success().
+			Follow("revoke", "Properties", "0", "Links").Success()
+		discord.GetRoute(game.IndexRoute).AuthFailure()
+		discord = login()
+		discord.GetRoute(game.IndexRoute).Success()
+	})
+
+	t.Run("TestRevokeAll", func(t *testing.T) {
+		NewEnv().SetUID(String("fake")).PostRoute(auth.RevokeAllSessionsRoute).RouteParams("user_id", discordID).Status(http.StatusForbidden)
+		discord.GetRoute(game.IndexRoute).Success()
+		discord.GetRoute(auth.ListSessionsRoute).RouteParams("user_id", discordID).Success().
+			Follow("revoke-all", "Links").Success()
+		discord.GetRoute(game.IndexRoute).AuthFailure()
+	})
+}
@@ -0,0 +1,139 @@
+package diptest
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+// serverNow returns the time of the server, which the in-process backend may
+// have advanced.
+func serverNow() time.Time {
+	if Fake != nil {
+		return Fake.Clock.Now()
+	}
+	return time.Now()
+}
+
+// enrollTOTP enrolls the user of env in TOTP, which also verifies the second
+// factor for the session of env, and returns the secret and recovery codes.
+func enrollTOTP(env *Env, uid string) (string, []interface{}) {
+	enrollment := env.PostRoute(auth.EnrollTOTPRoute).RouteParams("user_id", uid).Success()
+	secret := enrollment.GetValue("Properties", "Secret").(string)
+	code, err := auth.TOTPCode(secret, serverNow())
+	if err != nil {
+		panic(err)
+	}
+	env.PostRoute(auth.ConfirmTOTPRoute).RouteParams("user_id", uid).QueryParams(url.Values{
+		"code": []string{code},
+	}).Success().AssertEq(true, "Properties", "Confirmed")
+	return secret, enrollment.GetValue("Properties", "RecoveryCodes").([]interface{})
+}
+
+func TestTOTP(t *testing.T) {
+	address := String("totp") + "@fake.fake"
+	token, err := loginByEMail(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := NewEnv().SetToken(token)
+	uid := env.GetRoute(game.IndexRoute).Success().GetValue("Properties", "User", "Id").(string)
+	// Fake users on the dev app server have all permissions.
+	NewEnv().SetUID(String("fake")).PutRoute(auth.AssignRolesRoute).RouteParams("user_id", uid).Body(map[string]interface{}{
+		"Roles": []string{auth.ModeratorRole},
+	}).Success()
+
+	t.Run("PrivilegedEnrollmentRequiresFreshLogin", func(t *testing.T) {
+		if Fake == nil {
+			t.Skip("advancing time requires TRANSPORT=inprocess")
+		}
+		AdvanceTime(time.Hour)
+		env.PostRoute(auth.EnrollTOTPRoute).RouteParams("user_id", uid).Status(http.StatusForbidden)
+		token, err := loginByEMail(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env = NewEnv().SetToken(token)
+	})
+
+	t.Run("PermissionsRequireSecondFactor", func(t *testing.T) {
+		env.GetRoute(game.ListFlaggedMessagesRoute).Status(http.StatusForbidden)
+	})
+
+	secret, recoveryCodes := enrollTOTP(env, uid)
+
+	t.Run("EnrollmentVerifiesSession", func(t *testing.T) {
+		env.GetRoute(game.ListFlaggedMessagesRoute).Success()
+		env.PostRoute(auth.EnrollTOTPRoute).RouteParams("user_id", uid).Status(http.StatusConflict)
+	})
+
+	token, err = loginByEMail(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEnv := NewEnv().SetToken(token)
+
+	t.Run("NewSessionsRequireVerification", func(t *testing.T) {
+		newEnv.GetRoute(game.ListFlaggedMessagesRoute).Status(http.StatusForbidden)
+		code, err := auth.TOTPCode(secret, serverNow())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The code was already used to confirm the enrollment.
+		newEnv.PostRoute(auth.VerifyTOTPRoute).RouteParams("user_id", uid).QueryParams(url.Values{
+			"code": []string{code},
+		}).Status(http.StatusForbidden)
+		newEnv.PostRoute(auth.VerifyTOTPRoute).RouteParams("user_id", uid).QueryParams(url.Values{
+			"code": []string{recoveryCodes[0].(string)},
+		}).Success().AssertEq(float64(len(recoveryCodes)-1), "Properties", "RemainingRecoveryCodes")
+		newEnv.GetRoute(game.ListFlaggedMessagesRoute).Success()
+	})
+
+	t.Run("RecoveryCodesWorkOnce", func(t *testing.T) {
+		env.PostRoute(auth.VerifyTOTPRoute).RouteParams("user_id", uid).QueryParams(url.Values{
+			"code": []string{recoveryCodes[0].(string)},
+		}).Status(http.StatusForbidden)
+	})
+
+	t.Run("GameMastersCanBeRequiredToVerify", func(t *testing.T) {
+		gameDesc := String("test-game")
+		env.GetRoute(game.IndexRoute).Success().
+			Follow("create-game", "Links").
+			Body(map[string]interface{}{
+				"Desc":                          gameDesc,
+				"Variant":                       "Classical",
+				"PhaseLengthMinutes":            time.Duration(60),
+				"GameMasterEnabled":             true,
+				"RequireGameMasterSecondFactor": true,
+				"Private":                       true,
+			}).Success()
+		gameID := env.GetRoute(game.IndexRoute).Success().
+			Follow("mastered-staging-games", "Links").Success().
+			Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).GetValue("Properties", "ID").(string)
+
+		token, err := loginByEMail(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		NewEnv().SetToken(token).PutRoute("Game.Update").RouteParams("id", gameID).Body(map[string]interface{}{
+			"Desc": String("unverified"),
+		}).Status(http.StatusForbidden)
+		env.PutRoute("Game.Update").RouteParams("id", gameID).Body(map[string]interface{}{
+			"Desc": String("verified"),
+		}).Success()
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		env.DeleteRoute(auth.DeleteTOTPRoute).RouteParams("user_id", uid).QueryParams(url.Values{
+			"code": []string{recoveryCodes[1].(string)},
+		}).Success()
+		env.GetRoute(auth.LoadTOTPRoute).RouteParams("user_id", uid).Success().
+			AssertEq(false, "Properties", "Confirmed")
+		env.GetRoute(game.ListFlaggedMessagesRoute).Status(http.StatusForbidden)
+		newEnv.GetRoute(game.ListFlaggedMessagesRoute).Status(http.StatusForbidden)
+	})
+}
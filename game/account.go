@@ -0,0 +1,281 @@
+package game
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+// GameExport is the participation of a user in a game.
+type GameExport struct {
+	GameID   *datastore.Key
+	Desc     string
+	Started  bool
+	Finished bool
+	Member   Member
+	Orders   []Order
+	// Messages are the messages sent by the user.
+	Messages []Message
+}
+
+// UserExport is all the personal data stored about a user.
+type UserExport struct {
+	User              auth.User
+	UserConfig        auth.UserConfig
+	UserStats         UserStats
+	TrueSkills        TrueSkills
+	Sanctions         Sanctions
+	ModerationNotices ModerationNotices
+	Blocks            Blocks
+	Games             []GameExport
+	ExportedAt        time.Time
+}
+
+func (u *UserExport) Item(r Request) *Item {
+	return NewItem(u).SetName("user-export").SetDesc([][]string{
+		[]string{
+			"Export",
+			"The personal data stored about the user: the user, configuration, stats, rating history, moderation sanctions and notices, blocked users and the memberships, orders and sent messages of all games.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ExportUserRoute,
+		RouteParams: []string{"user_id", u.User.Id},
+	}))
+}
+
+// DeletedUser summarizes what deleting a user changed.
+type DeletedUser struct {
+	UserId          string
+	LeftGames       int
+	AnonymizedGames int
+	PurgedBans      int
+	PurgedBlocks    int
+}
+
+func (d *DeletedUser) Item(r Request) *Item {
+	return NewItem(d).SetName("deleted-user")
+}
+
+func exportUser(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only export your own data", http.StatusForbidden}
+	}
+
+	export := &UserExport{
+		UserConfig: auth.UserConfig{UserId: user.Id},
+		UserStats:  UserStats{UserId: user.Id},
+		ExportedAt: clock.Now(ctx),
+	}
+	if err := datastore.Get(ctx, auth.UserID(ctx, user.Id), &export.User); err == datastore.ErrNoSuchEntity {
+		export.User = *user
+	} else if err != nil {
+		return err
+	}
+	for _, err := range []error{
+		datastore.Get(ctx, auth.UserConfigID(ctx, auth.UserID(ctx, user.Id)), &export.UserConfig),
+		datastore.Get(ctx, UserStatsID(ctx, user.Id), &export.UserStats),
+	} {
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	if _, err := datastore.NewQuery(trueSkillKind).Filter("UserId=", user.Id).GetAll(ctx, &export.TrueSkills); err != nil {
+		return err
+	}
+	sanctions, err := loadSanctions(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	export.Sanctions = sanctions
+	if export.ModerationNotices, err = loadModerationNotices(ctx, user.Id); err != nil {
+		return err
+	}
+	if export.Blocks, err = loadBlocks(ctx, user.Id); err != nil {
+		return err
+	}
+
+	games := Games{}
+	gameIDs, err := datastore.NewQuery(gameKind).Filter("Members.User.Id=", user.Id).GetAll(ctx, &games)
+	if err != nil {
+		return err
+	}
+	for idx, gameID := range gameIDs {
+		member, isMember := games[idx].GetMemberByUserId(user.Id)
+		if !isMember {
+			continue
+		}
+		gameExport := GameExport{
+			GameID:   gameID,
+			Desc:     games[idx].Desc,
+			Started:  games[idx].Started,
+			Finished: games[idx].Finished,
+			Member:   *member,
+		}
+		if member.Nation != "" {
+			if _, err := datastore.NewQuery(orderKind).Ancestor(gameID).Filter("Nation=", member.Nation).GetAll(ctx, &gameExport.Orders); err != nil {
+				return err
+			}
+			if _, err := datastore.NewQuery(messageKind).Ancestor(gameID).Filter("Sender=", member.Nation).GetAll(ctx, &gameExport.Messages); err != nil {
+				return err
+			}
+		}
+		export.Games = append(export.Games, gameExport)
+	}
+
+	w.SetContent(export.Item(r))
+	return nil
+}
+
+// anonymizeFinishedMember replaces the user of userId with a deleted user,
+// keeping only the id, in a finished game where it can't be replaced.
+func anonymizeFinishedMember(ctx context.Context, gameID *datastore.Key, userId string) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return err
+		}
+		game.ID = gameID
+
+		member, isMember := game.GetMemberByUserId(userId)
+		if !isMember {
+			return nil
+		}
+		member.GameAlias = ""
+		member.User = auth.User{
+			Id:   userId,
+			Name: auth.DeletedUserName,
+		}
+
+		return game.DBSave(ctx)
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+// purgeOwnedBans removes userId as owner of all bans, deleting the bans it
+// was the only owner of, and returns the number of bans changed.
+func purgeOwnedBans(ctx context.Context, userId string) (int, error) {
+	banIDs, err := datastore.NewQuery(banKind).Filter("OwnerIds=", userId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, banID := range banIDs {
+		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			ban := &Ban{}
+			if err := datastore.Get(ctx, banID, ban); err != nil {
+				return err
+			}
+			newOwners := []string{}
+			for _, ownerId := range ban.OwnerIds {
+				if ownerId != userId {
+					newOwners = append(newOwners, ownerId)
+				}
+			}
+			ban.OwnerIds = newOwners
+
+			if err := UpdateUserStatsASAP(ctx, ban.UserIds); err != nil {
+				return err
+			}
+
+			if len(ban.OwnerIds) == 0 {
+				return datastore.Delete(ctx, banID)
+			}
+			return ban.Save(ctx)
+		}, &datastore.TransactionOptions{XG: true}); err != nil {
+			return 0, err
+		}
+	}
+	return len(banIDs), nil
+}
+
+func deleteUser(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only delete yourself", http.StatusForbidden}
+	}
+
+	deleted := &DeletedUser{
+		UserId: user.Id,
+	}
+
+	games := Games{}
+	gameIDs, err := datastore.NewQuery(gameKind).Filter("Members.User.Id=", user.Id).GetAll(ctx, &games)
+	if err != nil {
+		return err
+	}
+	for idx, gameID := range gameIDs {
+		if games[idx].Finished {
+			if err := anonymizeFinishedMember(ctx, gameID, user.Id); err != nil {
+				return err
+			}
+			deleted.AnonymizedGames++
+		} else {
+			// Leaves staging games, and makes the member replaceable in started games.
+			if _, err := deleteMemberHelper(ctx, gameID, deleteMemberRequest{systemReq: true, toRemoveId: user.Id}, true); err != nil {
+				return err
+			}
+			deleted.LeftGames++
+		}
+	}
+
+	configID := auth.UserConfigID(ctx, auth.UserID(ctx, user.Id))
+	config := &auth.UserConfig{}
+	if err := datastore.Get(ctx, configID, config); err == nil {
+		config.FCMTokens = nil
+		config.MailConfig = auth.MailConfig{}
+		if _, err := datastore.Put(ctx, configID, config); err != nil {
+			return err
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	if deleted.PurgedBans, err = purgeOwnedBans(ctx, user.Id); err != nil {
+		return err
+	}
+
+	blockIDs, err := datastore.NewQuery(blockKind).Ancestor(auth.UserID(ctx, user.Id)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(ctx, blockIDs); err != nil {
+		return err
+	}
+	deleted.PurgedBlocks = len(blockIDs)
+
+	if err := auth.DeleteUserCredentials(ctx, user.Id); err != nil {
+		return err
+	}
+
+	if err := UpdateUserStatsASAP(ctx, []string{user.Id}); err != nil {
+		return err
+	}
+
+	if err := auth.RecordAudit(ctx, nil, user.Id, auth.DeleteUserAuditAction, user.Id, nil, deleted); err != nil {
+		return err
+	}
+	log.Infof(ctx, "Deleted user %+v", deleted)
+
+	w.SetContent(deleted.Item(r))
+	return nil
+}
@@ -0,0 +1,46 @@
+package game
+
+import (
+	"net/http"
+
+	"github.com/zond/diplicity/auth"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+// listGameAuditLog lists the audit log of a game, visible to its members,
+// its game master and users allowed to read all audit logs.
+func listGameAuditLog(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err == datastore.ErrNoSuchEntity {
+		// Deleted games keep their audit log.
+		if err := auth.RequirePermission(ctx, r, auth.ReadAuditLogPermission); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if _, isMember := game.GetMemberByUserId(user.Id); !isMember && game.GameMaster.Id != user.Id {
+		if err := auth.RequirePermission(ctx, r, auth.ReadAuditLogPermission); err != nil {
+			return err
+		}
+	}
+
+	return auth.ListAuditEntries(w, r, auth.AuditLogQuery(gameID), Link{
+		Route:       ListGameAuditLogRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
+	})
+}
@@ -185,6 +185,10 @@ func deleteBan(w ResponseWriter, r Request) (*Ban, error) {
 		return nil, err
 	}
 
+	if err := auth.RecordAudit(ctx, nil, user.Id, auth.DeleteBanAuditAction, r.Vars()["banned_id"], map[string]bool{"Banned": true}, nil); err != nil {
+		return nil, err
+	}
+
 	return ban, nil
 }
 
@@ -284,5 +288,15 @@ func createBan(w ResponseWriter, r Request) (*Ban, error) {
 		return nil, err
 	}
 
+	bannedId := ""
+	for _, userId := range userIds {
+		if userId != user.Id {
+			bannedId = userId
+		}
+	}
+	if err := auth.RecordAudit(ctx, nil, user.Id, auth.CreateBanAuditAction, bannedId, nil, map[string]bool{"Banned": true}); err != nil {
+		return nil, err
+	}
+
 	return ban, nil
 }
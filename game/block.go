@@ -0,0 +1,302 @@
+package game
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	blockKind = "Block"
+	maxBlocks = 500
+)
+
+var BlockResource *Resource
+
+func init() {
+	BlockResource = &Resource{
+		Create:     createBlock,
+		Delete:     deleteBlock,
+		CreatePath: "/User/{user_id}/Block",
+		FullPath:   "/User/{user_id}/Block/{blocked_id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/Blocks",
+				Route:   ListBlocksRoute,
+				Handler: listBlocks,
+			},
+		},
+	}
+}
+
+type Blocks []Block
+
+func (b Blocks) Item(r Request, userId string) *Item {
+	blockItems := make(List, len(b))
+	for i := range b {
+		blockItems[i] = b[i].Item(r)
+	}
+	return NewItem(blockItems).SetName("blocks").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListBlocksRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(BlockResource.Link("create", Create, []string{"user_id", userId}))).SetDesc([][]string{
+		[]string{
+			"Blocks",
+			"Blocks silence users in all games. Messages from blocked users are hidden from you, you get no notifications for them, and they can't message you in private channels.",
+			"Unlike bans, blocks are one sided and don't prevent playing together. To avoid games with blocked users, filter game lists with `hide-blocked=true`.",
+		},
+	})
+}
+
+// Block is a user silenced by the owner, stored as a child of the owner
+// with the blocked user ID as key name.
+type Block struct {
+	OwnerId   string
+	BlockedId string `methods:"POST"`
+	// BlockedName is loaded from the blocked user, so that it follows name
+	// changes and account deletion.
+	BlockedName string `datastore:"-"`
+	CreatedAt   time.Time
+}
+
+func (b *Block) Load(props []datastore.Property) error {
+	err := datastore.LoadStruct(b, props)
+	if _, is := err.(*datastore.ErrFieldMismatch); is {
+		err = nil
+	}
+	return err
+}
+
+func (b *Block) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(b)
+}
+
+func (b *Block) Item(r Request) *Item {
+	return NewItem(b).SetName(b.BlockedName).
+		AddLink(r.NewLink(BlockResource.Link("unblock", Delete, []string{"user_id", b.OwnerId, "blocked_id", b.BlockedId})))
+}
+
+func BlockID(ctx context.Context, ownerId, blockedId string) *datastore.Key {
+	return datastore.NewKey(ctx, blockKind, blockedId, 0, auth.UserID(ctx, ownerId))
+}
+
+// loadBlockedIds returns the IDs of the users userId has blocked.
+func loadBlockedIds(ctx context.Context, userId string) (map[string]bool, error) {
+	blockIDs, err := datastore.NewQuery(blockKind).Ancestor(auth.UserID(ctx, userId)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]bool{}
+	for _, blockID := range blockIDs {
+		result[blockID.StringID()] = true
+	}
+	return result, nil
+}
+
+// blockedNations returns the nations of the members of g blocked by userId.
+func blockedNations(ctx context.Context, g *Game, userId string) (map[godip.Nation]struct{}, error) {
+	blockedIds, err := loadBlockedIds(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	result := map[godip.Nation]struct{}{}
+	for _, member := range g.Members {
+		if blockedIds[member.User.Id] && member.Nation != "" {
+			result[member.Nation] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+// hasBlocked returns true if ownerId has blocked blockedId.
+func hasBlocked(ctx context.Context, ownerId, blockedId string) (bool, error) {
+	if err := datastore.Get(ctx, BlockID(ctx, ownerId, blockedId), &Block{}); err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// senderBlockedBy returns true if userId has blocked the sender of messageID.
+// Grey press is never blocked, since that would reveal the sender.
+func senderBlockedBy(ctx context.Context, g *Game, messageID *datastore.Key, userId string) (bool, error) {
+	message := &Message{}
+	if err := datastore.Get(ctx, messageID, message); err != nil {
+		return false, err
+	}
+	sender, found := g.GetMemberByNation(message.Sender)
+	if message.Grey || !found || sender.User.Id == "" {
+		return false, nil
+	}
+	return hasBlocked(ctx, userId, sender.User.Id)
+}
+
+// checkNotBlocked returns an error if senderId tries to message a private
+// channel with a player who has blocked them.
+func (g *Game) checkNotBlocked(ctx context.Context, senderId string, members Nations) error {
+	if len(members) != 2 {
+		return nil
+	}
+	for _, nation := range members {
+		recipient, found := g.GetMemberByNation(nation)
+		if !found || recipient.User.Id == "" || recipient.User.Id == senderId {
+			continue
+		}
+		blocked, err := hasBlocked(ctx, recipient.User.Id, senderId)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return HTTPErr{"blocked by recipient", http.StatusForbidden}
+		}
+	}
+	return nil
+}
+
+// hasBlockedMember returns true if any member or the game master of g is
+// among blockedIds.
+func (g *Game) hasBlockedMember(blockedIds map[string]bool) bool {
+	if blockedIds[g.GameMaster.Id] {
+		return true
+	}
+	for _, member := range g.Members {
+		if blockedIds[member.User.Id] {
+			return true
+		}
+	}
+	return false
+}
+
+func createBlock(w ResponseWriter, r Request) (*Block, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only create your own blocks", http.StatusForbidden}
+	}
+
+	block := &Block{}
+	if err := Copy(block, r, "POST"); err != nil {
+		return nil, err
+	}
+	if block.BlockedId == "" {
+		return nil, HTTPErr{"must provide a user to block", http.StatusBadRequest}
+	}
+	if block.BlockedId == user.Id {
+		return nil, HTTPErr{"can't block yourself", http.StatusBadRequest}
+	}
+	block.OwnerId = user.Id
+	block.CreatedAt = clock.Now(ctx)
+
+	blockedUser := &auth.User{}
+	if err := datastore.Get(ctx, auth.UserID(ctx, block.BlockedId), blockedUser); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{"non existing user", http.StatusNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	block.BlockedName = blockedUser.Name
+
+	blockedIds, err := loadBlockedIds(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(blockedIds) >= maxBlocks && !blockedIds[block.BlockedId] {
+		return nil, HTTPErr{"too many blocks", http.StatusBadRequest}
+	}
+
+	if _, err := datastore.Put(ctx, BlockID(ctx, user.Id, block.BlockedId), block); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func deleteBlock(w ResponseWriter, r Request) (*Block, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only delete your own blocks", http.StatusForbidden}
+	}
+
+	blockID := BlockID(ctx, user.Id, r.Vars()["blocked_id"])
+	block := &Block{}
+	if err := datastore.Get(ctx, blockID, block); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{"block not found", http.StatusNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := datastore.Delete(ctx, blockID); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func loadBlocks(ctx context.Context, userId string) (Blocks, error) {
+	blocks := Blocks{}
+	if _, err := datastore.NewQuery(blockKind).Ancestor(auth.UserID(ctx, userId)).GetAll(ctx, &blocks); err != nil {
+		return nil, err
+	}
+	userIDs := make([]*datastore.Key, len(blocks))
+	for i := range blocks {
+		userIDs[i] = auth.UserID(ctx, blocks[i].BlockedId)
+	}
+	users := make([]auth.User, len(blocks))
+	if err := datastore.GetMulti(ctx, userIDs, users); err != nil {
+		merr, ok := err.(appengine.MultiError)
+		if !ok {
+			return nil, err
+		}
+		for _, serr := range merr {
+			if serr != nil && serr != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	}
+	for i := range blocks {
+		blocks[i].BlockedName = users[i].Name
+	}
+	return blocks, nil
+}
+
+func listBlocks(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own blocks", http.StatusForbidden}
+	}
+
+	blocks, err := loadBlocks(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+
+	w.SetContent(blocks.Item(r, user.Id))
+
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	"github.com/kvannotten/mailstrip"
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/enmime"
 	fcm "github.com/zond/go-fcm"
 	"github.com/zond/godip"
@@ -62,7 +63,10 @@ func init() {
 
 	MessageResource = &Resource{
 		Create:     createMessage,
+		Update:     updateMessage,
+		Delete:     retractMessage,
 		CreatePath: "/Game/{game_id}/Messages",
+		FullPath:   "/Game/{game_id}/Channel/{channel_members}/Messages/{id}",
 		Listers: []Lister{
 			{
 				Path:    "/Game/{game_id}/Channel/{channel_members}/Messages",
@@ -113,6 +117,8 @@ type msgNotificationContext struct {
 	fcmData      map[string]interface{}
 	mailData     map[string]interface{}
 	mapURL       *url.URL
+	// annotationsMapURL is the map of the annotations of the message, if any.
+	annotationsMapURL *url.URL
 }
 
 func getMsgNotificationContext(ctx context.Context, host string, gameID *datastore.Key, channelMembers Nations, messageID *datastore.Key, userId string) (*msgNotificationContext, error) {
@@ -176,6 +182,19 @@ func getMsgNotificationContext(ctx context.Context, host string, gameID *datasto
 	res.mapURL.Host = host
 	res.mapURL.Scheme = DefaultScheme
 
+	if !res.message.Annotations.IsEmpty() {
+		res.annotationsMapURL, err = router.Get(RenderMessageMapRoute).URL("game_id", res.game.ID.Encode(), "channel_members", channelMembers.String(), "message_id", messageID.Encode())
+		if err != nil {
+			log.Errorf(ctx, "Unable to create annotations map URL for message %v: %v; wtf?", messageID, err)
+			return nil, err
+		}
+		res.annotationsMapURL.Host = host
+		res.annotationsMapURL.Scheme = DefaultScheme
+	}
+
+	res.message.redactGreyPress(res.member.Nation)
+	res.channel.LatestMessage.redactGreyPress(res.member.Nation)
+
 	res.mailData = map[string]interface{}{
 		"game":    res.game,
 		"channel": res.channel,
@@ -183,6 +202,9 @@ func getMsgNotificationContext(ctx context.Context, host string, gameID *datasto
 		"user":    res.user,
 		"mapLink": res.mapURL.String(),
 	}
+	if res.annotationsMapURL != nil {
+		res.mailData["annotationsMapLink"] = res.annotationsMapURL.String()
+	}
 	res.fcmData = map[string]interface{}{
 		"type":    "message",
 		"message": res.message,
@@ -228,6 +250,9 @@ func sendMsgNotificationsToMail(ctx context.Context, host string, gameID *datast
 
 	msg := &auth.EMail{}
 	msg.TextBody = fmt.Sprintf("%s\n\nVisit %s to stop receiving email like this.\n\nVisit %s to see the latest phase in this game.", msgContext.message.Body, unsubscribeURL.String(), msgContext.mapURL.String())
+	if msgContext.annotationsMapURL != nil {
+		msg.TextBody += fmt.Sprintf("\n\nVisit %s to see the map annotations of this message.", msgContext.annotationsMapURL.String())
+	}
 	msg.Subject = fmt.Sprintf(
 		"%s: %s => %s",
 		msgContext.game.DescFor(msgContext.member.Nation),
@@ -415,7 +440,12 @@ func sendMsgNotificationsToUsers(ctx context.Context, host string, gameID *datas
 				log.Errorf(ctx, "Unable to load channels for %v in %v: %v; hope datastore gets fixed", member.Nation, gameID, err)
 				return err
 			}
-			if err := countUnreadMessages(ctx, channels, member.Nation); err != nil {
+			blockedNats, err := blockedNations(ctx, game, member.User.Id)
+			if err != nil {
+				log.Errorf(ctx, "Unable to load nations blocked by %v in %v: %v; hope datastore gets fixed", member.Nation, gameID, err)
+				return err
+			}
+			if err := countUnreadMessages(ctx, channels, member.Nation, blockedNats); err != nil {
 				log.Errorf(ctx, "Unable to count unread messages for %v in %v: %v; hope datastore gets fixed", member.Nation, gameID, err)
 				return err
 			}
@@ -430,13 +460,22 @@ func sendMsgNotificationsToUsers(ctx context.Context, host string, gameID *datas
 			}
 		}
 
-		if err := sendMsgNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, gameID, channelMembers, messageID, uids[0], map[string]struct{}{}); err != nil {
-			log.Errorf(ctx, "Unable to enqueue sending FCM to %q: %v; hope datastore gets fixed", uids[0], err)
+		blocked, err := senderBlockedBy(ctx, game, messageID, uids[0])
+		if err != nil {
+			log.Errorf(ctx, "Unable to check if %q blocked the sender of %v: %v; hope datastore gets fixed", uids[0], messageID, err)
 			return err
 		}
-		if err := sendMsgNotificationsToMailFunc.EnqueueIn(ctx, 0, host, gameID, channelMembers, messageID, uids[0]); err != nil {
-			log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
-			return err
+		if blocked {
+			log.Infof(ctx, "%q has blocked the sender of %v, skipping notifications", uids[0], messageID)
+		} else {
+			if err := sendMsgNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, gameID, channelMembers, messageID, uids[0], map[string]struct{}{}); err != nil {
+				log.Errorf(ctx, "Unable to enqueue sending FCM to %q: %v; hope datastore gets fixed", uids[0], err)
+				return err
+			}
+			if err := sendMsgNotificationsToMailFunc.EnqueueIn(ctx, 0, host, gameID, channelMembers, messageID, uids[0]); err != nil {
+				log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
+				return err
+			}
 		}
 		for len(uids) > 0 && uids[0] == "" {
 			uids = uids[1:]
@@ -515,10 +554,18 @@ func (c Channels) Item(r Request, gameID *datastore.Key, createMessageLink bool)
 			"Counters",
 			"Channels tell you how many messages they have, and how many new since you last loaded messages from them.",
 		},
+		[]string{
+			"Exports",
+			"The `export` links download the messages of a channel, or of all channels listed here, with the phases they were sent during. Add `format=markdown` (the default), `format=html` or `format=mbox` to choose the format.",
+		},
 	}).AddLink(r.NewLink(Link{
 		Rel:         "self",
 		Route:       ListChannelsRoute,
 		RouteParams: []string{"game_id", gameID.Encode()},
+	})).AddLink(r.NewLink(Link{
+		Rel:         "export",
+		Route:       ExportGameChannelsRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
 	}))
 	if createMessageLink {
 		channelsItem.AddLink(r.NewLink(MessageResource.Link("message", Create, []string{"game_id", gameID.Encode()})))
@@ -585,6 +632,10 @@ func (c *Channel) Item(r Request) *Item {
 		Rel:         "messages",
 		Route:       ListMessagesRoute,
 		RouteParams: []string{"game_id", c.GameID.Encode(), "channel_members", c.Members.String()},
+	})).AddLink(r.NewLink(Link{
+		Rel:         "export",
+		Route:       ExportChannelRoute,
+		RouteParams: []string{"game_id", c.GameID.Encode(), "recipients", c.Members.String()},
 	}))
 	return channelItem
 }
@@ -604,13 +655,22 @@ func (c *Channel) ID(ctx context.Context) (*datastore.Key, error) {
 	return ChannelID(ctx, c.GameID, c.Members)
 }
 
-func (c *Channel) CountSince(ctx context.Context, since time.Time) error {
+// CountSince counts the messages created after since, not counting those
+// sent by any of the muted nations.
+func (c *Channel) CountSince(ctx context.Context, since time.Time, muted map[godip.Nation]struct{}) error {
 	channelID, err := ChannelID(ctx, c.GameID, c.Members)
 	if err != nil {
 		return err
 	}
-	count, err := datastore.NewQuery(messageKind).Ancestor(channelID).Filter("CreatedAt>", since).Count(ctx)
-	if err != nil {
+	q := datastore.NewQuery(messageKind).Ancestor(channelID).Filter("CreatedAt>", since)
+	count := 0
+	if c.hasMuted(muted) {
+		messages := Messages{}
+		if _, err := q.GetAll(ctx, &messages); err != nil {
+			return err
+		}
+		count = len(messages.Unmuted(muted))
+	} else if count, err = q.Count(ctx); err != nil {
 		return err
 	}
 	c.NMessagesSince.Since = since
@@ -618,8 +678,29 @@ func (c *Channel) CountSince(ctx context.Context, since time.Time) error {
 	return nil
 }
 
+func (c *Channel) hasMuted(muted map[godip.Nation]struct{}) bool {
+	for _, nat := range c.Members {
+		if _, isMuted := muted[nat]; isMuted {
+			return true
+		}
+	}
+	return false
+}
+
 type Messages []Message
 
+// Unmuted returns the messages not sent by any of the muted nations. Grey
+// press is never muted, since that would reveal the sender.
+func (m Messages) Unmuted(muted map[godip.Nation]struct{}) Messages {
+	result := make(Messages, 0, len(m))
+	for _, msg := range m {
+		if _, isMuted := muted[msg.Sender]; !isMuted || msg.Grey {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
 func (m Messages) Item(r Request, gameID *datastore.Key, channelMembers Nations, isMember bool) *Item {
 	messageItems := make(List, len(m))
 	for i := range m {
@@ -628,7 +709,23 @@ func (m Messages) Item(r Request, gameID *datastore.Key, channelMembers Nations,
 	messagesItem := NewItem(messageItems).SetName("messages").SetDesc([][]string{
 		[]string{
 			"Limiting messages",
-			"Messages normally contain all messages for the chosen channel, but if you provide a `since` query parameter they will only contain new messages since that time.",
+			"Messages normally contain all messages for the chosen channel, but if you provide a `since` query parameter they will only contain new messages, and messages replied or reacted to, since that time.",
+		},
+		[]string{
+			"Threads and reactions",
+			"Messages can reply to, and quote, other messages in the same channel by providing `ReplyTo` and `Quote` when created. Replies have the ID of the first message of the thread as `ThreadID`, and a `thread` query parameter with that ID will limit the messages to that thread. Nations can react to messages with an emoji using PUT and DELETE on `/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Reactions/{emoji}`, which doesn't send any notifications.",
+		},
+		[]string{
+			"Grey press",
+			"In games with `AllowGreyPress`, messages created with `Grey` have `Anonymous` as sender for everyone but the sender. Games with `GreyPressBroadcastOnly` only allow grey press in the conference channel.",
+		},
+		[]string{
+			"Editing messages",
+			"Senders can edit and retract their messages using the `edit` and `retract` links, within the `MessageEditWindowMinutes` of the game (15 minutes by default). Edited messages have an `EditedAt` time, and retracted messages are `Retracted` and have no body, like messages `Hidden` by moderators. Previous versions are kept for moderation of flagged messages, and no new notifications are sent.",
+		},
+		[]string{
+			"Map annotations",
+			"Messages can carry `Annotations` when created: `Arrows` with a `From` and `To` province, `Highlights` of provinces and proposed `Orders` with space separated parts like `par Move bur`, validated against the map of the variant. Annotated messages have a `map` link rendering the annotations on the map of the phase they were sent during, and email notifications link to it.",
 		},
 	}).AddLink(r.NewLink(Link{
 		Rel:         "self",
@@ -646,9 +743,83 @@ type Message struct {
 	GameID         *datastore.Key
 	ChannelMembers Nations `methods:"POST"`
 	Sender         godip.Nation
-	Body           string `methods:"POST" datastore:",noindex"`
-	CreatedAt      time.Time
-	Age            time.Duration `datastore:"-" ticker:"true"`
+	Body           string `methods:"POST,PUT" datastore:",noindex"`
+	// Grey messages hide their sender from everyone but the sender.
+	Grey bool `methods:"POST" datastore:",noindex"`
+	// ReplyTo is the encoded ID of the message in the same channel this
+	// message replies to.
+	ReplyTo string `methods:"POST" datastore:",noindex"`
+	// Quote is the part of the body of the ReplyTo message being quoted.
+	Quote string `methods:"POST" datastore:",noindex"`
+	// Annotations are drawn on the map of the phase the message was sent
+	// during.
+	Annotations MapAnnotations `methods:"POST" datastore:",noindex"`
+	// ThreadID is the encoded ID of the first message of the thread of
+	// replies this message belongs to.
+	ThreadID  string
+	NReplies  int `datastore:",noindex"`
+	Reactions []MessageReaction
+	CreatedAt time.Time
+	// UpdatedAt is when the message was created, or last edited, replied or
+	// reacted to.
+	UpdatedAt time.Time
+	// EditedAt is when the sender last edited or retracted the message.
+	EditedAt  time.Time `datastore:",noindex"`
+	Retracted bool      `datastore:",noindex"`
+	// Hidden is set when a moderator removed the body of the message.
+	Hidden bool `datastore:",noindex"`
+	// SearchWords are the words of the body that the message can be searched
+	// by.
+	SearchWords []string      `json:"-"`
+	Age         time.Duration `datastore:"-" ticker:"true"`
+
+	// editable is whether the viewer can still edit or retract the message.
+	editable bool
+}
+
+// threadRoot returns the encoded ID of the first message of the thread of m,
+// or an empty string if m isn't part of a thread.
+func (m *Message) threadRoot() string {
+	if m.ThreadID != "" {
+		return m.ThreadID
+	}
+	if m.NReplies > 0 && m.ID != nil {
+		return m.ID.Encode()
+	}
+	return ""
+}
+
+// joinThread validates the ReplyTo and Quote of m, sets the ThreadID of m,
+// and returns the first message of the thread with the reply counted.
+func (m *Message) joinThread(ctx context.Context, channelID *datastore.Key) (*datastore.Key, *Message, error) {
+	replyToID, err := datastore.DecodeKey(m.ReplyTo)
+	if err != nil || replyToID.Kind() != messageKind || !replyToID.Parent().Equal(channelID) {
+		return nil, nil, HTTPErr{"can only reply to messages in the same channel", http.StatusBadRequest}
+	}
+	replyTo := &Message{}
+	if err := datastore.Get(ctx, replyToID, replyTo); err == datastore.ErrNoSuchEntity {
+		return nil, nil, HTTPErr{"message replied to not found", http.StatusNotFound}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if m.Quote != "" && !strings.Contains(replyTo.Body, m.Quote) {
+		return nil, nil, HTTPErr{"can only quote the message replied to", http.StatusBadRequest}
+	}
+
+	rootID, root := replyToID, replyTo
+	if replyTo.ThreadID != "" {
+		if rootID, err = datastore.DecodeKey(replyTo.ThreadID); err != nil {
+			return nil, nil, err
+		}
+		root = &Message{}
+		if err := datastore.Get(ctx, rootID, root); err != nil {
+			return nil, nil, err
+		}
+	}
+	m.ThreadID = rootID.Encode()
+	root.NReplies++
+	root.UpdatedAt = m.CreatedAt
+	return rootID, root, nil
 }
 
 func (m *Message) NotifyRecipients(ctx context.Context, host string, game *Game) error {
@@ -670,7 +841,7 @@ func (m *Message) NotifyRecipients(ctx context.Context, host string, game *Game)
 	unmutedMembers := []godip.Nation{}
 	if err == nil {
 		for _, state := range states {
-			if state.Nation != m.Sender && !state.HasMuted(m.Sender) {
+			if state.Nation != m.Sender && (m.Grey || !state.HasMuted(m.Sender)) {
 				unmutedMembers = append(unmutedMembers, state.Nation)
 			}
 		}
@@ -678,7 +849,7 @@ func (m *Message) NotifyRecipients(ctx context.Context, host string, game *Game)
 		if merr, ok := err.(appengine.MultiError); ok {
 			for index, serr := range merr {
 				if serr == nil {
-					if m.ChannelMembers[index] != m.Sender && !states[index].HasMuted(m.Sender) {
+					if m.ChannelMembers[index] != m.Sender && (m.Grey || !states[index].HasMuted(m.Sender)) {
 						unmutedMembers = append(unmutedMembers, states[index].Nation)
 					}
 				} else if serr != datastore.ErrNoSuchEntity {
@@ -729,11 +900,34 @@ func (m *Message) NotifyRecipients(ctx context.Context, host string, game *Game)
 }
 
 func (m *Message) Item(r Request) *Item {
-	return NewItem(m).SetName(string(m.Sender))
+	messageItem := NewItem(m).SetName(string(m.Sender))
+	if m.editable {
+		routeParams := []string{"game_id", m.GameID.Encode(), "channel_members", m.ChannelMembers.String(), "id", m.ID.Encode()}
+		messageItem.AddLink(r.NewLink(MessageResource.Link("edit", Update, routeParams)))
+		messageItem.AddLink(r.NewLink(MessageResource.Link("retract", Delete, routeParams)))
+	}
+	if !m.Annotations.IsEmpty() {
+		messageItem.AddLink(r.NewLink(Link{
+			Rel:         "map",
+			Route:       RenderMessageMapRoute,
+			RouteParams: []string{"game_id", m.GameID.Encode(), "channel_members", m.ChannelMembers.String(), "message_id", m.ID.Encode()},
+		}))
+	}
+	if thread := m.threadRoot(); thread != "" {
+		messageItem.AddLink(r.NewLink(Link{
+			Rel:         "thread",
+			Route:       ListMessagesRoute,
+			RouteParams: []string{"game_id", m.GameID.Encode(), "channel_members", m.ChannelMembers.String()},
+			QueryParams: url.Values{"thread": []string{thread}},
+		}))
+	}
+	return messageItem
 }
 
 func createMessageHelper(ctx context.Context, host string, message *Message) error {
-	message.CreatedAt = time.Now()
+	message.CreatedAt = clock.Now(ctx)
+	message.UpdatedAt = message.CreatedAt
+	message.indexWords()
 	sort.Sort(message.ChannelMembers)
 
 	channelID, err := ChannelID(ctx, message.GameID, message.ChannelMembers)
@@ -761,7 +955,6 @@ func createMessageHelper(ctx context.Context, host string, message *Message) err
 		}
 		game.ID = message.GameID
 		channel.NMessages += 1
-		channel.LatestMessage = *message
 		toSave := []interface{}{channel, message}
 		saveKeys := []*datastore.Key{channelID, datastore.NewIncompleteKey(ctx, messageKind, channelID)}
 		if !channelExisted {
@@ -769,10 +962,24 @@ func createMessageHelper(ctx context.Context, host string, message *Message) err
 			channelIntro := *message
 			channelIntro.Sender = DiplicitySender
 			channelIntro.Body = "Please note that all messages become public after the game ends."
+			channelIntro.Grey = false
+			channelIntro.ReplyTo = ""
+			channelIntro.Quote = ""
 			channelIntro.CreatedAt = message.CreatedAt.Add(-time.Second)
+			channelIntro.UpdatedAt = channelIntro.CreatedAt
+			channelIntro.indexWords()
 			toSave = append(toSave, &channelIntro)
 			saveKeys = append(saveKeys, datastore.NewIncompleteKey(ctx, messageKind, channelID))
 		}
+		if message.ReplyTo != "" {
+			rootID, root, err := message.joinThread(ctx, channelID)
+			if err != nil {
+				return err
+			}
+			toSave = append(toSave, root)
+			saveKeys = append(saveKeys, rootID)
+		}
+		channel.LatestMessage = *message
 		ids, err := datastore.PutMulti(
 			ctx,
 			saveKeys,
@@ -836,6 +1043,10 @@ func validateMessage(ctx context.Context, message *Message) error {
 		return HTTPErr{"can not create empty messages", http.StatusBadRequest}
 	}
 
+	if message.Quote != "" && message.ReplyTo == "" {
+		return HTTPErr{"can only quote messages replied to", http.StatusBadRequest}
+	}
+
 	if !message.ChannelMembers.Includes(message.Sender) {
 		return HTTPErr{"can only send messages to member channels", http.StatusForbidden}
 	}
@@ -844,21 +1055,27 @@ func validateMessage(ctx context.Context, message *Message) error {
 	if err := datastore.Get(ctx, message.GameID, game); err != nil {
 		return err
 	}
+	game.ID = message.GameID
 	if !game.Started {
 		return HTTPErr{"game not yet started", http.StatusBadRequest}
 	}
 	if !game.Mustered {
 		return HTTPErr{"game is mustering", http.StatusBadRequest}
 	}
-	if !game.Finished {
-		if game.DisablePrivateChat && len(message.ChannelMembers) == 2 {
-			return HTTPErr{"private chat disabled", http.StatusBadRequest}
+	if member, found := game.GetMemberByNation(message.Sender); found && member.User.Id != "" {
+		if err := checkSanctions(ctx, member.User.Id, game.ID); err != nil {
+			return err
 		}
-		if game.DisableGroupChat && len(message.ChannelMembers) > 2 && len(message.ChannelMembers) < len(variants.Variants[game.Variant].Nations) {
-			return HTTPErr{"group chat disabled", http.StatusBadRequest}
+		if err := game.checkNotBlocked(ctx, member.User.Id, message.ChannelMembers); err != nil {
+			return err
 		}
-		if game.DisableConferenceChat && len(message.ChannelMembers) == len(variants.Variants[game.Variant].Nations) {
-			return HTTPErr{"conference chat disabled", http.StatusBadRequest}
+	}
+	if !game.Finished {
+		if err := game.checkChatEnabled(message.ChannelMembers); err != nil {
+			return err
+		}
+		if err := game.checkPressRules(ctx, message, clock.Now(ctx)); err != nil {
+			return err
 		}
 	}
 
@@ -868,6 +1085,29 @@ func validateMessage(ctx context.Context, message *Message) error {
 		}
 	}
 
+	if err := validateGreyPress(game, message); err != nil {
+		return err
+	}
+
+	if err := message.Annotations.validate(game); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkChatEnabled returns an error if the kind of chat of a channel with
+// members is disabled in g.
+func (g *Game) checkChatEnabled(members Nations) error {
+	if g.DisablePrivateChat && len(members) == 2 {
+		return HTTPErr{"private chat disabled", http.StatusBadRequest}
+	}
+	if g.DisableGroupChat && len(members) > 2 && len(members) < len(variants.Variants[g.Variant].Nations) {
+		return HTTPErr{"group chat disabled", http.StatusBadRequest}
+	}
+	if g.DisableConferenceChat && len(members) == len(variants.Variants[g.Variant].Nations) {
+		return HTTPErr{"conference chat disabled", http.StatusBadRequest}
+	}
 	return nil
 }
 
@@ -897,6 +1137,93 @@ func isPublic(variant string, members Nations) bool {
 	return true
 }
 
+// messageViewer returns the nation user reads the messages of game as, which
+// is empty unless they are a member of a started and mustered game, and the
+// nations whose messages they have muted or whose players they have blocked.
+func messageViewer(ctx context.Context, game *Game, user *auth.User) (godip.Nation, map[godip.Nation]struct{}, error) {
+	var nation godip.Nation
+	mutedNats, err := blockedNations(ctx, game, user.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	if member, found := game.GetMemberByUserId(user.Id); game.Started && game.Mustered && found {
+		nation = member.Nation
+		gameStateID, err := GameStateID(ctx, game.ID, nation)
+		if err != nil {
+			return "", nil, err
+		}
+		gameState := &GameState{}
+		if err = datastore.Get(ctx, gameStateID, gameState); err == nil {
+			for _, nat := range gameState.Muted {
+				mutedNats[nat] = struct{}{}
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return "", nil, err
+		}
+	}
+	return nation, mutedNats, nil
+}
+
+func canListMessages(game *Game, nation godip.Nation, channelMembers Nations) bool {
+	return game.Finished || channelMembers.Includes(nation) || isPublic(game.Variant, channelMembers)
+}
+
+// loadChannelMessages returns the messages in channelID created, replied to or
+// reacted to after since, newest first.
+func loadChannelMessages(ctx context.Context, channelID *datastore.Key, since *time.Time) (Messages, error) {
+	messages := Messages{}
+	q := datastore.NewQuery(messageKind).Ancestor(channelID)
+	if since != nil {
+		q = q.Filter("UpdatedAt>", *since).Order("-UpdatedAt")
+	} else {
+		q = q.Order("-CreatedAt")
+	}
+	messageIDs, err := q.GetAll(ctx, &messages)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].ID = messageIDs[i]
+	}
+	if since != nil {
+		sort.SliceStable(messages, func(i, j int) bool {
+			return messages[i].CreatedAt.After(messages[j].CreatedAt)
+		})
+	}
+	return messages, nil
+}
+
+// loadThread returns the first message of the thread threadID and all
+// replies to it updated after since, newest first.
+func loadThread(ctx context.Context, threadID *datastore.Key, since *time.Time) (Messages, error) {
+	root := Message{}
+	if err := datastore.Get(ctx, threadID, &root); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{"thread not found", http.StatusNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	root.ID = threadID
+
+	replies := Messages{}
+	replyIDs, err := datastore.NewQuery(messageKind).Ancestor(threadID.Parent()).Filter("ThreadID=", threadID.Encode()).GetAll(ctx, &replies)
+	if err != nil {
+		return nil, err
+	}
+	messages := Messages{}
+	for i, message := range append(replies, root) {
+		if i < len(replyIDs) {
+			message.ID = replyIDs[i]
+		}
+		if since == nil || message.UpdatedAt.After(*since) {
+			messages = append(messages, message)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.After(messages[j].CreatedAt)
+	})
+	return messages, nil
+}
+
 func listMessages(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
@@ -926,6 +1253,13 @@ func listMessages(w ResponseWriter, r Request) error {
 
 	wait := r.Req().URL.Query().Get("wait") == "true"
 
+	var threadID *datastore.Key
+	if threadParam := r.Req().URL.Query().Get("thread"); threadParam != "" {
+		if threadID, err = datastore.DecodeKey(threadParam); err != nil {
+			return HTTPErr{"invalid thread", http.StatusBadRequest}
+		}
+	}
+
 	game := &Game{}
 	err = datastore.Get(ctx, gameID, game)
 	if err != nil {
@@ -933,25 +1267,16 @@ func listMessages(w ResponseWriter, r Request) error {
 	}
 	game.ID = gameID
 
-	var nation godip.Nation
-	mutedNats := map[godip.Nation]struct{}{}
-	if member, found := game.GetMemberByUserId(user.Id); game.Started && game.Mustered && found {
-		nation = member.Nation
-		gameStateID, err := GameStateID(ctx, gameID, nation)
-		if err != nil {
-			return err
-		}
-		gameState := &GameState{}
-		if err = datastore.Get(ctx, gameStateID, gameState); err == nil {
-			for _, nat := range gameState.Muted {
-				mutedNats[nat] = struct{}{}
-			}
-		} else if err != datastore.ErrNoSuchEntity {
-			return err
-		}
+	nation, mutedNats, err := messageViewer(ctx, game, user)
+	if err != nil {
+		return err
+	}
+	blockedNats, err := blockedNations(ctx, game, user.Id)
+	if err != nil {
+		return err
 	}
 
-	if !game.Finished && !channelMembers.Includes(nation) && !isPublic(game.Variant, channelMembers) {
+	if !canListMessages(game, nation, channelMembers) {
 		return HTTPErr{"can only list member channels", http.StatusForbidden}
 	}
 
@@ -960,21 +1285,26 @@ func listMessages(w ResponseWriter, r Request) error {
 		return err
 	}
 
+	if threadID != nil && (threadID.Kind() != messageKind || !threadID.Parent().Equal(channelID)) {
+		return HTTPErr{"thread not found", http.StatusNotFound}
+	}
+
 	var seenMarker *SeenMarker
 	messages := Messages{}
 	for {
 		if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-			q := datastore.NewQuery(messageKind).Ancestor(channelID)
-			if since != nil {
-				q = q.Filter("CreatedAt>", *since)
+			var err error
+			if threadID != nil {
+				messages, err = loadThread(ctx, threadID, since)
+			} else {
+				messages, err = loadChannelMessages(ctx, channelID, since)
 			}
-			messageIDs, err := q.Order("-CreatedAt").GetAll(ctx, &messages)
 			if err != nil {
 				return err
 			}
 			for i := range messages {
-				messages[i].ID = messageIDs[i]
-				messages[i].Age = time.Now().Sub(messages[i].CreatedAt)
+				messages[i].Age = clock.Now(ctx).Sub(messages[i].CreatedAt)
+				messages[i].editable = messages[i].editableBy(game, nation, clock.Now(ctx)) == nil
 			}
 			if game.Started && game.Mustered && nation != "" {
 				seenMarkerID, err := SeenMarkerID(ctx, channelID, nation)
@@ -1048,7 +1378,7 @@ func listMessages(w ResponseWriter, r Request) error {
 				}
 			}
 
-			if err := countUnreadMessages(ctx, filteredChannels, nation); err != nil {
+			if err := countUnreadMessages(ctx, filteredChannels, nation, blockedNats); err != nil {
 				return err
 			}
 
@@ -1072,14 +1402,7 @@ func listMessages(w ResponseWriter, r Request) error {
 		}
 	}
 
-	filteredMessages := make(Messages, 0, len(messages))
-	for _, msg := range messages {
-		if _, isMuted := mutedNats[msg.Sender]; !isMuted {
-			filteredMessages = append(filteredMessages, msg)
-		}
-	}
-
-	w.SetContent(filteredMessages.Item(r, gameID, channelMembers, isMember))
+	w.SetContent(messages.Unmuted(mutedNats).RedactGreyPress(nation).Item(r, gameID, channelMembers, isMember))
 	return nil
 }
 
@@ -1109,10 +1432,13 @@ func loadChannels(ctx context.Context, game *Game, viewer godip.Nation) (Channel
 			}
 		}
 	}
-	return channels, nil
+	return channels.RedactGreyPress(viewer), nil
 }
 
-func countUnreadMessages(ctx context.Context, unfilteredChannels Channels, viewer godip.Nation) error {
+// countUnreadMessages sets NMessagesSince of the channels viewer is a member
+// of to the messages since the last seen marker of viewer, not counting those
+// sent by the blocked nations.
+func countUnreadMessages(ctx context.Context, unfilteredChannels Channels, viewer godip.Nation, blocked map[godip.Nation]struct{}) error {
 	seenMarkerIDs := []*datastore.Key{}
 	seenMarkers := []SeenMarker{}
 	channels := []*Channel{}
@@ -1153,11 +1479,11 @@ func countUnreadMessages(ctx context.Context, unfilteredChannels Channels, viewe
 	results := make(chan error)
 	for i := range channels {
 		go func(c *Channel, since time.Time) {
-			if since.IsZero() {
+			if since.IsZero() && !c.hasMuted(blocked) {
 				c.NMessagesSince.NMessages = c.NMessages
 				results <- nil
 			} else {
-				results <- c.CountSince(ctx, since)
+				results <- c.CountSince(ctx, since, blocked)
 			}
 		}(channels[i], seenMarkerTimes[i])
 	}
@@ -1206,7 +1532,11 @@ func listChannels(w ResponseWriter, r Request) error {
 	}
 
 	if game.Started && game.Mustered && isMember {
-		if err := countUnreadMessages(ctx, channels, nation); err != nil {
+		blockedNats, err := blockedNations(ctx, game, user.Id)
+		if err != nil {
+			return err
+		}
+		if err := countUnreadMessages(ctx, channels, nation, blockedNats); err != nil {
 			return err
 		}
 	} else {
@@ -0,0 +1,348 @@
+package game
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	MarkdownChatExportFormat = "markdown"
+	HTMLChatExportFormat     = "html"
+	MboxChatExportFormat     = "mbox"
+
+	chatExportTimeFormat = "2006-01-02 15:04 MST"
+)
+
+var (
+	chatExportFormats = map[string]chatExportFormat{
+		MarkdownChatExportFormat: {"text/markdown; charset=utf-8", "md", writeMarkdownChatExport},
+		HTMLChatExportFormat:     {"text/html; charset=utf-8", "html", writeHTMLChatExport},
+		MboxChatExportFormat:     {"application/mbox", "mbox", writeMboxChatExport},
+	}
+
+	mboxFromLineRegexp = regexp.MustCompile("(?m)^(>*From )")
+
+	htmlChatExportTemplate = template.Must(template.New("chat-export").Funcs(template.FuncMap{
+		"time": func(t time.Time) string {
+			return t.Format(chatExportTimeFormat)
+		},
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Game.Desc}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; color: #222; }
+h2 { border-bottom: 1px solid #ccc; }
+h3 { color: #666; font-size: 1em; text-transform: uppercase; }
+.message { margin: 0.5em 0; }
+.sender { font-weight: bold; }
+.time { color: #888; font-size: 0.8em; }
+.body { white-space: pre-wrap; margin: 0.2em 0 0 1em; }
+.removed { color: #888; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>{{.Game.Desc}}</h1>
+{{range .Channels}}<h2>{{.Name}}</h2>
+{{range .Entries}}{{if .Phase}}<h3>{{.Phase}}</h3>
+{{else}}<div class="message"><span class="sender">{{.Message.Sender}}</span> <span class="time">{{time .Message.CreatedAt}}</span>
+{{if .Removed}}<div class="body removed">{{.Removed}}</div>{{else}}<div class="body">{{.Message.Body}}</div>{{end}}</div>
+{{end}}{{end}}{{end}}</body>
+</html>
+`))
+)
+
+type chatExportFormat struct {
+	contentType string
+	extension   string
+	write       func(buf *bytes.Buffer, export *chatExport) error
+}
+
+// chatExportEntry is either the start of a phase or a message.
+type chatExportEntry struct {
+	Phase   string
+	Message *Message
+}
+
+// Removed describes why the message has no body, if it was removed.
+func (e chatExportEntry) Removed() string {
+	if e.Message.Hidden {
+		return "(hidden by a moderator)"
+	}
+	if e.Message.Retracted {
+		return "(retracted)"
+	}
+	return ""
+}
+
+type chatExportChannel struct {
+	Members Nations
+	Entries []chatExportEntry
+}
+
+func (c chatExportChannel) Name() string {
+	names := make([]string, len(c.Members))
+	for i, nation := range c.Members {
+		names[i] = string(nation)
+	}
+	return strings.Join(names, ", ")
+}
+
+type chatExport struct {
+	Game     *Game
+	Host     string
+	Channels []chatExportChannel
+}
+
+func phaseExportName(phase *PhaseMeta) string {
+	return fmt.Sprintf("%s %d, %s", phase.Season, phase.Year, phase.Type)
+}
+
+// interleavePhases returns messages, oldest first, preceded by the start of
+// the phase each message was sent during.
+func interleavePhases(messages Messages, phases Phases) []chatExportEntry {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+	entries := []chatExportEntry{}
+	phaseIdx := -1
+	lastPhaseIdx := -1
+	for i := range messages {
+		for phaseIdx+1 < len(phases) && !phases[phaseIdx+1].CreatedAt.After(messages[i].CreatedAt) {
+			phaseIdx++
+		}
+		if phaseIdx != lastPhaseIdx {
+			entries = append(entries, chatExportEntry{Phase: phaseExportName(&phases[phaseIdx].PhaseMeta)})
+			lastPhaseIdx = phaseIdx
+		}
+		entries = append(entries, chatExportEntry{Message: &messages[i]})
+	}
+	return entries
+}
+
+// loadChatExportChannel returns the messages of channelMembers visible to
+// viewer, interleaved with the phases of the game.
+func loadChatExportChannel(ctx context.Context, game *Game, viewer godip.Nation, mutedNats map[godip.Nation]struct{}, phases Phases, channelMembers Nations) (*chatExportChannel, error) {
+	channelID, err := ChannelID(ctx, game.ID, channelMembers)
+	if err != nil {
+		return nil, err
+	}
+	unfiltered, err := loadChannelMessages(ctx, channelID, nil)
+	if err != nil {
+		return nil, err
+	}
+	messages := Messages{}
+	for _, message := range unfiltered {
+		if _, isMuted := mutedNats[message.Sender]; isMuted && !message.Grey {
+			continue
+		}
+		message.redactGreyPress(viewer)
+		messages = append(messages, message)
+	}
+	return &chatExportChannel{
+		Members: channelMembers,
+		Entries: interleavePhases(messages, phases),
+	}, nil
+}
+
+func writeMarkdownChatExport(buf *bytes.Buffer, export *chatExport) error {
+	fmt.Fprintf(buf, "# %s\n", export.Game.Desc)
+	for _, channel := range export.Channels {
+		fmt.Fprintf(buf, "\n## %s\n", channel.Name())
+		for _, entry := range channel.Entries {
+			if entry.Message == nil {
+				fmt.Fprintf(buf, "\n### %s\n", entry.Phase)
+				continue
+			}
+			fmt.Fprintf(buf, "\n**%s** %s\n\n", entry.Message.Sender, entry.Message.CreatedAt.Format(chatExportTimeFormat))
+			body := entry.Message.Body
+			if removed := entry.Removed(); removed != "" {
+				body = "_" + removed + "_"
+			}
+			for _, line := range strings.Split(body, "\n") {
+				fmt.Fprintf(buf, "> %s\n", line)
+			}
+		}
+	}
+	return nil
+}
+
+func writeHTMLChatExport(buf *bytes.Buffer, export *chatExport) error {
+	return htmlChatExportTemplate.Execute(buf, export)
+}
+
+// mboxAddress returns a mail address for nation, using only the letters and
+// digits of the nation as local part.
+func mboxAddress(nation godip.Nation, host string) string {
+	local := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, string(nation))
+	return fmt.Sprintf("%s <%s@%s>", mime.QEncoding.Encode("utf-8", string(nation)), local, host)
+}
+
+func writeMboxChatExport(buf *bytes.Buffer, export *chatExport) error {
+	type mboxMessage struct {
+		channel *chatExportChannel
+		phase   string
+		message *Message
+	}
+	mboxMessages := []mboxMessage{}
+	for i := range export.Channels {
+		phase := ""
+		for _, entry := range export.Channels[i].Entries {
+			if entry.Message == nil {
+				phase = entry.Phase
+			} else {
+				mboxMessages = append(mboxMessages, mboxMessage{&export.Channels[i], phase, entry.Message})
+			}
+		}
+	}
+	sort.SliceStable(mboxMessages, func(i, j int) bool {
+		return mboxMessages[i].message.CreatedAt.Before(mboxMessages[j].message.CreatedAt)
+	})
+	for _, m := range mboxMessages {
+		recipients := make([]string, len(m.channel.Members))
+		for i, nation := range m.channel.Members {
+			recipients[i] = mboxAddress(nation, export.Host)
+		}
+		fmt.Fprintf(buf, "From diplicity@%s %s\n", export.Host, m.message.CreatedAt.UTC().Format(time.ANSIC))
+		fmt.Fprintf(buf, "From: %s\n", mboxAddress(m.message.Sender, export.Host))
+		fmt.Fprintf(buf, "To: %s\n", strings.Join(recipients, ", "))
+		fmt.Fprintf(buf, "Subject: %s\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("[%s] %s: %s", m.phase, export.Game.Desc, m.channel.Name())))
+		fmt.Fprintf(buf, "Date: %s\n", m.message.CreatedAt.Format(time.RFC1123Z))
+		if m.message.ID != nil {
+			fmt.Fprintf(buf, "Message-ID: <%s@%s>\n", m.message.ID.Encode(), export.Host)
+		}
+		if m.message.ReplyTo != "" {
+			fmt.Fprintf(buf, "In-Reply-To: <%s@%s>\n", m.message.ReplyTo, export.Host)
+		}
+		fmt.Fprintf(buf, "X-Diplicity-Phase: %s\n", mime.QEncoding.Encode("utf-8", m.phase))
+		fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\n\n")
+		body := m.message.Body
+		if removed := (chatExportEntry{Message: m.message}).Removed(); removed != "" {
+			body = removed
+		}
+		fmt.Fprintf(buf, "%s\n\n", mboxFromLineRegexp.ReplaceAllString(strings.Replace(body, "\r\n", "\n", -1), ">$1"))
+	}
+	return nil
+}
+
+// exportChat writes the channels of the game of r, visible to the user,
+// and chosen by channelsFunc, in the format of r.
+func exportChat(w ResponseWriter, r Request, filename string, channelsFunc func(ctx context.Context, game *Game, viewer godip.Nation) ([]Nations, error)) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	formatName := r.Req().URL.Query().Get("format")
+	if formatName == "" {
+		formatName = MarkdownChatExportFormat
+	}
+	format, found := chatExportFormats[formatName]
+	if !found {
+		return HTTPErr{fmt.Sprintf("format must be %q, %q or %q", MarkdownChatExportFormat, HTMLChatExportFormat, MboxChatExportFormat), http.StatusBadRequest}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	viewer, mutedNats, err := messageViewer(ctx, game, user)
+	if err != nil {
+		return err
+	}
+
+	channelMembers, err := channelsFunc(ctx, game, viewer)
+	if err != nil {
+		return err
+	}
+
+	phases := Phases{}
+	if _, err := datastore.NewQuery(phaseKind).Ancestor(gameID).GetAll(ctx, &phases); err != nil {
+		return err
+	}
+	sort.Slice(phases, func(i, j int) bool {
+		return phases[i].PhaseOrdinal < phases[j].PhaseOrdinal
+	})
+
+	export := &chatExport{
+		Game: game,
+		Host: r.Req().Host,
+	}
+	for _, members := range channelMembers {
+		channel, err := loadChatExportChannel(ctx, game, viewer, mutedNats, phases, members)
+		if err != nil {
+			return err
+		}
+		export.Channels = append(export.Channels, *channel)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := format.write(buf, export); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s.%s", filename, format.extension)))
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func exportChannel(w ResponseWriter, r Request) error {
+	channelMembers := Nations{}
+	channelMembers.FromString(r.Vars()["recipients"])
+	sort.Sort(channelMembers)
+	return exportChat(w, r, strings.Replace(channelMembers.String(), ",", "-", -1), func(ctx context.Context, game *Game, viewer godip.Nation) ([]Nations, error) {
+		if !canListMessages(game, viewer, channelMembers) {
+			return nil, HTTPErr{"can only export channels you can list", http.StatusForbidden}
+		}
+		return []Nations{channelMembers}, nil
+	})
+}
+
+func exportGameChannels(w ResponseWriter, r Request) error {
+	return exportChat(w, r, "chat", func(ctx context.Context, game *Game, viewer godip.Nation) ([]Nations, error) {
+		channels, err := loadChannels(ctx, game, viewer)
+		if err != nil {
+			return nil, err
+		}
+		result := []Nations{}
+		for _, channel := range channels {
+			sort.Sort(channel.Members)
+			result = append(result, channel.Members)
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].String() < result[j].String()
+		})
+		return result, nil
+	})
+}
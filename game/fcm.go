@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/go-fcm"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/v2/datastore"
@@ -145,7 +146,7 @@ func manageFCMTokens(ctx context.Context, tokensToRemove, tokensToUpdate map[str
 			ctx,
 			toUpdate,
 			func(tok *auth.FCMToken, newValue string) {
-				tok.Note = fmt.Sprintf("Updated from %q at %v due to FCM service indication.", tok.Value, time.Now())
+				tok.Note = fmt.Sprintf("Updated from %q at %v due to FCM service indication.", tok.Value, clock.Now(ctx))
 				tok.Value = newValue
 			},
 			func() error {
@@ -16,6 +16,7 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/godip"
 	"github.com/zond/godip/variants"
 	"golang.org/x/net/context"
@@ -30,8 +31,10 @@ import (
 )
 
 const (
-	gameKind           = "Game"
-	MAX_PHASE_DEADLINE = 30 * 24 * 60
+	gameKind                    = "Game"
+	MAX_PHASE_DEADLINE          = 30 * 24 * 60
+	MAX_MESSAGE_EDIT_WINDOW     = 24 * 60
+	DEFAULT_MESSAGE_EDIT_WINDOW = 15
 )
 
 const (
@@ -75,6 +78,7 @@ func init() {
 		"conference-chat-disabled",
 		"group-chat-disabled",
 		"private-chat-disabled",
+		"hide-blocked",
 	}
 	GameResource = &Resource{
 		Load:   loadGame,
@@ -213,7 +217,7 @@ func (d *DelayFunc) EnqueueAt(ctx context.Context, taskETA time.Time, args ...in
 }
 
 func (d *DelayFunc) EnqueueIn(ctx context.Context, taskDelay time.Duration, args ...interface{}) error {
-	return d.EnqueueAt(ctx, time.Now().Add(taskDelay), args...)
+	return d.EnqueueAt(ctx, clock.Now(ctx).Add(taskDelay), args...)
 }
 
 type Games []Game
@@ -407,6 +411,7 @@ func (g Games) Item(r Request, user *auth.User, cursor *datastore.Cursor, limit
 			"`max-hater=X:Y` filters on max hater between X and Y.",
 			"`min-rating=X:Y` filters on min rating between X and Y.",
 			"`max-rating=X:Y` filters on max rating between X and Y.",
+			"`hide-blocked=true` hides games with players you have blocked.",
 		},
 	}).AddLink(r.NewLink(Link{
 		Rel:   "self",
@@ -455,7 +460,26 @@ type Game struct {
 	ChatLanguageISO639_1          string           `methods:"POST,PUT"`
 	GameMasterEnabled             bool             `methods:"POST"`
 	RequireGameMasterInvitation   bool             `methods:"POST,PUT"`
-	DiscordWebhooks               DiscordWebhooks  `methods:"POST" datastore:",noindex"`
+	RequireGameMasterSecondFactor bool             `methods:"POST,PUT"`
+	// MessageEditWindowMinutes is how long senders can edit or retract
+	// messages, or zero for the default.
+	MessageEditWindowMinutes time.Duration `methods:"POST,PUT"`
+	// AllowGreyPress lets members send messages that hide their sender.
+	AllowGreyPress bool `methods:"POST,PUT"`
+	// GreyPressBroadcastOnly only allows grey press in the conference channel.
+	GreyPressBroadcastOnly bool `methods:"POST,PUT"`
+	// PressPhaseTypes are the phase types press is allowed during, or empty
+	// for all phase types.
+	PressPhaseTypes []godip.PhaseType `methods:"POST,PUT"`
+	// MessagesPerPhase is how many messages each nation can send per phase,
+	// or zero for no limit.
+	MessagesPerPhase int `methods:"POST,PUT"`
+	// MaxMessageLength is the maximum number of characters of messages, or
+	// zero for no limit.
+	MaxMessageLength int `methods:"POST,PUT"`
+	// PressBlackoutMinutes is how long before deadlines press isn't allowed.
+	PressBlackoutMinutes time.Duration   `methods:"POST,PUT"`
+	DiscordWebhooks      DiscordWebhooks `methods:"POST" datastore:",noindex"`
 
 	GameMasterInvitations GameMasterInvitations
 	GameMaster            auth.User
@@ -577,6 +601,15 @@ func (g *Game) canMergeInto(o *Game, avoid *auth.User) bool {
 	if g.ChatLanguageISO639_1 != o.ChatLanguageISO639_1 {
 		return false
 	}
+	if g.MessageEditWindowMinutes != o.MessageEditWindowMinutes {
+		return false
+	}
+	if g.AllowGreyPress != o.AllowGreyPress || g.GreyPressBroadcastOnly != o.GreyPressBroadcastOnly {
+		return false
+	}
+	if !g.samePressRules(o) {
+		return false
+	}
 	for _, member := range o.Members {
 		if member.User.Id == avoid.Id {
 			return false
@@ -585,15 +618,15 @@ func (g *Game) canMergeInto(o *Game, avoid *auth.User) bool {
 	return true
 }
 
-func (g *Game) Refresh() {
+func (g *Game) Refresh(ctx context.Context) {
 	if !g.CreatedAt.IsZero() {
-		g.CreatedAgo = g.CreatedAt.Sub(time.Now())
+		g.CreatedAgo = g.CreatedAt.Sub(clock.Now(ctx))
 	}
 	if !g.StartedAt.IsZero() {
-		g.StartedAgo = g.StartedAt.Sub(time.Now())
+		g.StartedAgo = g.StartedAt.Sub(clock.Now(ctx))
 	}
 	if !g.FinishedAt.IsZero() {
-		g.FinishedAgo = g.FinishedAt.Sub(time.Now())
+		g.FinishedAgo = g.FinishedAt.Sub(clock.Now(ctx))
 	}
 }
 
@@ -658,6 +691,31 @@ func (g *Game) GetMemberByUserId(userID string) (*Member, bool) {
 	return nil, false
 }
 
+// CheckGameMasterSecondFactor returns an error if the game requires its game
+// master to have verified a second factor, and the session of r hasn't.
+func (g *Game) CheckGameMasterSecondFactor(r Request) error {
+	if !g.RequireGameMasterSecondFactor {
+		return nil
+	}
+	return auth.RequireSecondFactor(r)
+}
+
+// MessageEditWindow returns how long after creation messages can be edited
+// or retracted by their senders.
+func (g *Game) MessageEditWindow() time.Duration {
+	if g.MessageEditWindowMinutes == 0 {
+		return time.Minute * DEFAULT_MESSAGE_EDIT_WINDOW
+	}
+	return time.Minute * g.MessageEditWindowMinutes
+}
+
+func validateMessageEditWindow(g *Game) error {
+	if g.MessageEditWindowMinutes < 0 || g.MessageEditWindowMinutes > MAX_MESSAGE_EDIT_WINDOW {
+		return HTTPErr{"message edit windows must be between zero and 24 hours", http.StatusBadRequest}
+	}
+	return nil
+}
+
 func (g *Game) Leavable() bool {
 	return !g.Started
 }
@@ -699,6 +757,9 @@ func (g *Game) Joinable(user *auth.User) bool {
 
 func (g *Game) Item(r Request) *Item {
 	gameItem := NewItem(g).SetName(g.Desc).AddLink(r.NewLink(GameResource.Link("self", Load, []string{"id", g.ID.Encode()})))
+	if rules := g.PressRules(); len(rules) > 0 {
+		gameItem.SetDesc([][]string{append([]string{"Press rules"}, rules...)})
+	}
 	user, ok := r.Values()["user"].(*auth.User)
 	if ok {
 		if _, isMember := g.GetMemberByUserId(user.Id); isMember {
@@ -716,6 +777,27 @@ func (g *Game) Item(r Request) *Item {
 			Route:       ListChannelsRoute,
 			RouteParams: []string{"game_id", g.ID.Encode()},
 		}))
+		if g.Started {
+			gameItem.AddLink(r.NewLink(Link{
+				Rel:         "search-messages",
+				Route:       SearchMessagesRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			}))
+		}
+		if _, isMember := g.GetMemberByUserId(user.Id); isMember && g.Started && !g.Finished {
+			gameItem.AddLink(r.NewLink(Link{
+				Rel:         "scheduled-messages",
+				Route:       ListScheduledMessagesRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			}))
+		}
+		if _, isMember := g.GetMemberByUserId(user.Id); isMember || user.Id == g.GameMaster.Id {
+			gameItem.AddLink(r.NewLink(Link{
+				Rel:         "audit-log",
+				Route:       ListGameAuditLogRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			}))
+		}
 		if g.Started {
 			gameItem.AddLink(r.NewLink(Link{
 				Rel:         "phases",
@@ -792,9 +874,9 @@ func (g *Game) DBSave(ctx context.Context) error {
 	} else if len(g.Members) > 1 {
 		requiredSpots := float64(len(variants.Variants[g.Variant].Nations))
 		emptySpots := requiredSpots - float64(len(g.Members))
-		rate := (float64(len(g.Members)) - 1) / float64(time.Now().UnixNano()-g.CreatedAt.UnixNano())
+		rate := (float64(len(g.Members)) - 1) / float64(clock.Now(ctx).UnixNano()-g.CreatedAt.UnixNano())
 		timeLeft := time.Duration(float64(time.Nanosecond) * (emptySpots / rate))
-		g.StartETA = time.Now().Add(timeLeft)
+		g.StartETA = clock.Now(ctx).Add(timeLeft)
 	} else {
 		g.StartETA = time.Date(2525, time.January, 1, 0, 0, 0, 0, time.UTC)
 	}
@@ -884,6 +966,10 @@ func gameMasterDeleteGame(w ResponseWriter, r Request) (*Game, error) {
 			return HTTPErr{"unauthorized", http.StatusUnauthorized}
 		}
 
+		if err := game.CheckGameMasterSecondFactor(r); err != nil {
+			return err
+		}
+
 		if game.Started {
 			return HTTPErr{"game has already started", http.StatusPreconditionFailed}
 		}
@@ -896,6 +982,14 @@ func gameMasterDeleteGame(w ResponseWriter, r Request) (*Game, error) {
 			return err
 		}
 
+		if err := auth.RecordAudit(ctx, gameID, user.Id, auth.DeleteGameAuditAction, gameID.Encode(), map[string]interface{}{
+			"Desc":         game.Desc,
+			"MemberIds":    userIDs,
+			"GameMasterId": game.GameMaster.Id,
+		}, nil); err != nil {
+			return err
+		}
+
 		return datastore.Delete(ctx, gameID)
 	}, &datastore.TransactionOptions{XG: false}); err != nil {
 		return nil, err
@@ -929,13 +1023,19 @@ func createGame(w ResponseWriter, r Request) (*Game, error) {
 	if game.PhaseLengthMinutes > MAX_PHASE_DEADLINE {
 		return nil, HTTPErr{"no games with more than 30 day deadlines allowed", http.StatusBadRequest}
 	}
+	if err := validateMessageEditWindow(game); err != nil {
+		return nil, err
+	}
+	if err := validatePressRules(game); err != nil {
+		return nil, err
+	}
 	if game.GameMasterEnabled {
 		if !game.Private {
 			return nil, HTTPErr{"only private games can have game master", http.StatusBadRequest}
 		}
 		game.GameMaster = *user
 	}
-	game.CreatedAt = time.Now()
+	game.CreatedAt = clock.Now(ctx)
 
 	if !game.NoMerge && !game.Private {
 		mergedWith, err := merge(ctx, r, game, user)
@@ -1182,7 +1282,7 @@ func asyncStartGame(ctx context.Context, gameID *datastore.Key, host string) err
 		}
 
 		g.Started = true
-		g.StartedAt = time.Now()
+		g.StartedAt = clock.Now(ctx)
 		g.Closed = true
 		if err := g.AllocateNations(ctx); err != nil {
 			log.Errorf(ctx, "g.AllocateNations(): %v; fix it?", err)
@@ -1192,7 +1292,7 @@ func asyncStartGame(ctx context.Context, gameID *datastore.Key, host string) err
 			g.Mustered = true
 		}
 
-		phase := NewPhase(s, g.ID, 1, host)
+		phase := NewPhase(ctx, s, g.ID, 1, host)
 		// To ensure we don't get 0 phase length games.
 		if g.PhaseLengthMinutes == 0 {
 			g.PhaseLengthMinutes = MAX_PHASE_DEADLINE
@@ -1242,7 +1342,7 @@ func asyncStartGame(ctx context.Context, gameID *datastore.Key, host string) err
 				NoOrders:      len(options) == 0,
 				Messages:      messages,
 				ZippedOptions: zippedOptions,
-				Note:          fmt.Sprintf("Created by Diplicity at %v due to game start.", time.Now()),
+				Note:          fmt.Sprintf("Created by Diplicity at %v due to game start.", clock.Now(ctx)),
 			}
 			phaseStateID, err := phaseState.ID(ctx)
 			if err != nil {
@@ -1318,7 +1418,7 @@ func asyncStartGame(ctx context.Context, gameID *datastore.Key, host string) err
 		if g.Mustered {
 			greetingBody = fmt.Sprintf("Welcome to %v. Have fun!", gameDesc)
 		} else {
-			greetingBody = fmt.Sprintf("Welcome to %v. Before the game starts properly, all players must first declare themselves ready to play by checking 'ready to resolve'. If anyone doesn't do this within %v (before %v), they will be ejected from the game (and all other staging games) and it will re-enter the staging state. Have fun!", gameDesc, phase.DeadlineAt.Sub(time.Now()).Round(time.Minute), phase.DeadlineAt.Format(time.RFC822))
+			greetingBody = fmt.Sprintf("Welcome to %v. Before the game starts properly, all players must first declare themselves ready to play by checking 'ready to resolve'. If anyone doesn't do this within %v (before %v), they will be ejected from the game (and all other staging games) and it will re-enter the staging state. Have fun!", gameDesc, phase.DeadlineAt.Sub(clock.Now(ctx)).Round(time.Minute), phase.DeadlineAt.Format(time.RFC822))
 		}
 		members := make([]string, len(variant.Nations))
 		for idx := range variant.Nations {
@@ -1373,15 +1473,26 @@ func gameMasterUpdateGame(w ResponseWriter, r Request) (*Game, error) {
 			return HTTPErr{"unauthorized", http.StatusUnauthorized}
 		}
 
+		if err := game.CheckGameMasterSecondFactor(r); err != nil {
+			return err
+		}
+
+		before := *game
 		if err := Copy(game, r, "PUT"); err != nil {
 			return err
 		}
+		if err := validateMessageEditWindow(game); err != nil {
+			return err
+		}
+		if err := validatePressRules(game); err != nil {
+			return err
+		}
 
 		if _, err := datastore.Put(ctx, gameID, game); err != nil {
 			return err
 		}
 
-		return nil
+		return auth.RecordAudit(ctx, gameID, user.Id, auth.UpdateGameAuditAction, gameID.Encode(), before, game)
 	}, &datastore.TransactionOptions{XG: false}); err != nil {
 		return nil, err
 	}
@@ -1403,10 +1514,10 @@ func loadGamePublic(w ResponseWriter, r Request) (*Game, error) {
 	}
 	game.ID = gameID
 	for i := range game.NewestPhaseMeta {
-		game.NewestPhaseMeta[i].Refresh()
+		game.NewestPhaseMeta[i].Refresh(ctx)
 	}
 
-	game.Refresh()
+	game.Refresh(ctx)
 
 	game.RedactPublic(r)
 
@@ -1447,10 +1558,10 @@ func loadGameAuthenticated(w ResponseWriter, r Request) (*Game, error) {
 	}
 	game.ID = gameID
 	for i := range game.NewestPhaseMeta {
-		game.NewestPhaseMeta[i].Refresh()
+		game.NewestPhaseMeta[i].Refresh(ctx)
 	}
 
-	game.Refresh()
+	game.Refresh(ctx)
 
 	filtered := Games{*game}
 	if _, err = filtered.RemoveBanned(ctx, user.Id, false); err != nil {
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/godip"
 	"github.com/zond/godip/variants"
 	"golang.org/x/net/context"
@@ -237,7 +238,7 @@ func (g *GameResult) TrueSkillRate(ctx context.Context, onlyUnrated bool, update
 			TrueSkillContent: TrueSkillContent{
 				GameID:    g.GameID,
 				UserId:    players[idx].score.UserId,
-				CreatedAt: time.Now(),
+				CreatedAt: clock.Now(ctx),
 				Member:    players[idx].score.Member,
 				Mu:        newTSPlayers[idx].Mu(),
 				Sigma:     newTSPlayers[idx].Sigma(),
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/zond/diplicity/clock"
 	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/datastore"
 
@@ -123,8 +124,8 @@ func handleGlobalStats(w ResponseWriter, r Request) error {
 		bumpNamedHistogram("MinQuickness", int(game.MinQuickness), globalStats.ActiveGameHistograms)
 		bumpNamedHistogram("NMembers", game.NMembers, globalStats.ActiveGameHistograms)
 		bumpNamedHistogram("Variant", game.Variant, globalStats.ActiveGameHistograms)
-		bumpNamedHistogram("CreatedAtDaysAgo", int(time.Now().Sub(game.CreatedAt)/(time.Hour*24)), globalStats.ActiveGameHistograms)
-		bumpNamedHistogram("StartedAtDaysAgo", int(time.Now().Sub(game.StartedAt)/(time.Hour*24)), globalStats.ActiveGameHistograms)
+		bumpNamedHistogram("CreatedAtDaysAgo", int(clock.Now(ctx).Sub(game.CreatedAt)/(time.Hour*24)), globalStats.ActiveGameHistograms)
+		bumpNamedHistogram("StartedAtDaysAgo", int(clock.Now(ctx).Sub(game.StartedAt)/(time.Hour*24)), globalStats.ActiveGameHistograms)
 		bumpNamedHistogram("Private", fmt.Sprint(game.Private), globalStats.ActiveGameHistograms)
 		bumpNamedHistogram("Anonymous", fmt.Sprint(game.Anonymous), globalStats.ActiveGameHistograms)
 		bumpNamedHistogram("ConferenceChat", fmt.Sprint(!game.DisableConferenceChat), globalStats.ActiveGameHistograms)
@@ -0,0 +1,1202 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	graphQLMaxDepth       = 8
+	graphQLMaxParallelism = 16
+)
+
+type graphQLLoaderKeyType int
+
+const graphQLLoaderKey graphQLLoaderKeyType = 0
+
+// The GraphQL view of the game domain. It is read only, and every field is
+// subject to the same authorization and redaction as the corresponding REST
+// resource.
+const graphQLSchemaString = `
+schema {
+	query: Query
+}
+
+scalar Time
+
+type Query {
+	# The game with the given ID.
+	game(id: ID!): Game
+	# A list of games, where list is the name of one of the game lists of the
+	# REST API, e.g. "my-started-games" or "other-member-finished-games" (which
+	# requires userId).
+	games(list: String!, limit: Int, cursor: String, userId: String): GameList!
+	userStats(userId: String!): UserStats!
+}
+
+type GameList {
+	games: [Game!]!
+	# Pass as cursor to fetch the next batch, null if there are no more games.
+	cursor: String
+}
+
+type Game {
+	id: ID!
+	desc: String!
+	variant: String!
+	started: Boolean!
+	mustered: Boolean!
+	closed: Boolean!
+	finished: Boolean!
+	private: Boolean!
+	anonymous: Boolean!
+	phaseLengthMinutes: Int!
+	nonMovementPhaseLengthMinutes: Int!
+	nMembers: Int!
+	failedRequirements: [String!]!
+	gameMaster: User!
+	members: [Member!]!
+	createdAt: Time!
+	startedAt: Time!
+	finishedAt: Time!
+	phases: [Phase!]!
+	phase(ordinal: Int!): Phase
+	channels: [Channel!]!
+}
+
+type User {
+	id: String!
+	name: String!
+	givenName: String!
+	familyName: String!
+	email: String!
+	picture: String!
+}
+
+type Member {
+	user: User!
+	nation: String!
+	gameAlias: String!
+	nationPreferences: String!
+	unreadMessages: Int!
+	replaceable: Boolean!
+	newestPhaseState: PhaseState!
+	# Null for anonymous members.
+	stats: UserStats
+}
+
+type UserStats {
+	userId: String!
+	user: User!
+	joinedGames: Int!
+	startedGames: Int!
+	finishedGames: Int!
+	masteredGames: Int!
+	soloGames: Int!
+	diasGames: Int!
+	eliminatedGames: Int!
+	droppedGames: Int!
+	nmrPhases: Int!
+	activePhases: Int!
+	readyPhases: Int!
+	reliability: Float!
+	quickness: Float!
+	hated: Float!
+	hater: Float!
+	rating: Float!
+}
+
+type Phase {
+	ordinal: Int!
+	season: String!
+	year: Int!
+	type: String!
+	resolved: Boolean!
+	createdAt: Time!
+	resolvedAt: Time!
+	deadlineAt: Time!
+	units: [Unit!]!
+	scs: [SC!]!
+	phaseStates: [PhaseState!]!
+	orders: [Order!]!
+}
+
+type Unit {
+	province: String!
+	type: String!
+	nation: String!
+}
+
+type SC {
+	province: String!
+	owner: String!
+}
+
+type PhaseState {
+	nation: String!
+	readyToResolve: Boolean!
+	wantsDIAS: Boolean!
+	wantsConcede: Boolean!
+	onProbation: Boolean!
+	noOrders: Boolean!
+	eliminated: Boolean!
+	messages: String!
+	note: String!
+}
+
+type Order {
+	nation: String!
+	parts: [String!]!
+}
+
+type Channel {
+	members: [String!]!
+	nMessages: Int!
+	# Newest first.
+	messages(limit: Int): [Message!]!
+}
+
+type Message {
+	id: ID!
+	sender: String!
+	channelMembers: [String!]!
+	body: String!
+	# Grey press has "Anonymous" as sender for everyone but the sender.
+	grey: Boolean!
+	# The message this message replies to, if any.
+	replyTo: ID
+	quote: String!
+	# The first message of the thread this message belongs to, if any.
+	threadId: ID
+	nReplies: Int!
+	reactions: [Reaction!]!
+	createdAt: Time!
+	# When the sender last edited or retracted the message, if ever.
+	editedAt: Time
+	retracted: Boolean!
+	# Whether a moderator removed the body of the message.
+	hidden: Boolean!
+	annotations: MapAnnotations!
+}
+
+# Drawn on the map of the phase the message was sent during.
+type MapAnnotations {
+	arrows: [MapArrow!]!
+	highlights: [String!]!
+	# Proposed orders, with space separated parts like "par Move bur".
+	orders: [String!]!
+	phaseOrdinal: Int!
+}
+
+type MapArrow {
+	from: String!
+	to: String!
+}
+
+type Reaction {
+	nation: String!
+	emoji: String!
+}
+`
+
+var graphQLSchema = graphql.MustParseSchema(graphQLSchemaString, &graphQLQuery{},
+	graphql.MaxDepth(graphQLMaxDepth),
+	graphql.MaxParallelism(graphQLMaxParallelism),
+)
+
+var graphQLGameLists = map[string]*gamesHandler{}
+
+func init() {
+	for _, handler := range []*gamesHandler{
+		openGamesHandler,
+		startedGamesHandler,
+		finishedGamesHandler,
+		masteredStagingGamesHandler,
+		masteredStartedGamesHandler,
+		masteredFinishedGamesHandler,
+		myStagingGamesHandler,
+		myStartedGamesHandler,
+		myFinishedGamesHandler,
+		otherMemberStagingGamesHandler,
+		otherMemberStartedGamesHandler,
+		otherMemberFinishedGamesHandler,
+	} {
+		graphQLGameLists[handler.name] = handler
+	}
+}
+
+type graphQLParams struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func handleGraphQL(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	params := &graphQLParams{}
+	if r.Req().Method == "GET" {
+		params.Query = r.Req().URL.Query().Get("query")
+		params.OperationName = r.Req().URL.Query().Get("operationName")
+		if variables := r.Req().URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &params.Variables); err != nil {
+				return HTTPErr{err.Error(), http.StatusBadRequest}
+			}
+		}
+	} else if err := json.NewDecoder(r.Req().Body).Decode(params); err != nil {
+		return HTTPErr{err.Error(), http.StatusBadRequest}
+	}
+
+	loader := &graphQLLoader{
+		ctx:   ctx,
+		r:     r,
+		user:  user,
+		games: map[string]*graphQLGame{},
+	}
+	response := graphQLSchema.Exec(context.WithValue(ctx, graphQLLoaderKey, loader), params.Query, params.OperationName, params.Variables)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// graphQLRequest lets the REST loaders serve GraphQL queries, by replacing the
+// route variables and query parameters of the GraphQL request.
+type graphQLRequest struct {
+	Request
+	req  *http.Request
+	vars map[string]string
+}
+
+func newGraphQLRequest(r Request, vars map[string]string, query url.Values) *graphQLRequest {
+	req := r.Req().Clone(r.Req().Context())
+	req.URL.RawQuery = query.Encode()
+	return &graphQLRequest{
+		Request: r,
+		req:     req,
+		vars:    vars,
+	}
+}
+
+func (r *graphQLRequest) Req() *http.Request {
+	return r.req
+}
+
+func (r *graphQLRequest) Vars() map[string]string {
+	return r.vars
+}
+
+// graphQLLoader caches everything loaded while executing one query, and
+// loads related entities for all games, phases, channels and members at
+// once to avoid one datastore read per object.
+type graphQLLoader struct {
+	ctx   context.Context
+	r     Request
+	user  *auth.User
+	mutex sync.Mutex
+	games map[string]*graphQLGame
+}
+
+type graphQLGame struct {
+	// game is redacted for the viewer, and only used for display.
+	game *Game
+	// raw is used for authorization, like the REST handlers do.
+	raw         *Game
+	phases      Phases
+	phaseStates map[int64]PhaseStates
+	orders      map[int64]Orders
+	channels    Channels
+	messages    map[string]Messages
+	userStats   map[string]*UserStats
+}
+
+func graphQLLoaderFrom(ctx context.Context) *graphQLLoader {
+	return ctx.Value(graphQLLoaderKey).(*graphQLLoader)
+}
+
+func (l *graphQLLoader) game(id string) (*graphQLGame, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if g, found := l.games[id]; found {
+		return g, nil
+	}
+	game, err := loadGame(nil, newGraphQLRequest(l.r, map[string]string{"id": id}, url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	g := &graphQLGame{game: game}
+	l.games[id] = g
+	return g, nil
+}
+
+func (l *graphQLLoader) gameList(list string, limit *int32, cursor, userID *string) (Games, *datastore.Cursor, error) {
+	handler, found := graphQLGameLists[list]
+	if !found {
+		return nil, nil, HTTPErr{"unknown game list", http.StatusBadRequest}
+	}
+	query := url.Values{}
+	if limit != nil {
+		query.Set("limit", fmt.Sprint(*limit))
+	}
+	if cursor != nil {
+		query.Set("cursor", *cursor)
+	}
+	vars := map[string]string{}
+	if userID != nil {
+		vars["user_id"] = *userID
+	}
+	r := newGraphQLRequest(l.r, vars, query)
+	req, err := handler.request(nil, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	games, curs, err := req.load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i := range games {
+		raw := games[i]
+		raw.Members = append(Members{}, games[i].Members...)
+		raw.GameMasterInvitations = append(GameMasterInvitations{}, games[i].GameMasterInvitations...)
+		games[i].Redact(l.user, r)
+		l.games[games[i].ID.Encode()] = &graphQLGame{
+			game: &games[i],
+			raw:  &raw,
+		}
+	}
+	return games, curs, nil
+}
+
+// loadRaw loads the unredacted game, if it isn't already loaded.
+func (l *graphQLLoader) loadRaw(g *graphQLGame) error {
+	if g.raw != nil {
+		return nil
+	}
+	raw := &Game{}
+	if err := datastore.Get(l.ctx, g.game.ID, raw); err != nil {
+		return err
+	}
+	raw.ID = g.game.ID
+	g.raw = raw
+	return nil
+}
+
+func (l *graphQLLoader) phases(g *graphQLGame) (Phases, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if g.phases != nil {
+		return g.phases, nil
+	}
+	phases := Phases{}
+	if _, err := datastore.NewQuery(phaseKind).Ancestor(g.game.ID).GetAll(l.ctx, &phases); err != nil {
+		return nil, err
+	}
+	for i := range phases {
+		phases[i].Refresh(l.ctx)
+		phases[i].Score(variants.Variants[g.game.Variant].Nations)
+	}
+	g.phases = phases
+	return phases, nil
+}
+
+func (l *graphQLLoader) phaseStates(g *graphQLGame, phase *Phase) (PhaseStates, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.loadRaw(g); err != nil {
+		return nil, err
+	}
+	if g.phaseStates == nil {
+		all := PhaseStates{}
+		if _, err := datastore.NewQuery(phaseStateKind).Ancestor(g.game.ID).GetAll(l.ctx, &all); err != nil {
+			return nil, err
+		}
+		g.phaseStates = map[int64]PhaseStates{}
+		for _, phaseState := range all {
+			g.phaseStates[phaseState.PhaseOrdinal] = append(g.phaseStates[phaseState.PhaseOrdinal], phaseState)
+		}
+	}
+	return visiblePhaseStates(g.raw, g.game.ID, phase, l.user, g.phaseStates[phase.PhaseOrdinal]), nil
+}
+
+func (l *graphQLLoader) orders(g *graphQLGame, phase *Phase) (Orders, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.loadRaw(g); err != nil {
+		return nil, err
+	}
+	if g.orders == nil {
+		all := Orders{}
+		if _, err := datastore.NewQuery(orderKind).Filter("GameID=", g.game.ID).GetAll(l.ctx, &all); err != nil {
+			return nil, err
+		}
+		g.orders = map[int64]Orders{}
+		for _, order := range all {
+			g.orders[order.PhaseOrdinal] = append(g.orders[order.PhaseOrdinal], order)
+		}
+	}
+	return visibleOrders(g.raw, phase, l.user, g.orders[phase.PhaseOrdinal]), nil
+}
+
+func (l *graphQLLoader) channels(g *graphQLGame) (Channels, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if g.channels != nil {
+		return g.channels, nil
+	}
+	if err := l.loadRaw(g); err != nil {
+		return nil, err
+	}
+	var nation godip.Nation
+	if member, isMember := g.raw.GetMemberByUserId(l.user.Id); isMember {
+		nation = member.Nation
+	}
+	channels, err := loadChannels(l.ctx, g.raw, nation)
+	if err != nil {
+		return nil, err
+	}
+	g.channels = channels
+	return channels, nil
+}
+
+// messages loads the messages of all channels of the game at once, since
+// dashboards tend to show them all.
+func (l *graphQLLoader) messages(g *graphQLGame, channelMembers Nations) (Messages, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.loadRaw(g); err != nil {
+		return nil, err
+	}
+	nation, mutedNats, err := messageViewer(l.ctx, g.raw, l.user)
+	if err != nil {
+		return nil, err
+	}
+	if !canListMessages(g.raw, nation, channelMembers) {
+		return nil, HTTPErr{"can only list member channels", http.StatusForbidden}
+	}
+	if g.messages == nil {
+		all := Messages{}
+		ids, err := datastore.NewQuery(messageKind).Ancestor(g.game.ID).Order("-CreatedAt").GetAll(l.ctx, &all)
+		if err != nil {
+			return nil, err
+		}
+		g.messages = map[string]Messages{}
+		for i := range all {
+			all[i].ID = ids[i]
+			channel := ids[i].Parent().StringID()
+			g.messages[channel] = append(g.messages[channel], all[i])
+		}
+	}
+	return g.messages[channelMembers.String()].Unmuted(mutedNats).RedactGreyPress(nation), nil
+}
+
+// userStats loads the stats of all visible members of the game at once.
+func (l *graphQLLoader) userStats(g *graphQLGame, userID string) (*UserStats, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if g.userStats == nil {
+		ids := []*datastore.Key{}
+		stats := []UserStats{}
+		for _, member := range g.game.Members {
+			if member.User.Id != "" {
+				ids = append(ids, UserStatsID(l.ctx, member.User.Id))
+				stats = append(stats, UserStats{UserId: member.User.Id, User: member.User})
+			}
+		}
+		if err := datastore.GetMulti(l.ctx, ids, stats); err != nil {
+			merr, ok := err.(appengine.MultiError)
+			if !ok {
+				return nil, err
+			}
+			for _, serr := range merr {
+				if serr != nil && serr != datastore.ErrNoSuchEntity {
+					return nil, err
+				}
+			}
+		}
+		g.userStats = map[string]*UserStats{}
+		for i := range stats {
+			stats[i].User.Email = ""
+			g.userStats[ids[i].StringID()] = &stats[i]
+		}
+	}
+	return g.userStats[userID], nil
+}
+
+func graphQLTime(t time.Time) graphql.Time {
+	return graphql.Time{Time: t}
+}
+
+func graphQLOptionalID(id string) *graphql.ID {
+	if id == "" {
+		return nil
+	}
+	result := graphql.ID(id)
+	return &result
+}
+
+func graphQLStrings(nations Nations) []string {
+	result := make([]string, len(nations))
+	for i, nation := range nations {
+		result[i] = string(nation)
+	}
+	return result
+}
+
+type graphQLQuery struct{}
+
+func (q *graphQLQuery) Game(ctx context.Context, args struct{ ID graphql.ID }) (*gameResolver, error) {
+	l := graphQLLoaderFrom(ctx)
+	g, err := l.game(string(args.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &gameResolver{l: l, g: g}, nil
+}
+
+type gameListResolver struct {
+	games  []*gameResolver
+	cursor *string
+}
+
+func (g *gameListResolver) Games() []*gameResolver {
+	return g.games
+}
+
+func (g *gameListResolver) Cursor() *string {
+	return g.cursor
+}
+
+func (q *graphQLQuery) Games(ctx context.Context, args struct {
+	List   string
+	Limit  *int32
+	Cursor *string
+	UserID *string
+}) (*gameListResolver, error) {
+	l := graphQLLoaderFrom(ctx)
+	games, curs, err := l.gameList(args.List, args.Limit, args.Cursor, args.UserID)
+	if err != nil {
+		return nil, err
+	}
+	result := &gameListResolver{}
+	for i := range games {
+		g, err := l.game(games[i].ID.Encode())
+		if err != nil {
+			return nil, err
+		}
+		result.games = append(result.games, &gameResolver{l: l, g: g})
+	}
+	if curs != nil {
+		encoded := curs.String()
+		result.cursor = &encoded
+	}
+	return result, nil
+}
+
+func (q *graphQLQuery) UserStats(ctx context.Context, args struct{ UserID string }) (*userStatsResolver, error) {
+	l := graphQLLoaderFrom(ctx)
+	userStats, err := loadUserStats(nil, newGraphQLRequest(l.r, map[string]string{"user_id": args.UserID}, url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	userStats.User.Email = ""
+	return &userStatsResolver{userStats}, nil
+}
+
+type gameResolver struct {
+	l *graphQLLoader
+	g *graphQLGame
+}
+
+func (g *gameResolver) ID() graphql.ID {
+	return graphql.ID(g.g.game.ID.Encode())
+}
+
+func (g *gameResolver) Desc() string {
+	return g.g.game.Desc
+}
+
+func (g *gameResolver) Variant() string {
+	return g.g.game.Variant
+}
+
+func (g *gameResolver) Started() bool {
+	return g.g.game.Started
+}
+
+func (g *gameResolver) Mustered() bool {
+	return g.g.game.Mustered
+}
+
+func (g *gameResolver) Closed() bool {
+	return g.g.game.Closed
+}
+
+func (g *gameResolver) Finished() bool {
+	return g.g.game.Finished
+}
+
+func (g *gameResolver) Private() bool {
+	return g.g.game.Private
+}
+
+func (g *gameResolver) Anonymous() bool {
+	return g.g.game.Anonymous
+}
+
+func (g *gameResolver) PhaseLengthMinutes() int32 {
+	return int32(g.g.game.PhaseLengthMinutes)
+}
+
+func (g *gameResolver) NonMovementPhaseLengthMinutes() int32 {
+	return int32(g.g.game.NonMovementPhaseLengthMinutes)
+}
+
+func (g *gameResolver) NMembers() int32 {
+	return int32(g.g.game.NMembers)
+}
+
+func (g *gameResolver) FailedRequirements() []string {
+	return append([]string{}, g.g.game.FailedRequirements...)
+}
+
+func (g *gameResolver) GameMaster() *userResolver {
+	return &userResolver{&g.g.game.GameMaster}
+}
+
+func (g *gameResolver) Members() []*memberResolver {
+	result := make([]*memberResolver, len(g.g.game.Members))
+	for i := range g.g.game.Members {
+		result[i] = &memberResolver{l: g.l, g: g.g, member: &g.g.game.Members[i]}
+	}
+	return result
+}
+
+func (g *gameResolver) CreatedAt() graphql.Time {
+	return graphQLTime(g.g.game.CreatedAt)
+}
+
+func (g *gameResolver) StartedAt() graphql.Time {
+	return graphQLTime(g.g.game.StartedAt)
+}
+
+func (g *gameResolver) FinishedAt() graphql.Time {
+	return graphQLTime(g.g.game.FinishedAt)
+}
+
+func (g *gameResolver) Phases() ([]*phaseResolver, error) {
+	phases, err := g.l.phases(g.g)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*phaseResolver, len(phases))
+	for i := range phases {
+		result[i] = &phaseResolver{l: g.l, g: g.g, phase: &phases[i]}
+	}
+	return result, nil
+}
+
+func (g *gameResolver) Phase(args struct{ Ordinal int32 }) (*phaseResolver, error) {
+	phases, err := g.l.phases(g.g)
+	if err != nil {
+		return nil, err
+	}
+	for i := range phases {
+		if phases[i].PhaseOrdinal == int64(args.Ordinal) {
+			return &phaseResolver{l: g.l, g: g.g, phase: &phases[i]}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (g *gameResolver) Channels() ([]*channelResolver, error) {
+	channels, err := g.l.channels(g.g)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*channelResolver, len(channels))
+	for i := range channels {
+		result[i] = &channelResolver{l: g.l, g: g.g, channel: &channels[i]}
+	}
+	return result, nil
+}
+
+type userResolver struct {
+	user *auth.User
+}
+
+func (u *userResolver) ID() string {
+	return u.user.Id
+}
+
+func (u *userResolver) Name() string {
+	return u.user.Name
+}
+
+func (u *userResolver) GivenName() string {
+	return u.user.GivenName
+}
+
+func (u *userResolver) FamilyName() string {
+	return u.user.FamilyName
+}
+
+func (u *userResolver) Email() string {
+	return u.user.Email
+}
+
+func (u *userResolver) Picture() string {
+	return u.user.Picture
+}
+
+type memberResolver struct {
+	l      *graphQLLoader
+	g      *graphQLGame
+	member *Member
+}
+
+func (m *memberResolver) User() *userResolver {
+	return &userResolver{&m.member.User}
+}
+
+func (m *memberResolver) Nation() string {
+	return string(m.member.Nation)
+}
+
+func (m *memberResolver) GameAlias() string {
+	return m.member.GameAlias
+}
+
+func (m *memberResolver) NationPreferences() string {
+	return m.member.NationPreferences
+}
+
+func (m *memberResolver) UnreadMessages() int32 {
+	return int32(m.member.UnreadMessages)
+}
+
+func (m *memberResolver) Replaceable() bool {
+	return m.member.Replaceable
+}
+
+func (m *memberResolver) NewestPhaseState() *phaseStateResolver {
+	return &phaseStateResolver{&m.member.NewestPhaseState}
+}
+
+func (m *memberResolver) Stats() (*userStatsResolver, error) {
+	if m.member.User.Id == "" {
+		return nil, nil
+	}
+	userStats, err := m.l.userStats(m.g, m.member.User.Id)
+	if err != nil || userStats == nil {
+		return nil, err
+	}
+	return &userStatsResolver{userStats}, nil
+}
+
+type userStatsResolver struct {
+	userStats *UserStats
+}
+
+func (u *userStatsResolver) UserID() string {
+	return u.userStats.UserId
+}
+
+func (u *userStatsResolver) User() *userResolver {
+	return &userResolver{&u.userStats.User}
+}
+
+func (u *userStatsResolver) JoinedGames() int32 {
+	return int32(u.userStats.JoinedGames)
+}
+
+func (u *userStatsResolver) StartedGames() int32 {
+	return int32(u.userStats.StartedGames)
+}
+
+func (u *userStatsResolver) FinishedGames() int32 {
+	return int32(u.userStats.FinishedGames)
+}
+
+func (u *userStatsResolver) MasteredGames() int32 {
+	return int32(u.userStats.MasteredGames)
+}
+
+func (u *userStatsResolver) SoloGames() int32 {
+	return int32(u.userStats.SoloGames)
+}
+
+func (u *userStatsResolver) DIASGames() int32 {
+	return int32(u.userStats.DIASGames)
+}
+
+func (u *userStatsResolver) EliminatedGames() int32 {
+	return int32(u.userStats.EliminatedGames)
+}
+
+func (u *userStatsResolver) DroppedGames() int32 {
+	return int32(u.userStats.DroppedGames)
+}
+
+func (u *userStatsResolver) NMRPhases() int32 {
+	return int32(u.userStats.NMRPhases)
+}
+
+func (u *userStatsResolver) ActivePhases() int32 {
+	return int32(u.userStats.ActivePhases)
+}
+
+func (u *userStatsResolver) ReadyPhases() int32 {
+	return int32(u.userStats.ReadyPhases)
+}
+
+func (u *userStatsResolver) Reliability() float64 {
+	return u.userStats.Reliability
+}
+
+func (u *userStatsResolver) Quickness() float64 {
+	return u.userStats.Quickness
+}
+
+func (u *userStatsResolver) Hated() float64 {
+	return u.userStats.Hated
+}
+
+func (u *userStatsResolver) Hater() float64 {
+	return u.userStats.Hater
+}
+
+func (u *userStatsResolver) Rating() float64 {
+	return u.userStats.TrueSkill.Rating
+}
+
+type phaseResolver struct {
+	l     *graphQLLoader
+	g     *graphQLGame
+	phase *Phase
+}
+
+func (p *phaseResolver) Ordinal() int32 {
+	return int32(p.phase.PhaseOrdinal)
+}
+
+func (p *phaseResolver) Season() string {
+	return string(p.phase.Season)
+}
+
+func (p *phaseResolver) Year() int32 {
+	return int32(p.phase.Year)
+}
+
+func (p *phaseResolver) Type() string {
+	return string(p.phase.Type)
+}
+
+func (p *phaseResolver) Resolved() bool {
+	return p.phase.Resolved
+}
+
+func (p *phaseResolver) CreatedAt() graphql.Time {
+	return graphQLTime(p.phase.CreatedAt)
+}
+
+func (p *phaseResolver) ResolvedAt() graphql.Time {
+	return graphQLTime(p.phase.ResolvedAt)
+}
+
+func (p *phaseResolver) DeadlineAt() graphql.Time {
+	return graphQLTime(p.phase.DeadlineAt)
+}
+
+func (p *phaseResolver) Units() []*unitResolver {
+	result := make([]*unitResolver, len(p.phase.Units))
+	for i := range p.phase.Units {
+		result[i] = &unitResolver{&p.phase.Units[i]}
+	}
+	return result
+}
+
+func (p *phaseResolver) SCs() []*scResolver {
+	result := make([]*scResolver, len(p.phase.SCs))
+	for i := range p.phase.SCs {
+		result[i] = &scResolver{&p.phase.SCs[i]}
+	}
+	return result
+}
+
+func (p *phaseResolver) PhaseStates() ([]*phaseStateResolver, error) {
+	phaseStates, err := p.l.phaseStates(p.g, p.phase)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*phaseStateResolver, len(phaseStates))
+	for i := range phaseStates {
+		result[i] = &phaseStateResolver{&phaseStates[i]}
+	}
+	return result, nil
+}
+
+func (p *phaseResolver) Orders() ([]*orderResolver, error) {
+	orders, err := p.l.orders(p.g, p.phase)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*orderResolver, len(orders))
+	for i := range orders {
+		result[i] = &orderResolver{&orders[i]}
+	}
+	return result, nil
+}
+
+type unitResolver struct {
+	unit *UnitWrapper
+}
+
+func (u *unitResolver) Province() string {
+	return string(u.unit.Province)
+}
+
+func (u *unitResolver) Type() string {
+	return string(u.unit.Unit.Type)
+}
+
+func (u *unitResolver) Nation() string {
+	return string(u.unit.Unit.Nation)
+}
+
+type scResolver struct {
+	sc *SC
+}
+
+func (s *scResolver) Province() string {
+	return string(s.sc.Province)
+}
+
+func (s *scResolver) Owner() string {
+	return string(s.sc.Owner)
+}
+
+type phaseStateResolver struct {
+	phaseState *PhaseState
+}
+
+func (p *phaseStateResolver) Nation() string {
+	return string(p.phaseState.Nation)
+}
+
+func (p *phaseStateResolver) ReadyToResolve() bool {
+	return p.phaseState.ReadyToResolve
+}
+
+func (p *phaseStateResolver) WantsDIAS() bool {
+	return p.phaseState.WantsDIAS
+}
+
+func (p *phaseStateResolver) WantsConcede() bool {
+	return p.phaseState.WantsConcede
+}
+
+func (p *phaseStateResolver) OnProbation() bool {
+	return p.phaseState.OnProbation
+}
+
+func (p *phaseStateResolver) NoOrders() bool {
+	return p.phaseState.NoOrders
+}
+
+func (p *phaseStateResolver) Eliminated() bool {
+	return p.phaseState.Eliminated
+}
+
+func (p *phaseStateResolver) Messages() string {
+	return p.phaseState.Messages
+}
+
+func (p *phaseStateResolver) Note() string {
+	return p.phaseState.Note
+}
+
+type orderResolver struct {
+	order *Order
+}
+
+func (o *orderResolver) Nation() string {
+	return string(o.order.Nation)
+}
+
+func (o *orderResolver) Parts() []string {
+	return append([]string{}, o.order.Parts...)
+}
+
+type channelResolver struct {
+	l       *graphQLLoader
+	g       *graphQLGame
+	channel *Channel
+}
+
+func (c *channelResolver) Members() []string {
+	return graphQLStrings(c.channel.Members)
+}
+
+func (c *channelResolver) NMessages() int32 {
+	return int32(c.channel.NMessages)
+}
+
+func (c *channelResolver) Messages(args struct{ Limit *int32 }) ([]*messageResolver, error) {
+	messages, err := c.l.messages(c.g, c.channel.Members)
+	if err != nil {
+		return nil, err
+	}
+	if args.Limit != nil && int(*args.Limit) < len(messages) {
+		messages = messages[:*args.Limit]
+	}
+	result := make([]*messageResolver, len(messages))
+	for i := range messages {
+		result[i] = &messageResolver{&messages[i]}
+	}
+	return result, nil
+}
+
+type messageResolver struct {
+	message *Message
+}
+
+func (m *messageResolver) ID() graphql.ID {
+	return graphql.ID(m.message.ID.Encode())
+}
+
+func (m *messageResolver) Sender() string {
+	return string(m.message.Sender)
+}
+
+func (m *messageResolver) ChannelMembers() []string {
+	return graphQLStrings(m.message.ChannelMembers)
+}
+
+func (m *messageResolver) Body() string {
+	return m.message.Body
+}
+
+func (m *messageResolver) Grey() bool {
+	return m.message.Grey
+}
+
+func (m *messageResolver) ReplyTo() *graphql.ID {
+	return graphQLOptionalID(m.message.ReplyTo)
+}
+
+func (m *messageResolver) Quote() string {
+	return m.message.Quote
+}
+
+func (m *messageResolver) ThreadId() *graphql.ID {
+	return graphQLOptionalID(m.message.ThreadID)
+}
+
+func (m *messageResolver) NReplies() int32 {
+	return int32(m.message.NReplies)
+}
+
+func (m *messageResolver) Reactions() []*reactionResolver {
+	result := make([]*reactionResolver, len(m.message.Reactions))
+	for i := range m.message.Reactions {
+		result[i] = &reactionResolver{&m.message.Reactions[i]}
+	}
+	return result
+}
+
+func (m *messageResolver) CreatedAt() graphql.Time {
+	return graphQLTime(m.message.CreatedAt)
+}
+
+func (m *messageResolver) EditedAt() *graphql.Time {
+	if m.message.EditedAt.IsZero() {
+		return nil
+	}
+	editedAt := graphQLTime(m.message.EditedAt)
+	return &editedAt
+}
+
+func (m *messageResolver) Retracted() bool {
+	return m.message.Retracted
+}
+
+func (m *messageResolver) Hidden() bool {
+	return m.message.Hidden
+}
+
+func (m *messageResolver) Annotations() *mapAnnotationsResolver {
+	return &mapAnnotationsResolver{&m.message.Annotations}
+}
+
+type mapAnnotationsResolver struct {
+	annotations *MapAnnotations
+}
+
+func (a *mapAnnotationsResolver) Arrows() []*mapArrowResolver {
+	result := make([]*mapArrowResolver, len(a.annotations.Arrows))
+	for i := range a.annotations.Arrows {
+		result[i] = &mapArrowResolver{&a.annotations.Arrows[i]}
+	}
+	return result
+}
+
+func (a *mapAnnotationsResolver) Highlights() []string {
+	result := make([]string, len(a.annotations.Highlights))
+	for i, prov := range a.annotations.Highlights {
+		result[i] = string(prov)
+	}
+	return result
+}
+
+func (a *mapAnnotationsResolver) Orders() []string {
+	return append([]string{}, a.annotations.Orders...)
+}
+
+func (a *mapAnnotationsResolver) PhaseOrdinal() int32 {
+	return int32(a.annotations.PhaseOrdinal)
+}
+
+type mapArrowResolver struct {
+	arrow *MapArrow
+}
+
+func (a *mapArrowResolver) From() string {
+	return string(a.arrow.From)
+}
+
+func (a *mapArrowResolver) To() string {
+	return string(a.arrow.To)
+}
+
+type reactionResolver struct {
+	reaction *MessageReaction
+}
+
+func (r *reactionResolver) Nation() string {
+	return string(r.reaction.Nation)
+}
+
+func (r *reactionResolver) Emoji() string {
+	return r.reaction.Emoji
+}
@@ -0,0 +1,56 @@
+package game
+
+import (
+	"net/http"
+
+	"github.com/zond/godip"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	// GreyPressSender replaces the sender of grey press for everyone but the
+	// sender.
+	GreyPressSender = "Anonymous"
+)
+
+// validateGreyPress returns an error if message is grey press not allowed in
+// game.
+func validateGreyPress(game *Game, message *Message) error {
+	if !message.Grey {
+		return nil
+	}
+	if !game.AllowGreyPress {
+		return HTTPErr{"grey press not allowed", http.StatusBadRequest}
+	}
+	if game.GreyPressBroadcastOnly && !isPublic(game.Variant, message.ChannelMembers) {
+		return HTTPErr{"grey press only allowed in the conference channel", http.StatusBadRequest}
+	}
+	return nil
+}
+
+// redactGreyPress hides the sender of m if it's grey press and viewer didn't
+// send it.
+func (m *Message) redactGreyPress(viewer godip.Nation) {
+	if m.Grey && m.Sender != viewer {
+		m.Sender = GreyPressSender
+	}
+}
+
+// RedactGreyPress hides the senders of the grey press not sent by viewer,
+// and returns the messages.
+func (m Messages) RedactGreyPress(viewer godip.Nation) Messages {
+	for i := range m {
+		m[i].redactGreyPress(viewer)
+	}
+	return m
+}
+
+// RedactGreyPress hides the senders of the latest messages of the channels
+// if they are grey press not sent by viewer.
+func (c Channels) RedactGreyPress(viewer godip.Nation) Channels {
+	for i := range c {
+		c[i].LatestMessage.redactGreyPress(viewer)
+	}
+	return c
+}
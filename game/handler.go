@@ -12,6 +12,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/diplicity/variants"
 	"github.com/zond/godip"
 	"golang.org/x/net/context"
@@ -36,6 +37,7 @@ var (
 		gameKind:        func() interface{} { return &Game{} },
 		gameResultKind:  func() interface{} { return &GameResult{} },
 		phaseResultKind: func() interface{} { return &PhaseResult{} },
+		messageKind:     func() interface{} { return &Message{} },
 	}
 
 	AllocationResource *Resource
@@ -85,12 +87,27 @@ const (
 	ListChannelsRoute                   = "ListChannels"
 	ListMessagesRoute                   = "ListMessages"
 	ListBansRoute                       = "ListBans"
+	ListBlocksRoute                     = "ListBlocks"
+	ListModerationNoticesRoute          = "ListModerationNotices"
 	ListTopRatedPlayersRoute            = "ListTopRatedPlayers"
 	ListTopReliablePlayersRoute         = "ListTopReliablePlayers"
 	ListTopHatedPlayersRoute            = "ListTopHatedPlayers"
 	ListTopHaterPlayersRoute            = "ListTopHaterPlayers"
 	ListTopQuickPlayersRoute            = "ListTopQuickPlayers"
 	ListFlaggedMessagesRoute            = "ListFlaggedMessages"
+	ListGameAuditLogRoute               = "ListGameAuditLog"
+	AddReactionRoute                    = "AddReaction"
+	RemoveReactionRoute                 = "RemoveReaction"
+	SearchMessagesRoute                 = "SearchMessages"
+	ListScheduledMessagesRoute          = "ListScheduledMessages"
+	AssignFlaggedMessagesRoute          = "AssignFlaggedMessages"
+	FlaggedMessagesContextRoute         = "FlaggedMessagesContext"
+	ResolveFlaggedMessagesRoute         = "ResolveFlaggedMessages"
+	ExportChannelRoute                  = "ExportChannel"
+	ExportGameChannelsRoute             = "ExportGameChannels"
+	RenderMessageMapRoute               = "RenderMessageMap"
+	ExportUserRoute                     = "ExportUser"
+	DeleteUserRoute                     = "DeleteUser"
 	ListGameResultTrueSkillsRoute       = "ListGameResultTrueSkills"
 	DevResolvePhaseTimeoutRoute         = "DevResolvePhaseTimeout"
 	DevUserStatsUpdateRoute             = "DevUserStatsUpdate"
@@ -123,6 +140,7 @@ const (
 	FindBadlyResetGamesRoute            = "FindBadlyResetGames"
 	FixBrokenlyMusteredGamesRoute       = "FixBrokenlyMusteredGames"
 	FindBrokenNewestPhaseMetaRoute      = "FindBrokenNewestPhaseMeta"
+	GraphQLRoute                        = "GraphQL"
 )
 
 type userStatsHandler struct {
@@ -227,16 +245,16 @@ type gamesReq struct {
 }
 
 /*
- * handle uses the generating and filtering setup done by the gamesHandler
+ * load uses the generating and filtering setup done by the gamesHandler
  * to generate the next batch (according to cursor and limit)
  * of games to return.
  */
-func (req *gamesReq) handle() error {
+func (req *gamesReq) load() (Games, *datastore.Cursor, error) {
 	var err error
 	games := make(Games, 0, req.limit)
 	for err == nil && len(games) < req.limit {
 		var nextBatch Games
-		nextBatch, err = req.h.fetch(req.iter, req.limit-len(games))
+		nextBatch, err = req.h.fetch(req.ctx, req.iter, req.limit-len(games))
 		// Remove those not matching programmatic filters.
 		nextBatch.RemoveCustomFiltered(req.detailFilters)
 		// Mark failed requirements for games if required.
@@ -246,16 +264,25 @@ func (req *gamesReq) handle() error {
 		// Mark bans for games if required, and remove them if required.
 		if req.viewerBanFilter {
 			if _, filtErr := nextBatch.RemoveBanned(req.ctx, req.user.Id, req.viewerFilterRemove); filtErr != nil {
-				return filtErr
+				return nil, nil, filtErr
 			}
 		}
 		games = append(games, nextBatch...)
 	}
 	if err != nil && err != datastore.Done {
-		return err
+		return nil, nil, err
 	}
 
 	curs, err := req.cursor(err)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return games, curs, nil
+}
+
+func (req *gamesReq) handle() error {
+	games, curs, err := req.load()
 	if err != nil {
 		return err
 	}
@@ -338,6 +365,16 @@ func (req *gamesReq) intervalFilter(ctx context.Context, fieldName, paramName st
  *          and add some testing in diptest/game_test.go/TestGameListFilters and /TestIndexCreation.
  */
 func (h *gamesHandler) handle(w ResponseWriter, r Request) error {
+	req, err := h.request(w, r)
+	if err != nil {
+		return err
+	}
+	return req.handle()
+}
+
+// request prepares a gamesReq iterating over the games matching h and the
+// query parameters of r.
+func (h *gamesHandler) request(w ResponseWriter, r Request) (*gamesReq, error) {
 	req := &gamesReq{
 		ctx:                appengine.NewContext(r.Req()),
 		w:                  w,
@@ -350,7 +387,7 @@ func (h *gamesHandler) handle(w ResponseWriter, r Request) error {
 
 	user, ok := r.Values()["user"].(*auth.User)
 	if !ok {
-		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
 	}
 	req.user = user
 
@@ -358,7 +395,7 @@ func (h *gamesHandler) handle(w ResponseWriter, r Request) error {
 	if err := datastore.Get(req.ctx, UserStatsID(req.ctx, user.Id), userStats); err == datastore.ErrNoSuchEntity {
 		userStats.UserId = user.Id
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 	req.userStats = userStats
 
@@ -381,7 +418,7 @@ func (h *gamesHandler) handle(w ResponseWriter, r Request) error {
 	case scopeGameMaster:
 		q = q.Filter("GameMaster.Id=", user.Id)
 	default:
-		return HTTPErr{fmt.Sprintf("unrecognized scope %v", h.scope), http.StatusInternalServerError}
+		return nil, HTTPErr{fmt.Sprintf("unrecognized scope %v", h.scope), http.StatusInternalServerError}
 	}
 
 	apiLevel := auth.APILevel(r)
@@ -428,31 +465,40 @@ func (h *gamesHandler) handle(w ResponseWriter, r Request) error {
 	if f := req.intervalFilter(req.ctx, "MaxRating", "max-rating"); f != nil {
 		req.detailFilters = append(req.detailFilters, f)
 	}
+	if uq.Get("hide-blocked") == "true" {
+		blockedIds, err := loadBlockedIds(req.ctx, user.Id)
+		if err != nil {
+			return nil, err
+		}
+		req.detailFilters = append(req.detailFilters, func(g *Game) bool {
+			return !g.hasBlockedMember(blockedIds)
+		})
+	}
 
 	cursor := uq.Get("cursor")
 	if cursor == "" {
 		req.iter = q.Run(req.ctx)
-		return req.handle()
+		return req, nil
 	}
 
 	decoded, err := datastore.DecodeCursor(cursor)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.iter = q.Start(decoded).Run(req.ctx)
-	return req.handle()
+	return req, nil
 }
 
-func (h *gamesHandler) fetch(iter *datastore.Iterator, max int) (Games, error) {
+func (h *gamesHandler) fetch(ctx context.Context, iter *datastore.Iterator, max int) (Games, error) {
 	var err error
 	result := make(Games, 0, max)
 	for err == nil && len(result) < max {
 		game := Game{}
 		game.ID, err = iter.Next(&game)
 		for i := range game.NewestPhaseMeta {
-			game.NewestPhaseMeta[i].Refresh()
+			game.NewestPhaseMeta[i].Refresh(ctx)
 		}
-		game.Refresh()
+		game.Refresh(ctx)
 		if err == nil {
 			result = append(result, game)
 		}
@@ -661,11 +707,21 @@ type configuration struct {
 	Superusers            *auth.Superusers
 	DiscordBotCredentials *auth.DiscordBotCredentials
 	DiscordBotToken       *auth.DiscordBotToken
+	LoginProviders        []*auth.LoginProvider
 }
 
 func handleConfigure(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
+	// Until superusers or admins are configured, anyone may configure the server.
+	if granted, err := auth.PermissionGranted(ctx, auth.ConfigurePermission); err != nil {
+		return err
+	} else if granted {
+		if err := auth.RequirePermission(ctx, r, auth.ConfigurePermission); err != nil {
+			return err
+		}
+	}
+
 	conf := &configuration{}
 	if err := json.NewDecoder(r.Req().Body).Decode(conf); err != nil {
 		return err
@@ -700,6 +756,11 @@ func handleConfigure(w ResponseWriter, r Request) error {
 			return err
 		}
 	}
+	for _, provider := range conf.LoginProviders {
+		if err := auth.SetLoginProvider(ctx, provider); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -899,20 +960,8 @@ func reSave(ctx context.Context, kind string, counter int, cursorString string)
 func handleReGameResult(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	return reGameResultFunc.EnqueueIn(ctx, 0, r.Req().URL.Query().Get("with-repair") == "true", 0, 0, 0, "")
@@ -921,20 +970,8 @@ func handleReGameResult(w ResponseWriter, r Request) error {
 func handleUpdateAllUserStats(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	return updateAllUserStatsFunc.EnqueueIn(ctx, 0, 0, "")
@@ -943,20 +980,8 @@ func handleUpdateAllUserStats(w ResponseWriter, r Request) error {
 func handleReScore(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	return reScoreFunc.EnqueueIn(ctx, 0, 0, "")
@@ -965,20 +990,8 @@ func handleReScore(w ResponseWriter, r Request) error {
 func handleReSave(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	kind := r.Req().URL.Query().Get("kind")
@@ -996,20 +1009,8 @@ func reScheduleAll(w ResponseWriter, r Request, onlyBroken bool) error {
 
 	log.Infof(ctx, "reScheduleAll(..., %v)", onlyBroken)
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	log.Infof(ctx, "Authorized!")
@@ -1025,7 +1026,7 @@ func reScheduleAll(w ResponseWriter, r Request, onlyBroken bool) error {
 	log.Infof(ctx, "Found %v started and unfinished games.", len(games))
 	for _, game := range games {
 		if len(game.NewestPhaseMeta) > 0 {
-			if !onlyBroken || (game.NewestPhaseMeta[0].DeadlineAt.Before(time.Now()) && !game.NewestPhaseMeta[0].Resolved) {
+			if !onlyBroken || (game.NewestPhaseMeta[0].DeadlineAt.Before(clock.Now(ctx)) && !game.NewestPhaseMeta[0].Resolved) {
 				log.Infof(ctx, "Rescheduling %+v", game)
 				if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 					phaseID, err := PhaseID(ctx, game.ID, game.NewestPhaseMeta[0].PhaseOrdinal)
@@ -1057,20 +1058,8 @@ func handleReScheduleAll(w ResponseWriter, r Request) error {
 func handleRemoveDIASFromSoloGames(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	gameResults := GameResults{}
@@ -1115,20 +1104,8 @@ func diasUsersQuery() *datastore.Query {
 func handleReComputeAllDIASUsers(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	cursor, err := diasUsersQuery().Run(ctx).Cursor()
@@ -1195,20 +1172,8 @@ var (
 func handleFindBadlyResetGames(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	for gameIDString, resetMembers := range badlyResetGameMembersByGameIDString {
@@ -1287,7 +1252,7 @@ func handleFindBadlyResetGames(w ResponseWriter, r Request) error {
 						lastPhase = &phases[idx]
 					}
 				}
-				lastPhase.DeadlineAt = time.Now().Add(time.Hour * 24 * 3)
+				lastPhase.DeadlineAt = clock.Now(ctx).Add(time.Hour * 24 * 3)
 				if err := lastPhase.ScheduleResolution(ctx); err != nil {
 					return err
 				}
@@ -1312,20 +1277,8 @@ func handleFindBadlyResetGames(w ResponseWriter, r Request) error {
 func handleFixBrokenlyMusteredGames(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	games := Games{}
@@ -1418,20 +1371,8 @@ func handleFixBrokenlyMusteredGames(w ResponseWriter, r Request) error {
 func handleMusterAllFinishedGames(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	games := Games{}
@@ -1484,20 +1425,8 @@ func handleMusterAllFinishedGames(w ResponseWriter, r Request) error {
 func handleFindBrokenNewestPhaseMeta(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	games := Games{}
@@ -1549,20 +1478,8 @@ func newestPhaseForGame(ctx context.Context, gameID *datastore.Key) (*Phase, err
 func handleMusterAllRunningGames(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	games := Games{}
@@ -1615,20 +1532,8 @@ func handleMusterAllRunningGames(w ResponseWriter, r Request) error {
 func handleGlobalSystemMessage(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MessagePlayersPermission); err != nil {
+		return err
 	}
 
 	games := Games{}
@@ -1656,26 +1561,30 @@ func handleGlobalSystemMessage(w ResponseWriter, r Request) error {
 		}
 	}
 
+	if r.Req().FormValue("really") == "yes" {
+		return auth.RecordAudit(ctx, nil, auditActorId(r), auth.SendSystemMessageAuditAction, "", nil, map[string]interface{}{
+			"Body":  r.Req().FormValue("body"),
+			"Games": len(games),
+		})
+	}
+
 	return nil
 }
 
+// auditActorId returns the id of the user making r, or an empty string for
+// unauthenticated requests on the dev app server.
+func auditActorId(r Request) string {
+	if user, ok := r.Values()["user"].(*auth.User); ok {
+		return user.Id
+	}
+	return ""
+}
+
 func handleSendSystemMessage(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.ManageGamesPermission); err != nil {
+		return err
 	}
 
 	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
@@ -1704,7 +1613,11 @@ func handleSendSystemMessage(w ResponseWriter, r Request) error {
 		Body:           r.Req().FormValue("body"),
 	}
 
-	return createMessageHelper(ctx, r.Req().Host, newMessage)
+	if err := createMessageHelper(ctx, r.Req().Host, newMessage); err != nil {
+		return err
+	}
+
+	return auth.RecordAudit(ctx, gameID, auditActorId(r), auth.SendSystemMessageAuditAction, r.Vars()["recipients"], nil, map[string]string{"Body": newMessage.Body})
 }
 
 func handleRemoveZippedOptions(w ResponseWriter, r Request) error {
@@ -1712,20 +1625,8 @@ func handleRemoveZippedOptions(w ResponseWriter, r Request) error {
 
 	log.Infof(ctx, "handleRemoveZippedOptions(...)")
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	gameIDs, err := datastore.NewQuery(gameKind).Filter("Started=", true).Filter("Finished=", false).KeysOnly().GetAll(ctx, nil)
@@ -1777,20 +1678,8 @@ func handleRemoveZippedOptions(w ResponseWriter, r Request) error {
 func handleReSchedule(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.ManageGamesPermission); err != nil {
+		return err
 	}
 
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
@@ -1888,13 +1777,13 @@ func handleReapInactiveWaitingPlayers(w ResponseWriter, r Request) error {
 		userMap[userIds[idx].StringID()] = user
 	}
 
-	minValidUntil := time.Now().Add(-MAX_STAGING_GAME_INACTIVITY)
+	minValidUntil := clock.Now(ctx).Add(-MAX_STAGING_GAME_INACTIVITY)
 	if paramInactivity := r.Req().URL.Query().Get("max-staging-game-inactivity"); paramInactivity != "" {
 		parsed, err := strconv.Atoi(paramInactivity)
 		if err != nil {
 			return err
 		}
-		minValidUntil = time.Now().Add(time.Duration(-parsed) * time.Second)
+		minValidUntil = clock.Now(ctx).Add(time.Duration(-parsed) * time.Second)
 	}
 	log.Infof(ctx, "Going to eject users with ValidUntil < %v from these games", minValidUntil)
 
@@ -1928,6 +1817,31 @@ func ejectMember(ctx context.Context, gameID *datastore.Key, userId string) erro
 	return nil
 }
 
+// Resources returns the resources registered by SetupRouter.
+func Resources() []*Resource {
+	return []*Resource{
+		ForumMailResource,
+		GameResource,
+		AllocationResource,
+		GameMasterInvitationResource,
+		GameMasterEditNewestPhaseDeadlineAtResource,
+		MemberResource,
+		PhaseResource,
+		OrderResource,
+		MessageResource,
+		PhaseStateResource,
+		GameStateResource,
+		GameResultResource,
+		BanResource,
+		BlockResource,
+		PhaseResultResource,
+		UserStatsResource,
+		MessageFlagResource,
+		FlaggedMessagesResource,
+		ScheduledMessageResource,
+	}
+}
+
 func SetupRouter(r *mux.Router) {
 	router = r
 	Handle(r, "/_reap-inactive-waiting-players", []string{"GET"}, ReapInactiveWaitingPlayersRoute, handleReapInactiveWaitingPlayers)
@@ -1956,6 +1870,19 @@ func SetupRouter(r *mux.Router) {
 	Handle(r, "/", []string{"GET"}, IndexRoute, handleIndex)
 	Handle(r, "/Game/{game_id}/GameResults/TrueSkills", []string{"GET"}, ListGameResultTrueSkillsRoute, listGameResultTrueSkills)
 	Handle(r, "/Game/{game_id}/Channels", []string{"GET"}, ListChannelsRoute, listChannels)
+	Handle(r, "/Game/{game_id}/AuditLog", []string{"GET"}, ListGameAuditLogRoute, listGameAuditLog)
+	Handle(r, "/Game/{game_id}/MessageSearch", []string{"GET"}, SearchMessagesRoute, searchMessages)
+	Handle(r, "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Reactions/{emoji}", []string{"PUT"}, AddReactionRoute, addReaction)
+	Handle(r, "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Reactions/{emoji}", []string{"DELETE"}, RemoveReactionRoute, removeReaction)
+	Handle(r, "/Game/{game_id}/Channel/{recipients}/Export", []string{"GET"}, ExportChannelRoute, exportChannel)
+	Handle(r, "/Game/{game_id}/Channel/{channel_members}/Messages/{message_id}/Map", []string{"GET"}, RenderMessageMapRoute, renderMessageMap)
+	Handle(r, "/Game/{game_id}/Channels/Export", []string{"GET"}, ExportGameChannelsRoute, exportGameChannels)
+	Handle(r, "/FlaggedMessages/{flagged_messages_id}/_assign", []string{"POST"}, AssignFlaggedMessagesRoute, assignFlaggedMessages)
+	Handle(r, "/FlaggedMessages/{flagged_messages_id}/Context", []string{"GET"}, FlaggedMessagesContextRoute, loadFlaggedMessagesContext)
+	Handle(r, "/FlaggedMessages/{flagged_messages_id}/_resolve", []string{"POST"}, ResolveFlaggedMessagesRoute, resolveFlaggedMessages)
+	Handle(r, "/User/{user_id}/Export", []string{"GET"}, ExportUserRoute, exportUser)
+	Handle(r, "/User/{user_id}/ModerationNotices", []string{"GET"}, ListModerationNoticesRoute, listModerationNotices)
+	Handle(r, "/User/{user_id}", []string{"DELETE"}, DeleteUserRoute, deleteUser)
 	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/_dev_resolve_timeout", []string{"GET"}, DevResolvePhaseTimeoutRoute, devResolvePhaseTimeout)
 	Handle(r, "/User/{user_id}/Stats/_dev_update", []string{"PUT"}, DevUserStatsUpdateRoute, devUserStatsUpdate)
 	// TODO(zond): Remove this when the Android client no longer uses the old API.
@@ -1974,24 +1901,60 @@ func SetupRouter(r *mux.Router) {
 	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/CreateAndCorroborate", []string{"POST"}, CreateAndCorroborateRoute, createAndCorroborate)
 	Handle(r, "/GlobalStats", []string{"GET"}, GlobalStatsRoute, handleGlobalStats)
 	Handle(r, "/Rss", []string{"GET"}, RssRoute, handleRss)
+	Handle(r, "/graphql", []string{"GET", "POST"}, GraphQLRoute, handleGraphQL)
 	Handle(r, "/Users/Ratings/Histogram", []string{"GET"}, GetUserRatingHistogramRoute, getUserRatingHistogram)
-	HandleResource(r, ForumMailResource)
-	HandleResource(r, GameResource)
-	HandleResource(r, AllocationResource)
-	HandleResource(r, GameMasterInvitationResource)
-	HandleResource(r, GameMasterEditNewestPhaseDeadlineAtResource)
-	HandleResource(r, MemberResource)
-	HandleResource(r, PhaseResource)
-	HandleResource(r, OrderResource)
-	HandleResource(r, MessageResource)
-	HandleResource(r, PhaseStateResource)
-	HandleResource(r, GameStateResource)
-	HandleResource(r, GameResultResource)
-	HandleResource(r, BanResource)
-	HandleResource(r, PhaseResultResource)
-	HandleResource(r, UserStatsResource)
-	HandleResource(r, MessageFlagResource)
-	HandleResource(r, FlaggedMessagesResource)
+	for _, resource := range Resources() {
+		HandleResource(r, resource)
+	}
+	for _, route := range []string{
+		ReapInactiveWaitingPlayersRoute,
+		TestReapInactiveWaitingPlayersRoute,
+		ReSaveRoute,
+		DeleteTrueSkillsRoute,
+		ReRateTrueSkillsRoute,
+		ReScoreRoute,
+		UpdateAllUserStatsRoute,
+		ReGameResultRoute,
+		ReScheduleRoute,
+		FixBrokenlyMusteredGamesRoute,
+		FindBrokenNewestPhaseMetaRoute,
+		MusterAllRunningGamesRoute,
+		MusterAllFinishedGamesRoute,
+		FindBadlyResetGamesRoute,
+		ReScheduleAllBrokenRoute,
+		ReScheduleAllRoute,
+		RemoveZippedOptionsRoute,
+		RemoveDIASFromSoloGamesRoute,
+		ReComputeAllDIASUsersRoute,
+		DevResolvePhaseTimeoutRoute,
+	} {
+		// Maintenance routes are for logged in superusers, not their access tokens.
+		auth.AllowScopes(route)
+	}
+	// The personal data export is for the user, not their bots.
+	auth.AllowScopes(ExportUserRoute)
+	auth.AllowScopes(GraphQLRoute, auth.ReadOnlyScope)
+	auth.AllowScopes(OrderResource.Route(Create), auth.OrdersScope)
+	auth.AllowScopes(OrderResource.Route(Update), auth.OrdersScope)
+	auth.AllowScopes(OrderResource.Route(Delete), auth.OrdersScope)
+	auth.AllowScopes(PhaseStateResource.Route(Update), auth.OrdersScope)
+	auth.AllowScopes("deprecatedUpdatePhaseState", auth.OrdersScope)
+	auth.AllowScopes(CreateAndCorroborateRoute, auth.OrdersScope)
+	auth.AllowScopes(MessageResource.Route(Create), auth.PressScope)
+	auth.AllowScopes(MessageResource.Route(Update), auth.PressScope)
+	auth.AllowScopes(MessageResource.Route(Delete), auth.PressScope)
+	auth.AllowScopes(MessageFlagResource.Route(Create), auth.PressScope)
+	auth.AllowScopes(AddReactionRoute, auth.PressScope)
+	auth.AllowScopes(RemoveReactionRoute, auth.PressScope)
+	auth.AllowScopes(ScheduledMessageResource.Route(Create), auth.PressScope)
+	auth.AllowScopes(ScheduledMessageResource.Route(Delete), auth.PressScope)
+	auth.AllowScopes(GameStateResource.Route(Update), auth.PressScope)
+	auth.AllowScopes(GameResource.Route(Update), auth.GameMasterScope)
+	auth.AllowScopes(GameResource.Route(Delete), auth.GameMasterScope)
+	auth.AllowScopes(GameMasterInvitationResource.Route(Create), auth.GameMasterScope)
+	auth.AllowScopes(GameMasterInvitationResource.Route(Delete), auth.GameMasterScope)
+	auth.AllowScopes(GameMasterEditNewestPhaseDeadlineAtResource.Route(Create), auth.GameMasterScope)
+	auth.AllowScopes(MemberResource.Route(Delete), auth.GameMasterScope)
 	HeadCallback(func(head *Node) error {
 		head.AddEl("script", "src", "https://www.gstatic.com/firebasejs/7.9.2/firebase.js")
 		head.AddEl("script", "src", "https://www.gstatic.com/firebasejs/7.9.2/firebase-app.js")
@@ -0,0 +1,177 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	dvars "github.com/zond/diplicity/variants"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	maxMapAnnotations = 50
+)
+
+// MapArrow is an arrow from one province to another.
+type MapArrow struct {
+	From godip.Province `methods:"POST"`
+	To   godip.Province `methods:"POST"`
+}
+
+// MapAnnotations are drawn on the map of the phase a message was sent during.
+type MapAnnotations struct {
+	Arrows     []MapArrow       `methods:"POST"`
+	Highlights []godip.Province `methods:"POST"`
+	// Orders are proposed orders, with space separated parts like
+	// "par Move bur".
+	Orders []string `methods:"POST"`
+	// PhaseOrdinal is the phase the annotations were made during.
+	PhaseOrdinal int64
+}
+
+func (a *MapAnnotations) IsEmpty() bool {
+	return len(a.Arrows) == 0 && len(a.Highlights) == 0 && len(a.Orders) == 0
+}
+
+// validate checks that the annotations only refer to provinces of the variant
+// of g, and that the proposed orders parse, and sets the phase of the
+// annotations to the newest phase of g.
+func (a *MapAnnotations) validate(g *Game) error {
+	if a.IsEmpty() {
+		*a = MapAnnotations{}
+		return nil
+	}
+	if len(a.Arrows)+len(a.Highlights)+len(a.Orders) > maxMapAnnotations {
+		return HTTPErr{fmt.Sprintf("messages can have at most %d map annotations", maxMapAnnotations), http.StatusBadRequest}
+	}
+	variant := variants.Variants[g.Variant]
+	graph := variant.Graph()
+	checkProvince := func(prov godip.Province) error {
+		if !graph.Has(prov) {
+			return HTTPErr{fmt.Sprintf("unknown province %q", prov), http.StatusBadRequest}
+		}
+		return nil
+	}
+	for _, arrow := range a.Arrows {
+		for _, prov := range []godip.Province{arrow.From, arrow.To} {
+			if err := checkProvince(prov); err != nil {
+				return err
+			}
+		}
+	}
+	for _, prov := range a.Highlights {
+		if err := checkProvince(prov); err != nil {
+			return err
+		}
+	}
+	for _, order := range a.Orders {
+		parsed, err := variant.Parser.Parse(strings.Fields(order))
+		if err != nil {
+			return HTTPErr{fmt.Sprintf("invalid order %q: %v", order, err), http.StatusBadRequest}
+		}
+		for _, prov := range parsed.Targets() {
+			if err := checkProvince(prov); err != nil {
+				return err
+			}
+		}
+	}
+	if len(g.NewestPhaseMeta) > 0 {
+		a.PhaseOrdinal = g.NewestPhaseMeta[0].PhaseOrdinal
+	}
+	return nil
+}
+
+func (a *MapAnnotations) toVariantsAnnotations() dvars.Annotations {
+	result := dvars.Annotations{
+		Highlights: a.Highlights,
+	}
+	for _, arrow := range a.Arrows {
+		result.Arrows = append(result.Arrows, dvars.Arrow{From: arrow.From, To: arrow.To})
+	}
+	for _, order := range a.Orders {
+		result.Orders = append(result.Orders, strings.Fields(order))
+	}
+	return result
+}
+
+// renderMessageMap renders the annotations of a message on the map of the
+// phase it was sent during.
+func renderMessageMap(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	channelMembers := Nations{}
+	channelMembers.FromString(r.Vars()["channel_members"])
+
+	channelID, err := ChannelID(ctx, gameID, channelMembers)
+	if err != nil {
+		return err
+	}
+
+	messageID, err := datastore.DecodeKey(r.Vars()["message_id"])
+	if err != nil || messageID.Kind() != messageKind || !messageID.Parent().Equal(channelID) {
+		return HTTPErr{"message not found", http.StatusNotFound}
+	}
+
+	game := &Game{}
+	message := &Message{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, messageID}, []interface{}{game, message}); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok && merr[0] == nil && merr[1] == datastore.ErrNoSuchEntity {
+			return HTTPErr{"message not found", http.StatusNotFound}
+		}
+		return err
+	}
+	game.ID = gameID
+
+	nation, mutedNats, err := messageViewer(ctx, game, user)
+	if err != nil {
+		return err
+	}
+	if !canListMessages(game, nation, channelMembers) {
+		return HTTPErr{"can only view messages of member channels", http.StatusForbidden}
+	}
+	if _, isMuted := mutedNats[message.Sender]; isMuted && !message.Grey {
+		return HTTPErr{"message not found", http.StatusNotFound}
+	}
+	if message.Annotations.IsEmpty() {
+		return HTTPErr{"message has no map annotations", http.StatusNotFound}
+	}
+
+	phaseID, err := PhaseID(ctx, gameID, message.Annotations.PhaseOrdinal)
+	if err != nil {
+		return err
+	}
+	phase := &Phase{}
+	userConfig := &auth.UserConfig{}
+	if err := datastore.GetMulti(
+		ctx,
+		[]*datastore.Key{phaseID, auth.UserConfigID(ctx, auth.UserID(ctx, user.Id))},
+		[]interface{}{phase, userConfig},
+	); err != nil {
+		if merr, ok := err.(appengine.MultiError); !ok || merr[0] != nil || merr[1] != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	vPhase := phase.toVariantsPhase(game.Variant, nil)
+	vPhase.Annotations = message.Annotations.toVariantsAnnotations()
+
+	return dvars.RenderPhaseMap(w, r, vPhase, userConfig.Colors)
+}
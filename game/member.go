@@ -185,6 +185,9 @@ type deleteMemberRequest struct {
 	actorId    string
 	toRemoveId string
 	systemReq  bool
+	// secondFactorErr is returned if a game master removes a member from a
+	// game requiring a verified second factor of its game master.
+	secondFactorErr error
 }
 
 func deleteMemberHelper(ctx context.Context, gameID *datastore.Key, delReq deleteMemberRequest, idempotent bool) (*Member, error) {
@@ -209,6 +212,17 @@ func deleteMemberHelper(ctx context.Context, gameID *datastore.Key, delReq delet
 			return HTTPErr{"member not removable, or actor not game master", http.StatusPreconditionFailed}
 		}
 
+		if !delReq.systemReq && delReq.actorId != delReq.toRemoveId && game.RequireGameMasterSecondFactor && delReq.secondFactorErr != nil {
+			return delReq.secondFactorErr
+		}
+
+		// System requests have no actor, which is what the audit log expects.
+		if delReq.actorId != delReq.toRemoveId {
+			if err := auth.RecordAudit(ctx, gameID, delReq.actorId, auth.RemoveMemberAuditAction, delReq.toRemoveId, map[string]godip.Nation{"Nation": member.Nation}, nil); err != nil {
+				return err
+			}
+		}
+
 		if !game.Started {
 			newMembers := []Member{}
 			for memberIdx := range game.Members {
@@ -260,7 +274,7 @@ func deleteMember(w ResponseWriter, r Request) (*Member, error) {
 		return nil, err
 	}
 
-	return deleteMemberHelper(ctx, gameID, deleteMemberRequest{actorId: user.Id, toRemoveId: r.Vars()["user_id"]}, false)
+	return deleteMemberHelper(ctx, gameID, deleteMemberRequest{actorId: user.Id, toRemoveId: r.Vars()["user_id"], secondFactorErr: auth.RequireSecondFactor(r)}, false)
 }
 
 func createMemberHelper(
@@ -270,6 +284,9 @@ func createMemberHelper(
 	user *auth.User,
 	member *Member,
 ) (*Game, *Member, error) {
+	if err := checkSanctions(ctx, user.Id, nil); err != nil {
+		return nil, nil, err
+	}
 	var game *Game
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		game = &Game{}
@@ -359,6 +376,10 @@ func gameMasterDeleteInvitation(w ResponseWriter, r Request) (*GameMasterInvitat
 			return HTTPErr{"unauthorized", http.StatusUnauthorized}
 		}
 
+		if err := game.CheckGameMasterSecondFactor(r); err != nil {
+			return err
+		}
+
 		newInvitations := GameMasterInvitations{}
 		for _, invitation := range game.GameMasterInvitations {
 			if strings.ToLower(TrimSpace(invitation.Email)) != strings.ToLower(TrimSpace(r.Vars()["email"])) {
@@ -370,6 +391,13 @@ func gameMasterDeleteInvitation(w ResponseWriter, r Request) (*GameMasterInvitat
 		}
 		game.GameMasterInvitations = newInvitations
 
+		// Invited addresses aren't recorded, since members can read the audit log.
+		if gmi.Email != "" {
+			if err := auth.RecordAudit(ctx, gameID, user.Id, auth.DeleteInvitationAuditAction, "", map[string]godip.Nation{"Nation": gmi.Nation}, nil); err != nil {
+				return err
+			}
+		}
+
 		if _, err := datastore.Put(ctx, gameID, game); err != nil {
 			return err
 		}
@@ -417,6 +445,10 @@ func gameMasterCreateInvitation(w ResponseWriter, r Request) (*GameMasterInvitat
 			return HTTPErr{"unauthorized", http.StatusUnauthorized}
 		}
 
+		if err := game.CheckGameMasterSecondFactor(r); err != nil {
+			return err
+		}
+
 		if gmi.Nation != "" && !game.ValidNation(gmi.Nation) {
 			return HTTPErr{"unrecognized nation in variant", http.StatusBadRequest}
 		}
@@ -433,6 +465,11 @@ func gameMasterCreateInvitation(w ResponseWriter, r Request) (*GameMasterInvitat
 			game.GameMasterInvitations = append(game.GameMasterInvitations, *gmi)
 		}
 
+		// Invited addresses aren't recorded, since members can read the audit log.
+		if err := auth.RecordAudit(ctx, gameID, user.Id, auth.CreateInvitationAuditAction, "", nil, map[string]godip.Nation{"Nation": gmi.Nation}); err != nil {
+			return err
+		}
+
 		if _, err := datastore.Put(ctx, gameID, game); err != nil {
 			return err
 		}
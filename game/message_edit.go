@@ -0,0 +1,201 @@
+package game
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	messageEditKind = "MessageEdit"
+)
+
+// MessageEdit is a previous version of an edited or retracted message, kept
+// for moderation of flagged messages.
+type MessageEdit struct {
+	Body      string `datastore:",noindex"`
+	Quote     string `datastore:",noindex"`
+	Retracted bool
+	// EditedAt is when this version was replaced.
+	EditedAt time.Time
+}
+
+// editableBy returns an error unless nation can still edit or retract m.
+func (m *Message) editableBy(game *Game, nation godip.Nation, now time.Time) error {
+	if nation == "" || m.Sender != nation {
+		return HTTPErr{"can only edit your own messages", http.StatusForbidden}
+	}
+	if m.Retracted || m.Hidden {
+		return HTTPErr{"can not edit retracted or hidden messages", http.StatusBadRequest}
+	}
+	if now.Sub(m.CreatedAt) > game.MessageEditWindow() {
+		return HTTPErr{"can only edit messages within the edit window of the game", http.StatusForbidden}
+	}
+	return nil
+}
+
+func updateMessage(w ResponseWriter, r Request) (*Message, error) {
+	update := &Message{}
+	if err := Copy(update, r, "PUT"); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(update.Body) == "" {
+		return nil, HTTPErr{"can not create empty messages", http.StatusBadRequest}
+	}
+	return editMessage(r, update, func(message *Message) {
+		message.Body = update.Body
+	})
+}
+
+func retractMessage(w ResponseWriter, r Request) (*Message, error) {
+	return editMessage(r, nil, func(message *Message) {
+		message.Body = ""
+		message.Quote = ""
+		message.Annotations = MapAnnotations{}
+		message.Retracted = true
+	})
+}
+
+// editMessage applies f to the message of r, if the user sent it within the
+// edit window of the game, and keeps the previous version as a MessageEdit.
+// Unless update is nil, as when retracting, it must follow the sanctions,
+// blocks and press rules that apply to new messages, except the limit of
+// messages per phase.
+// Edits only wake up clients waiting for new messages, since notifications
+// about the message have already been sent.
+func editMessage(r Request, update *Message, f func(*Message)) (*Message, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	channelMembers := Nations{}
+	channelMembers.FromString(r.Vars()["channel_members"])
+
+	channelID, err := ChannelID(ctx, gameID, channelMembers)
+	if err != nil {
+		return nil, err
+	}
+
+	messageID, err := datastore.DecodeKey(r.Vars()["id"])
+	if err != nil || messageID.Kind() != messageKind || !messageID.Parent().Equal(channelID) {
+		return nil, HTTPErr{"message not found", http.StatusNotFound}
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return nil, err
+	}
+	game.ID = gameID
+
+	member, isMember := game.GetMemberByUserId(user.Id)
+	if !isMember {
+		return nil, HTTPErr{"can only edit messages in member games", http.StatusForbidden}
+	}
+
+	if update != nil {
+		if err := checkSanctions(ctx, user.Id, game.ID); err != nil {
+			return nil, err
+		}
+		if err := game.checkNotBlocked(ctx, user.Id, channelMembers); err != nil {
+			return nil, err
+		}
+		if !game.Finished {
+			if err := game.checkPressAllowed(update, clock.Now(ctx)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	message, err := replaceMessage(ctx, channelID, messageID, func(message *Message, now time.Time) error {
+		return message.editableBy(game, member.Nation, now)
+	}, f)
+	if err != nil {
+		return nil, err
+	}
+	message.ID = messageID
+	message.Age = clock.Now(ctx).Sub(message.CreatedAt)
+	message.editable = message.editableBy(game, member.Nation, clock.Now(ctx)) == nil
+
+	return message, nil
+}
+
+// replaceMessage applies f to messageID in channelID if check accepts it,
+// keeps the previous version as a MessageEdit and wakes up clients waiting
+// for new messages.
+func replaceMessage(ctx context.Context, channelID, messageID *datastore.Key, check func(*Message, time.Time) error, f func(*Message)) (*Message, error) {
+	message := &Message{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		channel := &Channel{}
+		if err := datastore.GetMulti(ctx, []*datastore.Key{messageID, channelID}, []interface{}{message, channel}); err != nil {
+			if merr, ok := err.(appengine.MultiError); ok && merr[0] == datastore.ErrNoSuchEntity {
+				return HTTPErr{"message not found", http.StatusNotFound}
+			}
+			return err
+		}
+		now := clock.Now(ctx)
+		if err := check(message, now); err != nil {
+			return err
+		}
+
+		edit := &MessageEdit{
+			Body:      message.Body,
+			Quote:     message.Quote,
+			Retracted: message.Retracted,
+			EditedAt:  now,
+		}
+		f(message)
+		message.indexWords()
+		message.EditedAt = now
+		message.UpdatedAt = now
+
+		keys := []*datastore.Key{messageID, datastore.NewIncompleteKey(ctx, messageEditKind, messageID)}
+		values := []interface{}{message, edit}
+		if channel.LatestMessage.Sender == message.Sender && channel.LatestMessage.CreatedAt.Equal(message.CreatedAt) {
+			channel.LatestMessage = *message
+			keys = append(keys, channelID)
+			values = append(values, channel)
+		}
+		_, err := datastore.PutMulti(ctx, keys, values)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	message.ID = messageID
+
+	if err := memcache.Delete(ctx, channelID.Encode()); err != nil && err != memcache.ErrCacheMiss {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// loadMessageEdits returns the previous versions of messageID, oldest first.
+func loadMessageEdits(ctx context.Context, messageID *datastore.Key) ([]MessageEdit, error) {
+	edits := []MessageEdit{}
+	if _, err := datastore.NewQuery(messageEditKind).Ancestor(messageID).GetAll(ctx, &edits); err != nil {
+		return nil, err
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].EditedAt.Before(edits[j].EditedAt)
+	})
+	return edits, nil
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/godip"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/v2"
@@ -56,22 +57,59 @@ func (m *MessageFlag) Item(r Request) *Item {
 
 type FlaggedMessage struct {
 	GameID         *datastore.Key
+	MessageID      *datastore.Key
 	ChannelMembers string
 	Sender         godip.Nation
 	Body           string
 	CreatedAt      time.Time
 	AuthorId       string
+	Retracted      bool
+	Hidden         bool
+	Grey           bool
+	// SupersededAt is when the sender edited or retracted this version of
+	// the message, or zero for the current version.
+	SupersededAt time.Time
 }
 
 type FlaggedMessages struct {
+	ID        *datastore.Key `datastore:"-"`
 	GameID    *datastore.Key
 	UserId    string
 	Messages  []FlaggedMessage
 	CreatedAt time.Time
+	// AssigneeId is the moderator handling the case, if any.
+	AssigneeId       string
+	Resolution       string
+	ResolutionReason string `datastore:",noindex"`
+	ResolvedBy       string
+	ResolvedAt       time.Time
 }
 
 func (f *FlaggedMessages) Item(r Request) *Item {
-	return NewItem(f).SetName("flagged-messages")
+	fmItem := NewItem(f).SetName("flagged-messages")
+	if f.ID != nil {
+		fmItem.AddLink(r.NewLink(Link{
+			Rel:         "context",
+			Route:       FlaggedMessagesContextRoute,
+			RouteParams: []string{"flagged_messages_id", f.ID.Encode()},
+		}))
+		if f.Resolution == "" {
+			fmItem.AddLink(r.NewLink(Link{
+				Rel:         "assign",
+				Route:       AssignFlaggedMessagesRoute,
+				RouteParams: []string{"flagged_messages_id", f.ID.Encode()},
+				Method:      "POST",
+			}))
+			fmItem.AddLink(r.NewLink(Link{
+				Rel:         "resolve",
+				Route:       ResolveFlaggedMessagesRoute,
+				RouteParams: []string{"flagged_messages_id", f.ID.Encode()},
+				Method:      "POST",
+				Type:        reflect.TypeOf(ModerationResolution{}),
+			}))
+		}
+	}
+	return fmItem
 }
 
 type FlaggedMessagess []FlaggedMessages
@@ -88,6 +126,10 @@ func (f FlaggedMessagess) Item(r Request, curs *datastore.Cursor, limit int, use
 				"This lists the messages flagged by users. The intention is to make it easier to browse examples of what others find to be bad behaviour, and ban authors of messages you don't want to see in your own games.",
 				"The ban link here is exactly the same as the one in the regular 'bans' view. To make it simpler to ban from the auto generated UI, and to make it easier to understand the intention of this list, it's provided here as well.",
 			},
+			[]string{
+				"Moderation",
+				"Each flag is a moderation case. List only the open cases with `unresolved=true`, `assign` a case to yourself, view the surrounding messages using `context`, and `resolve` it as `dismissed`, `warning`, `hidden` (removing the bodies of the flagged messages), `muted` (in the game) or `suspended` (from sending messages and joining games). Mutes and suspensions need `DurationMinutes` and expire automatically, and the reported user is notified by a system message in the game.",
+			},
 		}).
 		AddLink(r.NewLink(BanResource.Link("create-ban", Create, []string{"user_id", userId})))
 	if curs != nil {
@@ -95,8 +137,9 @@ func (f FlaggedMessagess) Item(r Request, curs *datastore.Cursor, limit int, use
 			Rel:   "self",
 			Route: ListFlaggedMessagesRoute,
 			QueryParams: url.Values{
-				"cursor": []string{curs.String()},
-				"limit":  []string{fmt.Sprint(limit)},
+				"cursor":     []string{curs.String()},
+				"limit":      []string{fmt.Sprint(limit)},
+				"unresolved": r.Req().URL.Query()["unresolved"],
 			},
 		}))
 	}
@@ -163,7 +206,8 @@ func createMessageFlag(w ResponseWriter, r Request) (*MessageFlag, error) {
 	}
 
 	messages := Messages{}
-	if _, err := datastore.NewQuery(messageKind).Ancestor(channelID).Filter("CreatedAt>=", messageFlag.From).Filter("CreatedAt<=", messageFlag.To).GetAll(ctx, &messages); err != nil {
+	messageIDs, err := datastore.NewQuery(messageKind).Ancestor(channelID).Filter("CreatedAt>=", messageFlag.From).Filter("CreatedAt<=", messageFlag.To).GetAll(ctx, &messages)
+	if err != nil {
 		return nil, err
 	}
 
@@ -171,23 +215,41 @@ func createMessageFlag(w ResponseWriter, r Request) (*MessageFlag, error) {
 		return nil, HTTPErr{"timestamps matched no messages", http.StatusBadRequest}
 	}
 
-	flaggedMessagess := make([]FlaggedMessage, len(messages))
+	flaggedMessagess := make([]FlaggedMessage, 0, len(messages))
 	for i, message := range messages {
-		flaggedMessagess[i] = FlaggedMessage{
+		flaggedMessage := FlaggedMessage{
 			GameID:         gameID,
+			MessageID:      messageIDs[i],
 			ChannelMembers: message.ChannelMembers.String(),
 			Sender:         message.Sender,
 			Body:           message.Body,
 			CreatedAt:      message.CreatedAt,
 			AuthorId:       userByNation[message.Sender].Id,
+			Retracted:      message.Retracted,
+			Hidden:         message.Hidden,
+			Grey:           message.Grey,
+		}
+		if !message.EditedAt.IsZero() {
+			edits, err := loadMessageEdits(ctx, messageIDs[i])
+			if err != nil {
+				return nil, err
+			}
+			for _, edit := range edits {
+				previous := flaggedMessage
+				previous.Body = edit.Body
+				previous.Retracted = edit.Retracted
+				previous.SupersededAt = edit.EditedAt
+				flaggedMessagess = append(flaggedMessagess, previous)
+			}
 		}
+		flaggedMessagess = append(flaggedMessagess, flaggedMessage)
 	}
 
 	flaggedMessages := &FlaggedMessages{
 		GameID:    gameID,
 		UserId:    user.Id,
 		Messages:  flaggedMessagess,
-		CreatedAt: time.Now(),
+		CreatedAt: clock.Now(ctx),
 	}
 
 	if _, err := datastore.Put(ctx, flaggedMessagesID, flaggedMessages); err != nil {
@@ -212,6 +274,10 @@ func listFlaggedMessages(w ResponseWriter, r Request) error {
 		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
 	}
 
+	if err := auth.RequirePermission(ctx, r, auth.ModeratePermission); err != nil {
+		return err
+	}
+
 	limit := maxLimit
 	if limitS := r.Req().URL.Query().Get("limit"); limitS != "" {
 		if i, err := strconv.ParseInt(r.Req().URL.Query().Get("limit"), 10, 64); err == nil {
@@ -219,6 +285,8 @@ func listFlaggedMessages(w ResponseWriter, r Request) error {
 		}
 	}
 
+	unresolved := r.Req().URL.Query().Get("unresolved") == "true"
+
 	query := datastore.NewQuery(flaggedMessagesKind).Order("-CreatedAt")
 
 	var iter *datastore.Iterator
@@ -238,8 +306,10 @@ func listFlaggedMessages(w ResponseWriter, r Request) error {
 	var err error
 	for len(flaggedMessagess) < limit && err == nil {
 		f := FlaggedMessages{}
-		_, err = iter.Next(&f)
-		if err == nil {
+		var id *datastore.Key
+		id, err = iter.Next(&f)
+		if err == nil && (!unresolved || f.Resolution == "") {
+			f.ID = id
 			flaggedMessagess = append(flaggedMessagess, f)
 		}
 	}
@@ -0,0 +1,151 @@
+package game
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	maxReactionRunes        = 8
+	maxReactionsPerMessage  = 16
+	reactionEmojiRouteParam = "emoji"
+)
+
+// MessageReaction is an emoji a nation reacted to a message with.
+type MessageReaction struct {
+	Nation godip.Nation
+	Emoji  string
+}
+
+func validateReactionEmoji(emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionRunes || strings.IndexFunc(emoji, unicode.IsSpace) != -1 {
+		return HTTPErr{"reactions must be a single emoji", http.StatusBadRequest}
+	}
+	return nil
+}
+
+// toggleReaction adds or removes the reaction of nation with emoji, and
+// returns whether the message changed.
+func (m *Message) toggleReaction(nation godip.Nation, emoji string, add bool) (bool, error) {
+	emojis := map[string]struct{}{}
+	for idx, reaction := range m.Reactions {
+		if reaction.Nation == nation && reaction.Emoji == emoji {
+			if add {
+				return false, nil
+			}
+			m.Reactions = append(m.Reactions[:idx], m.Reactions[idx+1:]...)
+			return true, nil
+		}
+		emojis[reaction.Emoji] = struct{}{}
+	}
+	if !add {
+		return false, nil
+	}
+	if _, found := emojis[emoji]; !found && len(emojis) >= maxReactionsPerMessage {
+		return false, HTTPErr{"too many different reactions to this message", http.StatusBadRequest}
+	}
+	m.Reactions = append(m.Reactions, MessageReaction{
+		Nation: nation,
+		Emoji:  emoji,
+	})
+	return true, nil
+}
+
+func addReaction(w ResponseWriter, r Request) error {
+	return updateReaction(w, r, true)
+}
+
+func removeReaction(w ResponseWriter, r Request) error {
+	return updateReaction(w, r, false)
+}
+
+// updateReaction changes the reactions of the nation of the user to a
+// message. Reactions only wake up clients waiting for new messages, and don't
+// send any FCM or email notifications.
+func updateReaction(w ResponseWriter, r Request, add bool) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	channelMembers := Nations{}
+	channelMembers.FromString(r.Vars()["channel_members"])
+
+	emoji := r.Vars()[reactionEmojiRouteParam]
+	if err := validateReactionEmoji(emoji); err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	member, isMember := game.GetMemberByUserId(user.Id)
+	if !isMember || !game.Started || !game.Mustered {
+		return HTTPErr{"can only react as member of started games", http.StatusForbidden}
+	}
+	if !channelMembers.Includes(member.Nation) && !isPublic(game.Variant, channelMembers) {
+		return HTTPErr{"can only react in member channels", http.StatusForbidden}
+	}
+
+	channelID, err := ChannelID(ctx, gameID, channelMembers)
+	if err != nil {
+		return err
+	}
+
+	messageID, err := datastore.DecodeKey(r.Vars()["message_id"])
+	if err != nil || messageID.Kind() != messageKind || !messageID.Parent().Equal(channelID) {
+		return HTTPErr{"message not found", http.StatusNotFound}
+	}
+
+	message := &Message{}
+	changed := false
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, messageID, message); err == datastore.ErrNoSuchEntity {
+			return HTTPErr{"message not found", http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+		if changed, err = message.toggleReaction(member.Nation, emoji, add); err != nil || !changed {
+			return err
+		}
+		message.UpdatedAt = clock.Now(ctx)
+		_, err := datastore.Put(ctx, messageID, message)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+	message.ID = messageID
+	message.Age = clock.Now(ctx).Sub(message.CreatedAt)
+	message.redactGreyPress(member.Nation)
+
+	if changed {
+		if err := memcache.Delete(ctx, channelID.Encode()); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+
+	w.SetContent(message.Item(r))
+	return nil
+}
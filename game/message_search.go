@@ -0,0 +1,257 @@
+package game
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	minSearchWordRunes = 2
+	maxSearchWords     = 500
+)
+
+// searchWords returns the distinct lower case words of text that messages
+// are indexed by.
+func searchWords(text string) []string {
+	seen := map[string]bool{}
+	words := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), isNotWordRune) {
+		if utf8.RuneCountInString(word) < minSearchWordRunes || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+		if len(words) == maxSearchWords {
+			break
+		}
+	}
+	return words
+}
+
+func isNotWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// indexWords updates the search index of m to match its body.
+func (m *Message) indexWords() {
+	m.SearchWords = searchWords(m.Body)
+}
+
+// Save indexes and stores the message, to let reSave index messages created
+// before they were searchable.
+func (m *Message) Save(ctx context.Context) error {
+	m.indexWords()
+	_, err := datastore.Put(ctx, m.ID, m)
+	return err
+}
+
+// MessageHighlight is the byte range of a word matching the search in the
+// body of a message.
+type MessageHighlight struct {
+	Start int
+	End   int
+}
+
+// highlights returns the ranges of body containing any of words.
+func highlights(body string, words []string) []MessageHighlight {
+	wanted := map[string]bool{}
+	for _, word := range words {
+		wanted[word] = true
+	}
+	result := []MessageHighlight{}
+	start := -1
+	for idx, r := range body + " " {
+		if isNotWordRune(r) {
+			if start != -1 && wanted[strings.ToLower(body[start:idx])] {
+				result = append(result, MessageHighlight{Start: start, End: idx})
+			}
+			start = -1
+		} else if start == -1 {
+			start = idx
+		}
+	}
+	return result
+}
+
+type MessageSearchHit struct {
+	Message
+	Highlights []MessageHighlight
+}
+
+func (h *MessageSearchHit) Item(r Request) *Item {
+	return NewItem(h).SetName(string(h.Sender)).AddLink(r.NewLink(Link{
+		Rel:         "messages",
+		Route:       ListMessagesRoute,
+		RouteParams: []string{"game_id", h.GameID.Encode(), "channel_members", h.ChannelMembers.String()},
+	}))
+}
+
+type MessageSearchHits []MessageSearchHit
+
+func (m MessageSearchHits) Item(r Request, gameID *datastore.Key) *Item {
+	hitItems := make(List, len(m))
+	for i := range m {
+		hitItems[i] = m[i].Item(r)
+	}
+	return NewItem(hitItems).SetName("message-search").SetDesc([][]string{
+		[]string{
+			"Searching messages",
+			"Searches the messages of all channels of the game you can list, newest first. Provide the words to search for as `text`, and optionally a `sender` nation, `channel_members` as in the channel name, and `from` and `to` RFC3339 times.",
+			"Messages contain all the words searched for, ignoring case, and `Highlights` contains the byte ranges of the matching words in the body.",
+			"Messages are found by nation, so searching never reveals the players of anonymous games, and grey press is never found by sender.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       SearchMessagesRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
+		QueryParams: r.Req().URL.Query(),
+	}))
+}
+
+func parseSearchTime(query url.Values, param string) (*time.Time, error) {
+	if query.Get(param) == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, query.Get(param))
+	if err != nil {
+		return nil, HTTPErr{"invalid " + param, http.StatusBadRequest}
+	}
+	return &t, nil
+}
+
+func searchMessages(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	query := r.Req().URL.Query()
+	words := searchWords(query.Get("text"))
+	sender := godip.Nation(query.Get("sender"))
+	if len(words) == 0 && sender == "" {
+		return HTTPErr{"can only search for text or senders", http.StatusBadRequest}
+	}
+	from, err := parseSearchTime(query, "from")
+	if err != nil {
+		return err
+	}
+	to, err := parseSearchTime(query, "to")
+	if err != nil {
+		return err
+	}
+	limit := maxLimit
+	if limitParam := query.Get("limit"); limitParam != "" {
+		if i, err := strconv.Atoi(limitParam); err == nil && i > 0 && i < maxLimit {
+			limit = i
+		}
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	nation, mutedNats, err := messageViewer(ctx, game, user)
+	if err != nil {
+		return err
+	}
+
+	channels := []Nations{}
+	if channelParam := query.Get("channel_members"); channelParam != "" {
+		channelMembers := Nations{}
+		channelMembers.FromString(channelParam)
+		if !canListMessages(game, nation, channelMembers) {
+			return HTTPErr{"can only search member channels", http.StatusForbidden}
+		}
+		channels = append(channels, channelMembers)
+	} else {
+		visibleChannels, err := loadChannels(ctx, game, nation)
+		if err != nil {
+			return err
+		}
+		for _, channel := range visibleChannels {
+			if canListMessages(game, nation, channel.Members) {
+				channels = append(channels, channel.Members)
+			}
+		}
+	}
+
+	hits := MessageSearchHits{}
+	for _, channelMembers := range channels {
+		channelID, err := ChannelID(ctx, gameID, channelMembers)
+		if err != nil {
+			return HTTPErr{"invalid channel_members", http.StatusBadRequest}
+		}
+		q := datastore.NewQuery(messageKind).Ancestor(channelID)
+		for _, word := range words {
+			q = q.Filter("SearchWords=", word)
+		}
+		if sender != "" {
+			q = q.Filter("Sender=", sender)
+		}
+		if from != nil {
+			q = q.Filter("CreatedAt>=", *from)
+		}
+		if to != nil {
+			q = q.Filter("CreatedAt<=", *to)
+		}
+		iter := q.Order("-CreatedAt").Run(ctx)
+		// Hits beyond the newest limit of a channel would be cut from the
+		// result anyway.
+		for found := 0; found < limit; {
+			message := Message{}
+			messageID, err := iter.Next(&message)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return err
+			}
+			if _, isMuted := mutedNats[message.Sender]; isMuted && !message.Grey {
+				continue
+			}
+			if sender != "" && message.Grey && message.Sender != nation {
+				continue
+			}
+			message.ID = messageID
+			message.Age = clock.Now(ctx).Sub(message.CreatedAt)
+			message.redactGreyPress(nation)
+			hits = append(hits, MessageSearchHit{
+				Message:    message,
+				Highlights: highlights(message.Body, words),
+			})
+			found++
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].CreatedAt.After(hits[j].CreatedAt)
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	w.SetContent(hits.Item(r, gameID))
+	return nil
+}
@@ -0,0 +1,458 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	sanctionKind         = "Sanction"
+	moderationNoticeKind = "ModerationNotice"
+
+	DismissedResolution = "dismissed"
+	WarningResolution   = "warning"
+	HiddenResolution    = "hidden"
+	MutedResolution     = "muted"
+	SuspendedResolution = "suspended"
+
+	MuteSanction       = "mute"
+	SuspensionSanction = "suspension"
+
+	maxSanctionMinutes    = 365 * 24 * 60
+	moderationContextSpan = time.Hour
+)
+
+var (
+	moderationResolutions = []string{DismissedResolution, WarningResolution, HiddenResolution, MutedResolution, SuspendedResolution}
+)
+
+// Sanction is a time limited mute in a game, or site wide suspension, of a
+// user.
+type Sanction struct {
+	UserId string
+	Kind   string
+	// GameID is the game the user is muted in, or nil for suspensions.
+	GameID    *datastore.Key
+	Reason    string `datastore:",noindex"`
+	CaseID    *datastore.Key
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type Sanctions []Sanction
+
+func loadSanctions(ctx context.Context, userId string) (Sanctions, error) {
+	sanctions := Sanctions{}
+	if _, err := datastore.NewQuery(sanctionKind).Ancestor(auth.UserID(ctx, userId)).GetAll(ctx, &sanctions); err != nil {
+		return nil, err
+	}
+	return sanctions, nil
+}
+
+// checkSanctions returns an error if userId is suspended, or muted in gameID.
+func checkSanctions(ctx context.Context, userId string, gameID *datastore.Key) error {
+	sanctions, err := loadSanctions(ctx, userId)
+	if err != nil {
+		return err
+	}
+	now := clock.Now(ctx)
+	for _, sanction := range sanctions {
+		if !sanction.ExpiresAt.After(now) {
+			continue
+		}
+		if sanction.Kind == SuspensionSanction {
+			return HTTPErr{fmt.Sprintf("suspended until %v", sanction.ExpiresAt.Format(time.RFC822)), http.StatusForbidden}
+		}
+		if sanction.Kind == MuteSanction && gameID != nil && gameID.Equal(sanction.GameID) {
+			return HTTPErr{fmt.Sprintf("muted in this game until %v", sanction.ExpiresAt.Format(time.RFC822)), http.StatusForbidden}
+		}
+	}
+	return nil
+}
+
+// ModerationResolution resolves a moderation case. UserId is the reported
+// user, and can be left out when all flagged messages have the same author.
+type ModerationResolution struct {
+	Resolution      string `methods:"POST"`
+	UserId          string `methods:"POST"`
+	DurationMinutes int64  `methods:"POST"`
+	Reason          string `methods:"POST"`
+}
+
+// ModerationContext is the messages around the flagged messages of a case.
+type ModerationContext struct {
+	FlaggedMessagesID *datastore.Key
+	Messages          []FlaggedMessage
+}
+
+func (m *ModerationContext) Item(r Request) *Item {
+	return NewItem(m).SetName("moderation-context").SetDesc([][]string{
+		[]string{
+			"Moderation context",
+			fmt.Sprintf("All messages in the flagged channels from %v before the first to %v after the last flagged message, with their authors.", moderationContextSpan, moderationContextSpan),
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       FlaggedMessagesContextRoute,
+		RouteParams: []string{"flagged_messages_id", m.FlaggedMessagesID.Encode()},
+	}))
+}
+
+func loadModerationCase(ctx context.Context, r Request) (*FlaggedMessages, error) {
+	if err := auth.RequirePermission(ctx, r, auth.ModeratePermission); err != nil {
+		return nil, err
+	}
+	caseID, err := datastore.DecodeKey(r.Vars()["flagged_messages_id"])
+	if err != nil || caseID.Kind() != flaggedMessagesKind {
+		return nil, HTTPErr{"flagged messages not found", http.StatusNotFound}
+	}
+	flaggedMessages := &FlaggedMessages{}
+	if err := datastore.Get(ctx, caseID, flaggedMessages); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{"flagged messages not found", http.StatusNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	flaggedMessages.ID = caseID
+	return flaggedMessages, nil
+}
+
+func assignFlaggedMessages(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	flaggedMessages, err := loadModerationCase(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, flaggedMessages.ID, flaggedMessages); err != nil {
+			return err
+		}
+		if flaggedMessages.Resolution != "" {
+			return HTTPErr{"case already resolved", http.StatusBadRequest}
+		}
+		flaggedMessages.AssigneeId = auditActorId(r)
+		_, err := datastore.Put(ctx, flaggedMessages.ID, flaggedMessages)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	w.SetContent(flaggedMessages.Item(r))
+	return nil
+}
+
+func loadFlaggedMessagesContext(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	flaggedMessages, err := loadModerationCase(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, flaggedMessages.GameID, game); err != nil {
+		return err
+	}
+	authors := map[godip.Nation]string{}
+	for _, member := range game.Members {
+		authors[member.Nation] = member.User.Id
+	}
+
+	type span struct {
+		from time.Time
+		to   time.Time
+	}
+	spans := map[string]*span{}
+	for _, flagged := range flaggedMessages.Messages {
+		if s, found := spans[flagged.ChannelMembers]; !found {
+			spans[flagged.ChannelMembers] = &span{from: flagged.CreatedAt, to: flagged.CreatedAt}
+		} else if flagged.CreatedAt.Before(s.from) {
+			s.from = flagged.CreatedAt
+		} else if flagged.CreatedAt.After(s.to) {
+			s.to = flagged.CreatedAt
+		}
+	}
+
+	moderationContext := &ModerationContext{
+		FlaggedMessagesID: flaggedMessages.ID,
+		Messages:          []FlaggedMessage{},
+	}
+	for channelName, s := range spans {
+		channelMembers := Nations{}
+		channelMembers.FromString(channelName)
+		channelID, err := ChannelID(ctx, flaggedMessages.GameID, channelMembers)
+		if err != nil {
+			return err
+		}
+		messages := Messages{}
+		messageIDs, err := datastore.NewQuery(messageKind).Ancestor(channelID).
+			Filter("CreatedAt>=", s.from.Add(-moderationContextSpan)).
+			Filter("CreatedAt<=", s.to.Add(moderationContextSpan)).
+			GetAll(ctx, &messages)
+		if err != nil {
+			return err
+		}
+		for i, message := range messages {
+			moderationContext.Messages = append(moderationContext.Messages, FlaggedMessage{
+				GameID:         flaggedMessages.GameID,
+				MessageID:      messageIDs[i],
+				ChannelMembers: channelName,
+				Sender:         message.Sender,
+				Body:           message.Body,
+				CreatedAt:      message.CreatedAt,
+				AuthorId:       authors[message.Sender],
+				Retracted:      message.Retracted,
+				Hidden:         message.Hidden,
+				Grey:           message.Grey,
+			})
+		}
+	}
+	sort.Slice(moderationContext.Messages, func(i, j int) bool {
+		return moderationContext.Messages[i].CreatedAt.Before(moderationContext.Messages[j].CreatedAt)
+	})
+
+	w.SetContent(moderationContext.Item(r))
+	return nil
+}
+
+// reportedUser returns the user resolution is about, which must be the
+// author of one of the flagged messages.
+func (f *FlaggedMessages) reportedUser(resolution *ModerationResolution) (string, error) {
+	authors := map[string]bool{}
+	for _, flagged := range f.Messages {
+		if flagged.AuthorId != "" {
+			authors[flagged.AuthorId] = true
+		}
+	}
+	if resolution.UserId != "" {
+		if !authors[resolution.UserId] {
+			return "", HTTPErr{"can only sanction authors of flagged messages", http.StatusBadRequest}
+		}
+		return resolution.UserId, nil
+	}
+	if len(authors) != 1 {
+		return "", HTTPErr{"flagged messages have several authors, provide a UserId", http.StatusBadRequest}
+	}
+	for author := range authors {
+		return author, nil
+	}
+	return "", nil
+}
+
+func resolveFlaggedMessages(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	flaggedMessages, err := loadModerationCase(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	resolution := &ModerationResolution{}
+	if err := Copy(resolution, r, "POST"); err != nil {
+		return err
+	}
+	found := false
+	for _, allowed := range moderationResolutions {
+		found = found || resolution.Resolution == allowed
+	}
+	if !found {
+		return HTTPErr{fmt.Sprintf("resolution must be among %v", moderationResolutions), http.StatusBadRequest}
+	}
+	sanctionType := map[string]string{
+		MutedResolution:     MuteSanction,
+		SuspendedResolution: SuspensionSanction,
+	}[resolution.Resolution]
+	if sanctionType != "" && (resolution.DurationMinutes < 1 || resolution.DurationMinutes > maxSanctionMinutes) {
+		return HTTPErr{"mutes and suspensions must last between one minute and a year", http.StatusBadRequest}
+	}
+
+	userId := ""
+	if resolution.Resolution != DismissedResolution {
+		if userId, err = flaggedMessages.reportedUser(resolution); err != nil {
+			return err
+		}
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, flaggedMessages.GameID, game); err != nil {
+		return err
+	}
+	game.ID = flaggedMessages.GameID
+
+	now := clock.Now(ctx)
+	moderatorId := auditActorId(r)
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, flaggedMessages.ID, flaggedMessages); err != nil {
+			return err
+		}
+		if flaggedMessages.Resolution != "" {
+			return HTTPErr{"case already resolved", http.StatusBadRequest}
+		}
+		flaggedMessages.Resolution = resolution.Resolution
+		flaggedMessages.ResolutionReason = resolution.Reason
+		flaggedMessages.ResolvedBy = moderatorId
+		flaggedMessages.ResolvedAt = now
+		if _, err := datastore.Put(ctx, flaggedMessages.ID, flaggedMessages); err != nil {
+			return err
+		}
+		if sanctionType != "" {
+			sanction := &Sanction{
+				UserId:    userId,
+				Kind:      sanctionType,
+				Reason:    resolution.Reason,
+				CaseID:    flaggedMessages.ID,
+				CreatedBy: moderatorId,
+				CreatedAt: now,
+				ExpiresAt: now.Add(time.Duration(resolution.DurationMinutes) * time.Minute),
+			}
+			if sanctionType == MuteSanction {
+				sanction.GameID = game.ID
+			}
+			if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, sanctionKind, auth.UserID(ctx, userId)), sanction); err != nil {
+				return err
+			}
+		}
+		return notifyModeratedUser(ctx, game, userId, resolution, now)
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	if resolution.Resolution == HiddenResolution {
+		for _, flagged := range flaggedMessages.Messages {
+			if flagged.AuthorId != userId || flagged.MessageID == nil || !flagged.SupersededAt.IsZero() {
+				continue
+			}
+			if _, err := replaceMessage(ctx, flagged.MessageID.Parent(), flagged.MessageID, func(message *Message, now time.Time) error {
+				if message.Hidden {
+					return HTTPErr{"message already hidden", http.StatusBadRequest}
+				}
+				return nil
+			}, func(message *Message) {
+				message.Body = ""
+				message.Quote = ""
+				message.Annotations = MapAnnotations{}
+				message.Hidden = true
+			}); err != nil {
+				if _, isHTTPErr := err.(HTTPErr); !isHTTPErr {
+					return err
+				}
+				log.Infof(ctx, "Not hiding %v: %v", flagged.MessageID, err)
+			}
+		}
+	}
+
+	if err := auth.RecordAudit(ctx, game.ID, moderatorId, auth.ModerateAuditAction, userId, nil, resolution); err != nil {
+		return err
+	}
+
+	w.SetContent(flaggedMessages.Item(r))
+	return nil
+}
+
+// notifyModeratedUser stores a moderation notice about resolution for
+// userId, readable only by the user, since system messages in game channels
+// become public when the game ends.
+func notifyModeratedUser(ctx context.Context, game *Game, userId string, resolution *ModerationResolution, now time.Time) error {
+	if resolution.Resolution == DismissedResolution {
+		return nil
+	}
+	until := now.Add(time.Duration(resolution.DurationMinutes) * time.Minute)
+	notice := &ModerationNotice{
+		UserId:     userId,
+		GameID:     game.ID,
+		GameDesc:   game.Desc,
+		Resolution: resolution.Resolution,
+		Reason:     resolution.Reason,
+		CreatedAt:  now,
+	}
+	if resolution.Resolution == MutedResolution || resolution.Resolution == SuspendedResolution {
+		notice.ExpiresAt = until
+	}
+	notice.Body = map[string]string{
+		WarningResolution:   fmt.Sprintf("A moderator has reviewed messages you sent in %q, and warns you to follow the rules of the community.", game.Desc),
+		HiddenResolution:    fmt.Sprintf("A moderator has reviewed messages you sent in %q, and hidden them.", game.Desc),
+		MutedResolution:     fmt.Sprintf("A moderator has reviewed messages you sent in %q, and muted you in that game until %v.", game.Desc, until.Format(time.RFC822)),
+		SuspendedResolution: fmt.Sprintf("A moderator has reviewed messages you sent in %q, and suspended you from sending messages and joining games until %v.", game.Desc, until.Format(time.RFC822)),
+	}[resolution.Resolution]
+	if resolution.Reason != "" {
+		notice.Body = fmt.Sprintf("%s Reason: %s", notice.Body, resolution.Reason)
+	}
+	_, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, moderationNoticeKind, auth.UserID(ctx, userId)), notice)
+	return err
+}
+
+// ModerationNotice tells a user about the resolution of a moderation case
+// about their messages.
+type ModerationNotice struct {
+	UserId     string
+	GameID     *datastore.Key
+	GameDesc   string `datastore:",noindex"`
+	Resolution string
+	Reason     string `datastore:",noindex"`
+	Body       string `datastore:",noindex"`
+	CreatedAt  time.Time
+	// ExpiresAt is when a mute or suspension ends.
+	ExpiresAt time.Time
+}
+
+type ModerationNotices []ModerationNotice
+
+func (m ModerationNotices) Item(r Request, userId string) *Item {
+	noticeItems := make(List, len(m))
+	for i := range m {
+		noticeItems[i] = NewItem(m[i]).SetName(m[i].Resolution)
+	}
+	return NewItem(noticeItems).SetName("moderation-notices").SetDesc([][]string{
+		[]string{
+			"Moderation notices",
+			"Notices about moderators acting on messages you sent, newest first. Only you can read them.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListModerationNoticesRoute,
+		RouteParams: []string{"user_id", userId},
+	}))
+}
+
+func loadModerationNotices(ctx context.Context, userId string) (ModerationNotices, error) {
+	notices := ModerationNotices{}
+	if _, err := datastore.NewQuery(moderationNoticeKind).Ancestor(auth.UserID(ctx, userId)).Order("-CreatedAt").GetAll(ctx, &notices); err != nil {
+		return nil, err
+	}
+	return notices, nil
+}
+
+func listModerationNotices(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own moderation notices", http.StatusForbidden}
+	}
+
+	notices, err := loadModerationNotices(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+
+	w.SetContent(notices.Item(r, user.Id))
+	return nil
+}
@@ -365,6 +365,24 @@ func createOrder(w ResponseWriter, r Request) (*Order, error) {
 	return order, nil
 }
 
+// visibleOrders returns the orders in found that viewer is allowed to see,
+// which are all of them for resolved phases and only their own otherwise.
+func visibleOrders(game *Game, phase *Phase, viewer *auth.User, found Orders) Orders {
+	var nation godip.Nation
+
+	if member, isMember := game.GetMemberByUserId(viewer.Id); isMember {
+		nation = member.Nation
+	}
+
+	toReturn := Orders{}
+	for _, order := range found {
+		if phase.Resolved || order.Nation == nation {
+			toReturn = append(toReturn, order)
+		}
+	}
+	return toReturn
+}
+
 func listOrders(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
@@ -396,25 +414,12 @@ func listOrders(w ResponseWriter, r Request) error {
 	}
 	game.ID = gameID
 
-	var nation godip.Nation
-
-	if member, found := game.GetMemberByUserId(user.Id); found {
-		nation = member.Nation
-	}
-
 	found := Orders{}
 	_, err = datastore.NewQuery(orderKind).Filter("GameID=", gameID).Filter("PhaseOrdinal=", phaseOrdinal).GetAll(ctx, &found)
 	if err != nil {
 		return err
 	}
 
-	toReturn := Orders{}
-	for _, order := range found {
-		if phase.Resolved || order.Nation == nation {
-			toReturn = append(toReturn, order)
-		}
-	}
-
-	w.SetContent(toReturn.Item(r, gameID, phase))
+	w.SetContent(visibleOrders(game, phase, user, found).Item(r, gameID, phase))
 	return nil
 }
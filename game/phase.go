@@ -15,6 +15,7 @@ import (
 
 	"github.com/dustin/go-humanize/english"
 	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/godip"
 	"github.com/zond/godip/state"
 	"github.com/zond/godip/variants"
@@ -164,7 +165,7 @@ func getPhaseNotificationContext(ctx context.Context, host string, gameID *datas
 							log.Errorf(ctx, "Unable to create state to generate fake phase for notification: %v", err)
 							return nil, err
 						}
-						res.phase = NewPhase(s, gameID, 1, host)
+						res.phase = NewPhase(ctx, s, gameID, 1, host)
 					} else {
 						log.Errorf(ctx, "Unable to load game or user: %v; hope datastore gets fixed", err)
 						return nil, err
@@ -522,7 +523,7 @@ func sendPhaseDeadlineWarning(ctx context.Context, gameID *datastore.Key, phaseO
 			return err
 		}
 		sendAt := phase.DeadlineAt.Add(-time.Minute * time.Duration(userConfig.PhaseDeadlineWarningMinutesAhead))
-		now := time.Now()
+		now := clock.Now(ctx)
 		if sendAt.Before(now) {
 			newMessage := &Message{
 				GameID:         gameID,
@@ -608,7 +609,7 @@ func planPhaseTimeout(ctx context.Context, gameID *datastore.Key, phaseOrdinal i
 	for idx, userConfig := range userConfigs {
 		if userConfig.PhaseDeadlineWarningMinutesAhead > 0 {
 			sendAt := phase.DeadlineAt.Add(-time.Minute * time.Duration(userConfig.PhaseDeadlineWarningMinutesAhead))
-			if sendAt.After(time.Now()) {
+			if sendAt.After(clock.Now(ctx)) {
 				nation := string(game.Members[idx].Nation)
 				if err := sendPhaseDeadlineWarningFunc.EnqueueAt(ctx, sendAt, gameID, phase.PhaseOrdinal, nation); err != nil {
 					log.Errorf(ctx, "sendPhaseDeadlineWarningFunc.EnqueueAt(..., %v, %v, %v, %v): %v; hope taskqueues get fixed", sendAt, gameID, phase.PhaseOrdinal, nation, err)
@@ -787,7 +788,7 @@ func (p *PhaseResolver) Act() error {
 
 	// Sanity check time and resolution status of the phase.
 
-	if p.TimeoutTriggered && p.Phase.DeadlineAt.After(time.Now()) {
+	if p.TimeoutTriggered && p.Phase.DeadlineAt.After(clock.Now(p.Context)) {
 		log.Infof(p.Context, "Resolution postponed to %v by %v; rescheduling task", p.Phase.DeadlineAt, PP(p.Phase))
 		return p.Phase.ScheduleResolution(p.Context)
 	}
@@ -886,7 +887,7 @@ func (p *PhaseResolver) Act() error {
 	// Finish and save old phase.
 
 	p.Phase.Resolved = true
-	p.Phase.ResolvedAt = time.Now()
+	p.Phase.ResolvedAt = clock.Now(p.Context)
 	if err := p.Phase.DBSave(p.Context); err != nil {
 		log.Errorf(p.Context, "Unable to save old phase %v: %v; hope datastore gets fixed", PP(p.Phase), err)
 		return err
@@ -894,7 +895,7 @@ func (p *PhaseResolver) Act() error {
 
 	// Create the new phase.
 
-	newPhase := NewPhase(s, p.Phase.GameID, p.Phase.PhaseOrdinal+1, p.Phase.Host)
+	newPhase := NewPhase(p.Context, s, p.Phase.GameID, p.Phase.PhaseOrdinal+1, p.Phase.Host)
 	newPhase.SoloSCCount = p.Variant.SoloSCCount(s)
 	// To make old games work.
 	if p.Game.PhaseLengthMinutes == 0 {
@@ -1043,9 +1044,9 @@ func (p *PhaseResolver) Act() error {
 	finishGame := func() {
 		// Just to ensure we don't try to resolve it again, even by mistake.
 		newPhase.Resolved = true
-		newPhase.ResolvedAt = time.Now()
+		newPhase.ResolvedAt = clock.Now(p.Context)
 		p.Game.Finished = true
-		p.Game.FinishedAt = time.Now()
+		p.Game.FinishedAt = clock.Now(p.Context)
 		p.Game.Closed = true
 	}
 	if soloWinner != "" || len(quitters) == len(p.Variant.Nations) || (p.Game.LastYear != 0 && newPhase.Year > p.Game.LastYear) {
@@ -1157,7 +1158,7 @@ func (p *PhaseResolver) Act() error {
 			AllUsers:          oldPhaseResult.AllUsers,
 			TrueSkillRated:    false,
 			Private:           p.Game.Private,
-			CreatedAt:         time.Now(),
+			CreatedAt:         clock.Now(p.Context),
 		}
 		gameResult.AssignScores()
 		if err := gameResult.DBSave(p.Context, p.Game); err != nil {
@@ -1192,7 +1193,7 @@ func (p *PhaseResolver) Act() error {
 
 			log.Infof(p.Context, "Since all players are ready to resolve RIGHT NOW, rolling forward again")
 
-			newPhase.DeadlineAt = time.Now()
+			newPhase.DeadlineAt = clock.Now(p.Context)
 			p.Phase = newPhase
 			p.PhaseStates = newPhaseStates
 			// Note that we are reusing the same resolver, which means the nonEliminatedUserIds will be the same, and not replaced when we Act().
@@ -1247,6 +1248,22 @@ func (p *PhaseResolver) Act() error {
 		return err
 	}
 
+	if !p.Game.Finished {
+
+		// Deliver the messages scheduled for the start of the new phase.
+
+		if err := deliverPhaseScheduledMessagesFunc.EnqueueIn(
+			p.Context,
+			0,
+			p.Phase.Host,
+			p.Game.ID,
+			newPhase.PhaseOrdinal,
+		); err != nil {
+			log.Errorf(p.Context, "Unable to enqueue delivery of scheduled messages: %v; hope datastore will get fixed", err)
+			return err
+		}
+	}
+
 	if p.Game.Finished {
 
 		// Clean up last order options from what's cached in the game.
@@ -1356,9 +1373,9 @@ func (p *PhaseResolver) actNonMustered() error {
 	if len(readyNationMap) == len(p.Variant.Nations) {
 		p.Game.Mustered = true
 		if p.Phase.Type != godip.Movement && p.Game.NonMovementPhaseLengthMinutes != 0 {
-			p.Phase.DeadlineAt = time.Now().Add(time.Minute * p.Game.NonMovementPhaseLengthMinutes)
+			p.Phase.DeadlineAt = clock.Now(p.Context).Add(time.Minute * p.Game.NonMovementPhaseLengthMinutes)
 		} else {
-			p.Phase.DeadlineAt = time.Now().Add(time.Minute * p.Game.PhaseLengthMinutes)
+			p.Phase.DeadlineAt = clock.Now(p.Context).Add(time.Minute * p.Game.PhaseLengthMinutes)
 		}
 		p.Game.NewestPhaseMeta = []PhaseMeta{p.Phase.PhaseMeta}
 		// Delete all the old phase states.
@@ -1403,7 +1420,7 @@ func (p *PhaseResolver) actNonMustered() error {
 				NoOrders:      len(options) == 0,
 				Messages:      strings.Join(s.Phase().Messages(s, p.Game.Members[idx].Nation), ","),
 				ZippedOptions: zippedOptions,
-				Note:          fmt.Sprintf("Created by Diplicity at %v due to game muster.", time.Now()),
+				Note:          fmt.Sprintf("Created by Diplicity at %v due to game muster.", clock.Now(p.Context)),
 			}
 			phaseStateID, err := phaseState.ID(p.Context)
 			if err != nil {
@@ -1598,15 +1615,15 @@ type PhaseMeta struct {
 	SCsJSON        string        `datastore:",noindex"`
 }
 
-func (p *PhaseMeta) Refresh() {
+func (p *PhaseMeta) Refresh(ctx context.Context) {
 	if !p.DeadlineAt.IsZero() {
-		p.NextDeadlineIn = p.DeadlineAt.Sub(time.Now())
+		p.NextDeadlineIn = p.DeadlineAt.Sub(clock.Now(ctx))
 	}
 	if !p.CreatedAt.IsZero() {
-		p.CreatedAgo = p.CreatedAt.Sub(time.Now())
+		p.CreatedAgo = p.CreatedAt.Sub(clock.Now(ctx))
 	}
 	if !p.ResolvedAt.IsZero() {
-		p.ResolvedAgo = p.ResolvedAt.Sub(time.Now())
+		p.ResolvedAgo = p.ResolvedAt.Sub(clock.Now(ctx))
 	}
 }
 
@@ -1742,7 +1759,7 @@ func devResolvePhaseTimeout(w ResponseWriter, r Request) error {
 		return err
 	}
 
-	phase.DeadlineAt = time.Now()
+	phase.DeadlineAt = clock.Now(ctx)
 	if _, err := datastore.Put(ctx, phaseID, phase); err != nil {
 		return err
 	}
@@ -1777,7 +1794,7 @@ func loadPhase(w ResponseWriter, r Request) (*Phase, error) {
 		return nil, err
 	}
 	game.ID = gameID
-	phase.Refresh()
+	phase.Refresh(ctx)
 	phase.Score(variants.Variants[game.Variant].Nations)
 
 	user, ok := r.Values()["user"].(*auth.User)
@@ -1869,7 +1886,7 @@ func (p *Phase) DBSave(ctx context.Context) error {
 	return err
 }
 
-func NewPhase(s *state.State, gameID *datastore.Key, phaseOrdinal int64, host string) *Phase {
+func NewPhase(ctx context.Context, s *state.State, gameID *datastore.Key, phaseOrdinal int64, host string) *Phase {
 	current := s.Phase()
 	p := &Phase{
 		PhaseMeta: PhaseMeta{
@@ -1877,7 +1894,7 @@ func NewPhase(s *state.State, gameID *datastore.Key, phaseOrdinal int64, host st
 			Season:       current.Season(),
 			Year:         current.Year(),
 			Type:         current.Type(),
-			CreatedAt:    time.Now(),
+			CreatedAt:    clock.Now(ctx),
 		},
 		GameID: gameID,
 		Host:   host,
@@ -2261,7 +2278,7 @@ func listPhases(w ResponseWriter, r Request) error {
 		return err
 	}
 	for i := range phases {
-		phases[i].Refresh()
+		phases[i].Refresh(ctx)
 		phases[i].Score(variants.Variants[game.Variant].Nations)
 	}
 
@@ -2298,7 +2315,7 @@ func gameMasterEditNewestPhaseDeadlineAt(w ResponseWriter, r Request) (*GameEdit
 		return nil, err
 	}
 
-	wantedPhaseDeadlineAt := time.Now().Add(time.Minute * time.Duration(genpdlim.NextPhaseDeadlineInMinutes))
+	wantedPhaseDeadlineAt := clock.Now(ctx).Add(time.Minute * time.Duration(genpdlim.NextPhaseDeadlineInMinutes))
 
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		game := &Game{}
@@ -2311,6 +2328,10 @@ func gameMasterEditNewestPhaseDeadlineAt(w ResponseWriter, r Request) (*GameEdit
 			return HTTPErr{"unauthorized", http.StatusUnauthorized}
 		}
 
+		if err := game.CheckGameMasterSecondFactor(r); err != nil {
+			return err
+		}
+
 		if len(game.NewestPhaseMeta) != 1 {
 			return HTTPErr{"game unstarted", http.StatusPreconditionFailed}
 		}
@@ -2332,6 +2353,10 @@ func gameMasterEditNewestPhaseDeadlineAt(w ResponseWriter, r Request) (*GameEdit
 			return HTTPErr{"phase already resolved", http.StatusPreconditionFailed}
 		}
 
+		if err := auth.RecordAudit(ctx, gameID, user.Id, auth.EditDeadlineAuditAction, r.Vars()["phase_ordinal"], map[string]time.Time{"DeadlineAt": phase.DeadlineAt}, map[string]time.Time{"DeadlineAt": wantedPhaseDeadlineAt}); err != nil {
+			return err
+		}
+
 		phase.DeadlineAt = wantedPhaseDeadlineAt
 		game.NewestPhaseMeta = []PhaseMeta{phase.PhaseMeta}
 
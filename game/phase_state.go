@@ -220,6 +220,57 @@ func updatePhaseState(w ResponseWriter, r Request) (*PhaseState, error) {
 	return phaseState, nil
 }
 
+// visiblePhaseStates returns the phase states of phase that viewer is allowed
+// to see, picked from stored and completed with defaults for nations without
+// stored states.
+func visiblePhaseStates(game *Game, gameID *datastore.Key, phase *Phase, viewer *auth.User, stored PhaseStates) PhaseStates {
+	phaseStates := PhaseStates{}
+
+	if phase.Resolved {
+		phaseStates = append(phaseStates, stored...)
+		for _, nat := range variants.Variants[game.Variant].Nations {
+			found := false
+			for _, phaseState := range phaseStates {
+				if phaseState.Nation == nat {
+					found = true
+					break
+				}
+			}
+			if !found {
+				phaseStates = append(phaseStates, PhaseState{
+					GameID:       gameID,
+					PhaseOrdinal: phase.PhaseOrdinal,
+					Nation:       nat,
+				})
+			}
+		}
+	} else {
+		member, isMember := game.GetMemberByUserId(viewer.Id)
+		if isMember {
+			phaseState := PhaseState{
+				GameID:       gameID,
+				PhaseOrdinal: phase.PhaseOrdinal,
+				Nation:       member.Nation,
+			}
+			for _, candidate := range stored {
+				if candidate.Nation == member.Nation {
+					phaseState = candidate
+					break
+				}
+			}
+			phaseStates = append(phaseStates, phaseState)
+		}
+	}
+
+	if !game.Mustered {
+		for idx := range phaseStates {
+			phaseStates[idx].Nation = ""
+		}
+	}
+
+	return phaseStates
+}
+
 func listPhaseStates(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
@@ -249,28 +300,12 @@ func listPhaseStates(w ResponseWriter, r Request) error {
 		return err
 	}
 
-	phaseStates := PhaseStates{}
+	stored := PhaseStates{}
 
 	if phase.Resolved {
-		if _, err := datastore.NewQuery(phaseStateKind).Ancestor(phaseID).GetAll(ctx, &phaseStates); err != nil {
+		if _, err := datastore.NewQuery(phaseStateKind).Ancestor(phaseID).GetAll(ctx, &stored); err != nil {
 			return err
 		}
-		for _, nat := range variants.Variants[game.Variant].Nations {
-			found := false
-			for _, phaseState := range phaseStates {
-				if phaseState.Nation == nat {
-					found = true
-					break
-				}
-			}
-			if !found {
-				phaseStates = append(phaseStates, PhaseState{
-					GameID:       gameID,
-					PhaseOrdinal: phaseOrdinal,
-					Nation:       nat,
-				})
-			}
-		}
 	} else {
 		member, isMember := game.GetMemberByUserId(user.Id)
 		if isMember {
@@ -279,22 +314,15 @@ func listPhaseStates(w ResponseWriter, r Request) error {
 				return err
 			}
 			phaseState := &PhaseState{}
-			if err := datastore.Get(ctx, phaseStateID, phaseState); err == datastore.ErrNoSuchEntity {
-				phaseState.GameID = gameID
-				phaseState.PhaseOrdinal = phaseOrdinal
-				phaseState.Nation = member.Nation
-			} else if err != nil {
+			if err := datastore.Get(ctx, phaseStateID, phaseState); err == nil {
+				stored = append(stored, *phaseState)
+			} else if err != datastore.ErrNoSuchEntity {
 				return err
 			}
-			phaseStates = append(phaseStates, *phaseState)
 		}
 	}
 
-	if !game.Mustered {
-		for idx := range phaseStates {
-			phaseStates[idx].Nation = ""
-		}
-	}
+	phaseStates := visiblePhaseStates(game, gameID, phase, user, stored)
 
 	w.SetContent(phaseStates.Item(r, phase))
 	return nil
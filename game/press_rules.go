@@ -0,0 +1,114 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zond/godip"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+var (
+	pressPhaseTypes = []godip.PhaseType{godip.Movement, godip.Retreat, godip.Adjustment}
+)
+
+func validatePressRules(g *Game) error {
+	for _, phaseType := range g.PressPhaseTypes {
+		found := false
+		for _, allowed := range pressPhaseTypes {
+			found = found || phaseType == allowed
+		}
+		if !found {
+			return HTTPErr{fmt.Sprintf("unknown phase type %q, press phase types must be among %v", phaseType, pressPhaseTypes), http.StatusBadRequest}
+		}
+	}
+	if g.MessagesPerPhase < 0 {
+		return HTTPErr{"messages per phase can't be negative", http.StatusBadRequest}
+	}
+	if g.MaxMessageLength < 0 {
+		return HTTPErr{"max message length can't be negative", http.StatusBadRequest}
+	}
+	if g.PressBlackoutMinutes < 0 || g.PressBlackoutMinutes > MAX_PHASE_DEADLINE {
+		return HTTPErr{"press blackouts must be between zero and 30 days", http.StatusBadRequest}
+	}
+	return nil
+}
+
+func (g *Game) samePressRules(o *Game) bool {
+	return fmt.Sprint(g.PressPhaseTypes) == fmt.Sprint(o.PressPhaseTypes) &&
+		g.MessagesPerPhase == o.MessagesPerPhase &&
+		g.MaxMessageLength == o.MaxMessageLength &&
+		g.PressBlackoutMinutes == o.PressBlackoutMinutes
+}
+
+// PressRules describes the press rules of the game.
+func (g *Game) PressRules() []string {
+	rules := []string{}
+	if len(g.PressPhaseTypes) > 0 {
+		types := make([]string, len(g.PressPhaseTypes))
+		for i, phaseType := range g.PressPhaseTypes {
+			types[i] = string(phaseType)
+		}
+		rules = append(rules, fmt.Sprintf("Press is only allowed during %s phases.", strings.Join(types, " and ")))
+	}
+	if g.MessagesPerPhase > 0 {
+		rules = append(rules, fmt.Sprintf("Each nation can send at most %d messages per phase.", g.MessagesPerPhase))
+	}
+	if g.MaxMessageLength > 0 {
+		rules = append(rules, fmt.Sprintf("Messages can be at most %d characters long.", g.MaxMessageLength))
+	}
+	if g.PressBlackoutMinutes > 0 {
+		rules = append(rules, fmt.Sprintf("No press is allowed during the last %d minutes before the deadline.", g.PressBlackoutMinutes))
+	}
+	return rules
+}
+
+// checkPressRules returns an error if message breaks the press rules of the
+// current phase of g.
+func (g *Game) checkPressRules(ctx context.Context, message *Message, now time.Time) error {
+	if err := g.checkPressAllowed(message, now); err != nil {
+		return err
+	}
+	if g.MessagesPerPhase > 0 && len(g.NewestPhaseMeta) > 0 {
+		sent, err := datastore.NewQuery(messageKind).Ancestor(g.ID).Filter("Sender=", message.Sender).Filter("CreatedAt>=", g.NewestPhaseMeta[0].CreatedAt).Count(ctx)
+		if err != nil {
+			return err
+		}
+		if sent >= g.MessagesPerPhase {
+			return HTTPErr{fmt.Sprintf("nations can send at most %d messages per phase in this game", g.MessagesPerPhase), http.StatusForbidden}
+		}
+	}
+	return nil
+}
+
+// checkPressAllowed returns an error if message is too long, or press isn't
+// allowed at now in the current phase of g. Unlike checkPressRules it doesn't
+// count messages, so it applies to edits as well.
+func (g *Game) checkPressAllowed(message *Message, now time.Time) error {
+	if g.MaxMessageLength > 0 && utf8.RuneCountInString(message.Body) > g.MaxMessageLength {
+		return HTTPErr{fmt.Sprintf("messages in this game can be at most %d characters long", g.MaxMessageLength), http.StatusBadRequest}
+	}
+	if len(g.NewestPhaseMeta) == 0 {
+		return nil
+	}
+	phase := g.NewestPhaseMeta[0]
+	if len(g.PressPhaseTypes) > 0 {
+		found := false
+		for _, phaseType := range g.PressPhaseTypes {
+			found = found || phaseType == phase.Type
+		}
+		if !found {
+			return HTTPErr{fmt.Sprintf("press is not allowed during %s phases in this game", phase.Type), http.StatusForbidden}
+		}
+	}
+	if g.PressBlackoutMinutes > 0 && !phase.DeadlineAt.IsZero() && phase.DeadlineAt.Sub(now) < time.Minute*g.PressBlackoutMinutes {
+		return HTTPErr{fmt.Sprintf("press is not allowed during the last %d minutes before the deadline in this game", g.PressBlackoutMinutes), http.StatusForbidden}
+	}
+	return nil
+}
@@ -30,6 +30,8 @@ func handleIndex(w ResponseWriter, r Request) error {
 			[]string{
 				"Authentication",
 				"The `login` link redirects to the Google OAuth2 login flow, and then back the `redirect-to` query param used when loading the `login` link.",
+				"The `login-providers` link lists `login` links for all configured login providers, e.g. GitHub, Discord or OpenID Connect issuers.",
+				"The `email-login` link takes an `email` parameter, and sends a single use login link to that address.",
 				"In the final redirect, the query parameter `token` will be your OAuth2 token.",
 				"Use this token as the URL parameter `token`, or use it inside an `Authorization: Bearer ...` header to authenticate requests.",
 			},
@@ -46,6 +48,11 @@ func handleIndex(w ResponseWriter, r Request) error {
 				"NoMerge should be set to true if the game should _not_ be merged with another open public game with the same settings.",
 				"Private should be set to true if the game should _not_ show up in any game lists other than 'My ...'.",
 			},
+			[]string{
+				"Personal data",
+				"The `export` link returns all personal data stored about the logged in user.",
+				"The `delete-account` link deletes the logged in user: it leaves staging games, becomes replaceable in started games and anonymous in finished games, and loses its notification config, owned bans and ways to log in.",
+			},
 		}).AddLink(r.NewLink(Link{
 		Rel:   "self",
 		Route: IndexRoute,
@@ -74,6 +81,20 @@ func handleIndex(w ResponseWriter, r Request) error {
 			QueryParams: url.Values{
 				"redirect-to": []string{redirectURL.String()},
 			},
+		})).AddLink(r.NewLink(Link{
+			Rel:   "login-providers",
+			Route: auth.ListLoginProvidersRoute,
+			QueryParams: url.Values{
+				"redirect-to": []string{redirectURL.String()},
+			},
+		}))
+		index.AddLink(r.NewLink(Link{
+			Rel:    "email-login",
+			Route:  auth.EMailLoginRoute,
+			Method: "POST",
+			QueryParams: url.Values{
+				"redirect-to": []string{redirectURL.String()},
+			},
 		}))
 	} else {
 		index.AddLink(r.NewLink(Link{
@@ -110,10 +131,34 @@ func handleIndex(w ResponseWriter, r Request) error {
 		index.AddLink(r.NewLink(Link{
 			Rel:   "flagged-messages",
 			Route: ListFlaggedMessagesRoute,
+		})).AddLink(r.NewLink(Link{
+			Rel:         "moderation-queue",
+			Route:       ListFlaggedMessagesRoute,
+			QueryParams: url.Values{"unresolved": []string{"true"}},
 		})).AddLink(r.NewLink(Link{
 			Rel:         "approved-frontends",
 			Route:       auth.ListRedirectURLsRoute,
 			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "access-tokens",
+			Route:       auth.ListAccessTokensRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "oauth2-clients",
+			Route:       auth.ListOAuth2ClientsRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "sessions",
+			Route:       auth.ListSessionsRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "identities",
+			Route:       auth.ListIdentitiesRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "totp",
+			Route:       auth.LoadTOTPRoute,
+			RouteParams: []string{"user_id", user.Id},
 		})).AddLink(r.NewLink(GameResource.Link("create-game", Create, nil))).
 			AddLink(r.NewLink(auth.UserConfigResource.Link("user-config", Load, []string{"user_id", user.Id}))).
 			AddLink(r.NewLink(Link{
@@ -121,6 +166,24 @@ func handleIndex(w ResponseWriter, r Request) error {
 				Route:       ListBansRoute,
 				RouteParams: []string{"user_id", user.Id},
 			})).AddLink(r.NewLink(UserStatsResource.Link("user-stats", Load, []string{"user_id", user.Id})))
+		index.AddLink(r.NewLink(Link{
+			Rel:         "blocks",
+			Route:       ListBlocksRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "moderation-notices",
+			Route:       ListModerationNoticesRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "export",
+			Route:       ExportUserRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "delete-account",
+			Route:       DeleteUserRoute,
+			RouteParams: []string{"user_id", user.Id},
+			Method:      "DELETE",
+		}))
 	}
 	w.SetContent(index)
 	return nil
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/zond/diplicity/clock"
 	"github.com/zond/godip"
 
 	"github.com/gorilla/feeds"
@@ -320,7 +321,7 @@ func handleRss(w ResponseWriter, r Request) error {
 	if err != nil {
 		return err
 	}
-	lastModified := time.Now()
+	lastModified := clock.Now(ctx)
 	if len(eventTimes) > 0 {
 		lastModified = eventTimes[0]
 	}
@@ -361,7 +362,7 @@ func handleRss(w ResponseWriter, r Request) error {
 
 	// Populate memcache.
 	// Use an expiry of 1 hour, since requests after that will hit the db anyway.
-	checkedStr := time.Now().Format(httpDateFormat)
+	checkedStr := clock.Now(ctx).Format(httpDateFormat)
 	checkedItem := &memcache.Item{
 		Key:        checkedKey,
 		Value:      []byte(checkedStr),
@@ -0,0 +1,335 @@
+package game
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/clock"
+	"github.com/zond/godip"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	scheduledMessageKind = "ScheduledMessage"
+
+	maxPendingScheduledMessages = 20
+	maxScheduledMessageDelay    = 30 * 24 * time.Hour
+)
+
+var (
+	ScheduledMessageResource *Resource
+
+	deliverScheduledMessageFunc       *DelayFunc
+	deliverPhaseScheduledMessagesFunc *DelayFunc
+)
+
+func init() {
+	deliverScheduledMessageFunc = NewDelayFunc("game-deliverScheduledMessage", deliverScheduledMessage)
+	deliverPhaseScheduledMessagesFunc = NewDelayFunc("game-deliverPhaseScheduledMessages", deliverPhaseScheduledMessages)
+
+	ScheduledMessageResource = &Resource{
+		Create:     createScheduledMessage,
+		Delete:     cancelScheduledMessage,
+		CreatePath: "/Game/{game_id}/ScheduledMessage",
+		FullPath:   "/Game/{game_id}/ScheduledMessage/{id}",
+		Type:       reflect.TypeOf(ScheduledMessage{}),
+		Listers: []Lister{
+			{
+				Path:    "/Game/{game_id}/ScheduledMessages",
+				Route:   ListScheduledMessagesRoute,
+				Handler: listScheduledMessages,
+			},
+		},
+	}
+}
+
+// ScheduledMessage is a message queued by a nation, to be sent at DeliverAt,
+// or when the phase after AfterPhaseOrdinal starts if OnPhaseStart is set.
+// It is deleted when delivered, cancelled or dropped.
+type ScheduledMessage struct {
+	ID                *datastore.Key `datastore:"-"`
+	GameID            *datastore.Key
+	ChannelMembers    Nations `methods:"POST"`
+	Sender            godip.Nation
+	Body              string    `methods:"POST" datastore:",noindex"`
+	DeliverAt         time.Time `methods:"POST"`
+	OnPhaseStart      bool      `methods:"POST"`
+	AfterPhaseOrdinal int64
+	CreatedAt         time.Time
+}
+
+func (s *ScheduledMessage) Item(r Request) *Item {
+	return NewItem(s).SetName(s.ChannelMembers.String()).AddLink(r.NewLink(ScheduledMessageResource.Link("cancel", Delete, []string{"game_id", s.GameID.Encode(), "id", s.ID.Encode()})))
+}
+
+type ScheduledMessages []ScheduledMessage
+
+func (s ScheduledMessages) Item(r Request, gameID *datastore.Key) *Item {
+	scheduledItems := make(List, len(s))
+	for i := range s {
+		scheduledItems[i] = s[i].Item(r)
+	}
+	return NewItem(scheduledItems).SetName("scheduled-messages").SetDesc([][]string{
+		[]string{
+			"Scheduled messages",
+			"Your pending scheduled messages in this game. Schedule a message with a `DeliverAt` time to send it then, or with `OnPhaseStart` to send it when the next phase starts.",
+			"Pending messages can be cancelled. Messages are dropped without being sent if your nation is eliminated, or if the message isn't allowed in the channel when it's due.",
+		},
+	}).AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListScheduledMessagesRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
+	})).AddLink(r.NewLink(ScheduledMessageResource.Link("schedule-message", Create, []string{"game_id", gameID.Encode()})))
+}
+
+// scheduledMessageSender returns the game and the nation of user, if user can
+// schedule messages in the game.
+func scheduledMessageSender(ctx context.Context, gameID *datastore.Key, user *auth.User) (*Game, godip.Nation, error) {
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return nil, "", err
+	}
+	game.ID = gameID
+	member, isMember := game.GetMemberByUserId(user.Id)
+	if !isMember || !game.Started || !game.Mustered || game.Finished {
+		return nil, "", HTTPErr{"can only schedule messages as member of running games", http.StatusForbidden}
+	}
+	if member.NewestPhaseState.Eliminated {
+		return nil, "", HTTPErr{"eliminated nations can't schedule messages", http.StatusForbidden}
+	}
+	return game, member.Nation, nil
+}
+
+func createScheduledMessage(w ResponseWriter, r Request) (*ScheduledMessage, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled := &ScheduledMessage{}
+	if err := Copy(scheduled, r, "POST"); err != nil {
+		return nil, err
+	}
+
+	game, nation, err := scheduledMessageSender(ctx, gameID, user)
+	if err != nil {
+		return nil, err
+	}
+
+	now := clock.Now(ctx)
+	scheduled.GameID = gameID
+	scheduled.Sender = nation
+	scheduled.CreatedAt = now
+	sort.Sort(scheduled.ChannelMembers)
+	if len(game.NewestPhaseMeta) > 0 {
+		scheduled.AfterPhaseOrdinal = game.NewestPhaseMeta[0].PhaseOrdinal
+	}
+
+	if strings.TrimSpace(scheduled.Body) == "" {
+		return nil, HTTPErr{"can not create empty messages", http.StatusBadRequest}
+	}
+	if scheduled.OnPhaseStart == !scheduled.DeliverAt.IsZero() {
+		return nil, HTTPErr{"scheduled messages need exactly one of DeliverAt and OnPhaseStart", http.StatusBadRequest}
+	}
+	if !scheduled.OnPhaseStart && (!scheduled.DeliverAt.After(now) || scheduled.DeliverAt.Sub(now) > maxScheduledMessageDelay) {
+		return nil, HTTPErr{"messages can only be scheduled up to 30 days into the future", http.StatusBadRequest}
+	}
+	if !scheduled.ChannelMembers.Includes(nation) {
+		return nil, HTTPErr{"can only send messages to member channels", http.StatusForbidden}
+	}
+	for _, channelMember := range scheduled.ChannelMembers {
+		if !Nations(variants.Variants[game.Variant].Nations).Includes(channelMember) {
+			return nil, HTTPErr{"unknown channel member", http.StatusBadRequest}
+		}
+	}
+	if err := game.checkChatEnabled(scheduled.ChannelMembers); err != nil {
+		return nil, err
+	}
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		pending, err := datastore.NewQuery(scheduledMessageKind).Ancestor(gameID).Filter("Sender=", nation).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if len(pending) >= maxPendingScheduledMessages {
+			return HTTPErr{fmt.Sprintf("nations can have at most %d pending scheduled messages", maxPendingScheduledMessages), http.StatusForbidden}
+		}
+		if scheduled.ID, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, scheduledMessageKind, gameID), scheduled); err != nil {
+			return err
+		}
+		if !scheduled.OnPhaseStart {
+			return deliverScheduledMessageFunc.EnqueueAt(ctx, scheduled.DeliverAt, r.Req().Host, scheduled.ID)
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	return scheduled, nil
+}
+
+func cancelScheduledMessage(w ResponseWriter, r Request) (*ScheduledMessage, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return nil, err
+	}
+	member, isMember := game.GetMemberByUserId(user.Id)
+	if !isMember {
+		return nil, HTTPErr{"can only cancel your own scheduled messages", http.StatusForbidden}
+	}
+
+	scheduledID, err := datastore.DecodeKey(r.Vars()["id"])
+	if err != nil || scheduledID.Kind() != scheduledMessageKind || !scheduledID.Parent().Equal(gameID) {
+		return nil, HTTPErr{"scheduled message not found", http.StatusNotFound}
+	}
+
+	scheduled := &ScheduledMessage{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, scheduledID, scheduled); err == datastore.ErrNoSuchEntity {
+			return HTTPErr{"scheduled message not found, it may already have been sent", http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+		if scheduled.Sender != member.Nation {
+			return HTTPErr{"can only cancel your own scheduled messages", http.StatusForbidden}
+		}
+		return datastore.Delete(ctx, scheduledID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+	scheduled.ID = scheduledID
+
+	return scheduled, nil
+}
+
+func listScheduledMessages(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthenticated", http.StatusUnauthorized}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	member, isMember := game.GetMemberByUserId(user.Id)
+	if !isMember {
+		return HTTPErr{"can only list scheduled messages of your own games", http.StatusForbidden}
+	}
+
+	scheduled := ScheduledMessages{}
+	ids, err := datastore.NewQuery(scheduledMessageKind).Ancestor(gameID).Filter("Sender=", member.Nation).GetAll(ctx, &scheduled)
+	if err != nil {
+		return err
+	}
+	for i := range scheduled {
+		scheduled[i].ID = ids[i]
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].CreatedAt.Before(scheduled[j].CreatedAt)
+	})
+
+	w.SetContent(scheduled.Item(r, gameID))
+	return nil
+}
+
+// deliverPhaseScheduledMessages delivers the messages scheduled for the start
+// of the phase with phaseOrdinal, and is enqueued by the PhaseResolver when a
+// new phase starts.
+func deliverPhaseScheduledMessages(ctx context.Context, host string, gameID *datastore.Key, phaseOrdinal int64) error {
+	log.Infof(ctx, "deliverPhaseScheduledMessages(..., %q, %v, %v)", host, gameID, phaseOrdinal)
+	ids, err := datastore.NewQuery(scheduledMessageKind).Ancestor(gameID).Filter("OnPhaseStart=", true).Filter("AfterPhaseOrdinal<", phaseOrdinal).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load scheduled messages for %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+	for _, id := range ids {
+		if err := deliverScheduledMessage(ctx, host, id); err != nil {
+			return err
+		}
+	}
+	log.Infof(ctx, "deliverPhaseScheduledMessages(..., %q, %v, %v) *** SUCCESS ***", host, gameID, phaseOrdinal)
+	return nil
+}
+
+// deliverScheduledMessage sends the scheduled message with scheduledID via
+// AsyncSendMsgFunc, unless it has been cancelled, or drops it if the sender
+// is eliminated or the message isn't allowed anymore.
+func deliverScheduledMessage(ctx context.Context, host string, scheduledID *datastore.Key) error {
+	log.Infof(ctx, "deliverScheduledMessage(..., %q, %v)", host, scheduledID)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		scheduled := &ScheduledMessage{}
+		if err := datastore.Get(ctx, scheduledID, scheduled); err == datastore.ErrNoSuchEntity {
+			log.Infof(ctx, "%v has been cancelled or already delivered", scheduledID)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		game := &Game{}
+		if err := datastore.Get(ctx, scheduled.GameID, game); err != nil {
+			return err
+		}
+		if err := datastore.Delete(ctx, scheduledID); err != nil {
+			return err
+		}
+		if member, isMember := game.GetMemberByNation(scheduled.Sender); !isMember || member.NewestPhaseState.Eliminated {
+			log.Infof(ctx, "Dropping %v, since %v is eliminated", PP(scheduled), scheduled.Sender)
+			return nil
+		}
+		message := &Message{
+			GameID:         scheduled.GameID,
+			ChannelMembers: scheduled.ChannelMembers,
+			Sender:         scheduled.Sender,
+			Body:           scheduled.Body,
+		}
+		if err := validateMessage(ctx, message); err != nil {
+			if _, isHTTPErr := err.(HTTPErr); isHTTPErr {
+				log.Infof(ctx, "Dropping %v, since it's not allowed anymore: %v", PP(scheduled), err)
+				return nil
+			}
+			return err
+		}
+		channelMembers := make([]string, len(scheduled.ChannelMembers))
+		for i, nation := range scheduled.ChannelMembers {
+			channelMembers[i] = string(nation)
+		}
+		return AsyncSendMsgFunc.EnqueueIn(ctx, 0, scheduled.GameID, string(scheduled.Sender), channelMembers, scheduled.Body, host)
+	}, &datastore.TransactionOptions{XG: true})
+}
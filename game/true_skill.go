@@ -117,20 +117,8 @@ func handleDeleteTrueSkills(w ResponseWriter, r Request) error {
 
 	log.Infof(ctx, "handleDeleteTrueSkills(..., ...)")
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	getFunc := func() ([]*datastore.Key, error) {
@@ -205,20 +193,8 @@ func handleReRateTrueSkills(w ResponseWriter, r Request) error {
 
 	log.Infof(ctx, "handleReRateTrueSkills(..., ...)")
 
-	if !appengine.IsDevAppServer() {
-		user, ok := r.Values()["user"].(*auth.User)
-		if !ok {
-			return HTTPErr{"unauthenticated", http.StatusUnauthorized}
-		}
-
-		superusers, err := auth.GetSuperusers(ctx)
-		if err != nil {
-			return err
-		}
-
-		if !superusers.Includes(user.Id) {
-			return HTTPErr{"unauthorized", http.StatusForbidden}
-		}
+	if err := auth.RequirePermission(ctx, r, auth.MaintenancePermission); err != nil {
+		return err
 	}
 
 	return reRateTrueSkillsFunc.EnqueueIn(ctx, 0, 0, "", false, false)
@@ -4,10 +4,13 @@ go 1.20
 
 require (
 	github.com/aymerick/raymond v2.0.2+incompatible
+	github.com/bwmarrin/discordgo v0.28.1
 	github.com/davecgh/go-spew v1.1.1
 	github.com/dustin/go-humanize v1.0.0
+	github.com/golang/protobuf v1.5.0
 	github.com/gorilla/feeds v1.1.1
 	github.com/gorilla/mux v1.8.0
+	github.com/graph-gophers/graphql-go v1.5.0
 	github.com/jmoiron/jsonq v0.0.0-20150511023944-e874b168d07e
 	github.com/kr/pretty v0.2.0
 	github.com/kvannotten/mailstrip v0.0.0-20181210132851-650244c72ccd
@@ -28,9 +31,7 @@ require (
 
 require (
 	cloud.google.com/go v0.38.0 // indirect
-	github.com/bwmarrin/discordgo v0.28.1 // indirect
 	github.com/gogs/chardet v0.0.0-20150115103509-2404f7772561 // indirect
-	github.com/golang/protobuf v1.5.0 // indirect
 	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
 	github.com/gorilla/schema v1.2.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
@@ -42,7 +43,6 @@ require (
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
-	github.com/stretchr/testify v1.5.1 // indirect
 	go.opencensus.io v0.21.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
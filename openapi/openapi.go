@@ -0,0 +1,448 @@
+// Package openapi generates an OpenAPI 3 description of the routes and
+// resources registered with goaeoas.
+package openapi
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	Version = "3.0.3"
+
+	jsonMedia = "application/json"
+)
+
+var (
+	pathVarReg   = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+	keyType      = reflect.TypeOf(&datastore.Key{})
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Servers    []Server             `json:"servers,omitempty"`
+	Paths      map[string]PathItem  `json:"paths"`
+	Components Components           `json:"components"`
+	Security   []map[string][]string `json:"security,omitempty"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+// PathItem maps lower case HTTP methods to operations.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string              `json:"operationId"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	Name   string `json:"name,omitempty"`
+	In     string `json:"in,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type resourceRoute struct {
+	resource *Resource
+	method   Method
+	lister   *Lister
+}
+
+type generator struct {
+	doc            *Document
+	resourceRoutes map[string]resourceRoute
+	schemaNames    map[reflect.Type]string
+}
+
+// Generate describes every named route of router. Routes belonging to one of
+// resources get schemas derived from the resource type, where request bodies
+// only contain the fields whose `methods` tag includes the HTTP method used.
+func Generate(router *mux.Router, resources []*Resource, info Info) (*Document, error) {
+	g := &generator{
+		doc: &Document{
+			OpenAPI: Version,
+			Info:    info,
+			Paths:   map[string]PathItem{},
+			Components: Components{
+				Schemas: map[string]*Schema{},
+				SecuritySchemes: map[string]SecurityScheme{
+					"bearer": {Type: "http", Scheme: "bearer"},
+					"token":  {Type: "apiKey", Name: "token", In: "query"},
+				},
+			},
+			Security: []map[string][]string{{}, {"bearer": {}}, {"token": {}}},
+		},
+		resourceRoutes: map[string]resourceRoute{},
+		schemaNames:    map[reflect.Type]string{},
+	}
+	for _, resource := range resources {
+		if resource.Type == nil {
+			return nil, fmt.Errorf("resource %+v not registered with HandleResource", resource)
+		}
+		for _, meth := range []Method{Create, Update, Delete, Load} {
+			g.resourceRoutes[resource.Route(meth)] = resourceRoute{
+				resource: resource,
+				method:   meth,
+			}
+		}
+		for i := range resource.Listers {
+			g.resourceRoutes[resource.Listers[i].Route] = resourceRoute{
+				resource: resource,
+				lister:   &resource.Listers[i],
+			}
+		}
+	}
+	g.doc.Components.Schemas["Link"] = &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Rel":        {Type: "string"},
+			"URL":        {Type: "string"},
+			"Method":     {Type: "string"},
+			"JSONSchema": {Type: "object", Description: "Describes the body expected by POST and PUT links."},
+		},
+	}
+	if err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		name := route.GetName()
+		if name == "" {
+			return nil
+		}
+		pathTemplate, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		return g.addRoute(name, pathTemplate, methods)
+	}); err != nil {
+		return nil, err
+	}
+	return g.doc, nil
+}
+
+func (g *generator) addRoute(name, pathTemplate string, methods []string) error {
+	path := pathVarReg.ReplaceAllString(pathTemplate, "{$1}")
+	item, found := g.doc.Paths[path]
+	if !found {
+		item = PathItem{}
+		g.doc.Paths[path] = item
+	}
+	for _, method := range methods {
+		op := &Operation{
+			OperationID: name,
+			Responses: map[string]Response{
+				"200": {Description: "Success."},
+			},
+		}
+		for _, match := range pathVarReg.FindAllStringSubmatch(pathTemplate, -1) {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:     match[1],
+				In:       "path",
+				Required: true,
+				Schema:   &Schema{Type: "string"},
+			})
+		}
+		if rr, found := g.resourceRoutes[name]; found {
+			if err := g.describeResourceRoute(op, method, rr); err != nil {
+				return err
+			}
+		} else if parts := strings.Split(strings.Trim(path, "/"), "/"); parts[0] != "" {
+			op.Tags = []string{parts[0]}
+		}
+		item[strings.ToLower(method)] = op
+	}
+	return nil
+}
+
+func (g *generator) describeResourceRoute(op *Operation, method string, rr resourceRoute) error {
+	typ := rr.resource.Type
+	op.Tags = []string{typ.Name()}
+	if rr.lister != nil {
+		queryParams := append([]string{}, rr.lister.QueryParams...)
+		sort.Strings(queryParams)
+		for _, param := range queryParams {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:   param,
+				In:     "query",
+				Schema: &Schema{Type: "string"},
+			})
+		}
+		list, err := g.listSchema(typ)
+		if err != nil {
+			return err
+		}
+		op.Responses["200"] = Response{
+			Description: fmt.Sprintf("A list of %v.", typ.Name()),
+			Content:     map[string]MediaType{jsonMedia: {Schema: list}},
+		}
+		return nil
+	}
+	if rr.method == Create || rr.method == Update {
+		body, err := g.schema(typ, method)
+		if err != nil {
+			return err
+		}
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{jsonMedia: {Schema: body}},
+		}
+	}
+	item, err := g.itemSchema(typ)
+	if err != nil {
+		return err
+	}
+	op.Responses["200"] = Response{
+		Description: fmt.Sprintf("The %v.", typ.Name()),
+		Content:     map[string]MediaType{jsonMedia: {Schema: item}},
+	}
+	return nil
+}
+
+func ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// itemSchema describes a goaeoas Item wrapping a typ.
+func (g *generator) itemSchema(typ reflect.Type) (*Schema, error) {
+	name := typ.Name() + "Item"
+	if _, found := g.doc.Components.Schemas[name]; found {
+		return ref(name), nil
+	}
+	properties, err := g.schema(typ, "GET")
+	if err != nil {
+		return nil, err
+	}
+	g.doc.Components.Schemas[name] = &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Name":       {Type: "string"},
+			"Type":       {Type: "string"},
+			"Desc":       {Type: "array", Items: &Schema{Type: "array", Items: &Schema{Type: "string"}}},
+			"Links":      {Type: "array", Items: ref("Link")},
+			"Properties": properties,
+		},
+	}
+	return ref(name), nil
+}
+
+// listSchema describes a goaeoas Item wrapping a list of Items wrapping typ.
+func (g *generator) listSchema(typ reflect.Type) (*Schema, error) {
+	name := typ.Name() + "List"
+	if _, found := g.doc.Components.Schemas[name]; found {
+		return ref(name), nil
+	}
+	item, err := g.itemSchema(typ)
+	if err != nil {
+		return nil, err
+	}
+	g.doc.Components.Schemas[name] = &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"Name":       {Type: "string"},
+			"Type":       {Type: "string"},
+			"Desc":       {Type: "array", Items: &Schema{Type: "array", Items: &Schema{Type: "string"}}},
+			"Links":      {Type: "array", Items: ref("Link")},
+			"Properties": {Type: "array", Items: item},
+		},
+	}
+	return ref(name), nil
+}
+
+// schemaName returns a component name for typ as sent with method, unique
+// even if types in different packages share names.
+func (g *generator) schemaName(typ reflect.Type, method string) string {
+	name, found := g.schemaNames[typ]
+	if !found {
+		name = typ.Name()
+		for _, other := range g.schemaNames {
+			if other == name {
+				parts := strings.Split(typ.PkgPath(), "/")
+				pkg := parts[len(parts)-1]
+				name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+				break
+			}
+		}
+		g.schemaNames[typ] = name
+	}
+	switch method {
+	case "POST":
+		return name + "Create"
+	case "PUT":
+		return name + "Update"
+	}
+	return name
+}
+
+// fieldIncluded mirrors how goaeoas decides which fields to accept for each
+// method: all JSON fields for GET, and only those tagged with the method
+// otherwise.
+func fieldIncluded(field reflect.StructField, method string) bool {
+	if method == "GET" {
+		return field.Tag.Get("json") != "-"
+	}
+	for _, tagged := range strings.Split(field.Tag.Get("methods"), ",") {
+		if tagged == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *generator) addFields(schema *Schema, typ reflect.Type, method string) error {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if !fieldIncluded(field, method) {
+			continue
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr && fieldType != keyType {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && fieldType.Kind() == reflect.Struct {
+			if err := g.addFields(schema, fieldType, method); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Name
+		if jsonName := strings.Split(field.Tag.Get("json"), ",")[0]; jsonName != "" && jsonName != "-" {
+			name = jsonName
+		}
+		fieldSchema, err := g.schema(field.Type, method)
+		if err != nil {
+			return fmt.Errorf("%v.%v: %v", typ, field.Name, err)
+		}
+		if field.Type == durationType && field.Tag.Get("ticker") != "" {
+			fieldSchema.Description = "Nanoseconds relative to when the response was generated."
+		}
+		schema.Properties[name] = fieldSchema
+	}
+	return nil
+}
+
+func (g *generator) schema(typ reflect.Type, method string) (*Schema, error) {
+	switch typ {
+	case keyType:
+		return &Schema{Type: "string", Description: "Encoded datastore key."}, nil
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}, nil
+	case durationType:
+		return &Schema{Type: "integer", Format: "int64", Description: "Nanoseconds."}, nil
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return g.schema(typ.Elem(), method)
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}, nil
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}, nil
+	case reflect.Interface:
+		return &Schema{}, nil
+	case reflect.Map:
+		values, err := g.schema(typ.Elem(), method)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}, nil
+		}
+		items, err := g.schema(typ.Elem(), method)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	case reflect.Struct:
+		schema := &Schema{
+			Type:       "object",
+			Properties: map[string]*Schema{},
+		}
+		if typ.Name() == "" {
+			if err := g.addFields(schema, typ, method); err != nil {
+				return nil, err
+			}
+			return schema, nil
+		}
+		name := g.schemaName(typ, method)
+		if _, found := g.doc.Components.Schemas[name]; !found {
+			// Register before populating, to terminate recursive types.
+			g.doc.Components.Schemas[name] = schema
+			if err := g.addFields(schema, typ, method); err != nil {
+				return nil, err
+			}
+		}
+		return ref(name), nil
+	}
+	return nil, fmt.Errorf("untranslatable Go type %v", typ)
+}
@@ -0,0 +1,34 @@
+package openapi_test
+
+import (
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/zond/diplicity/routes"
+)
+
+func TestGenerate(t *testing.T) {
+	router := mux.NewRouter()
+	routes.Setup(router)
+	doc, err := routes.OpenAPI(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := doc.Paths["/Game"]["post"]
+	if op == nil || op.OperationID != "Game.Create" {
+		t.Fatalf("got %+v, wanted Game.Create", op)
+	}
+	if ref := op.RequestBody.Content["application/json"].Schema.Ref; ref != "#/components/schemas/GameCreate" {
+		t.Errorf("got %q, wanted GameCreate body", ref)
+	}
+	create := doc.Components.Schemas["GameCreate"]
+	if _, found := create.Properties["Desc"]; !found {
+		t.Errorf("GameCreate lacks Desc: %+v", create.Properties)
+	}
+	if _, found := create.Properties["ID"]; found {
+		t.Errorf("GameCreate has ID: %+v", create.Properties)
+	}
+	if doc.Paths["/openapi.json"]["get"] == nil {
+		t.Errorf("the document doesn't describe itself")
+	}
+}
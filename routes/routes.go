@@ -1,16 +1,41 @@
 package routes
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/zond/diplicity/auth"
 	"github.com/zond/diplicity/game"
+	"github.com/zond/diplicity/openapi"
 	"github.com/zond/diplicity/variants"
 
 	. "github.com/zond/goaeoas"
 )
 
+const (
+	OpenAPIRoute = "OpenAPI"
+)
+
+// Resources returns all resources registered by Setup.
+func Resources() []*Resource {
+	result := []*Resource{}
+	result = append(result, auth.Resources()...)
+	result = append(result, game.Resources()...)
+	result = append(result, variants.Resources()...)
+	return result
+}
+
+// OpenAPI describes the API served by r, which must have been passed to Setup.
+func OpenAPI(r *mux.Router) (*openapi.Document, error) {
+	return openapi.Generate(r, Resources(), openapi.Info{
+		Title:       "Diplicity",
+		Description: "The Diplicity HATEOAS API. Follow the Links of each response to discover what can be done next.",
+		Version:     fmt.Sprint(auth.HTMLAPILevel),
+	})
+}
+
 func Setup(r *mux.Router) {
 	r.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		CORSHeaders(w)
@@ -18,4 +43,16 @@ func Setup(r *mux.Router) {
 	auth.SetupRouter(r)
 	game.SetupRouter(r)
 	variants.SetupRouter(r)
+	// Not using `Handle` here, since the document isn't a goaeoas resource.
+	r.Path("/openapi.json").Methods("GET").Name(OpenAPIRoute).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		CORSHeaders(w)
+		doc, err := OpenAPI(r)
+		if err != nil {
+			HTTPError(w, req, err)
+			return
+		}
+		doc.Servers = []openapi.Server{{URL: fmt.Sprintf("%s://%s", DefaultScheme, req.Host)}}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(doc)
+	})
 }
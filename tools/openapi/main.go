@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/zond/diplicity/openapi"
+	"github.com/zond/diplicity/routes"
+)
+
+func main() {
+	out := flag.String("out", "", "Where to put the generated OpenAPI document, stdout if empty.")
+	server := flag.String("server", "https://diplicity-engine.appspot.com", "The server URL to put in the document.")
+	flag.Parse()
+
+	router := mux.NewRouter()
+	routes.Setup(router)
+	doc, err := routes.OpenAPI(router)
+	if err != nil {
+		panic(err)
+	}
+	if *server != "" {
+		doc.Servers = []openapi.Server{{URL: *server}}
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if *out == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		panic(err)
+	}
+}
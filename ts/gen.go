@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/openapi"
+	"github.com/zond/diplicity/routes"
+	"github.com/zond/diplicity/variants"
+)
+
+var (
+	identifierReg = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+	clientTemplate = template.Must(template.New("client.ts").Parse(`// Generated by ts/gen.go, do not edit.
+
+import { Link } from "./types";
+
+// The highest API level any variant is scheduled to launch at.
+export const APILevel = {{.APILevel}};
+
+// Maps variant names to the API level where they become visible.
+export const LaunchSchedule: { [variant: string]: number } = {
+{{- range .LaunchSchedule}}
+  {{printf "%q" .Variant}}: {{.Level}},
+{{- end}}
+};
+
+// launched returns whether variant is visible to clients at apiLevel.
+export function launched(variant: string, apiLevel: number = APILevel): boolean {
+  const level = LaunchSchedule[variant];
+  return level === undefined || level <= apiLevel;
+}
+
+export interface Linked {
+  Links?: Link[] | null;
+}
+
+export class APIError extends Error {
+  constructor(public status: number, public body: string) {
+    super(` + "`${status}: ${body}`" + `);
+  }
+}
+
+export class Client {
+  constructor(
+    public baseURL: string,
+    public token?: string,
+    public apiLevel: number = APILevel,
+  ) {}
+
+  async request<T>(method: string, url: string, body?: unknown): Promise<T> {
+    const headers: { [name: string]: string } = {
+      Accept: "application/json",
+      "X-Diplicity-API-Level": String(this.apiLevel),
+    };
+    if (this.token) {
+      headers["Authorization"] = "Bearer " + this.token;
+    }
+    if (body !== undefined) {
+      headers["Content-Type"] = "application/json";
+    }
+    const res = await fetch(new URL(url, this.baseURL).toString(), {
+      method: method,
+      headers: headers,
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!res.ok) {
+      throw new APIError(res.status, await res.text());
+    }
+    return (await res.json()) as T;
+  }
+
+  // root loads the index, which links to everything else.
+  root<T extends Linked>(): Promise<T> {
+    return this.request<T>("GET", "/");
+  }
+
+  // link returns the link of item with rel, if any.
+  link(item: Linked, rel: string): Link | undefined {
+    return (item.Links || []).find((link) => link.Rel === rel);
+  }
+
+  // follow requests the link of item with rel, sending body if provided.
+  follow<T>(item: Linked, rel: string, body?: unknown): Promise<T> {
+    const link = this.link(item, rel);
+    if (!link) {
+      throw new Error(` + "`no link with Rel ${rel}`" + `);
+    }
+    return this.request<T>(link.Method, link.URL, body);
+  }
+}
+`))
+)
+
+type launch struct {
+	Variant string
+	Level   int
+}
+
+// tsType returns the TypeScript type of values described by schema.
+func tsType(schema *openapi.Schema, indent string) string {
+	if schema == nil {
+		return "unknown"
+	}
+	if schema.Ref != "" {
+		parts := strings.Split(schema.Ref, "/")
+		return parts[len(parts)-1]
+	}
+	switch schema.Type {
+	case "boolean":
+		return "boolean"
+	case "string":
+		return "string"
+	case "integer", "number":
+		return "number"
+	case "array":
+		elem := tsType(schema.Items, indent)
+		if strings.ContainsAny(elem, " |") {
+			return fmt.Sprintf("Array<%s>", elem)
+		}
+		return elem + "[]"
+	case "object":
+		if schema.AdditionalProperties != nil {
+			return fmt.Sprintf("{ [key: string]: %s }", tsType(schema.AdditionalProperties, indent))
+		}
+		return tsObject(schema, indent)
+	}
+	return "any"
+}
+
+// tsObject returns an object type literal with the properties of schema.
+func tsObject(schema *openapi.Schema, indent string) string {
+	if len(schema.Properties) == 0 {
+		return "{}"
+	}
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "{")
+	for _, name := range names {
+		prop := schema.Properties[name]
+		if prop.Description != "" {
+			fmt.Fprintf(buf, "%s  // %s\n", indent, prop.Description)
+		}
+		key := name
+		if !identifierReg.MatchString(key) {
+			key = fmt.Sprintf("%q", key)
+		}
+		typ := tsType(prop, indent+"  ")
+		// Go marshals nil slices, maps and pointers as null.
+		if prop.Ref != "" || prop.Type == "array" || prop.Type == "object" {
+			typ += " | null"
+		}
+		// Fields tagged omitempty may be missing altogether.
+		fmt.Fprintf(buf, "%s  %s?: %s;\n", indent, key, typ)
+	}
+	fmt.Fprintf(buf, "%s}", indent)
+	return buf.String()
+}
+
+func genTypes(doc *openapi.Document) []byte {
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "// Generated by ts/gen.go, do not edit.")
+	for _, name := range names {
+		schema := doc.Components.Schemas[name]
+		fmt.Fprintln(buf)
+		if schema.Description != "" {
+			fmt.Fprintf(buf, "// %s\n", schema.Description)
+		}
+		if schema.Type == "object" && schema.AdditionalProperties == nil {
+			fmt.Fprintf(buf, "export interface %s %s\n", name, tsObject(schema, ""))
+		} else {
+			fmt.Fprintf(buf, "export type %s = %s;\n", name, tsType(schema, ""))
+		}
+	}
+	return buf.Bytes()
+}
+
+func genClient() ([]byte, error) {
+	launches := []launch{}
+	for variant, level := range variants.LaunchSchedule {
+		launches = append(launches, launch{Variant: variant, Level: level})
+	}
+	sort.Slice(launches, func(i, j int) bool {
+		return launches[i].Variant < launches[j].Variant
+	})
+	buf := &bytes.Buffer{}
+	if err := clientTemplate.Execute(buf, map[string]interface{}{
+		"APILevel":       auth.HTMLAPILevel,
+		"LaunchSchedule": launches,
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func main() {
+	dir := flag.String("dir", "", "Where to put the generated files.")
+	flag.Parse()
+
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	router := mux.NewRouter()
+	routes.Setup(router)
+	doc, err := routes.OpenAPI(router)
+	if err != nil {
+		panic(err)
+	}
+	client, err := genClient()
+	if err != nil {
+		panic(err)
+	}
+	os.MkdirAll(*dir, 0755)
+	if err := ioutil.WriteFile(filepath.Join(*dir, "types.ts"), genTypes(doc), 0644); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*dir, "client.ts"), client, 0644); err != nil {
+		panic(err)
+	}
+}
@@ -22,6 +22,10 @@ var (
 	nationVariableReg = regexp.MustCompile("[^a-zA-Z0-9]+")
 )
 
+const (
+	annotationColor = "#ffffff"
+)
+
 func ParseColors(colors []string) (
 	overrides []string,
 	nations map[godip.Nation]string,
@@ -159,6 +163,19 @@ func RenderPhaseMap(w ResponseWriter, r Request, phase *Phase, colors []string)
 			jsBuf = append(jsBuf, fmt.Sprintf("map.addCross(%q, '#ff0000');", prov))
 		}
 	}
+	for _, prov := range phase.Annotations.Highlights {
+		jsBuf = append(jsBuf, fmt.Sprintf("map.highlightProvince(%q);", prov))
+	}
+	for _, arrow := range phase.Annotations.Arrows {
+		jsBuf = append(jsBuf, fmt.Sprintf("map.addArrow([%q, %q], %q);", arrow.From, arrow.To, annotationColor))
+	}
+	for _, order := range phase.Annotations.Orders {
+		parts := []string{}
+		for _, part := range order {
+			parts = append(parts, fmt.Sprintf("%q", part))
+		}
+		jsBuf = append(jsBuf, fmt.Sprintf("map.addOrder([%s], %q);", strings.Join(parts, ","), annotationColor))
+	}
 
 	htmlNode := NewEl("html")
 	headNode := htmlNode.AddEl("head")
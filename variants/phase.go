@@ -28,6 +28,23 @@ type Phase struct {
 	Dislodgers    map[godip.Province]godip.Province            `methods:"POST"`
 	Bounces       map[godip.Province]map[godip.Province]bool   `methods:"POST"`
 	Resolutions   map[godip.Province]string                    `methods:"POST"`
+	// Annotations are drawn on top of the phase, e.g. when showing the
+	// annotations of a message.
+	Annotations Annotations
+}
+
+// Arrow is an arrow from one province to another.
+type Arrow struct {
+	From godip.Province
+	To   godip.Province
+}
+
+// Annotations are arrows, highlighted provinces and orders drawn on a phase
+// map in the annotation color.
+type Annotations struct {
+	Arrows     []Arrow
+	Highlights []godip.Province
+	Orders     [][]string
 }
 
 func (p *Phase) FromQuery(q url.Values) error {
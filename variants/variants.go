@@ -318,9 +318,18 @@ func variantMap(w ResponseWriter, r Request) error {
 	return err
 }
 
+// Resources returns the resources registered by SetupRouter.
+func Resources() []*Resource {
+	return []*Resource{
+		VariantResource,
+	}
+}
+
 func SetupRouter(r *mux.Router) {
 	router = r
-	HandleResource(r, VariantResource)
+	for _, resource := range Resources() {
+		HandleResource(r, resource)
+	}
 	Handle(r, "/Variant/{name}/Start", []string{"GET"}, VariantStartRoute, startVariant)
 	Handle(r, "/Variant/{name}/Resolve", []string{"POST"}, VariantResolveRoute, resolveVariant)
 	Handle(r, "/Variant/{name}/{nation}/Options", []string{"POST"}, VariantOptionsRoute, variantOptions)